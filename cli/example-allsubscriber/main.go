@@ -4,11 +4,9 @@ import (
 	"github.com/boltdb/bolt"
 	"github.com/function61/eventhorizon/metaevents"
 	"github.com/function61/eventhorizon/pusher/pushlib"
-	"github.com/function61/eventhorizon/pusher/pushlib/writerproxyclient"
 	rtypes "github.com/function61/eventhorizon/reader/types"
 	"github.com/function61/eventhorizon/util/clicommon"
 	"github.com/function61/eventhorizon/util/cryptorandombytes"
-	wtypes "github.com/function61/eventhorizon/writer/types"
 	"log"
 	"net/http"
 )
@@ -19,14 +17,14 @@ import (
 
 	$ horizon stream-create /_sub/all
 
-	Subscribe "all" to root stream
+	Subscribe "all" recursively to root stream
 
-	$ horizon stream-subscribe / /_sub/all
+	$ horizon stream-subscribe '/**' /_sub/all
 
-	Now when you run this program, it will start observing events from root and
-	when it sees any child streams, it will subscribe to them, and the whole
-	process goes recursively, resulting in this program seeing *everything*
-	there ever will be.
+	Now when you run this program, it will start observing events from root.
+	Writer subscribes "all" to every stream created from now on, resulting in
+	this program seeing *everything* there ever will be. Streams that existed
+	before subscribing have to be subscribed to separately.
 */
 var (
 	cursorsBucket = []byte("cursors")
@@ -36,7 +34,6 @@ type AllSubscriberApp struct {
 	pushLibrary    *pushlib.Library
 	db             *bolt.DB
 	srv            *http.Server
-	wproxy         *writerproxyclient.Client
 	subscriptionId string
 }
 
@@ -49,7 +46,6 @@ func NewAllSubscriberApp() *AllSubscriberApp {
 	a := &AllSubscriberApp{
 		db:             db,
 		srv:            &http.Server{Addr: ":8080"},
-		wproxy:         writerproxyclient.New(),
 		subscriptionId: "/_sub/all",
 	}
 
@@ -82,30 +78,16 @@ func (a *AllSubscriberApp) Run() {
 }
 
 func (a *AllSubscriberApp) PushHandleEvent(stream string, line *rtypes.ReadResultLine, tx_ interface{}) error {
-	// we are only interested about child stream creations
+	// new streams are subscribed to by Writer, we just tell about them
 	if line.MetaType != metaevents.ChildStreamCreatedId {
 		return nil
 	}
 
 	payload := line.MetaPayload.(map[string]interface{})
-	childStream := payload["name"].(string)
 
-	// do not subscribe to any subscription streams, that is not allowed as
-	// that would cause recursive loop
-	if stream == "/_sub" {
-		return nil
-	}
-
-	log.Printf("newstream: %s", childStream)
-
-	// subscribe to the new stream. if this fails, Pusher will re-push this event.
-	// this operation is idempotent, so lost ACKs from Writer are ok.
-	err := a.wproxy.SubscribeToStream(&wtypes.SubscribeToStreamRequest{
-		Stream:         childStream,
-		SubscriptionId: a.subscriptionId,
-	})
+	log.Printf("newstream: %s", payload["name"].(string))
 
-	return err
+	return nil
 }
 
 func (a *AllSubscriberApp) PushGetOffset(stream string, tx_ interface{}) (string, error) {
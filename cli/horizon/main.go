@@ -1,7 +1,10 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/function61/eventhorizon/config/configfactory"
+	"github.com/function61/eventhorizon/metaevents"
 	"github.com/function61/eventhorizon/pubsub/client"
 	"github.com/function61/eventhorizon/pubsub/server"
 	"github.com/function61/eventhorizon/pusher"
@@ -84,6 +87,111 @@ func writer_(args []string) error {
 	return nil
 }
 
+// read-only Writer that serves live reads for the Writer at <Writer>
+func writerFollower(args []string) error {
+	if len(args) != 1 {
+		return usage("<Writer>")
+	}
+
+	banner()
+
+	confCtx := configfactory.BuildMust()
+
+	follower := writer.NewFollower(confCtx, args[0])
+
+	httpCloser := make(chan bool)
+	httpCloserDone := make(chan bool)
+	writerhttp.FollowerHttpServe(follower, httpCloser, httpCloserDone, confCtx)
+
+	log.Printf("main: waiting for stop signal")
+
+	log.Println(clicommon.WaitForInterrupt())
+
+	httpCloser <- true
+	<-httpCloserDone
+
+	follower.Close()
+
+	return nil
+}
+
+// rebuilds Writer's local state from scalablestore after losing /eventhorizon-data
+func writerRecover(args []string) error {
+	if len(args) != 0 {
+		return usage("(no args)")
+	}
+
+	if err := clicommon.CheckForS3AccessKeys(); err != nil {
+		return err
+	}
+
+	return writer.RecoverFromScalableStore(configfactory.BuildMust())
+}
+
+// subscriptions the Writers unsubscribed because their subscription stream was gone
+func writerOrphanedSubs(args []string) error {
+	if len(args) != 0 {
+		return usage("(no args)")
+	}
+
+	wclient := writerclient.New(configfactory.BuildMust())
+
+	output, err := wclient.OrphanedSubscriptions()
+	if err != nil {
+		return err
+	}
+
+	for _, orphaned := range output.Subscriptions {
+		fmt.Printf(
+			"%s  %s  unsubscribed from %s\n",
+			orphaned.RemovedAt.Format(time.RFC3339),
+			orphaned.SubscriptionId,
+			strings.Join(orphaned.Streams, ", "))
+	}
+
+	return nil
+}
+
+func writerSubStatus(args []string) error {
+	if len(args) > 1 {
+		return usage("[SubscriptionId]")
+	}
+
+	req := &wtypes.SubscriptionStatusRequest{}
+	if len(args) == 1 {
+		req.SubscriptionId = args[0]
+	}
+
+	wclient := writerclient.New(configfactory.BuildMust())
+
+	output, err := wclient.SubscriptionStatus(req)
+	if err != nil {
+		return err
+	}
+
+	for _, subscriptionStatus := range output.Subscriptions {
+		fmt.Printf(
+			"%s  lag %d bytes, %d lines, %ds\n",
+			subscriptionStatus.SubscriptionId,
+			subscriptionStatus.LagBytes,
+			subscriptionStatus.LagLines,
+			subscriptionStatus.LagSeconds)
+
+		for _, streamStatus := range subscriptionStatus.Streams {
+			fmt.Printf(
+				"  %s  acked %s, head %s, lag %d bytes, %d lines, %ds\n",
+				streamStatus.Stream,
+				streamStatus.Acked,
+				streamStatus.Head,
+				streamStatus.LagBytes,
+				streamStatus.LagLines,
+				streamStatus.LagSeconds)
+		}
+	}
+
+	return nil
+}
+
 func streamAppend(args []string) error {
 	if len(args) != 2 {
 		return usage("<Stream> <Line>")
@@ -101,8 +209,8 @@ func streamAppend(args []string) error {
 }
 
 func streamSubscribe(args []string) error {
-	if len(args) != 2 {
-		return usage("<Stream> <SubscriptionId>")
+	if len(args) < 2 || len(args) > 4 {
+		return usage(`<Stream, or /stream/** for recursive> <SubscriptionId> [Filter, e.g. {"event_types": ["OrderPlaced"]}, {} = none] [ActivityIntervalMs]`)
 	}
 
 	wclient := writerclient.New(configfactory.BuildMust())
@@ -112,12 +220,28 @@ func streamSubscribe(args []string) error {
 		SubscriptionId: args[1],
 	}
 
+	if len(args) >= 3 {
+		req.Filter = &metaevents.SubscriptionFilter{}
+		if err := json.Unmarshal([]byte(args[2]), req.Filter); err != nil {
+			return err
+		}
+	}
+
+	if len(args) == 4 {
+		activityIntervalMs, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil {
+			return err
+		}
+
+		req.ActivityIntervalMs = activityIntervalMs
+	}
+
 	return wclient.SubscribeToStream(req)
 }
 
 func streamCreate(args []string) error {
-	if len(args) != 1 {
-		return usage("<Stream>")
+	if len(args) < 1 || len(args) > 3 {
+		return usage("<Stream> [ChunkSizeBytes, 0 = inherited from parent] [Durability strict/batched/relaxed]")
 	}
 
 	wclient := writerclient.New(configfactory.BuildMust())
@@ -126,10 +250,145 @@ func streamCreate(args []string) error {
 		Name: args[0],
 	}
 
+	if len(args) >= 2 {
+		chunkSize, err := strconv.Atoi(args[1])
+		if err != nil {
+			return err
+		}
+
+		req.Settings.ChunkSize = chunkSize
+	}
+
+	if len(args) == 3 {
+		req.Settings.Durability = wtypes.Durability(args[2])
+	}
+
 	_, err := wclient.CreateStream(req)
 	return err
 }
 
+func streamDelete(args []string) error {
+	if len(args) != 2 {
+		return usage("<Stream> <PurgeFromScalableStore y/n>")
+	}
+
+	wclient := writerclient.New(configfactory.BuildMust())
+
+	req := &wtypes.DeleteStreamRequest{
+		Name:  args[0],
+		Purge: args[1] == "y",
+	}
+
+	return wclient.DeleteStream(req)
+}
+
+// zero means unlimited. "0 0 0 n" removes the policy
+func streamRetention(args []string) error {
+	if len(args) != 5 {
+		return usage("<Stream> <MaxAge, e.g. 720h> <MaxTotalBytes> <MaxChunks> <Recursive y/n>")
+	}
+
+	maxAge, err := time.ParseDuration(args[1])
+	if err != nil {
+		return err
+	}
+
+	maxTotalBytes, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	maxChunks, err := strconv.Atoi(args[3])
+	if err != nil {
+		return err
+	}
+
+	wclient := writerclient.New(configfactory.BuildMust())
+
+	req := &wtypes.SetRetentionPolicyRequest{
+		Stream: args[0],
+		Policy: wtypes.RetentionPolicy{
+			MaxAgeSeconds: int(maxAge.Seconds()),
+			MaxTotalBytes: maxTotalBytes,
+			MaxChunks:     maxChunks,
+			Recursive:     args[4] == "y",
+		},
+	}
+
+	return wclient.SetRetentionPolicy(req)
+}
+
+// moves the stream's live chunk to another Writer shard
+func streamHandoff(args []string) error {
+	if len(args) != 2 {
+		return usage("<Stream> <Writer>")
+	}
+
+	wclient := writerclient.New(configfactory.BuildMust())
+
+	req := &wtypes.HandoffStreamRequest{
+		Stream: args[0],
+		Writer: args[1],
+	}
+
+	return wclient.HandoffStream(req)
+}
+
+func streamStat(args []string) error {
+	if len(args) != 1 {
+		return usage("<Stream>")
+	}
+
+	confCtx := configfactory.BuildMust()
+
+	wclient := writerclient.New(confCtx)
+
+	info, err := wclient.StreamInfo(&wtypes.StreamInfoRequest{
+		Stream: args[0],
+	})
+	if err != nil {
+		return err
+	}
+
+	lastWrite := "never"
+	if !info.LastWriteTime.IsZero() {
+		lastWrite = info.LastWriteTime.Format(time.RFC3339)
+	}
+
+	fmt.Printf("Stream:     %s\n", info.Name)
+	fmt.Printf("Head:       %s\n", info.Head)
+	fmt.Printf("Lines:      %d\n", info.LineCount)
+	fmt.Printf("Bytes:      %d\n", info.ByteCount)
+	fmt.Printf("Chunks:     %d\n", info.ChunkCount)
+	fmt.Printf("Chunk size: %d\n", info.Settings.EffectiveChunkSize())
+	fmt.Printf("Durability: %s\n", info.Settings.EffectiveDurability(wtypes.Durability(confCtx.Durability())))
+	fmt.Printf("Last write: %s\n", lastWrite)
+
+	return nil
+}
+
+func streamLs(args []string) error {
+	if len(args) != 2 {
+		return usage("<Stream> <Recursive y/n>")
+	}
+
+	wclient := writerclient.New(configfactory.BuildMust())
+
+	output, err := wclient.ListStreams(&wtypes.ListStreamsRequest{
+		Stream:    args[0],
+		Recursive: args[1] == "y",
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(args[0])
+
+	printStreamTree(args[0], output.Streams, "")
+
+	return nil
+}
+
 func streamUnsubscribe(args []string) error {
 	if len(args) != 2 {
 		return usage("<Stream> <SubscriptionId>")
@@ -277,15 +536,24 @@ func streamLiveRead(args []string) error {
 func main() {
 	mapping := map[string]func([]string) error{
 		"stream-create":         streamCreate,
+		"stream-delete":         streamDelete,
 		"stream-append":         streamAppend,
 		"stream-appendfromfile": streamAppendFromFile,
 		"stream-subscribe":      streamSubscribe,
 		"stream-unsubscribe":    streamUnsubscribe,
+		"stream-retention":      streamRetention,
+		"stream-handoff":        streamHandoff,
+		"stream-stat":           streamStat,
+		"stream-ls":             streamLs,
 		"stream-liveread":       streamLiveRead,
 		"pubsub-subscribe":      pubsubSubscribe,
 		"pusher":                pusher_,
 		"reader-read":           readerRead,
 		"writer":                writer_,
+		"writer-recover":        writerRecover,
+		"writer-follower":       writerFollower,
+		"writer-orphanedsubs":   writerOrphanedSubs,
+		"writer-substatus":      writerSubStatus,
 	}
 
 	if len(os.Args) < 2 {
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// prints streams below parent as a tree:
+//
+//	/tenants
+//	├── /tenants/bar
+//	└── /tenants/foo
+//	    └── /tenants/foo/baz
+func printStreamTree(parent string, streams []string, indent string) {
+	children := directChildren(parent, streams)
+
+	for idx, child := range children {
+		isLast := idx == len(children)-1
+
+		branch, childIndent := "├── ", "│   "
+		if isLast {
+			branch, childIndent = "└── ", "    "
+		}
+
+		fmt.Printf("%s%s%s\n", indent, branch, child)
+
+		printStreamTree(child, streams, indent+childIndent)
+	}
+}
+
+func directChildren(parent string, streams []string) []string {
+	childPrefix := strings.TrimRight(parent, "/") + "/"
+
+	children := []string{}
+
+	for _, stream := range streams {
+		if strings.HasPrefix(stream, childPrefix) && !strings.Contains(stream[len(childPrefix):], "/") {
+			children = append(children, stream)
+		}
+	}
+
+	sort.Strings(children)
+
+	return children
+}
@@ -8,11 +8,22 @@ import (
 	ctypes "github.com/function61/eventhorizon/config/types"
 	"github.com/function61/eventhorizon/util/sslca"
 	"net/url"
+	"os"
+	"sync"
+	"time"
 )
 
-const (
+// variables only so that tests can use temp directories
+var (
 	WalManagerDataDir = "/eventhorizon-data/store-live"
 
+	WalSegmentsDir = "/eventhorizon-data/wal-segments"
+
+	// live chunk replicas of a follower Writer
+	FollowerDataDir = "/eventhorizon-data/store-follower"
+)
+
+const (
 	SeekableStorePath = "/eventhorizon-data/store-seekable"
 
 	CompressedEncryptedStorePath = "/eventhorizon-data/store-compressed_and_encrypted"
@@ -24,10 +35,65 @@ const (
 
 	WriterHttpPort = 9092
 
+	// Raft traffic between replicated Writers
+	WriterRaftPort = 9095
+
+	WriterRaftDir = "/eventhorizon-data/raft"
+
+	// when WAL grows over this, written files are fsync'd and WAL segments deleted
 	WalSizeThreshold = uint64(4 * 1024 * 1024)
 
+	WalSegmentSize = int64(1024 * 1024)
+
 	ChunkRotateThreshold = 8 * 1024 * 1024
 
+	// how long Writer remembers append idempotency keys, unless overridden in discovery file
+	DefaultIdempotencyKeyWindow = 24 * time.Hour
+
+	// live chunks older than this are sealed & shipped even if they're below
+	// ChunkRotateThreshold, unless overridden in discovery file
+	DefaultMaxChunkAge = 1 * time.Hour
+
+	// how often Writer looks for live chunks older than max chunk age
+	ChunkSealerTaskInterval = 1 * time.Minute
+
+	// durability of streams that don't have their own, unless overridden in discovery file
+	DefaultDurability = "strict"
+
+	// "batched" durability fsyncs WAL at least this often, unless overridden in discovery file
+	DefaultDurabilityBatchInterval = 50 * time.Millisecond
+
+	// appends arriving within this window after the first one are committed
+	// in the same transaction, up to max appends
+	GroupCommitWindow     = 2 * time.Millisecond
+	GroupCommitMaxAppends = 128
+
+	// how often Writer raises SubscriptionActivity, unless overridden in discovery file
+	DefaultSubscriptionActivityInterval = 5 * time.Second
+
+	// in adaptive mode, how often Writer checks if it should raise SubscriptionActivity
+	// before the interval, and how many dirty marks (~ appends to subscribed streams)
+	// make it do so
+	SubscriptionActivityAdaptiveTick = 100 * time.Millisecond
+	SubscriptionActivityBurstMarks   = 1000
+
+	// how often Writer checks streams' retention policies
+	RetentionTaskInterval = 10 * time.Minute
+
+	// how often Writer retries delivering meta events to other shards
+	CrossShardRetryInterval = 5 * time.Second
+
+	// how often a follower Writer asks the primary for new live chunk bytes, and
+	// how much it gets at most at a time
+	FollowerPollInterval = 250 * time.Millisecond
+	FollowerTailMaxBytes = 4 * 1024 * 1024
+
+	// how often Pusher reports its target's acked cursors to Writer, for lag tracking
+	PusherAckReportInterval = 5 * time.Second
+
+	// per stream. when there are more, the older half is thinned
+	LagCheckpointsMax = 64
+
 	pubSubPort = 9091
 )
 
@@ -38,18 +104,54 @@ type Context struct {
 
 	// on-the-fly signed server cert for this server instance
 	serverKeyPair *tls.Certificate
+
+	// streams handed off to a Writer other than the one they hash to
+	placementsMu sync.RWMutex
+	placements   map[string]string
 }
 
 func NewContext(discovery *ctypes.DiscoveryFile, scalableStoreUrl *url.URL) *Context {
-	return &Context{discovery, scalableStoreUrl, nil}
+	return &Context{
+		discovery:        discovery,
+		scalableStoreUrl: scalableStoreUrl,
+		placements:       map[string]string{},
+	}
 }
 
 func (c *Context) AuthToken() string {
 	return c.discovery.AuthToken
 }
 
+// for a Writer, the address of its own shard (see sharding.go). for others writer_ip
 func (c *Context) GetWriterIp() string {
-	return c.discovery.WriterIp
+	return shardIpFromEnv(c.discovery.WriterIp)
+}
+
+// this Writer's own IP in a replicated group, which differs from writer_ip, or
+// a follower Writer's IP. given in WRITER_NODE_IP
+func (c *Context) GetWriterNodeIp() string {
+	if ip := os.Getenv("WRITER_NODE_IP"); ip != "" {
+		return ip
+	}
+
+	return c.GetWriterIp()
+}
+
+// the replicated group of this Writer's shard. empty if Writer is not replicated
+func (c *Context) WriterPeers() []string {
+	shard := c.GetWriterIp()
+
+	if shard == c.discovery.WriterIp {
+		return c.discovery.WriterPeers
+	}
+
+	return c.discovery.WriterShardPeers[shard]
+}
+
+// follower Writers that serve live reads for the Writer at server (see
+// "horizon writer-follower"). empty if none
+func (c *Context) WriterFollowers(server string) []string {
+	return c.discovery.WriterFollowers[server]
 }
 
 func (c *Context) GetWriterPort() int {
@@ -61,15 +163,67 @@ func (c *Context) GetWriterServerAddr() string {
 }
 
 func (c *Context) GetPubSubServerBindAddr() string {
-	// FIXME: currently expecting pub/sub server to be located on the same box
-	//        as the writer
 	return fmt.Sprintf("0.0.0.0:%d", pubSubPort)
 }
 
+// pub/sub server runs alongside the Writer at writer_ip. with many shards, all
+// of them publish there
 func (c *Context) GetPubSubServerAddr() string {
-	// FIXME: currently expecting pub/sub server to be located on the same box
-	//        as the writer
-	return fmt.Sprintf("%s:%d", c.GetWriterIp(), pubSubPort)
+	return fmt.Sprintf("%s:%d", c.discovery.WriterIp, pubSubPort)
+}
+
+func (c *Context) IdempotencyKeyWindow() time.Duration {
+	if c.discovery.IdempotencyKeyWindowSeconds == 0 {
+		return DefaultIdempotencyKeyWindow
+	}
+
+	return time.Duration(c.discovery.IdempotencyKeyWindowSeconds) * time.Second
+}
+
+// zero means that chunks are only rotated by size
+func (c *Context) MaxChunkAge() time.Duration {
+	if c.discovery.MaxChunkAgeSeconds == 0 {
+		return DefaultMaxChunkAge
+	}
+
+	if c.discovery.MaxChunkAgeSeconds < 0 {
+		return 0
+	}
+
+	return time.Duration(c.discovery.MaxChunkAgeSeconds) * time.Second
+}
+
+func (c *Context) Durability() string {
+	if c.discovery.Durability == "" {
+		return DefaultDurability
+	}
+
+	return c.discovery.Durability
+}
+
+func (c *Context) DurabilityBatchInterval() time.Duration {
+	if c.discovery.DurabilityBatchIntervalMs == 0 {
+		return DefaultDurabilityBatchInterval
+	}
+
+	return time.Duration(c.discovery.DurabilityBatchIntervalMs) * time.Millisecond
+}
+
+func (c *Context) SubscriptionActivityInterval() time.Duration {
+	if c.discovery.SubscriptionActivityIntervalMs == 0 {
+		return DefaultSubscriptionActivityInterval
+	}
+
+	return time.Duration(c.discovery.SubscriptionActivityIntervalMs) * time.Millisecond
+}
+
+func (c *Context) SubscriptionActivityAdaptive() bool {
+	return c.discovery.SubscriptionActivityAdaptive
+}
+
+// zero means that Writer does not snapshot its state to scalablestore
+func (c *Context) SnapshotInterval() time.Duration {
+	return time.Duration(c.discovery.SnapshotIntervalSeconds) * time.Second
 }
 
 func (c *Context) ScalableStoreUrl() *url.URL {
@@ -90,16 +244,7 @@ func (c *Context) GetCaCertificates() *x509.CertPool {
 func (c *Context) GetSignedServerCertificate() tls.Certificate {
 	// cache it, many server components might ask for this
 	if c.serverKeyPair == nil {
-		// sign server cert on-the-fly for this IP
-		cert, privKey := sslca.SignServerCert(
-			c.GetWriterIp(),
-			c.discovery.CaCertificate,
-			c.discovery.CaPrivateKey)
-
-		keyPair, err := tls.X509KeyPair(cert, privKey)
-		if err != nil {
-			panic(err)
-		}
+		keyPair := c.GetSignedCertificateFor(c.GetWriterIp())
 
 		c.serverKeyPair = &keyPair
 	}
@@ -107,6 +252,22 @@ func (c *Context) GetSignedServerCertificate() tls.Certificate {
 	return *c.serverKeyPair
 }
 
+// signs a certificate on-the-fly for the IP. replicated Writers use one for
+// their own IP to authenticate to each other
+func (c *Context) GetSignedCertificateFor(ip string) tls.Certificate {
+	cert, privKey := sslca.SignServerCert(
+		ip,
+		c.discovery.CaCertificate,
+		c.discovery.CaPrivateKey)
+
+	keyPair, err := tls.X509KeyPair(cert, privKey)
+	if err != nil {
+		panic(err)
+	}
+
+	return keyPair
+}
+
 // TODO: have separate key per stream, provisioned in ChildStreamCreated? the
 // only drawback is that then you cannot directly access streams by knowing
 // their name, but rather walk to the stream hierarchy from the root stream to
@@ -0,0 +1,94 @@
+package config
+
+import (
+	"hash/fnv"
+	"os"
+)
+
+// Streams are spread over the Writer shards listed in writer_shards by
+// rendezvous hashing: each stream goes to the shard whose hash(shard, stream)
+// is highest. Adding or removing a shard only moves the streams that hash to
+// it, and every component computes the placement without asking anybody.
+//
+// The built-in streams ("/" and "/_sub") are always on writer_ip, so a
+// cluster can be bootstrapped without the other shards being up.
+//
+// A stream handed off to another Writer is placed there explicitly (placement
+// records in scalablestore, loaded by Writers). Others learn of it when the
+// Writer the stream hashes to redirects them.
+
+// address of each shard. a shard is a single Writer or a replicated group
+func (c *Context) WriterShards() []string {
+	if len(c.discovery.WriterShards) == 0 {
+		return []string{c.discovery.WriterIp}
+	}
+
+	return c.discovery.WriterShards
+}
+
+// Writer owning the stream
+func (c *Context) GetWriterIpForStream(streamName string) string {
+	if streamName == "/" || streamName == "/_sub" {
+		return c.discovery.WriterIp
+	}
+
+	c.placementsMu.RLock()
+	placed, isPlaced := c.placements[streamName]
+	c.placementsMu.RUnlock()
+
+	if isPlaced {
+		return placed
+	}
+
+	return shardForStream(c.WriterShards(), streamName)
+}
+
+// overrides hashing for the stream
+func (c *Context) SetWriterIpForStream(streamName string, writerIp string) {
+	c.placementsMu.Lock()
+	defer c.placementsMu.Unlock()
+
+	c.placements[streamName] = writerIp
+}
+
+// address of the shard this Writer belongs to. given in WRITER_SHARD_IP,
+// defaults to writer_ip
+func shardIpFromEnv(writerIp string) string {
+	if ip := os.Getenv("WRITER_SHARD_IP"); ip != "" {
+		return ip
+	}
+
+	return writerIp
+}
+
+func shardForStream(shards []string, streamName string) string {
+	best := ""
+	var bestScore uint64
+
+	for _, shard := range shards {
+		hash := fnv.New64a()
+		hash.Write([]byte(shard))
+		hash.Write([]byte{0})
+		hash.Write([]byte(streamName))
+
+		score := mix(hash.Sum64())
+
+		if best == "" || score > bestScore {
+			best = shard
+			bestScore = score
+		}
+	}
+
+	return best
+}
+
+// FNV alone spreads names that differ only in their last bytes poorly
+// (splitmix64's finalizer)
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
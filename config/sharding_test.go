@@ -0,0 +1,100 @@
+package config
+
+import (
+	"fmt"
+	ctypes "github.com/function61/eventhorizon/config/types"
+	"github.com/function61/eventhorizon/util/ass"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestGetWriterIpForStreamSingleShard(t *testing.T) {
+	confCtx := NewContext(&ctypes.DiscoveryFile{WriterIp: "10.0.0.1"}, nil)
+
+	ass.EqualString(t, confCtx.GetWriterIpForStream("/tenants/foo"), "10.0.0.1")
+}
+
+func TestGetWriterIpForStream(t *testing.T) {
+	shards := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+
+	confCtx := NewContext(&ctypes.DiscoveryFile{
+		WriterIp:     "10.0.0.2",
+		WriterShards: shards,
+	}, nil)
+
+	ass.EqualString(t, confCtx.GetWriterIpForStream("/"), "10.0.0.2")
+	ass.EqualString(t, confCtx.GetWriterIpForStream("/_sub"), "10.0.0.2")
+
+	streamsPerShard := map[string]int{}
+
+	for i := 0; i < 3000; i++ {
+		streamsPerShard[confCtx.GetWriterIpForStream(fmt.Sprintf("/tenants/%d", i))]++
+	}
+
+	for _, shard := range shards {
+		ass.True(t, streamsPerShard[shard] > 800 && streamsPerShard[shard] < 1200)
+	}
+}
+
+func TestAddingShardOnlyMovesStreamsToIt(t *testing.T) {
+	before := []string{"10.0.0.1", "10.0.0.2"}
+	after := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+
+	moved := 0
+
+	for i := 0; i < 1000; i++ {
+		streamName := fmt.Sprintf("/tenants/%d", i)
+
+		if shardForStream(before, streamName) != shardForStream(after, streamName) {
+			ass.EqualString(t, shardForStream(after, streamName), "10.0.0.3")
+			moved++
+		}
+	}
+
+	ass.True(t, moved > 250 && moved < 420)
+}
+
+func TestSetWriterIpForStream(t *testing.T) {
+	confCtx := NewContext(&ctypes.DiscoveryFile{
+		WriterIp:     "10.0.0.1",
+		WriterShards: []string{"10.0.0.1", "10.0.0.2"},
+	}, nil)
+
+	hashed := confCtx.GetWriterIpForStream("/tenants/foo")
+
+	moved := "10.0.0.1"
+	if hashed == moved {
+		moved = "10.0.0.2"
+	}
+
+	confCtx.SetWriterIpForStream("/tenants/foo", moved)
+
+	ass.EqualString(t, confCtx.GetWriterIpForStream("/tenants/foo"), moved)
+	ass.EqualString(t, shardForStream(confCtx.WriterShards(), "/tenants/foo"), hashed)
+}
+
+func TestWriterPeersPerShard(t *testing.T) {
+	discovery := &ctypes.DiscoveryFile{
+		WriterIp:     "10.0.0.1",
+		WriterShards: []string{"10.0.0.1", "10.0.1.1", "10.0.2.1"},
+		WriterPeers:  []string{"10.0.0.11", "10.0.0.12", "10.0.0.13"},
+		WriterShardPeers: map[string][]string{
+			"10.0.1.1": {"10.0.1.11", "10.0.1.12", "10.0.1.13"},
+		},
+	}
+
+	peersOfShard := func(shard string) string {
+		os.Setenv("WRITER_SHARD_IP", shard)
+		defer os.Unsetenv("WRITER_SHARD_IP")
+
+		return strings.Join(NewContext(discovery, nil).WriterPeers(), ",")
+	}
+
+	ass.EqualString(t, peersOfShard(""), "10.0.0.11,10.0.0.12,10.0.0.13")
+	ass.EqualString(t, peersOfShard("10.0.0.1"), "10.0.0.11,10.0.0.12,10.0.0.13")
+	ass.EqualString(t, peersOfShard("10.0.1.1"), "10.0.1.11,10.0.1.12,10.0.1.13")
+
+	// single Writer
+	ass.EqualString(t, peersOfShard("10.0.2.1"), "")
+}
@@ -6,4 +6,35 @@ type DiscoveryFile struct {
 	CaCertificate       string `json:"ca_certificate"`
 	CaPrivateKey        string `json:"ca_private_key"`
 	EncryptionMasterKey string `json:"encryption_master_key"`
+
+	// optional cluster-wide settings. zero means default
+	IdempotencyKeyWindowSeconds int `json:"idempotency_key_window_seconds,omitempty"`
+	MaxChunkAgeSeconds          int `json:"max_chunk_age_seconds,omitempty"` // negative disables
+
+	// default for streams that don't have their own: strict | batched | relaxed
+	Durability                string `json:"durability,omitempty"`
+	DurabilityBatchIntervalMs int    `json:"durability_batch_interval_ms,omitempty"`
+
+	SnapshotIntervalSeconds int `json:"snapshot_interval_seconds,omitempty"` // zero disables
+
+	// adaptive skips rounds that have nothing to raise, and raises sooner under bursts
+	SubscriptionActivityIntervalMs int  `json:"subscription_activity_interval_ms,omitempty"`
+	SubscriptionActivityAdaptive   bool `json:"subscription_activity_adaptive,omitempty"`
+
+	// IPs of a replicated Writer group (3 or 5 nodes). writer_ip is then the
+	// group's address (e.g. a floating IP). empty = single Writer
+	WriterPeers []string `json:"writer_peers,omitempty"`
+
+	// like writer_peers, for the other shards that are replicated groups, by the
+	// shard's address. writer_peers is the group at writer_ip
+	WriterShardPeers map[string][]string `json:"writer_shard_peers,omitempty"`
+
+	// addresses of Writer shards (each a single Writer or a group's writer_ip),
+	// streams are spread over them by name. writer_ip must be one of them.
+	// empty = one shard at writer_ip
+	WriterShards []string `json:"writer_shards,omitempty"`
+
+	// follower Writers (read-only, serving live reads) by the address of the
+	// Writer they follow
+	WriterFollowers map[string][]string `json:"writer_followers,omitempty"`
 }
@@ -10,7 +10,17 @@ const CreatedId = "Created"
 // /Created {"subscription_ids": "89a3c083-6396", "ts":"2017-02-27T17:12:31.446Z"}
 type Created struct {
 	SubscriptionIds []string `json:"subscription_ids"`
-	Timestamp       string   `json:"ts"`
+
+	// of those, the ones that new child streams inherit
+	RecursiveSubscriptionIds []string `json:"recursive_subscription_ids,omitempty"`
+
+	// of those, the ones that have a filter
+	SubscriptionFilters map[string]*SubscriptionFilter `json:"subscription_filters,omitempty"`
+
+	// of those, the ones that have an activity interval (in milliseconds)
+	SubscriptionActivityIntervals map[string]int64 `json:"subscription_activity_intervals,omitempty"`
+
+	Timestamp string `json:"ts"`
 }
 
 func (c *Created) Serialize() string {
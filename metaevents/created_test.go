@@ -14,3 +14,13 @@ func TestCreated(t *testing.T) {
 
 	ass.EqualString(t, created.Timestamp, "2017-02-27T17:12:31.446Z")
 }
+
+func TestCreatedWithRecursiveSubscriptions(t *testing.T) {
+	_, _, event := Parse("/Created {\"subscription_ids\":[\"/_sub/a\",\"/_sub/b\"],\"recursive_subscription_ids\":[\"/_sub/b\"],\"ts\":\"2017-02-27T17:12:31.446Z\"}")
+
+	created := event.(Created)
+
+	ass.EqualInt(t, len(created.SubscriptionIds), 2)
+	ass.EqualInt(t, len(created.RecursiveSubscriptionIds), 1)
+	ass.EqualString(t, created.RecursiveSubscriptionIds[0], "/_sub/b")
+}
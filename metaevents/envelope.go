@@ -0,0 +1,69 @@
+package metaevents
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// Envelope line is a regular line decorated with event sourcing metadata.
+// The envelope is JSON followed by a space and the content, as-is:
+//
+// !{"id":"5f0c6d1e","type":"OrderPlaced","ts":"2017-02-27T17:12:31.446Z","headers":{"correlation_id":"a1b2"}} {"order_id": 42}
+
+const envelopeLineType = "!"
+
+type Envelope struct {
+	Id        string            `json:"id"`
+	Type      string            `json:"type"`
+	Timestamp string            `json:"ts"`
+	Headers   map[string]string `json:"headers,omitempty"`
+}
+
+// encodes an envelope line for storing in Event Horizon. caller's responsibility
+// is to check that content does not contain \n
+func (e *Envelope) Encode(content string) string {
+	asJson, _ := json.Marshal(e)
+
+	return envelopeLineType + string(asJson) + " " + content
+}
+
+func NewEnvelope(id string, typ string, headers map[string]string) *Envelope {
+	return &Envelope{
+		Id:        id,
+		Type:      typ,
+		Timestamp: time.Now().Format("2006-01-02T15:04:05.999Z"),
+		Headers:   headers,
+	}
+}
+
+// "!{...} content" => (envelope, "content")
+func parseEnvelope(line string) (Envelope, string) {
+	errUnableToParse := errors.New("Unable to parse envelope line: " + line)
+
+	envelopeAndContent := strings.NewReader(line[1:])
+
+	// decoder knows where the JSON ends, so we don't have to worry about
+	// spaces inside the JSON strings
+	decoder := json.NewDecoder(envelopeAndContent)
+
+	obj := Envelope{}
+	if err := decoder.Decode(&obj); err != nil {
+		panic(errUnableToParse)
+	}
+
+	// decoder might have buffered some of the content
+	rest, err := ioutil.ReadAll(io.MultiReader(decoder.Buffered(), envelopeAndContent))
+	if err != nil {
+		panic(err)
+	}
+
+	if len(rest) == 0 || rest[0] != ' ' {
+		panic(errUnableToParse)
+	}
+
+	return obj, string(rest[1:])
+}
@@ -0,0 +1,44 @@
+package metaevents
+
+import (
+	"github.com/function61/eventhorizon/util/ass"
+	"testing"
+)
+
+func TestEnvelope(t *testing.T) {
+	metaType, content, event := Parse("!{\"id\":\"5f0c6d1e\",\"type\":\"OrderPlaced\",\"ts\":\"2017-02-27T17:12:31.446Z\",\"headers\":{\"correlation_id\":\"a b\"}} {\"order_id\": 42}")
+
+	// envelope lines are regular lines, not meta events
+	ass.EqualString(t, metaType, "")
+	ass.EqualString(t, content, "{\"order_id\": 42}")
+
+	envelope := event.(Envelope)
+
+	ass.EqualString(t, envelope.Id, "5f0c6d1e")
+	ass.EqualString(t, envelope.Type, "OrderPlaced")
+	ass.EqualString(t, envelope.Timestamp, "2017-02-27T17:12:31.446Z")
+	ass.EqualString(t, envelope.Headers["correlation_id"], "a b")
+}
+
+func TestEnvelopeEncode(t *testing.T) {
+	envelope := &Envelope{
+		Id:        "5f0c6d1e",
+		Type:      "OrderPlaced",
+		Timestamp: "2017-02-27T17:12:31.446Z",
+	}
+
+	ass.EqualString(t, envelope.Encode("foo bar"), "!{\"id\":\"5f0c6d1e\",\"type\":\"OrderPlaced\",\"ts\":\"2017-02-27T17:12:31.446Z\"} foo bar")
+
+	_, content, event := Parse(envelope.Encode(""))
+
+	ass.EqualString(t, content, "")
+	ass.EqualString(t, event.(Envelope).Type, "OrderPlaced")
+}
+
+func TestEnvelopeMissingContentSeparator(t *testing.T) {
+	defer func() {
+		ass.EqualString(t, recover().(error).Error(), "Unable to parse envelope line: !{\"id\":\"5f0c6d1e\"}")
+	}()
+
+	Parse("!{\"id\":\"5f0c6d1e\"}")
+}
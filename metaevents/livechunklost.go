@@ -0,0 +1,33 @@
+package metaevents
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const LiveChunkLostId = "LiveChunkLost"
+
+// written by writer-recover to a chunk whose original (live, not yet shipped)
+// content was lost with the Writer's local disk. if the chunk was restored from
+// Writer's snapshot, only content written after "since" was lost. also written by
+// Writer to a live chunk that lost committed (but not yet fsync'd) lines in an OS
+// crash, just before sealing the chunk
+//
+// /LiveChunkLost {"since":"2017-02-27T17:10:00Z","ts":"2017-02-27T17:12:31.446Z"}
+type LiveChunkLost struct {
+	Since     string `json:"since,omitempty"`
+	Timestamp string `json:"ts"`
+}
+
+func (l *LiveChunkLost) Serialize() string {
+	asJson, _ := json.Marshal(l)
+
+	return "/LiveChunkLost " + string(asJson) + "\n"
+}
+
+func NewLiveChunkLost(since string) *LiveChunkLost {
+	return &LiveChunkLost{
+		Since:     since,
+		Timestamp: time.Now().Format("2006-01-02T15:04:05.999Z"),
+	}
+}
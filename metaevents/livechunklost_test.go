@@ -0,0 +1,19 @@
+package metaevents
+
+import (
+	"github.com/function61/eventhorizon/util/ass"
+	"testing"
+)
+
+func TestLiveChunkLost(t *testing.T) {
+	metaType, _, event := Parse("/LiveChunkLost {\"ts\":\"2017-02-27T17:12:31.446Z\"}")
+
+	ass.True(t, metaType == LiveChunkLostId)
+
+	ass.EqualString(t, event.(LiveChunkLost).Since, "")
+	ass.EqualString(t, event.(LiveChunkLost).Timestamp, "2017-02-27T17:12:31.446Z")
+
+	_, _, event = Parse("/LiveChunkLost {\"since\":\"2017-02-27T17:10:00Z\",\"ts\":\"2017-02-27T17:12:31.446Z\"}")
+
+	ass.EqualString(t, event.(LiveChunkLost).Since, "2017-02-27T17:10:00Z")
+}
@@ -21,7 +21,8 @@ func EncodeRegularLine(input string) string {
 	return " " + input
 }
 
-// parses both regular and meta event lines
+// parses regular, envelope and meta event lines. envelope lines are regular
+// lines as well (metaType is empty), but metaEvent is the Envelope
 func Parse(line string) (metaType string, lineContent string, metaEvent interface{}) {
 	// this shouldn't happen, but [0] would panic so
 	if len(line) == 0 {
@@ -32,6 +33,12 @@ func Parse(line string) (metaType string, lineContent string, metaEvent interfac
 		return "", line[1:], nil
 	}
 
+	if line[0:1] == envelopeLineType {
+		envelope, content := parseEnvelope(line)
+
+		return "", content, envelope
+	}
+
 	if line[0:1] != "/" {
 		panic(errorUnknownType)
 	}
@@ -90,6 +97,27 @@ func Parse(line string) (metaType string, lineContent string, metaEvent interfac
 			panic(errors.New("Unable to parse meta line: " + typ))
 		}
 
+		return typ, payload, obj
+	} else if typ == "StreamDeleted" {
+		obj := StreamDeleted{}
+		if err := json.Unmarshal([]byte(payload), &obj); err != nil {
+			panic(errors.New("Unable to parse meta line: " + typ))
+		}
+
+		return typ, payload, obj
+	} else if typ == "Truncated" {
+		obj := Truncated{}
+		if err := json.Unmarshal([]byte(payload), &obj); err != nil {
+			panic(errors.New("Unable to parse meta line: " + typ))
+		}
+
+		return typ, payload, obj
+	} else if typ == "LiveChunkLost" {
+		obj := LiveChunkLost{}
+		if err := json.Unmarshal([]byte(payload), &obj); err != nil {
+			panic(errors.New("Unable to parse meta line: " + typ))
+		}
+
 		return typ, payload, obj
 	}
 
@@ -0,0 +1,29 @@
+package metaevents
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const StreamDeletedId = "StreamDeleted"
+
+// /StreamDeleted {"name":"/tenants/foo","purged":false,"ts":"2017-02-27T17:12:31.446Z"}
+type StreamDeleted struct {
+	Name      string `json:"name"`
+	Purged    bool   `json:"purged"` // chunks were removed from scalablestore
+	Timestamp string `json:"ts"`
+}
+
+func (s *StreamDeleted) Serialize() string {
+	asJson, _ := json.Marshal(s)
+
+	return "/StreamDeleted " + string(asJson) + "\n"
+}
+
+func NewStreamDeleted(name string, purged bool) *StreamDeleted {
+	return &StreamDeleted{
+		Name:      name,
+		Purged:    purged,
+		Timestamp: time.Now().Format("2006-01-02T15:04:05.999Z"),
+	}
+}
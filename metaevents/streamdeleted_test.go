@@ -0,0 +1,18 @@
+package metaevents
+
+import (
+	"github.com/function61/eventhorizon/util/ass"
+	"testing"
+)
+
+func TestStreamDeleted(t *testing.T) {
+	metaType, _, event := Parse("/StreamDeleted {\"name\":\"/tenants/foo\",\"purged\":true,\"ts\":\"2017-02-27T17:12:31.446Z\"}")
+
+	ass.True(t, metaType == StreamDeletedId)
+
+	streamDeleted := event.(StreamDeleted)
+
+	ass.EqualString(t, streamDeleted.Name, "/tenants/foo")
+	ass.True(t, streamDeleted.Purged)
+	ass.EqualString(t, streamDeleted.Timestamp, "2017-02-27T17:12:31.446Z")
+}
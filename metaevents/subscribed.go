@@ -9,8 +9,11 @@ const SubscribedId = "Subscribed"
 
 // /Subscribed {"subscription_id":"6894605c-2a8e","ts":"2017-02-27T17:12:31.446Z"}
 type Subscribed struct {
-	SubscriptionId string `json:"subscription_id"`
-	Timestamp      string `json:"ts"`
+	SubscriptionId     string              `json:"subscription_id"`
+	Recursive          bool                `json:"recursive,omitempty"`            // also child streams created afterwards
+	Filter             *SubscriptionFilter `json:"filter,omitempty"`               // nil = notified about every line
+	ActivityIntervalMs int64               `json:"activity_interval_ms,omitempty"` // 0 = the cluster's interval
+	Timestamp          string              `json:"ts"`
 }
 
 func (s *Subscribed) Serialize() string {
@@ -0,0 +1,84 @@
+package metaevents
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Limits the lines that a subscriber is notified about. Zero value matches every
+// line, otherwise a line matches if any of the given conditions match:
+//
+// {"meta_types": ["ChildStreamCreated"], "event_types": ["OrderPlaced"], "line_prefix": "ERROR", "json_field": "level", "json_value": "error"}
+//
+// line_prefix and json_field/json_value look at regular lines and events' content.
+// json_value is compared to the field's value formatted as text (42, true, error)
+type SubscriptionFilter struct {
+	MetaTypes  []string `json:"meta_types,omitempty"`
+	EventTypes []string `json:"event_types,omitempty"`
+	LinePrefix string   `json:"line_prefix,omitempty"`
+	JsonField  string   `json:"json_field,omitempty"`
+	JsonValue  string   `json:"json_value,omitempty"`
+}
+
+func (s *SubscriptionFilter) IsEmpty() bool {
+	return len(s.MetaTypes) == 0 && len(s.EventTypes) == 0 && s.LinePrefix == "" && s.JsonField == ""
+}
+
+// raw lines as stored, separated by \n
+func (s *SubscriptionFilter) MatchesAny(rawLines string) bool {
+	for _, line := range strings.Split(rawLines, "\n") {
+		if line != "" && s.Matches(line) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *SubscriptionFilter) Matches(line string) bool {
+	if s.IsEmpty() {
+		return true
+	}
+
+	metaType, content, metaEvent := Parse(line)
+
+	if metaType != "" {
+		return containsString(s.MetaTypes, metaType)
+	}
+
+	if envelope, isEnvelope := metaEvent.(Envelope); isEnvelope && containsString(s.EventTypes, envelope.Type) {
+		return true
+	}
+
+	if s.LinePrefix != "" && strings.HasPrefix(content, s.LinePrefix) {
+		return true
+	}
+
+	if s.JsonField != "" {
+		// numbers as written, as float64 would format 1234567 as 1.234567e+06
+		decoder := json.NewDecoder(strings.NewReader(content))
+		decoder.UseNumber()
+
+		fields := map[string]interface{}{}
+		if err := decoder.Decode(&fields); err != nil {
+			return false // not a JSON object
+		}
+
+		if value, has := fields[s.JsonField]; has && fmt.Sprintf("%v", value) == s.JsonValue {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsString(items []string, item string) bool {
+	for _, candidate := range items {
+		if candidate == item {
+			return true
+		}
+	}
+
+	return false
+}
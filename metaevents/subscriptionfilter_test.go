@@ -0,0 +1,38 @@
+package metaevents
+
+import (
+	"github.com/function61/eventhorizon/util/ass"
+	"testing"
+)
+
+func TestSubscriptionFilter(t *testing.T) {
+	orderPlaced := NewEnvelope("1", "OrderPlaced", nil).Encode("{\"order_id\": 42}")
+	orderShipped := NewEnvelope("2", "OrderShipped", nil).Encode("{\"order_id\": 43}")
+	childStreamCreated := "/ChildStreamCreated {\"name\":\"/tenants/foo\",\"cursor\":\"/tenants/foo:0:0\",\"ts\":\"2017-02-27T17:12:31.446Z\"}"
+
+	everything := &SubscriptionFilter{}
+	ass.True(t, everything.IsEmpty())
+	ass.True(t, everything.Matches(" foo"))
+
+	byType := &SubscriptionFilter{MetaTypes: []string{"ChildStreamCreated"}, EventTypes: []string{"OrderPlaced"}}
+	ass.True(t, byType.Matches(orderPlaced))
+	ass.False(t, byType.Matches(orderShipped))
+	ass.True(t, byType.Matches(childStreamCreated))
+	ass.False(t, byType.Matches(" OrderPlaced"))
+	ass.True(t, byType.MatchesAny(" foo\n"+orderShipped+"\n"+childStreamCreated+"\n"))
+	ass.False(t, byType.MatchesAny(" foo\n"+orderShipped+"\n"))
+
+	byPrefix := &SubscriptionFilter{LinePrefix: "ERROR"}
+	ass.True(t, byPrefix.Matches(" ERROR disk full"))
+	ass.False(t, byPrefix.Matches(" INFO all good"))
+	ass.False(t, byPrefix.Matches(childStreamCreated))
+
+	byJsonField := &SubscriptionFilter{JsonField: "order_id", JsonValue: "42"}
+	ass.True(t, byJsonField.Matches(orderPlaced))
+	ass.False(t, byJsonField.Matches(orderShipped))
+	ass.False(t, byJsonField.Matches(" not json"))
+
+	byLargeId := &SubscriptionFilter{JsonField: "order_id", JsonValue: "1234567"}
+	ass.True(t, byLargeId.Matches(" {\"order_id\": 1234567}"))
+	ass.False(t, byLargeId.Matches(" {\"order_id\": 1234568}"))
+}
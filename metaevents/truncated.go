@@ -0,0 +1,27 @@
+package metaevents
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const TruncatedId = "Truncated"
+
+// /Truncated {"earliest":"/tenants/foo:5:0","ts":"2017-02-27T17:12:31.446Z"}
+type Truncated struct {
+	Earliest  string `json:"earliest"` // chunks before this cursor have expired
+	Timestamp string `json:"ts"`
+}
+
+func (t *Truncated) Serialize() string {
+	asJson, _ := json.Marshal(t)
+
+	return "/Truncated " + string(asJson) + "\n"
+}
+
+func NewTruncated(earliest string) *Truncated {
+	return &Truncated{
+		Earliest:  earliest,
+		Timestamp: time.Now().Format("2006-01-02T15:04:05.999Z"),
+	}
+}
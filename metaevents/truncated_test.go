@@ -0,0 +1,17 @@
+package metaevents
+
+import (
+	"github.com/function61/eventhorizon/util/ass"
+	"testing"
+)
+
+func TestTruncated(t *testing.T) {
+	metaType, _, event := Parse("/Truncated {\"earliest\":\"/tenants/foo:5:0\",\"ts\":\"2017-02-27T17:12:31.446Z\"}")
+
+	ass.True(t, metaType == TruncatedId)
+
+	truncated := event.(Truncated)
+
+	ass.EqualString(t, truncated.Earliest, "/tenants/foo:5:0")
+	ass.EqualString(t, truncated.Timestamp, "2017-02-27T17:12:31.446Z")
+}
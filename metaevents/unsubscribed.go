@@ -10,6 +10,7 @@ const UnsubscribedId = "Unsubscribed"
 // /Unsubscribed {"subscription_id":"6894605c-2a8e","ts":"2017-02-27T17:12:31.446Z"}
 type Unsubscribed struct {
 	SubscriptionId string `json:"subscription_id"`
+	Recursive      bool   `json:"recursive,omitempty"`
 	Timestamp      string `json:"ts"`
 }
 
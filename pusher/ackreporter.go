@@ -0,0 +1,97 @@
+package pusher
+
+import (
+	"github.com/function61/eventhorizon/config"
+	"github.com/function61/eventhorizon/cursor"
+	wtypes "github.com/function61/eventhorizon/writer/types"
+	"github.com/function61/eventhorizon/writer/writerclient"
+	"log"
+	"sync"
+	"time"
+)
+
+// Reports the cursors the target has acked to Writers, which track the
+// subscription's lag with them. Only the latest cursor of each stream is
+// reported, every PusherAckReportInterval.
+
+type ackReporter struct {
+	subscriptionId string
+	writerClient   *writerclient.Client
+	mu             sync.Mutex
+	pending        map[string]string // stream => serialized cursor
+	stop           chan bool
+	done           chan bool
+}
+
+func newAckReporter(subscriptionId string, writerClient *writerclient.Client) *ackReporter {
+	a := &ackReporter{
+		subscriptionId: subscriptionId,
+		writerClient:   writerClient,
+		pending:        map[string]string{},
+		stop:           make(chan bool),
+		done:           make(chan bool),
+	}
+
+	go a.loopUntilStopped()
+
+	return a
+}
+
+func (a *ackReporter) Acked(ackedCursor *cursor.Cursor) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.pending[ackedCursor.Stream] = ackedCursor.Serialize()
+}
+
+func (a *ackReporter) loopUntilStopped() {
+	for {
+		select {
+		case <-a.stop:
+			a.report() // so the last acks are not lost
+			a.done <- true
+			return
+		case <-time.After(config.PusherAckReportInterval):
+			a.report()
+		}
+	}
+}
+
+func (a *ackReporter) report() {
+	a.mu.Lock()
+	pending := a.pending
+	a.pending = map[string]string{}
+	a.mu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	req := &wtypes.ReportAckedCursorsRequest{
+		SubscriptionId: a.subscriptionId,
+		Cursors:        []string{},
+	}
+
+	for _, cursorSerialized := range pending {
+		req.Cursors = append(req.Cursors, cursorSerialized)
+	}
+
+	if err := a.writerClient.ReportAckedCursors(req); err != nil {
+		log.Printf("Pusher: reporting acked cursors: %s", err.Error())
+
+		// try again next time, unless the target acked newer ones meanwhile
+		a.mu.Lock()
+		for stream, cursorSerialized := range pending {
+			if _, hasNewer := a.pending[stream]; !hasNewer {
+				a.pending[stream] = cursorSerialized
+			}
+		}
+		a.mu.Unlock()
+	}
+}
+
+func (a *ackReporter) Close() {
+	a.stop <- true
+
+	<-a.done
+}
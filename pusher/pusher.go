@@ -25,6 +25,8 @@ type Pusher struct {
 	done         *sync.WaitGroup
 	streams      map[string]*StreamStatus
 	writerProxy  *writerproxy.Proxy
+	writerClient *writerclient.Client
+	acks         *ackReporter
 }
 
 func New(confCtx *config.Context, target ptypes.Transport) *Pusher {
@@ -37,6 +39,7 @@ func New(confCtx *config.Context, target ptypes.Transport) *Pusher {
 		done:         &sync.WaitGroup{},
 		streams:      make(map[string]*StreamStatus),
 		writerProxy:  writerproxy.New(confCtx, writerClient),
+		writerClient: writerClient,
 	}
 }
 
@@ -67,6 +70,9 @@ func (p *Pusher) Run() {
 		return
 	}
 
+	p.acks = newAckReporter(subscriptionId, p.writerClient)
+	defer p.acks.Close()
+
 	p.pubSubClient.Subscribe("sub:" + subscriptionId)
 
 	p.streams[subscriptionId] = &StreamStatus{
@@ -190,6 +196,8 @@ func (p *Pusher) processIntelligence(inte *StreamStatus) {
 
 	// have intelligence on target status?
 	if inte.targetAckedCursor != nil {
+		p.acks.Acked(inte.targetAckedCursor)
+
 		// we didn't have previous information => copy as is
 		if stored.targetAckedCursor == nil {
 			stored.targetAckedCursor = inte.targetAckedCursor
@@ -17,6 +17,7 @@ import (
 	"errors"
 	"fmt"
 	wtypes "github.com/function61/eventhorizon/writer/types"
+	"github.com/function61/eventhorizon/writer/writerclient"
 	"io/ioutil"
 	"net/http"
 )
@@ -47,9 +48,9 @@ func (c *Client) CreateStream(req *wtypes.CreateStreamRequest) (*wtypes.CreateSt
 func (c *Client) Append(req *wtypes.AppendToStreamRequest) (*wtypes.AppendToStreamOutput, error) {
 	reqJson, _ := json.Marshal(req)
 
-	resJson, _, err := c.handleAndReturnBodyAndStatusCode(c.url("/writer/append"), reqJson, http.StatusCreated)
+	resJson, statusCode, err := c.handleAndReturnBodyAndStatusCode(c.url("/writer/append"), reqJson, http.StatusCreated)
 	if err != nil {
-		return nil, err
+		return nil, writerclient.AppendError(resJson, statusCode, err)
 	}
 
 	var output wtypes.AppendToStreamOutput
@@ -60,6 +61,38 @@ func (c *Client) Append(req *wtypes.AppendToStreamRequest) (*wtypes.AppendToStre
 	return &output, nil
 }
 
+func (c *Client) StreamInfo(req *wtypes.StreamInfoRequest) (*wtypes.StreamInfoOutput, error) {
+	reqJson, _ := json.Marshal(req)
+
+	resJson, _, err := c.handleAndReturnBodyAndStatusCode(c.url("/writer/stream_info"), reqJson, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+
+	var output wtypes.StreamInfoOutput
+	if err := json.Unmarshal(resJson, &output); err != nil {
+		return nil, err
+	}
+
+	return &output, nil
+}
+
+func (c *Client) AppendMulti(req *wtypes.AppendMultiRequest) (*wtypes.AppendMultiOutput, error) {
+	reqJson, _ := json.Marshal(req)
+
+	resJson, statusCode, err := c.handleAndReturnBodyAndStatusCode(c.url("/writer/append_multi"), reqJson, http.StatusCreated)
+	if err != nil {
+		return nil, writerclient.AppendError(resJson, statusCode, err)
+	}
+
+	var output wtypes.AppendMultiOutput
+	if err := json.Unmarshal(resJson, &output); err != nil {
+		return nil, err
+	}
+
+	return &output, nil
+}
+
 func (c *Client) SubscribeToStream(req *wtypes.SubscribeToStreamRequest) error {
 	reqJson, _ := json.Marshal(req)
 
@@ -49,7 +49,24 @@ func New(confCtx *config.Context, writerClient *writerclient.Client) *Proxy {
 
 		output, err := p.writerClient.Append(&appendToStreamRequest)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeAppendError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(output)
+	})
+
+	http.HandleFunc("/writer/append_multi", func(w http.ResponseWriter, r *http.Request) {
+		var appendMultiRequest wtypes.AppendMultiRequest
+		if err := json.NewDecoder(r.Body).Decode(&appendMultiRequest); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		output, err := p.writerClient.AppendMulti(&appendMultiRequest)
+		if err != nil {
+			writeAppendError(w, err)
 			return
 		}
 
@@ -74,6 +91,22 @@ func New(confCtx *config.Context, writerClient *writerclient.Client) *Proxy {
 		json.NewEncoder(w).Encode(output)
 	})
 
+	http.HandleFunc("/writer/stream_info", func(w http.ResponseWriter, r *http.Request) {
+		var req wtypes.StreamInfoRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		output, err := p.writerClient.StreamInfo(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(output)
+	})
+
 	http.HandleFunc("/writer/subscribe", func(w http.ResponseWriter, r *http.Request) {
 		var req wtypes.SubscribeToStreamRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -131,3 +164,13 @@ func (p *Proxy) Close() {
 
 	p.serverDone.Wait()
 }
+
+// conflicts are passed on as Writer returns them, so the application can tell
+// them apart from other errors
+func writeAppendError(w http.ResponseWriter, err error) {
+	if writerclient.WriteAppendConflict(w, err) {
+		return
+	}
+
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -49,11 +49,9 @@ func New(confCtx *config.Context, writerClient *writerclient.Client) *Eventstore
 func (e *EventstoreReader) Read(opts *rtypes.ReadOptions) (*rtypes.ReadResult, error) {
 	cur := opts.Cursor
 
-	// FIXME: this assumes we're only running one server
-	// (this could be resolved from S3)
 	if cur.Server == cursor.UnknownServer {
-		// replace cursor with one pointing to writer
-		cur = cursor.New(cur.Stream, cur.Chunk, cur.Offset, e.confCtx.GetWriterIp())
+		// replace cursor with one pointing to the writer owning the stream
+		cur = cursor.New(cur.Stream, cur.Chunk, cur.Offset, e.confCtx.GetWriterIpForStream(cur.Stream))
 	}
 
 	/*	Read from S3 as long as we're not encountering EOF.
@@ -95,6 +93,10 @@ func (e *EventstoreReader) Read(opts *rtypes.ReadOptions) (*rtypes.ReadResult, e
 			if !e.compressedEncryptedStore.DownloadFromS3(cur, e.s3manager) {
 				log.Printf("EventstoreReader: %s miss from S3", cur.Serialize())
 
+				if truncatedErr := e.truncatedErrorIfExpired(cur); truncatedErr != nil {
+					return nil, truncatedErr
+				}
+
 				// TODO: try this from the server pointed to in the cursor
 				return nil, errors.New("Did not find from S3")
 			}
@@ -130,6 +132,32 @@ func (e *EventstoreReader) Read(opts *rtypes.ReadOptions) (*rtypes.ReadResult, e
 	return parseFromReader(fd, cur, opts)
 }
 
+// chunk was not found. was it expired by the stream's retention policy?
+func (e *EventstoreReader) truncatedErrorIfExpired(cur *cursor.Cursor) *rtypes.TruncatedError {
+	response, err := e.s3manager.Get(wtypes.TruncationMarkerPath(cur.Stream))
+	if err != nil { // stream has never been truncated
+		return nil
+	}
+	defer response.Body.Close()
+
+	marker := wtypes.TruncationMarker{}
+	if err := json.NewDecoder(response.Body).Decode(&marker); err != nil {
+		log.Printf("EventstoreReader: invalid truncation marker: %s", err.Error())
+		return nil
+	}
+
+	earliestValid := cursor.CursorFromserializedMust(marker.EarliestValidCursor)
+
+	if cur.Chunk >= earliestValid.Chunk {
+		return nil
+	}
+
+	return &rtypes.TruncatedError{
+		Cursor:              cur.Serialize(),
+		EarliestValidCursor: marker.EarliestValidCursor,
+	}
+}
+
 func parseFromReader(reader io.Reader, cur *cursor.Cursor, opts *rtypes.ReadOptions) (*rtypes.ReadResult, error) {
 	scanner := bufio.NewScanner(reader)
 
@@ -170,6 +198,13 @@ func parseFromReader(reader io.Reader, cur *cursor.Cursor, opts *rtypes.ReadOpti
 			MetaPayload: metaPayload,
 		}
 
+		if envelope, isEnvelope := event.(metaevents.Envelope); isEnvelope {
+			readResultLine.EventId = envelope.Id
+			readResultLine.EventType = envelope.Type
+			readResultLine.Timestamp = envelope.Timestamp
+			readResultLine.Headers = envelope.Headers
+		}
+
 		readResult.Lines = append(readResult.Lines, readResultLine)
 
 		previousCursor = newCursor
@@ -6,6 +6,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"github.com/function61/eventhorizon/config"
 	"github.com/function61/eventhorizon/cursor"
@@ -153,44 +154,75 @@ func (c *CompressedEncryptedStore) SaveFromLiveFile(cur *cursor.Cursor, fromFd *
 		return err
 	}
 
+	if err := c.Encrypt(fromFd, resultingFile); err != nil {
+		return err
+	}
+
+	if err := resultingFile.Close(); err != nil {
+		return err
+	}
+
+	// atomically rename the compressed & encrypted file to the final name
+	// with which the whole stored block becomes valid
+	if err := os.Rename(localPathTemp, localPath); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// compresses & encrypts in the same format as chunks. also used for data that is
+// not chunks (Writer's snapshots)
+func (c *CompressedEncryptedStore) Encrypt(plaintext io.Reader, sink io.Writer) error {
 	iv := generateRandomAesIv()
 
 	// write header section (magic bytes + IV)
-	if _, err := resultingFile.Write(headerMagicBytes); err != nil {
-		panic(err)
+	if _, err := sink.Write(headerMagicBytes); err != nil {
+		return err
 	}
-	if _, err := resultingFile.Write(iv); err != nil {
-		panic(err)
+	if _, err := sink.Write(iv); err != nil {
+		return err
 	}
 
-	// use the resulting file as a sink for AES stream
-	aesWriter := createAesCtrWriterPipe(c.confCtx.GetStreamEncryptionKey(), iv, resultingFile)
+	// use the sink for AES stream
+	aesWriter := createAesCtrWriterPipe(c.confCtx.GetStreamEncryptionKey(), iv, sink)
 
 	// use AES writer as a sink for gzip stream
 	gzipWriter := gzip.NewWriter(aesWriter)
 
-	// pump the original file through the pipeline: gzip -> AES -> result
-	if _, err := io.Copy(gzipWriter, fromFd); err != nil {
+	// pump the plaintext through the pipeline: gzip -> AES -> result
+	if _, err := io.Copy(gzipWriter, plaintext); err != nil {
 		return err
 	}
 
 	// this is super necessary - it writes some trailing headers without which
 	// some gzip decoders work ($ gzip) and some don't (Golang's gzip)
-	if err := gzipWriter.Close(); err != nil {
+	return gzipWriter.Close()
+}
+
+// reverse of Encrypt()
+func (c *CompressedEncryptedStore) Decrypt(encrypted io.Reader, sink io.Writer) error {
+	headerPlusIV := make([]byte, len(headerMagicBytes)+aes.BlockSize)
+	if _, err := io.ReadFull(encrypted, headerPlusIV); err != nil {
 		return err
 	}
 
-	if err := resultingFile.Close(); err != nil {
-		return err
+	if !bytes.Equal(headerPlusIV[0:len(headerMagicBytes)], headerMagicBytes) {
+		return errors.New("incorrect header")
 	}
 
-	// atomically rename the compressed & encrypted file to the final name
-	// with which the whole stored block becomes valid
-	if err := os.Rename(localPathTemp, localPath); err != nil {
+	aesReader := createAesCtrReaderPipe(
+		c.confCtx.GetStreamEncryptionKey(),
+		headerPlusIV[len(headerMagicBytes):],
+		encrypted)
+
+	gzipReader, err := gzip.NewReader(aesReader)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	_, err = io.Copy(sink, gzipReader)
+	return err
 }
 
 // upload compressed&encrypted to S3. only done once
@@ -1,6 +1,7 @@
 package types
 
 import (
+	"fmt"
 	"github.com/function61/eventhorizon/cursor"
 )
 
@@ -9,6 +10,12 @@ type ReadResultLine struct {
 	Content     string
 	MetaType    string
 	MetaPayload interface{}
+
+	// only present for envelope lines
+	EventId   string            `json:",omitempty"`
+	EventType string            `json:",omitempty"`
+	Timestamp string            `json:",omitempty"`
+	Headers   map[string]string `json:",omitempty"`
 }
 
 type ReadOptions struct {
@@ -32,3 +39,13 @@ func NewReadResult() *ReadResult {
 		Lines: []ReadResultLine{},
 	}
 }
+
+// read was attempted from a chunk that the stream's retention policy has expired
+type TruncatedError struct {
+	Cursor              string
+	EarliestValidCursor string
+}
+
+func (t *TruncatedError) Error() string {
+	return fmt.Sprintf("stream truncated: %s has expired, earliest valid cursor is %s", t.Cursor, t.EarliestValidCursor)
+}
@@ -16,6 +16,12 @@ type ScalableStoreGetResponse struct {
 	Body io.ReadCloser
 }
 
+type ScalableStoreObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
 type S3Manager struct {
 	bucketName string
 	s3Client   *s3.S3
@@ -89,6 +95,37 @@ func (s *S3Manager) Get(key string) (*ScalableStoreGetResponse, error) {
 	}, nil
 }
 
+func (s *S3Manager) Delete(key string) error {
+	_, err := s.s3Client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: &s.bucketName,
+		Key:    &key,
+	})
+
+	return err
+}
+
+// lists all objects whose key starts with prefix, in lexicographic key order
+func (s *S3Manager) List(prefix string) ([]ScalableStoreObject, error) {
+	objects := []ScalableStoreObject{}
+
+	err := s.s3Client.ListObjectsPages(&s3.ListObjectsInput{
+		Bucket: &s.bucketName,
+		Prefix: &prefix,
+	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, object := range page.Contents {
+			objects = append(objects, ScalableStoreObject{
+				Key:          *object.Key,
+				Size:         *object.Size,
+				LastModified: *object.LastModified,
+			})
+		}
+
+		return true // continue to next page
+	})
+
+	return objects, err
+}
+
 // bucket is eligible for bootstrap if it is completely empty
 func (s *S3Manager) IsEligibleForBootstrap() (bool, error) {
 	result, err := s.s3Client.ListObjects(&s3.ListObjectsInput{
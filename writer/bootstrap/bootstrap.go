@@ -12,8 +12,10 @@ import (
 	"github.com/function61/eventhorizon/util/resolvepublicip"
 	"github.com/function61/eventhorizon/util/sslca"
 	"github.com/function61/eventhorizon/writer"
+	wtypes "github.com/function61/eventhorizon/writer/types"
 	"log"
 	"os"
+	"strings"
 )
 
 func Run() error {
@@ -48,17 +50,24 @@ func Run() error {
 	// now we can build real configuration (which Writer needs)
 	realConf := configfactory.BuildMust()
 
+	// replicated group's leader creates the built-in streams once a majority is up
+	if len(realConf.WriterPeers()) > 0 {
+		log.Printf("bootstrap: replicated Writer group of %v", realConf.WriterPeers())
+
+		return nil
+	}
+
 	wri := writer.New(realConf)
 
 	log.Printf("bootstrap: creating / stream")
 
-	if _, err := wri.CreateStream("/"); err != nil {
+	if _, err := wri.CreateStream(&wtypes.CreateStreamRequest{Name: "/"}); err != nil {
 		return err
 	}
 
 	log.Printf("bootstrap: creating /_sub stream")
 
-	if _, err := wri.CreateStream("/_sub"); err != nil {
+	if _, err := wri.CreateStream(&wtypes.CreateStreamRequest{Name: "/_sub"}); err != nil {
 		return err
 	}
 
@@ -95,6 +104,8 @@ func generateAndStoreDiscoveryFile(confCtx *config.Context, s3 *scalablestore.S3
 		CaCertificate:       string(caCert),
 		CaPrivateKey:        string(caPrivateKey),
 		EncryptionMasterKey: encryptionMasterKey,
+		WriterPeers:         writerPeers(),
+		WriterShards:        writerShards(),
 	}
 
 	discoveryFileJson, err := json.MarshalIndent(discoveryFile, "", "    ")
@@ -113,6 +124,25 @@ func generateAndStoreDiscoveryFile(confCtx *config.Context, s3 *scalablestore.S3
 	return nil
 }
 
+// "10.0.0.1,10.0.0.2,10.0.0.3" => replicated Writer group
+func writerPeers() []string {
+	if peers := os.Getenv("WRITER_PEERS"); peers != "" {
+		return strings.Split(peers, ",")
+	}
+
+	return nil
+}
+
+// "10.0.0.1,10.0.1.1" => streams are sharded over these Writers. the one
+// bootstrapping must be one of them, as the built-in streams live on it
+func writerShards() []string {
+	if shards := os.Getenv("WRITER_SHARDS"); shards != "" {
+		return strings.Split(shards, ",")
+	}
+
+	return nil
+}
+
 func resolveWriterPublicIp() (string, error) {
 	if ip := os.Getenv("WRITER_IP_TO_ADVERTISE"); ip != "" {
 		return ip, nil
@@ -0,0 +1,140 @@
+package writer
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/function61/eventhorizon/config"
+	"github.com/function61/eventhorizon/cursor"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"github.com/function61/eventhorizon/writer/types"
+	"log"
+	"time"
+)
+
+// Low-traffic streams might never reach ChunkRotateThreshold, so their data
+// would stay only on Writer's local disk. This task seals live chunks that are
+// older than max chunk age (and have non-meta lines in them), which ships them
+// to long term storage like a regular rotation.
+
+type ChunkSealerTask struct {
+	writer *EventstoreWriter
+	stop   chan bool
+	done   chan bool
+}
+
+func NewChunkSealerTask(writer *EventstoreWriter) *ChunkSealerTask {
+	t := &ChunkSealerTask{
+		writer: writer,
+		stop:   make(chan bool),
+		done:   make(chan bool),
+	}
+
+	go t.loopUntilStopped()
+
+	return t
+}
+
+func (t *ChunkSealerTask) loopUntilStopped() {
+	for {
+		select {
+		case <-t.stop:
+			t.done <- true
+			return
+		case <-time.After(config.ChunkSealerTaskInterval):
+			break
+		}
+
+		// followers seal chunks when the leader's transaction says so
+		if !t.writer.IsLeader() {
+			continue
+		}
+
+		maxChunkAge := t.writer.confCtx.MaxChunkAge()
+		if maxChunkAge == 0 { // disabled
+			continue
+		}
+
+		if err := t.sealOldChunks(maxChunkAge); err != nil {
+			log.Printf("ChunkSealerTask: %s", err.Error())
+		}
+	}
+}
+
+func (t *ChunkSealerTask) sealOldChunks(maxChunkAge time.Duration) error {
+	t.writer.mu.Lock()
+	defer t.writer.mu.Unlock()
+
+	now := time.Now()
+
+	streamsToSeal := []string{}
+
+	err := t.writer.database.View(func(boltTx *bolt.Tx) error {
+		for streamName, chunkSpec := range t.writer.streamToChunkName {
+			stats, err := getStreamStats(streamName, boltTx)
+			if err != nil {
+				return err
+			}
+
+			if chunkShouldBeSealed(chunkSpec, stats.LastAppend, maxChunkAge, now) {
+				streamsToSeal = append(streamsToSeal, streamName)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// one transaction per stream, so one failing stream does not block the others
+	for _, streamName := range streamsToSeal {
+		log.Printf("ChunkSealerTask: sealing %s", streamName)
+
+		tx := transaction.NewEventstoreTransaction(t.writer.database)
+
+		if err := t.writer.update(tx, func() error {
+			return t.writer.sealLiveChunk(streamName, tx)
+		}); err != nil {
+			return err
+		}
+
+		if err := t.writer.applySideEffects(tx); err != nil {
+			return err
+		}
+
+		t.writer.metrics.ChunksSealedByAge.Inc()
+	}
+
+	return nil
+}
+
+func (t *ChunkSealerTask) Close() {
+	log.Printf("ChunkSealerTask: stopping")
+
+	t.stop <- true
+
+	<-t.done
+
+	log.Printf("ChunkSealerTask: stopped")
+}
+
+// only chunks that got a non-meta append after opening are sealed. meta events
+// are appended to idle streams as well (RetentionTask's Truncated, Subscribed
+// etc.), and sealing for those would produce an endless amount of chunks - and
+// with a MaxChunks retention policy, each of them would expire real data.
+//
+// lastAppend is the stream's cursor after its latest non-meta append. streams
+// last appended to by a version that did not record it are sealed only after
+// their next append.
+func chunkShouldBeSealed(chunkSpec *types.ChunkSpec, lastAppend string, maxChunkAge time.Duration, now time.Time) bool {
+	if lastAppend == "" {
+		return false
+	}
+
+	lastAppendCursor := cursor.CursorFromserializedMust(lastAppend)
+
+	if lastAppendCursor.Chunk != chunkSpec.ChunkNumber || lastAppendCursor.Offset <= chunkSpec.HeadAfterOpen {
+		return false
+	}
+
+	return now.Sub(time.Unix(chunkSpec.OpenedAt, 0)) > maxChunkAge
+}
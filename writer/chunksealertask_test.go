@@ -0,0 +1,82 @@
+package writer
+
+import (
+	"github.com/function61/eventhorizon/cursor"
+	"github.com/function61/eventhorizon/util/ass"
+	"github.com/function61/eventhorizon/writer/types"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChunkShouldBeSealed(t *testing.T) {
+	now := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	spec := &types.ChunkSpec{
+		ChunkNumber:   2,
+		OpenedAt:      now.Add(-2 * time.Hour).Unix(),
+		HeadAfterOpen: 100,
+	}
+
+	ass.True(t, chunkShouldBeSealed(spec, "/foo:2:150", time.Hour, now))
+
+	// not old enough
+	ass.False(t, chunkShouldBeSealed(spec, "/foo:2:150", 3*time.Hour, now))
+
+	// nothing appended, or appended by a version that did not record this
+	ass.False(t, chunkShouldBeSealed(spec, "", time.Hour, now))
+
+	// latest append was into a previous chunk => only meta events in this one
+	ass.False(t, chunkShouldBeSealed(spec, "/foo:1:150", time.Hour, now))
+
+	// append that rotated into this chunk only left the Created event here
+	ass.False(t, chunkShouldBeSealed(spec, "/foo:2:100", time.Hour, now))
+}
+
+// idle stream + MaxChunks used to feed each other: Truncated got the live chunk
+// sealed, which expired another chunk with real data, which appended Truncated..
+func TestRetentionAndSealerOnIdleStream(t *testing.T) {
+	e, cleanup := newTestWriter(t)
+	defer cleanup()
+
+	store := newTestScalableStore()
+	sealer := &ChunkSealerTask{writer: e}
+	retention := &RetentionTask{writer: e, s3Manager: store}
+
+	_, err := e.CreateStream(&types.CreateStreamRequest{Name: "/foo"})
+	ass.True(t, err == nil)
+	ass.True(t, e.SetRetentionPolicy("/foo", &types.RetentionPolicy{MaxChunks: 1}) == nil)
+
+	shippedCount := 0
+	shipSealed := func() {
+		shipped := e.shipper.(*testShipper).shipped
+		for _, chunkPath := range shipped[shippedCount:] {
+			store.objects[chunkPath] = []byte("data")
+		}
+		shippedCount = len(shipped)
+	}
+
+	for i := 0; i < 2; i++ {
+		appendLines(t, e, "/foo", "line")
+		ass.True(t, sealer.sealOldChunks(-1*time.Second) == nil)
+	}
+	shipSealed()
+
+	for i := 0; i < 3; i++ {
+		candidates, err := retention.findCandidates()
+		ass.True(t, err == nil)
+		ass.EqualInt(t, len(candidates), 1)
+		ass.True(t, retention.enforce(candidates[0]) == nil)
+
+		ass.True(t, sealer.sealOldChunks(-1*time.Second) == nil)
+		shipSealed()
+	}
+
+	// only the first chunk expired
+	ass.EqualString(t, strings.Join(store.keys("/foo/_/"), ","), "/foo/_/1.log,/foo/_/truncated.json")
+
+	info, err := e.StreamInfo("/foo")
+	ass.True(t, err == nil)
+	ass.EqualInt(t, cursor.CursorFromserializedMust(info.Head).Chunk, 2)
+	ass.True(t, strings.Contains(readLiveChunk(t, e, "/foo/_/2.log"), "/Truncated "))
+}
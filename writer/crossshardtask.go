@@ -0,0 +1,263 @@
+package writer
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/function61/eventhorizon/config"
+	"github.com/function61/eventhorizon/scalablestore"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"github.com/function61/eventhorizon/writer/types"
+	"github.com/function61/eventhorizon/writer/writerclient"
+	"log"
+	"strings"
+	"time"
+)
+
+// Delivers the meta events queued in _crossshardoutbox (see sharding.go) to the
+// shards owning their streams, in the order they were queued. Delivery stops
+// at the first failure and is retried later, so a ChildStreamCreated never
+// arrives after the same stream's StreamDeleted. Each delivery carries an
+// idempotency key, so a delivery whose response got lost is not appended twice.
+//
+// Also retries completing handoffs (see handoff.go) that failed half-way.
+
+type CrossShardTask struct {
+	writer    *EventstoreWriter
+	client    *writerclient.Client
+	s3Manager *scalablestore.S3Manager
+	wake      chan bool
+	stop      chan bool
+	done      chan bool
+}
+
+type pendingCrossShardMetaEvent struct {
+	seqKey []byte
+	event  crossShardMetaEvent
+}
+
+func NewCrossShardTask(writer *EventstoreWriter) *CrossShardTask {
+	t := &CrossShardTask{
+		writer:    writer,
+		client:    writerclient.New(writer.confCtx),
+		s3Manager: scalablestore.NewS3Manager(writer.confCtx),
+		wake:      make(chan bool, 1),
+		stop:      make(chan bool),
+		done:      make(chan bool),
+	}
+
+	go t.loopUntilStopped()
+
+	return t
+}
+
+// the queueing transaction holds Writer's lock, so we only look at the
+// outbox after it's committed
+func (t *CrossShardTask) Wake() {
+	select {
+	case t.wake <- true:
+	default: // already woken
+	}
+}
+
+func (t *CrossShardTask) loopUntilStopped() {
+	for {
+		select {
+		case <-t.stop:
+			t.done <- true
+			return
+		case <-t.wake:
+			break
+		case <-time.After(config.CrossShardRetryInterval):
+			break
+		}
+
+		// the leader delivers, and replicates removing the delivered ones
+		if !t.writer.IsLeader() {
+			continue
+		}
+
+		if err := t.deliverPending(); err != nil {
+			log.Printf("CrossShardTask: %s", err.Error())
+		}
+
+		if err := t.completePendingHandoffs(); err != nil {
+			log.Printf("CrossShardTask: %s", err.Error())
+		}
+	}
+}
+
+func (t *CrossShardTask) deliverPending() error {
+	pending, err := t.readPending()
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+
+	delivered := [][]byte{}
+	orphanedSubscriptions := []string{}
+
+	var deliveryErr error
+
+	for _, item := range pending {
+		err := t.client.AppendMeta(&types.AppendMetaRequest{
+			Stream:         item.event.Stream,
+			MetaEvent:      item.event.MetaEvent,
+			IdempotencyKey: fmt.Sprintf("crossshard:%s:%d", t.writer.confCtx.GetWriterIp(), binary.BigEndian.Uint64(item.seqKey)),
+		})
+		if err == writerclient.ErrStreamNotFound {
+			log.Printf("CrossShardTask: dropping meta event for %s, which does not exist", item.event.Stream)
+
+			// subscription stream deleted while still subscribed to streams here
+			if strings.HasPrefix(item.event.MetaEvent, "/SubscriptionActivity ") {
+				orphanedSubscriptions = append(orphanedSubscriptions, item.event.Stream)
+			}
+		} else if err != nil {
+			deliveryErr = err
+			break
+		}
+
+		delivered = append(delivered, item.seqKey)
+
+		t.writer.metrics.CrossShardMetaEventsDelivered.Inc()
+	}
+
+	if len(delivered) > 0 {
+		if err := t.removeDelivered(delivered, orphanedSubscriptions); err != nil {
+			return err
+		}
+	}
+
+	return deliveryErr
+}
+
+func (t *CrossShardTask) readPending() ([]pendingCrossShardMetaEvent, error) {
+	t.writer.mu.RLock()
+	defer t.writer.mu.RUnlock()
+
+	pending := []pendingCrossShardMetaEvent{}
+
+	err := t.writer.database.View(func(boltTx *bolt.Tx) error {
+		outboxBucket := boltTx.Bucket([]byte("_crossshardoutbox"))
+		if outboxBucket == nil {
+			return nil
+		}
+
+		return outboxBucket.ForEach(func(seqKey []byte, entryJson []byte) error {
+			item := pendingCrossShardMetaEvent{
+				seqKey: append([]byte{}, seqKey...), // only valid during the transaction
+			}
+
+			if err := json.Unmarshal(entryJson, &item.event); err != nil {
+				return err
+			}
+
+			pending = append(pending, item)
+
+			return nil
+		})
+	})
+
+	return pending, err
+}
+
+func (t *CrossShardTask) removeDelivered(seqKeys [][]byte, orphanedSubscriptions []string) error {
+	t.writer.mu.Lock()
+	defer t.writer.mu.Unlock()
+
+	tx := transaction.NewEventstoreTransaction(t.writer.database)
+
+	if err := t.writer.update(tx, func() error {
+		for _, seqKey := range seqKeys {
+			if err := tx.Delete("_crossshardoutbox", seqKey); err != nil {
+				return err
+			}
+		}
+
+		for _, subscription := range orphanedSubscriptions {
+			if err := t.writer.removeOrphanedSubscription(subscription, tx); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return t.writer.applySideEffects(tx)
+}
+
+// steps 2) - 4) of a handoff. each is fine to repeat
+func (t *CrossShardTask) completeHandoff(streamName string, handoff *pendingHandoff) error {
+	if err := putPlacement(t.s3Manager, streamName, handoff.Writer); err != nil {
+		return err
+	}
+
+	if err := t.client.AdoptStream(handoff.Writer, &handoff.Adopt); err != nil {
+		return err
+	}
+
+	t.writer.mu.Lock()
+	defer t.writer.mu.Unlock()
+
+	tx := transaction.NewEventstoreTransaction(t.writer.database)
+
+	if err := t.writer.update(tx, func() error {
+		return tx.Delete("_handoffs", []byte(streamName))
+	}); err != nil {
+		return err
+	}
+
+	log.Printf("CrossShardTask: %s handed off to %s", streamName, handoff.Writer)
+
+	return t.writer.applySideEffects(tx)
+}
+
+func (t *CrossShardTask) completePendingHandoffs() error {
+	pending := map[string]*pendingHandoff{}
+
+	t.writer.mu.RLock()
+
+	err := t.writer.database.View(func(boltTx *bolt.Tx) error {
+		handoffsBucket := boltTx.Bucket([]byte("_handoffs"))
+		if handoffsBucket == nil {
+			return nil
+		}
+
+		return handoffsBucket.ForEach(func(streamName []byte, handoffJson []byte) error {
+			handoff := &pendingHandoff{}
+			if err := json.Unmarshal(handoffJson, handoff); err != nil {
+				return err
+			}
+
+			pending[string(streamName)] = handoff
+
+			return nil
+		})
+	})
+
+	t.writer.mu.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	for streamName, handoff := range pending {
+		if err := t.completeHandoff(streamName, handoff); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *CrossShardTask) Close() {
+	log.Printf("CrossShardTask: stopping")
+
+	t.stop <- true
+
+	<-t.done
+
+	log.Printf("CrossShardTask: stopped")
+}
@@ -9,46 +9,133 @@ import (
 	"github.com/function61/eventhorizon/cursor"
 	"github.com/function61/eventhorizon/metaevents"
 	"github.com/function61/eventhorizon/pubsub/client"
+	"github.com/function61/eventhorizon/scalablestore"
 	"github.com/function61/eventhorizon/util/stringslice"
 	"github.com/function61/eventhorizon/writer/longtermshipper"
+	"github.com/function61/eventhorizon/writer/replication"
 	"github.com/function61/eventhorizon/writer/transaction"
 	"github.com/function61/eventhorizon/writer/types"
 	"github.com/function61/eventhorizon/writer/wal"
+	"github.com/function61/eventhorizon/writer/writerclient"
 	"log"
 	"os"
+	"reflect"
 	"strings"
 	"sync"
+	"time"
 )
 
+// Concurrency: mu guards the in-memory stream state (streamToChunkName, WAL's
+// open files) and serializes bolt write transactions, of which there can only
+// be one at a time anyway. Read-only operations (live reads, stream info etc.)
+// only take the read lock, and live reads release it after opening the file,
+// before reading it or doing any network I/O.
+//
+// TODO: per-stream locking. appends to independent streams still wait for each
+// other on mu. group commit only batches concurrent appends into one
+// transaction, inside of which the files of different streams are written to
+// concurrently
 type EventstoreWriter struct {
 	walManager        *wal.WalManager
-	mu                sync.Mutex
+	mu                sync.RWMutex
 	database          *bolt.DB
-	shipper           *longtermshipper.Shipper
-	pubSubClient      *client.PubSubClient
+	shipper           chunkShipper
+	pubSubClient      publisher
 	streamToChunkName map[string]*types.ChunkSpec
+	groupCommitter    *GroupCommitter
 	subAct            *SubscriptionActivityTask
+	chunkSealer       *ChunkSealerTask
+	walSyncer         *WalSyncTask
+	snapshotter       *SnapshotTask
+	retention         *RetentionTask
+	crossShard        *CrossShardTask
+	shardClient       *writerclient.Client // for asking other shards
+	replication       *replication.Node    // nil if not replicated
 	LiveReader        *LiveReader
+	pendingAcks       pendingAcks // reported by pushers, not persisted yet
 	metrics           *Metrics
 	confCtx           *config.Context
 }
 
+// *longtermshipper.Shipper. tests don't ship to scalablestore
+type chunkShipper interface {
+	MarkFileToBeShipped(fileToShip *types.LongTermShippableFile, tx *transaction.EventstoreTransaction) error
+	MarkStreamToBePurged(streamName string, tx *transaction.EventstoreTransaction) error
+	Ship(ltsf *types.LongTermShippableFile, database *bolt.DB)
+	Purge(streamName string, database *bolt.DB)
+	RecoverUnfinishedShipments(tx *transaction.EventstoreTransaction) error
+	Close()
+}
+
+// *client.PubSubClient. tests don't connect to pub/sub
+type publisher interface {
+	Publish(topic string, message string)
+	Close()
+}
+
+// variable only so that tests can use a temp directory
+var dbLocation = config.BoltDbDir + "/evenstore-wal.boltdb"
+
 func New(confCtx *config.Context) *EventstoreWriter {
 	e := &EventstoreWriter{
 		streamToChunkName: make(map[string]*types.ChunkSpec),
-		mu:                sync.Mutex{},
+		mu:                sync.RWMutex{},
 		shipper:           longtermshipper.New(confCtx),
 		metrics:           NewMetrics(),
+		shardClient:       writerclient.New(confCtx),
 		confCtx:           confCtx,
 	}
 
+	if err := types.Durability(confCtx.Durability()).Validate(); err != nil {
+		log.Fatalf("EventstoreWriter: discovery file: %s", err.Error())
+	}
+
 	e.makeBoltDbDirIfNotExist()
 
+	// handed off streams. pending handoffs are loaded from BoltDB below
+	if len(confCtx.WriterShards()) > 1 {
+		if err := e.loadPlacements(scalablestore.NewS3Manager(confCtx)); err != nil {
+			log.Fatalf("EventstoreWriter: failed to load placement records: %s", err.Error())
+		}
+	}
+
 	e.startPubSubClient()
 
-	// DB will be created if not exists
+	e.openDatabase()
+
+	e.metrics.WalBytesLostOnRecovery.Add(float64(e.walManager.BytesLostOnRecovery()))
+
+	// replicated entries are applied right away, but we only lead once started below
+	if len(confCtx.WriterPeers()) > 0 {
+		e.startReplication()
+	}
+
+	e.subAct = NewSubscriptionActivityTask(e)
+
+	e.groupCommitter = NewGroupCommitter(e)
+
+	e.chunkSealer = NewChunkSealerTask(e)
 
-	dbLocation := config.BoltDbDir + "/evenstore-wal.boltdb"
+	e.walSyncer = NewWalSyncTask(e)
+
+	e.snapshotter = NewSnapshotTask(e)
+
+	e.retention = NewRetentionTask(e)
+
+	e.crossShard = NewCrossShardTask(e)
+
+	e.LiveReader = NewLiveReader(e)
+
+	if e.replication != nil {
+		e.replication.Start()
+	}
+
+	return e
+}
+
+// opens BoltDB and recovers the WAL & the open streams from it
+func (e *EventstoreWriter) openDatabase() {
+	// DB will be created if not exists
 
 	log.Printf("EventstoreWriter: opening DB %s", dbLocation)
 
@@ -63,6 +150,21 @@ func New(confCtx *config.Context) *EventstoreWriter {
 
 		_streams:
 			stream_name => latest block spec
+
+		_tombstones:
+			stream_name => StreamDeleted meta event
+
+		_retentionpolicies:
+			stream_name => retention policy
+
+		_streamstats:
+			stream_name => line/byte/chunk counters
+
+		_streamsettings:
+			stream_name => stream settings (chunk size etc.)
+
+		_replication:
+			appliedindex => index of the latest Raft log entry applied (replicated Writer)
 	*/
 	db, err := bolt.Open(dbLocation, 0600, nil)
 	if err != nil {
@@ -73,11 +175,9 @@ func New(confCtx *config.Context) *EventstoreWriter {
 
 	tx := transaction.NewEventstoreTransaction(e.database)
 
-	if err := e.database.Update(func(boltTx *bolt.Tx) error {
-		tx.BoltTx = boltTx
-
+	if err := e.updateLocal(tx, func() error {
 		// TODO: have one WAL instance per file instead of a WAL manager.
-		e.walManager = wal.NewWalManager(tx)
+		e.walManager = wal.NewWalManager(e.confCtx.DurabilityBatchInterval(), tx)
 
 		// since we just started with empty data structures, read from database
 		// which blocks we have open (and their metadata), and re-open
@@ -90,28 +190,57 @@ func New(confCtx *config.Context) *EventstoreWriter {
 			return err
 		}
 
+		if err := e.discoverPendingHandoffs(tx); err != nil {
+			return err
+		}
+
 		return nil
 	}); err != nil {
 		panic(err)
 	}
 
-	// Recovered writes from WAL, WAL compactions etc.
+	// Recovered writes from old-style WAL etc.
 	if err := e.applySideEffects(tx); err != nil {
 		panic(err)
 	}
-
-	e.subAct = NewSubscriptionActivityTask(e)
-
-	e.LiveReader = NewLiveReader(e)
-
-	return e
 }
 
 func (e *EventstoreWriter) GetConfigurationContext() *config.Context {
 	return e.confCtx
 }
 
-func (e *EventstoreWriter) CreateStream(streamName string) (*types.CreateStreamOutput, error) {
+func (e *EventstoreWriter) CreateStream(req *types.CreateStreamRequest) (*types.CreateStreamOutput, error) {
+	if err := req.Settings.Validate(); err != nil {
+		return nil, err
+	}
+
+	streamName := req.Name
+
+	if err := e.checkOwnership(streamName); err != nil {
+		return nil, err
+	}
+
+	// "/tenants/foo" => "/tenants"
+	parentStream := parentStreamName(streamName)
+
+	// asked before taking our lock, so two shards creating children for each
+	// other's streams cannot deadlock
+	var remoteParentSettings *types.StreamSettings
+	var remoteParentRecursiveSubscriptions []string
+	var remoteParentSubscriptionFilters map[string]*metaevents.SubscriptionFilter
+	var remoteParentActivityIntervals map[string]int64
+	if parentStream != streamName && !e.ownsStream(parentStream) {
+		parentInfo, err := e.shardClient.StreamInfo(&types.StreamInfoRequest{Stream: parentStream})
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("CreateStream: parent stream %s: %s", parentStream, err.Error()))
+		}
+
+		remoteParentSettings = &parentInfo.Settings
+		remoteParentRecursiveSubscriptions = parentInfo.RecursiveSubscriptions
+		remoteParentSubscriptionFilters = parentInfo.SubscriptionFilters
+		remoteParentActivityIntervals = parentInfo.ActivityIntervals
+	}
+
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
@@ -125,24 +254,102 @@ func (e *EventstoreWriter) CreateStream(streamName string) (*types.CreateStreamO
 
 	tx := transaction.NewEventstoreTransaction(e.database)
 
-	err := e.database.Update(func(boltTx *bolt.Tx) error {
-		tx.BoltTx = boltTx
+	err := e.update(tx, func() error {
+		if tombstone := getTombstone(streamName, tx.BoltTx); tombstone != nil {
+			if !canRecreate(tombstone, tx.BoltTx) {
+				return errors.New(fmt.Sprintf("CreateStream: stream %s has been deleted. it can be re-created once purged", streamName))
+			}
 
-		// "/tenants/foo" => "/tenants"
-		parentStream := parentStreamName(streamName)
+			if err := tx.Delete("_tombstones", []byte(streamName)); err != nil {
+				return err
+			}
+
+			// local copies of the purged chunks
+			if err := e.walManager.ForgetFiles(types.ChunkPathPrefix(streamName), tx); err != nil {
+				return err
+			}
+		}
+
+		settings := &req.Settings
+		inheritedSubscriptions := []string{}
+		inheritedFilters := map[string]*metaevents.SubscriptionFilter{}
+		inheritedIntervals := map[string]int64{}
 
 		if parentStream != streamName { // only equal when "/" (root stream)
+			parentSettings := remoteParentSettings
+			parentRecursiveSubscriptions := remoteParentRecursiveSubscriptions
+			parentFilters := remoteParentSubscriptionFilters
+			parentIntervals := remoteParentActivityIntervals
+			if parentSettings == nil {
+				var err error
+				parentSettings, err = getStreamSettings(parentStream, tx.BoltTx)
+				if err != nil {
+					return err
+				}
+
+				parentRecursiveSubscriptions = getRecursiveSubscriptionsForStream(parentStream, tx.BoltTx)
+				parentFilters = getSubscriptionFiltersForStream(parentStream, tx.BoltTx)
+				parentIntervals = getSubscriptionActivityIntervalsForStream(parentStream, tx.BoltTx)
+			}
+
+			settings = settings.InheritFrom(parentSettings)
+
+			if inheritsSubscriptions(streamName) {
+				inheritedSubscriptions = parentRecursiveSubscriptions
+
+				for _, subscriptionId := range inheritedSubscriptions {
+					if filter, hasFilter := parentFilters[subscriptionId]; hasFilter {
+						inheritedFilters[subscriptionId] = filter
+					}
+
+					if intervalMs, hasInterval := parentIntervals[subscriptionId]; hasInterval {
+						inheritedIntervals[subscriptionId] = intervalMs
+					}
+				}
+			}
+
 			childStreamCreated := metaevents.NewChildStreamCreated(
 				streamFirstChunkCursor.Stream,
 				streamFirstChunkCursor.Serialize())
 
-			// errors also if parent stream does not exist
-			if err := e.appendToStreamInternal(parentStream, nil, childStreamCreated.Serialize(), tx); err != nil {
+			// errors also if parent stream does not exist (on this shard)
+			if err := e.appendMetaToStream(parentStream, childStreamCreated.Serialize(), tx); err != nil {
 				return err
 			}
 		}
 
-		return e.openChunkLocally(streamFirstChunkCursor, tx)
+		if err := saveStreamSettings(streamName, settings, tx); err != nil {
+			return err
+		}
+
+		// before opening the chunk, so its Created lists them
+		if err := saveSubscriptionsForStream(streamName, inheritedSubscriptions, tx); err != nil {
+			return err
+		}
+
+		if err := saveRecursiveSubscriptionsForStream(streamName, inheritedSubscriptions, tx); err != nil {
+			return err
+		}
+
+		if err := saveSubscriptionFiltersForStream(streamName, inheritedFilters, tx); err != nil {
+			return err
+		}
+
+		if err := saveSubscriptionActivityIntervalsForStream(streamName, inheritedIntervals, tx); err != nil {
+			return err
+		}
+
+		cursorAfter, err := e.openChunkLocally(streamFirstChunkCursor, tx)
+		if err != nil {
+			return err
+		}
+
+		// inheriting subscribers notice the new stream from SubscriptionActivity
+		if len(inheritedSubscriptions) > 0 {
+			return e.streamHeadMoved(cursorAfter, "", tx)
+		}
+
+		return nil
 	})
 	if err != nil {
 		return nil, err
@@ -162,43 +369,391 @@ func (e *EventstoreWriter) CreateStream(streamName string) (*types.CreateStreamO
 	return output, nil
 }
 
-func (e *EventstoreWriter) SubscribeToStream(streamName string, subscriptionId string) error {
+// Appends StreamDeleted to the stream and its parent, seals the live chunk and
+// forgets the stream. With purge the stream's chunks are also removed from
+// scalablestore, otherwise the last chunk is shipped like on rotation.
+// The name is tombstoned, i.e. it cannot be re-created until purged. Deleting
+// an already deleted stream with purge purges it.
+func (e *EventstoreWriter) DeleteStream(streamName string, purge bool) error {
+	if err := e.checkOwnership(streamName); err != nil {
+		return err
+	}
+
+	parentStream := parentStreamName(streamName)
+
+	if parentStream == streamName || streamName == "/_sub" {
+		return errors.New("DeleteStream: cannot delete a built-in stream")
+	}
+
+	// children on this shard are checked in the transaction
+	if err := e.checkNoChildStreamsOnOtherShards(streamName); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	log.Printf("EventstoreWriter: DeleteStream: %s (purge=%v)", streamName, purge)
+
+	streamDeleted := metaevents.NewStreamDeleted(streamName, purge)
+
+	tx := transaction.NewEventstoreTransaction(e.database)
+
+	var liveFilePath string
+
+	err := e.update(tx, func() error {
+		chunkSpec, streamExists := e.streamToChunkName[streamName]
+		if !streamExists {
+			if tombstone := getTombstone(streamName, tx.BoltTx); tombstone != nil && purge {
+				return e.purgeDeletedStream(tombstone, streamDeleted, tx)
+			}
+
+			return errors.New(fmt.Sprintf("DeleteStream: stream %s does not exist", streamName))
+		}
+
+		if hasChildStreams(streamName, tx.BoltTx) {
+			return errors.New(fmt.Sprintf("DeleteStream: stream %s has child streams", streamName))
+		}
+
+		// otherwise SubscriptionActivity would be delivered to a stream that does not exist
+		if subscribedTo := getStreamsSubscribedTo(streamName, tx.BoltTx); len(subscribedTo) > 0 {
+			return errors.New(fmt.Sprintf("DeleteStream: %s is still subscribed to %v", streamName, subscribedTo))
+		}
+
+		// not using appendToStreamInternal(), because we don't want the chunk to rotate
+		nextOffset, err := e.walManager.AppendToFile(chunkSpec.ChunkPath, streamDeleted.Serialize(), tx)
+		if err != nil {
+			return err
+		}
+
+		cursorAfterSerialized := cursor.New(
+			streamName,
+			chunkSpec.ChunkNumber,
+			nextOffset,
+			e.confCtx.GetWriterIp()).Serialize()
+
+		tx.AffectedStreams[streamName] = cursorAfterSerialized
+
+		// subscriptions are dropped below, so this realtime notification is the last
+		// one subscribers get. the StreamDeleted in the parent stream is durable though.
+		for _, subscriber := range getSubscriptionsForStream(streamName, tx.BoltTx) {
+			tx.SubscriberNotifications = append(tx.SubscriberNotifications, &types.SubscriberNotification{
+				SubscriptionId:         subscriber,
+				LatestCursorSerialized: cursorAfterSerialized,
+			})
+		}
+
+		if err := e.appendMetaToStream(parentStream, streamDeleted.Serialize(), tx); err != nil {
+			return err
+		}
+
+		liveFilePath, err = e.walManager.CloseActiveFile(chunkSpec.ChunkPath, tx)
+		if err != nil {
+			return err
+		}
+
+		if purge {
+			if err := e.shipper.MarkStreamToBePurged(streamName, tx); err != nil {
+				return err
+			}
+		} else {
+			fileToShip := &types.LongTermShippableFile{
+				Block:    cursor.New(chunkSpec.StreamName, chunkSpec.ChunkNumber, 0, cursor.NoServer),
+				FilePath: liveFilePath,
+			}
+
+			if err := e.shipper.MarkFileToBeShipped(fileToShip, tx); err != nil {
+				return err
+			}
+		}
+
+		return e.forgetStream(streamName, streamDeleted.Serialize(), tx)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := e.applySideEffects(tx); err != nil {
+		return err
+	}
+
+	// file was closed in side effects. the purge does not need it, and it's
+	// not worth the trouble to make this durable as it's just local garbage
+	if purge && liveFilePath != "" {
+		if err := os.Remove(liveFilePath); err != nil {
+			log.Printf("EventstoreWriter: DeleteStream: failed to remove %s: %s", liveFilePath, err.Error())
+		}
+	}
+
+	e.metrics.DeleteStreamOps.Inc()
+
+	return nil
+}
+
+// for a stream that was deleted without purge. the parent gets another
+// StreamDeleted, so readers (and recovery) know that the chunks are gone. if the
+// parent was deleted since, its nearest ancestor that still exists gets it
+func (e *EventstoreWriter) purgeDeletedStream(tombstone *metaevents.StreamDeleted, streamDeleted *metaevents.StreamDeleted, tx *transaction.EventstoreTransaction) error {
+	if tombstone.Purged {
+		return nil // purged, or being purged
+	}
+
+	if err := e.shipper.MarkStreamToBePurged(tombstone.Name, tx); err != nil {
+		return err
+	}
+
+	ancestor := parentStreamName(tombstone.Name)
+	for e.ownsStream(ancestor) && !e.streamExists(ancestor, tx) {
+		ancestor = parentStreamName(ancestor) // root stream cannot be deleted
+	}
+
+	if err := e.appendMetaToStream(ancestor, streamDeleted.Serialize(), tx); err != nil {
+		return err
+	}
+
+	return saveTombstone(tombstone.Name, streamDeleted.Serialize(), tx)
+}
+
+// removes the stream's metadata and tombstones it. the live chunk must already be closed
+func (e *EventstoreWriter) forgetStream(streamName string, streamDeletedSerialized string, tx *transaction.EventstoreTransaction) error {
+	if err := tx.Delete("_streams", []byte(streamName)); err != nil {
+		return err
+	}
+
+	if err := saveSubscriptionsForStream(streamName, []string{}, tx); err != nil {
+		return err
+	}
+
+	if err := saveRecursiveSubscriptionsForStream(streamName, []string{}, tx); err != nil {
+		return err
+	}
+
+	if err := forgetSubscriptionFilters(streamName, tx); err != nil {
+		return err
+	}
+
+	if err := forgetSubscriptionAcks(streamName, tx); err != nil {
+		return err
+	}
+
+	if err := tx.Delete("_dirtystreams", []byte(streamName)); err != nil {
+		return err
+	}
+
+	if err := deleteStreamStats(streamName, tx); err != nil {
+		return err
+	}
+
+	if err := saveStreamSettings(streamName, &types.StreamSettings{}, tx); err != nil {
+		return err
+	}
+
+	if err := forgetIdempotencyKeys(streamName, tx); err != nil {
+		return err
+	}
+
+	if err := saveRetentionPolicy(streamName, &types.RetentionPolicy{}, tx); err != nil {
+		return err
+	}
+
+	if err := saveTombstone(streamName, streamDeletedSerialized, tx); err != nil {
+		return err
+	}
+
+	tx.DeletedStreams = append(tx.DeletedStreams, streamName)
+
+	return nil
+}
+
+// zero policy removes the stream's policy. expired chunks are removed by RetentionTask
+func (e *EventstoreWriter) SetRetentionPolicy(streamName string, policy *types.RetentionPolicy) error {
+	if err := e.checkOwnership(streamName); err != nil {
+		return err
+	}
+
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
+	if !e.streamExists(streamName, nil) {
+		return errors.New(fmt.Sprintf("SetRetentionPolicy: stream %s does not exist", streamName))
+	}
+
+	tx := transaction.NewEventstoreTransaction(e.database)
+
+	if err := e.update(tx, func() error {
+		return saveRetentionPolicy(streamName, policy, tx)
+	}); err != nil {
+		return err
+	}
+
+	return e.applySideEffects(tx)
+}
+
+func (e *EventstoreWriter) ListStreams(streamName string, recursive bool) (*types.ListStreamsOutput, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	// with shards, a stream can have children here even if it's not ours
+	if e.ownsStream(streamName) && !e.streamExists(streamName, nil) {
+		return nil, errors.New(fmt.Sprintf("ListStreams: stream %s does not exist", streamName))
+	}
+
+	output := &types.ListStreamsOutput{}
+
+	if err := e.database.View(func(boltTx *bolt.Tx) error {
+		output.Streams = listChildStreams(streamName, recursive, boltTx)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return output, nil
+}
+
+func (e *EventstoreWriter) StreamInfo(streamName string) (*types.StreamInfoOutput, error) {
+	if err := e.checkOwnership(streamName); err != nil {
+		return nil, err
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	head, err := e.streamHead(streamName, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var stats *streamStats
+	var settings *types.StreamSettings
+	var recursiveSubscriptions []string
+	var subscriptionFilters map[string]*metaevents.SubscriptionFilter
+	var activityIntervals map[string]int64
+
+	if err := e.database.View(func(boltTx *bolt.Tx) error {
+		var err error
+		stats, err = getStreamStats(streamName, boltTx)
+		if err != nil {
+			return err
+		}
+
+		recursiveSubscriptions = getRecursiveSubscriptionsForStream(streamName, boltTx)
+
+		subscriptionFilters = getSubscriptionFiltersForStream(streamName, boltTx)
+		activityIntervals = getSubscriptionActivityIntervalsForStream(streamName, boltTx)
+
+		settings, err = getStreamSettings(streamName, boltTx)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	output := &types.StreamInfoOutput{
+		Name:       streamName,
+		Head:       head.Serialize(),
+		LineCount:  stats.LineCount,
+		ByteCount:  stats.ByteCount,
+		ChunkCount: stats.ChunkCount,
+		Settings:   *settings,
+
+		RecursiveSubscriptions: recursiveSubscriptions,
+		SubscriptionFilters:    subscriptionFilters,
+		ActivityIntervals:      activityIntervals,
+	}
+
+	if stats.LastWrite != 0 {
+		output.LastWriteTime = time.Unix(0, stats.LastWrite).UTC()
+	}
+
+	return output, nil
+}
+
+// "/tenants/**" subscribes recursively: to /tenants and the child streams that
+// are created afterwards (recursively), but not to existing child streams.
+// with a filter, the subscriber is only notified about lines that match it, and
+// with an activity interval, at most that often. subscribing again changes them
+func (e *EventstoreWriter) SubscribeToStream(stream string, subscriptionId string, filter *metaevents.SubscriptionFilter, activityIntervalMs int64) error {
+	streamName, recursive := types.RecursiveSubscriptionStream(stream)
+
+	if err := e.checkOwnership(streamName); err != nil {
+		return err
+	}
+
+	if filter != nil && filter.IsEmpty() {
+		filter = nil
+	}
+
+	if activityIntervalMs < 0 {
+		return errors.New("SubscribeToStream: activity interval cannot be negative")
+	}
+
 	subscribedEvent := metaevents.NewSubscribed(subscriptionId)
+	subscribedEvent.Recursive = recursive
+	subscribedEvent.Filter = filter
+	subscribedEvent.ActivityIntervalMs = activityIntervalMs
 
 	if !strings.HasPrefix(subscriptionId, subscriptionStreamPath("")) {
 		return errors.New("SubscribeToStream: subscription is not a subscription stream")
 	}
 
-	if strings.HasPrefix(streamName, subscriptionStreamPath("")) {
+	if strings.HasPrefix(streamName, subscriptionStreamPath("")) || (recursive && streamName == "/_sub") {
 		// this would cause an endless SubscriptionActivity notification loop
 		return errors.New("SubscribeToStream: cannot subscribe to a subscription stream")
 	}
 
-	tx := transaction.NewEventstoreTransaction(e.database)
+	// like in CreateStream(), another shard is asked before taking our lock
+	if !e.ownsStream(subscriptionId) {
+		if _, err := e.shardClient.StreamInfo(&types.StreamInfoRequest{Stream: subscriptionId}); err != nil {
+			return errors.New(fmt.Sprintf("SubscribeToStream: subscription %s: %s", subscriptionId, err.Error()))
+		}
+	}
 
-	err := e.database.Update(func(boltTx *bolt.Tx) error {
-		tx.BoltTx = boltTx
+	e.mu.Lock()
+	defer e.mu.Unlock()
 
-		// TODO: cannot do this check in a clustered context
-		if !e.streamExists(subscriptionId, tx) {
+	tx := transaction.NewEventstoreTransaction(e.database)
+
+	err := e.update(tx, func() error {
+		if e.ownsStream(subscriptionId) && !e.streamExists(subscriptionId, tx) {
 			return errors.New(fmt.Sprintf("SubscribeToStream: subscription %s does not exist", subscriptionId))
 		}
 
 		existingSubscriptions := getSubscriptionsForStream(streamName, tx.BoltTx)
+		existingRecursiveSubscriptions := getRecursiveSubscriptionsForStream(streamName, tx.BoltTx)
+
+		subscribed := stringslice.ItemIndex(subscriptionId, existingSubscriptions) != -1
+		subscribedRecursively := stringslice.ItemIndex(subscriptionId, existingRecursiveSubscriptions) != -1
+
+		filterUnchanged := reflect.DeepEqual(filter, getSubscriptionFilter(streamName, subscriptionId, tx.BoltTx))
+		intervalUnchanged := activityIntervalMs == getSubscriptionActivityIntervalsForStream(streamName, tx.BoltTx)[subscriptionId]
 
-		if stringslice.ItemIndex(subscriptionId, existingSubscriptions) != -1 {
+		if subscribed && (subscribedRecursively || !recursive) && filterUnchanged && intervalUnchanged {
 			// is already subscribed => NOOP. cannot return error, as this could
 			// be a re-try due to previous ACK not getting delivered
 			log.Printf("EventstoreWriter: subscribe: subscription already exists")
 			return nil
 		}
 
-		newSubscriptions := append(existingSubscriptions, subscriptionId)
+		if !subscribed {
+			newSubscriptions := append(existingSubscriptions, subscriptionId)
+
+			if err := saveSubscriptionsForStream(streamName, newSubscriptions, tx); err != nil {
+				return err
+			}
+		}
+
+		if recursive && !subscribedRecursively {
+			newRecursiveSubscriptions := append(existingRecursiveSubscriptions, subscriptionId)
+
+			if err := saveRecursiveSubscriptionsForStream(streamName, newRecursiveSubscriptions, tx); err != nil {
+				return err
+			}
+		}
+
+		if err := saveSubscriptionFilter(streamName, subscriptionId, filter, tx); err != nil {
+			return err
+		}
 
-		if err := saveSubscriptionsForStream(streamName, newSubscriptions, tx.BoltTx); err != nil {
+		if err := saveSubscriptionActivityInterval(streamName, subscriptionId, activityIntervalMs, tx); err != nil {
 			return err
 		}
 
@@ -207,7 +762,7 @@ func (e *EventstoreWriter) SubscribeToStream(streamName string, subscriptionId s
 		// for the stream even if the stream doesn't have any other "real" activity.
 		// => subscriber will notice it. everything went better than expected :)
 
-		return e.appendToStreamInternal(streamName, nil, subscribedEvent.Serialize(), tx)
+		return e.appendToStreamInternal(streamName, "", subscribedEvent.Serialize(), tx)
 	})
 	if err != nil {
 		return err
@@ -224,38 +779,47 @@ func (e *EventstoreWriter) SubscribeToStream(streamName string, subscriptionId s
 	return nil
 }
 
-func (e *EventstoreWriter) UnsubscribeFromStream(streamName string, subscriptionId string) error {
+// removes the subscription from the stream, also if it was recursive ("/tenants/**"
+// is accepted as well). with "/tenants/**", our descendants that inherited it are
+// unsubscribed as well. descendants on other shards must be unsubscribed there
+func (e *EventstoreWriter) UnsubscribeFromStream(stream string, subscriptionId string) error {
+	streamName, recursive := types.RecursiveSubscriptionStream(stream)
+
+	if err := e.checkOwnership(streamName); err != nil {
+		return err
+	}
+
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
 	unsubscribedEvent := metaevents.NewUnsubscribed(subscriptionId)
+	unsubscribedEvent.Recursive = recursive
 
 	tx := transaction.NewEventstoreTransaction(e.database)
 
-	err := e.database.Update(func(boltTx *bolt.Tx) error {
-		tx.BoltTx = boltTx
-
+	err := e.update(tx, func() error {
 		// intentionally not checking if subscription stream exists here, because it was
 		// already checked on subscription
+		if err := e.unsubscribeInTx(streamName, unsubscribedEvent, tx); err != nil {
+			return err
+		}
 
-		existingSubscriptions := getSubscriptionsForStream(streamName, tx.BoltTx)
-
-		idxInSlice := stringslice.ItemIndex(subscriptionId, existingSubscriptions)
-
-		if idxInSlice == -1 {
-			// subscription does not exist => cannot unsubscribe => NOOP, as we
-			// cannot error because this could be a re-try due to a lost ACK
-			log.Printf("EventstoreWriter: unsubscribe for a non-existing subscription")
+		if !recursive {
 			return nil
 		}
 
-		newSubscriptions := append(existingSubscriptions[:idxInSlice], existingSubscriptions[idxInSlice+1:]...)
+		// the ones that only have a non-recursive subscription of their own keep it
+		for _, descendant := range listChildStreams(streamName, true, tx.BoltTx) {
+			if stringslice.ItemIndex(subscriptionId, getRecursiveSubscriptionsForStream(descendant, tx.BoltTx)) == -1 {
+				continue
+			}
 
-		if err := saveSubscriptionsForStream(streamName, newSubscriptions, tx.BoltTx); err != nil {
-			return err
+			if err := e.unsubscribeInTx(descendant, unsubscribedEvent, tx); err != nil {
+				return err
+			}
 		}
 
-		return e.appendToStreamInternal(streamName, nil, unsubscribedEvent.Serialize(), tx)
+		return nil
 	})
 	if err != nil {
 		return err
@@ -270,16 +834,115 @@ func (e *EventstoreWriter) UnsubscribeFromStream(streamName string, subscription
 	return nil
 }
 
-func (e *EventstoreWriter) AppendToStream(streamName string, contentArr []string) (*types.AppendToStreamOutput, error) {
+func (e *EventstoreWriter) unsubscribeInTx(streamName string, unsubscribedEvent *metaevents.Unsubscribed, tx *transaction.EventstoreTransaction) error {
+	subscriptionId := unsubscribedEvent.SubscriptionId
+
+	existingSubscriptions := getSubscriptionsForStream(streamName, tx.BoltTx)
+
+	idxInSlice := stringslice.ItemIndex(subscriptionId, existingSubscriptions)
+
+	if idxInSlice == -1 {
+		// subscription does not exist => cannot unsubscribe => NOOP, as we
+		// cannot error because this could be a re-try due to a lost ACK
+		log.Printf("EventstoreWriter: unsubscribe for a non-existing subscription")
+		return nil
+	}
+
+	newSubscriptions := append(existingSubscriptions[:idxInSlice], existingSubscriptions[idxInSlice+1:]...)
+
+	if err := saveSubscriptionsForStream(streamName, newSubscriptions, tx); err != nil {
+		return err
+	}
+
+	if err := saveSubscriptionFilter(streamName, subscriptionId, nil, tx); err != nil {
+		return err
+	}
+
+	if err := saveSubscriptionActivityInterval(streamName, subscriptionId, 0, tx); err != nil {
+		return err
+	}
+
+	if err := tx.Delete("_subscriptionacks", streamSubscriptionKey(streamName, subscriptionId)); err != nil {
+		return err
+	}
+
+	// non-recursive unsubscribe removes the recursive one as well, as a
+	// recursive subscription always covers the stream itself
+	existingRecursiveSubscriptions := getRecursiveSubscriptionsForStream(streamName, tx.BoltTx)
+
+	if idx := stringslice.ItemIndex(subscriptionId, existingRecursiveSubscriptions); idx != -1 {
+		newRecursiveSubscriptions := append(existingRecursiveSubscriptions[:idx], existingRecursiveSubscriptions[idx+1:]...)
+
+		if err := saveRecursiveSubscriptionsForStream(streamName, newRecursiveSubscriptions, tx); err != nil {
+			return err
+		}
+	}
+
+	return e.appendToStreamInternal(streamName, "", unsubscribedEvent.Serialize(), tx)
+}
+
+func (e *EventstoreWriter) AppendToStream(req *types.AppendToStreamRequest) (*types.AppendToStreamOutput, error) {
+	if err := e.checkOwnership(req.Stream); err != nil {
+		return nil, err
+	}
+
+	rawLines, err := encodeAppend(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// concurrent appends are committed together in one transaction
+	return e.groupCommitter.Append(req, rawLines)
+}
+
+// all-or-nothing: either every append is committed or none is. appends are done
+// in the given order, so the same stream can be appended to more than once
+func (e *EventstoreWriter) AppendMulti(req *types.AppendMultiRequest) (*types.AppendMultiOutput, error) {
+	if len(req.Appends) == 0 {
+		return nil, errors.New("EventstoreWriter.AppendMulti: no appends")
+	}
+
+	rawLinesPerAppend := []string{}
+
+	for idx := range req.Appends {
+		// the transaction cannot span shards
+		if err := e.checkOwnership(req.Appends[idx].Stream); err != nil {
+			return nil, err
+		}
+
+		// replaying only some of the appends would break all-or-nothing
+		if req.Appends[idx].IdempotencyKey != "" {
+			return nil, errors.New("EventstoreWriter.AppendMulti: IdempotencyKey not supported")
+		}
+
+		rawLines, err := encodeAppend(&req.Appends[idx])
+		if err != nil {
+			return nil, err
+		}
+
+		rawLinesPerAppend = append(rawLinesPerAppend, rawLines)
+	}
+
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
 	tx := transaction.NewEventstoreTransaction(e.database)
 
-	err := e.database.Update(func(boltTx *bolt.Tx) error {
-		tx.BoltTx = boltTx
+	output := &types.AppendMultiOutput{
+		Outputs: []types.AppendToStreamOutput{},
+	}
+
+	err := e.update(tx, func() error {
+		for idx := range req.Appends {
+			appendOutput, _, err := e.appendToStreamInTx(&req.Appends[idx], rawLinesPerAppend[idx], tx)
+			if err != nil {
+				return err
+			}
 
-		return e.appendToStreamInternal(streamName, contentArr, "", tx)
+			output.Outputs = append(output.Outputs, *appendOutput)
+		}
+
+		return nil
 	})
 	if err != nil {
 		return nil, err
@@ -289,41 +952,95 @@ func (e *EventstoreWriter) AppendToStream(streamName string, contentArr []string
 		return nil, err
 	}
 
-	e.metrics.AppendToStreamOps.Inc()
+	e.metrics.AppendMultiOps.Inc()
+
+	return output, nil
+}
+
+// returns replayed=true if the append was not done because of a previously
+// seen idempotency key. can be called many times within one transaction
+func (e *EventstoreWriter) appendToStreamInTx(req *types.AppendToStreamRequest, rawLines string, tx *transaction.EventstoreTransaction) (*types.AppendToStreamOutput, bool, error) {
+	idempotencyKeyWindow := e.confCtx.IdempotencyKeyWindow()
+
+	// must be checked before expected offset, because a retry of a
+	// succeeded append would always conflict
+	if req.IdempotencyKey != "" {
+		replayedOutput, err := lookupIdempotencyKey(req.Stream, req.IdempotencyKey, idempotencyKeyWindow, tx.BoltTx)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if replayedOutput != nil {
+			return replayedOutput, true, nil
+		}
+	}
+
+	if req.ExpectedOffset != "" {
+		if err := e.verifyExpectedOffset(req.Stream, req.ExpectedOffset, tx); err != nil {
+			return nil, false, err
+		}
+	}
+
+	tx.NonMetaLinesAdded += len(req.Lines) + len(req.Events)
+
+	if err := e.appendToStreamInternal(req.Stream, rawLines, "", tx); err != nil {
+		return nil, false, err
+	}
 
+	// the same transaction might later append to this stream again, so this
+	// must be captured now
 	output := &types.AppendToStreamOutput{
-		Offset: tx.AffectedStreams[streamName],
+		Offset: tx.AffectedStreams[req.Stream],
 	}
 
-	return output, nil
+	if req.IdempotencyKey != "" {
+		if err := saveIdempotencyKey(req.Stream, req.IdempotencyKey, output, idempotencyKeyWindow, tx); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return output, false, nil
 }
 
-func (e *EventstoreWriter) appendToStreamInternal(streamName string, contentArr []string, metaEventsRaw string, tx *transaction.EventstoreTransaction) error {
-	chunkSpec, streamExists := e.streamToChunkName[streamName]
+// rawLines are already encoded (regular or envelope lines), metaEventsRaw are
+// appended after them
+func (e *EventstoreWriter) appendToStreamInternal(streamName string, rawLines string, metaEventsRaw string, tx *transaction.EventstoreTransaction) error {
+	chunkSpec, streamExists := e.chunkSpecInTx(streamName, tx)
 	if !streamExists {
 		return errors.New(fmt.Sprintf("EventstoreWriter.AppendToStream: stream %s does not exist", streamName))
 	}
 
-	if len(contentArr) == 0 && metaEventsRaw == "" {
+	if rawLines == "" && metaEventsRaw == "" {
 		return nil // not an error to call with empty append
 	}
 
-	tx.NonMetaLinesAdded += len(contentArr)
+	// lost writes' offsets would be given to these lines
+	if e.walManager.LostWritesOnRecovery(chunkSpec.ChunkPath, tx) {
+		if err := e.sealLiveChunk(streamName, tx); err != nil {
+			return err
+		}
+
+		chunkSpec, _ = e.chunkSpecInTx(streamName, tx)
+	}
 
-	rawLines, err := stringArrayToRawLines(contentArr)
+	lengthBeforeAppend, err := e.walManager.GetCurrentFileLength(chunkSpec.ChunkPath, tx)
 	if err != nil {
 		return err
 	}
+	lengthAfterAppend := lengthBeforeAppend + len(rawLines)
 
-	lengthBeforeAppend, err := e.walManager.GetCurrentFileLength(chunkSpec.ChunkPath)
+	settings, err := getStreamSettings(streamName, tx.BoltTx)
 	if err != nil {
 		return err
 	}
-	lengthAfterAppend := lengthBeforeAppend + len(rawLines)
+
+	chunkSize := settings.EffectiveChunkSize()
+
+	tx.RequireDurability(settings.EffectiveDurability(types.Durability(e.confCtx.Durability())))
 
 	var rotatedCursor *cursor.Cursor
 
-	if lengthAfterAppend > config.ChunkRotateThreshold {
+	if lengthAfterAppend > chunkSize {
 		rotatedCursor = e.nextChunkCursorFromCurrentChunkSpec(chunkSpec)
 	}
 
@@ -339,6 +1056,10 @@ func (e *EventstoreWriter) appendToStreamInternal(streamName string, contentArr
 		return err
 	}
 
+	if err := updateStreamStats(streamName, rawLines, metaEventsRaw, 0, tx); err != nil {
+		return err
+	}
+
 	cursorAfter := cursor.New(
 		streamName,
 		chunkSpec.ChunkNumber,
@@ -346,22 +1067,82 @@ func (e *EventstoreWriter) appendToStreamInternal(streamName string, contentArr
 		e.confCtx.GetWriterIp())
 
 	if rotatedCursor != nil {
-		log.Printf("EventstoreWriter: AppendToStream: starting rotate, %d threshold exceeded: %s", config.ChunkRotateThreshold, streamName)
+		log.Printf("EventstoreWriter: AppendToStream: starting rotate, %d threshold exceeded: %s", chunkSize, streamName)
 
-		// FIXME: this affects cursor as well
-		if err := e.rotateStreamChunk(rotatedCursor, tx); err != nil {
+		// stream's head moved to the next chunk
+		cursorAfter, err = e.rotateStreamChunk(rotatedCursor, tx)
+		if err != nil {
 			return err
 		}
 	}
 
-	e.subAct.MarkOneDirty(cursorAfter, tx)
+	if rawLines != "" {
+		if err := saveLastAppend(cursorAfter, tx); err != nil {
+			return err
+		}
+	}
+
+	return e.streamHeadMoved(cursorAfter, rawLines+metaEventsRaw, tx)
+}
+
+// seals the live chunk even though it's below the rotate threshold, so its
+// data gets shipped to long term storage
+func (e *EventstoreWriter) sealLiveChunk(streamName string, tx *transaction.EventstoreTransaction) error {
+	chunkSpec, streamExists := e.chunkSpecInTx(streamName, tx)
+	if !streamExists {
+		return errors.New(fmt.Sprintf("EventstoreWriter.sealLiveChunk: stream %s does not exist", streamName))
+	}
+
+	rotatedCursor := e.nextChunkCursorFromCurrentChunkSpec(chunkSpec)
+
+	metaEventsRaw := metaevents.NewRotated(rotatedCursor.Serialize()).Serialize()
+
+	// readers of the sealed chunk see where the crash happened
+	if e.walManager.LostWritesOnRecovery(chunkSpec.ChunkPath, tx) {
+		metaEventsRaw = metaevents.NewLiveChunkLost("").Serialize() + metaEventsRaw
+	}
+
+	if _, err := e.walManager.AppendToFile(chunkSpec.ChunkPath, metaEventsRaw, tx); err != nil {
+		return err
+	}
+
+	if err := updateStreamStats(streamName, "", metaEventsRaw, 0, tx); err != nil {
+		return err
+	}
+
+	cursorAfter, err := e.rotateStreamChunk(rotatedCursor, tx)
+	if err != nil {
+		return err
+	}
+
+	return e.streamHeadMoved(cursorAfter, metaEventsRaw, tx)
+}
+
+// marks the stream dirty for SubscriptionActivity & notifies its subscribers.
+// subscribers with a filter only if appendedLines (raw) has lines matching it
+func (e *EventstoreWriter) streamHeadMoved(cursorAfter *cursor.Cursor, appendedLines string, tx *transaction.EventstoreTransaction) error {
+	if err := e.subAct.MarkOneDirty(cursorAfter, tx); err != nil {
+		return err
+	}
 
 	cursorAfterSerialized := cursorAfter.Serialize()
 
 	tx.AffectedStreams[cursorAfter.Stream] = cursorAfterSerialized
 
+	filters := getSubscriptionFiltersForStream(cursorAfter.Stream, tx.BoltTx)
+
 	subscribers := getSubscriptionsForStream(cursorAfter.Stream, tx.BoltTx)
 	for _, subscriber := range subscribers {
+		if filter, hasFilter := filters[subscriber]; hasFilter {
+			if !filter.MatchesAny(appendedLines) && !subscribedIn(subscriber, appendedLines) {
+				continue
+			}
+
+			if err := e.subAct.MarkDirtyForSubscription(cursorAfter, subscriber, tx); err != nil {
+				return err
+			}
+		}
+
 		tx.SubscriberNotifications = append(tx.SubscriberNotifications, &types.SubscriberNotification{
 			SubscriptionId:         subscriber,
 			LatestCursorSerialized: cursorAfterSerialized,
@@ -371,10 +1152,11 @@ func (e *EventstoreWriter) appendToStreamInternal(streamName string, contentArr
 	return nil
 }
 
-func (e *EventstoreWriter) rotateStreamChunk(nextChunkCursor *cursor.Cursor, tx *transaction.EventstoreTransaction) error {
-	currentChunkSpec, ok := e.streamToChunkName[nextChunkCursor.Stream]
+// returns the stream's head cursor in the new chunk
+func (e *EventstoreWriter) rotateStreamChunk(nextChunkCursor *cursor.Cursor, tx *transaction.EventstoreTransaction) (*cursor.Cursor, error) {
+	currentChunkSpec, ok := e.chunkSpecInTx(nextChunkCursor.Stream, tx)
 	if !ok {
-		return errors.New("Stream to chunk not found") // should not happen
+		return nil, errors.New("Stream to chunk not found") // should not happen
 	}
 
 	log.Printf("EventstoreWriter: rotateStreamChunk: %s -> %s", currentChunkSpec.ChunkPath, nextChunkCursor.ToChunkPath())
@@ -382,7 +1164,7 @@ func (e *EventstoreWriter) rotateStreamChunk(nextChunkCursor *cursor.Cursor, tx
 	// this will never be written to again
 	filePath, err := e.walManager.CloseActiveFile(currentChunkSpec.ChunkPath, tx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	fileToShip := &types.LongTermShippableFile{
@@ -392,59 +1174,110 @@ func (e *EventstoreWriter) rotateStreamChunk(nextChunkCursor *cursor.Cursor, tx
 
 	// durably mark sealed block to be shipped to long term storage
 	if err := e.shipper.MarkFileToBeShipped(fileToShip, tx); err != nil {
-		return err
+		return nil, err
 	}
 
-	if err := e.openChunkLocally(nextChunkCursor, tx); err != nil {
-		return err
+	return e.openChunkLocally(nextChunkCursor, tx)
+}
+
+// returns cursor pointing to after the Created meta event, i.e. the new chunk's head
+func (e *EventstoreWriter) openChunkLocally(chunkCursor *cursor.Cursor, tx *transaction.EventstoreTransaction) (*cursor.Cursor, error) {
+	streamsBucket := tx.BoltTx.Bucket([]byte("_streams"))
+
+	if streamsBucket == nil {
+		return nil, errors.New("No _streams bucket") // should not happen
 	}
 
-	return nil
-}
+	if err := e.walManager.OpenNewFile(chunkCursor.ToChunkPath(), tx); err != nil {
+		return nil, err
+	}
 
-func (e *EventstoreWriter) openChunkLocally(chunkCursor *cursor.Cursor, tx *transaction.EventstoreTransaction) error {
-	chunkSpec := &types.ChunkSpec{
-		ChunkPath:   chunkCursor.ToChunkPath(),
-		StreamName:  chunkCursor.Stream,
-		ChunkNumber: chunkCursor.Chunk,
+	streamsActiveSubscriptions := getSubscriptionsForStream(chunkCursor.Stream, tx.BoltTx)
+
+	created := metaevents.NewCreated(streamsActiveSubscriptions)
+	created.RecursiveSubscriptionIds = getRecursiveSubscriptionsForStream(chunkCursor.Stream, tx.BoltTx)
+	created.SubscriptionFilters = getSubscriptionFiltersForStream(chunkCursor.Stream, tx.BoltTx)
+	created.SubscriptionActivityIntervals = getSubscriptionActivityIntervalsForStream(chunkCursor.Stream, tx.BoltTx)
+
+	metaEventsRaw := created.Serialize()
+
+	nextOffset, err := e.walManager.AppendToFile(chunkCursor.ToChunkPath(), metaEventsRaw, tx)
+	if err != nil {
+		return nil, err
 	}
 
-	streamsBucket := tx.BoltTx.Bucket([]byte("_streams"))
+	if err := updateStreamStats(chunkCursor.Stream, "", metaEventsRaw, 1, tx); err != nil {
+		return nil, err
+	}
 
-	if streamsBucket == nil {
-		return errors.New("No _streams bucket") // should not happen
+	chunkSpec := &types.ChunkSpec{
+		ChunkPath:     chunkCursor.ToChunkPath(),
+		StreamName:    chunkCursor.Stream,
+		ChunkNumber:   chunkCursor.Chunk,
+		OpenedAt:      time.Now().Unix(),
+		HeadAfterOpen: nextOffset,
 	}
 
 	specAsJson, err := json.Marshal(chunkSpec)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if err := streamsBucket.Put([]byte(chunkCursor.Stream), specAsJson); err != nil {
-		return err
+	if err := tx.Put("_streams", []byte(chunkCursor.Stream), specAsJson); err != nil {
+		return nil, err
 	}
 
-	if err := e.walManager.OpenNewFile(chunkCursor.ToChunkPath(), tx); err != nil {
-		return err
-	}
+	tx.NewChunks = append(tx.NewChunks, chunkSpec)
 
-	streamsActiveSubscriptions := getSubscriptionsForStream(chunkCursor.Stream, tx.BoltTx)
+	return cursor.New(chunkCursor.Stream, chunkCursor.Chunk, nextOffset, e.confCtx.GetWriterIp()), nil
+}
 
-	created := metaevents.NewCreated(streamsActiveSubscriptions)
+// runs fn in a bolt transaction. WAL records of the transaction's writes are made
+// durable just before the commit, so the writes can be applied after it
+// with replication, the transaction is replicated to a majority of the group
+// just before it commits (see replicated.go)
+func (e *EventstoreWriter) update(tx *transaction.EventstoreTransaction, fn func() error) error {
+	replicated := false
 
-	metaEventsRaw := created.Serialize()
+	err := e.updateLocal(tx, func() error {
+		if e.replication != nil && !e.replication.IsLeader() {
+			return replication.ErrNotLeader
+		}
 
-	if _, err := e.walManager.AppendToFile(chunkCursor.ToChunkPath(), metaEventsRaw, tx); err != nil {
-		return err
+		if err := fn(); err != nil {
+			return err
+		}
+
+		if err := e.replicate(tx); err != nil {
+			return err
+		}
+
+		replicated = e.replication != nil
+
+		return nil
+	})
+	if err != nil && replicated {
+		// other Writers apply the transaction, so we cannot continue without it
+		panic(fmt.Errorf("EventstoreWriter: replicated transaction failed to commit: %s", err.Error()))
 	}
 
-	tx.NewChunks = append(tx.NewChunks, chunkSpec)
+	return err
+}
 
-	return nil
+// not replicated. for recovering local state & applying replicated transactions
+func (e *EventstoreWriter) updateLocal(tx *transaction.EventstoreTransaction, fn func() error) error {
+	return e.database.Update(func(boltTx *bolt.Tx) error {
+		tx.BoltTx = boltTx
+
+		if err := fn(); err != nil {
+			return err
+		}
+
+		return e.walManager.PrepareCommit(tx)
+	})
 }
 
 // these happen after COMMIT, i.e. transaction is not in effect.
-// in rare cases WAL manager starts a transaction (for compaction)
 func (e *EventstoreWriter) applySideEffects(tx *transaction.EventstoreTransaction) error {
 	// do all kinds of complicated stuff related to the file writing
 	if err := e.walManager.ApplySideEffects(tx); err != nil {
@@ -464,6 +1297,18 @@ func (e *EventstoreWriter) applySideEffects(tx *transaction.EventstoreTransactio
 		e.shipper.Ship(file, tx.Bolt)
 	}
 
+	for _, streamName := range tx.PurgeStreams {
+		e.shipper.Purge(streamName, tx.Bolt)
+	}
+
+	for _, streamName := range tx.DeletedStreams {
+		delete(e.streamToChunkName, streamName)
+	}
+
+	for streamName, writerIp := range tx.Placements {
+		e.confCtx.SetWriterIpForStream(streamName, writerIp)
+	}
+
 	// pub/sub publishes are guaranteed to never block and to never grow buffers
 	// unbounded even on connectivity issues. publishes are partitioned per topic
 	// and if pub/sub server reads our publishes slowly, we only deliver the latest msg.
@@ -473,11 +1318,38 @@ func (e *EventstoreWriter) applySideEffects(tx *transaction.EventstoreTransactio
 	}
 
 	e.metrics.AppendedLinesExclMeta.Add(float64(tx.NonMetaLinesAdded))
+	e.metrics.OrphanedSubscriptionsRemoved.Add(float64(tx.OrphanedSubsRemoved))
+
+	if tx.WalSynced {
+		e.metrics.WalFsyncs.Inc()
+	} else if len(tx.WriteOps) > 0 {
+		e.metrics.UnsyncedCommits.Inc()
+	}
 
 	return nil
 }
 
 func (e *EventstoreWriter) Close() {
+	// these take the lock themselves, so they must be stopped before we take it.
+	// replication first, so we stop applying entries before the rest stops
+	if e.replication != nil {
+		if err := e.replication.Close(); err != nil {
+			log.Printf("EventstoreWriter: Close: %s", err.Error())
+		}
+	}
+
+	e.retention.Close()
+
+	e.crossShard.Close()
+
+	e.chunkSealer.Close()
+
+	e.groupCommitter.Close()
+
+	e.walSyncer.Close()
+
+	e.snapshotter.Close()
+
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
@@ -494,8 +1366,8 @@ func (e *EventstoreWriter) Close() {
 	// Close doesn't need an active transaction, but only the database reference
 	e.walManager.Close(tx)
 
-	// WAL's applySideEffects() might start a transaction in the case
-	// if we've got WAL logs to compact
+	// WAL's applySideEffects() checkpoints the WAL, so there's nothing
+	// to replay on next start
 	if err := e.applySideEffects(tx); err != nil {
 		panic(err)
 	}
@@ -549,12 +1421,91 @@ func (e *EventstoreWriter) makeBoltDbDirIfNotExist() {
 	}
 }
 
+// with tx, takes into account streams created and deleted (or handed off)
+// earlier in the transaction. tx can be nil
 func (e *EventstoreWriter) streamExists(streamName string, tx *transaction.EventstoreTransaction) bool {
-	_, streamExists := e.streamToChunkName[streamName]
+	if tx != nil && stringslice.ItemIndex(streamName, tx.DeletedStreams) != -1 {
+		return false
+	}
+
+	_, streamExists := e.chunkSpecInTx(streamName, tx)
 
 	return streamExists
 }
 
+// live chunk of the stream, taking into account chunks rotated earlier in the
+// transaction (not yet applied to streamToChunkName). tx can be nil
+func (e *EventstoreWriter) chunkSpecInTx(streamName string, tx *transaction.EventstoreTransaction) (*types.ChunkSpec, bool) {
+	if tx != nil {
+		for i := len(tx.NewChunks) - 1; i >= 0; i-- {
+			if tx.NewChunks[i].StreamName == streamName {
+				return tx.NewChunks[i], true
+			}
+		}
+	}
+
+	chunkSpec, exists := e.streamToChunkName[streamName]
+	return chunkSpec, exists
+}
+
+// the cursor after the last line in the stream. the next append starts from here.
+// with tx, includes that transaction's appends
+func (e *EventstoreWriter) streamHead(streamName string, tx *transaction.EventstoreTransaction) (*cursor.Cursor, error) {
+	chunkSpec, streamExists := e.chunkSpecInTx(streamName, tx)
+	if !streamExists {
+		return nil, errors.New(fmt.Sprintf("EventstoreWriter: stream %s does not exist", streamName))
+	}
+
+	length, err := e.walManager.GetCurrentFileLength(chunkSpec.ChunkPath, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	return cursor.New(streamName, chunkSpec.ChunkNumber, length, e.confCtx.GetWriterIp()), nil
+}
+
+// meta events that we append by ourselves (Subscribed, Unsubscribed, Rotated by
+// ChunkSealerTask, Truncated by RetentionTask...) move the head as well, so
+// anything from the end of the latest non-meta append to the head is accepted
+func (e *EventstoreWriter) verifyExpectedOffset(streamName string, expectedOffsetSerialized string, tx *transaction.EventstoreTransaction) error {
+	expectedOffset, err := cursor.CursorFromserialized(expectedOffsetSerialized)
+	if err != nil {
+		return err
+	}
+
+	if expectedOffset.Stream != streamName {
+		return errors.New("EventstoreWriter: ExpectedOffset is for a different stream")
+	}
+
+	head, err := e.streamHead(streamName, tx)
+	if err != nil {
+		return err
+	}
+
+	stats, err := getStreamStats(streamName, tx.BoltTx)
+	if err != nil {
+		return err
+	}
+
+	conflict := expectedOffset.IsAheadComparedTo(head)
+
+	if stats.LastAppend != "" {
+		conflict = conflict || cursor.CursorFromserializedMust(stats.LastAppend).IsAheadComparedTo(expectedOffset)
+	} else if stats.LineCount > 0 {
+		// appended to by an older version, so we don't know where
+		conflict = !expectedOffset.PositionEquals(head)
+	}
+
+	if conflict {
+		return &types.AppendConflictError{
+			ExpectedOffset: expectedOffsetSerialized,
+			CurrentOffset:  head.Serialize(),
+		}
+	}
+
+	return nil
+}
+
 func (e *EventstoreWriter) nextChunkCursorFromCurrentChunkSpec(chunkSpec *types.ChunkSpec) *cursor.Cursor {
 	return cursor.New(chunkSpec.StreamName, chunkSpec.ChunkNumber+1, 0, e.confCtx.GetWriterIp())
 }
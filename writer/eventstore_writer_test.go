@@ -0,0 +1,393 @@
+package writer
+
+import (
+	"errors"
+	"github.com/boltdb/bolt"
+	"github.com/function61/eventhorizon/cursor"
+	"github.com/function61/eventhorizon/util/ass"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"github.com/function61/eventhorizon/writer/types"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpectedOffset(t *testing.T) {
+	e, cleanup := newTestWriter(t)
+	defer cleanup()
+
+	_, err := e.CreateStream(&types.CreateStreamRequest{Name: "/foo"})
+	ass.True(t, err == nil)
+
+	_, err = e.CreateStream(&types.CreateStreamRequest{Name: "/_sub/bar"})
+	ass.True(t, err == nil)
+
+	appendExpecting := func(expectedOffset string) (string, error) {
+		output, err := e.AppendToStream(&types.AppendToStreamRequest{
+			Stream:         "/foo",
+			Lines:          []string{"line"},
+			ExpectedOffset: expectedOffset,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		return output.Offset, nil
+	}
+
+	// nothing appended yet, so the beginning of the stream is as good as the head
+	_, err = appendExpecting(cursor.BeginningOfStream("/foo", "127.0.0.1").Serialize())
+	ass.True(t, err == nil)
+
+	head, err := e.StreamInfo("/foo")
+	ass.True(t, err == nil)
+
+	offset, err := appendExpecting(head.Head)
+	ass.True(t, err == nil)
+
+	// somebody else appended after the expected offset
+	_, err = appendExpecting(head.Head)
+	conflictErr, isConflict := err.(*types.AppendConflictError)
+	ass.True(t, isConflict)
+	ass.EqualString(t, conflictErr.ExpectedOffset, head.Head)
+	ass.EqualString(t, conflictErr.CurrentOffset, offset)
+
+	// meta events that we append by ourselves don't count as appends
+	ass.True(t, e.SubscribeToStream("/foo", "/_sub/bar", nil, 0) == nil)
+	ass.True(t, (&ChunkSealerTask{writer: e}).sealOldChunks(-1*time.Second) == nil)
+
+	afterMeta, err := e.StreamInfo("/foo")
+	ass.True(t, err == nil)
+	ass.EqualInt(t, cursor.CursorFromserializedMust(afterMeta.Head).Chunk, 1)
+
+	offset, err = appendExpecting(offset)
+	ass.True(t, err == nil)
+
+	// past the head
+	ahead := cursor.CursorFromserializedMust(offset)
+	ahead.Offset += 10
+
+	_, err = appendExpecting(ahead.Serialize())
+	_, isConflict = err.(*types.AppendConflictError)
+	ass.True(t, isConflict)
+
+	_, err = e.AppendToStream(&types.AppendToStreamRequest{
+		Stream:         "/foo",
+		Lines:          []string{"line"},
+		ExpectedOffset: "/bar:0:0:127.0.0.1",
+	})
+	ass.EqualString(t, err.Error(), "EventstoreWriter: ExpectedOffset is for a different stream")
+}
+
+func TestAppendMultiIsAllOrNothing(t *testing.T) {
+	e, cleanup := newTestWriter(t)
+	defer cleanup()
+
+	for _, streamName := range []string{"/foo", "/bar"} {
+		_, err := e.CreateStream(&types.CreateStreamRequest{Name: streamName})
+		ass.True(t, err == nil)
+	}
+
+	fooHead := appendLines(t, e, "/foo", "first")
+	barHead := appendLines(t, e, "/bar", "first")
+
+	fooBefore := readLiveChunk(t, e, "/foo/_/0.log")
+	barBefore := readLiveChunk(t, e, "/bar/_/0.log")
+
+	assertUnchanged := func() {
+		ass.EqualString(t, readLiveChunk(t, e, "/foo/_/0.log"), fooBefore)
+		ass.EqualString(t, readLiveChunk(t, e, "/bar/_/0.log"), barBefore)
+
+		for streamName, head := range map[string]string{"/foo": fooHead, "/bar": barHead} {
+			info, err := e.StreamInfo(streamName)
+			ass.True(t, err == nil)
+			ass.EqualString(t, info.Head, head)
+		}
+	}
+
+	appendMulti := func(appends ...types.AppendToStreamRequest) (*types.AppendMultiOutput, error) {
+		return e.AppendMulti(&types.AppendMultiRequest{Appends: appends})
+	}
+
+	// second append conflicts, as the first one appended after fooHead
+	_, err := appendMulti(
+		types.AppendToStreamRequest{Stream: "/foo", Lines: []string{"a"}},
+		types.AppendToStreamRequest{Stream: "/bar", Lines: []string{"b"}},
+		types.AppendToStreamRequest{Stream: "/foo", Lines: []string{"c"}, ExpectedOffset: fooHead},
+	)
+	_, isConflict := err.(*types.AppendConflictError)
+	ass.True(t, isConflict)
+	assertUnchanged()
+
+	_, err = appendMulti(
+		types.AppendToStreamRequest{Stream: "/foo", Lines: []string{"a"}},
+		types.AppendToStreamRequest{Stream: "/bar", Lines: []string{"b"}},
+		types.AppendToStreamRequest{Stream: "/nonexistent", Lines: []string{"c"}},
+	)
+	ass.True(t, err != nil)
+	assertUnchanged()
+
+	// rolled back appends did not leave anything behind that would affect the next ones
+	output, err := appendMulti(
+		types.AppendToStreamRequest{Stream: "/foo", Lines: []string{"a"}, ExpectedOffset: fooHead},
+		types.AppendToStreamRequest{Stream: "/bar", Lines: []string{"b"}, ExpectedOffset: barHead},
+	)
+	ass.True(t, err == nil)
+	ass.EqualInt(t, len(output.Outputs), 2)
+	ass.EqualString(t, readLiveChunk(t, e, "/foo/_/0.log"), fooBefore+" a\n")
+	ass.EqualString(t, readLiveChunk(t, e, "/bar/_/0.log"), barBefore+" b\n")
+
+	fooInfo, err := e.StreamInfo("/foo")
+	ass.True(t, err == nil)
+	ass.EqualString(t, fooInfo.Head, output.Outputs[0].Offset)
+}
+
+func TestDeleteStream(t *testing.T) {
+	e, cleanup := newTestWriter(t)
+	defer cleanup()
+
+	shipper := e.shipper.(*testShipper)
+
+	for _, streamName := range []string{"/foo", "/bar", "/_sub/baz"} {
+		_, err := e.CreateStream(&types.CreateStreamRequest{Name: streamName})
+		ass.True(t, err == nil)
+	}
+
+	appendLines(t, e, "/foo", "line")
+
+	ass.True(t, e.DeleteStream("/foo", false) == nil)
+
+	ass.False(t, e.streamExists("/foo", nil))
+	ass.EqualString(t, strings.Join(shipper.shipped, ","), "/foo/_/0.log")
+	ass.True(t, strings.Contains(readLiveChunk(t, e, "/_/0.log"), "/StreamDeleted {\"name\":\"/foo\",\"purged\":false"))
+
+	// chunks are still in scalablestore
+	_, err := e.CreateStream(&types.CreateStreamRequest{Name: "/foo"})
+	ass.EqualString(t, err.Error(), "CreateStream: stream /foo has been deleted. it can be re-created once purged")
+
+	ass.EqualString(t, e.DeleteStream("/foo", false).Error(), "DeleteStream: stream /foo does not exist")
+
+	// purges the already deleted stream
+	ass.True(t, e.DeleteStream("/foo", true) == nil)
+	ass.EqualString(t, strings.Join(shipper.purged, ","), "/foo")
+	ass.True(t, strings.Contains(readLiveChunk(t, e, "/_/0.log"), "/StreamDeleted {\"name\":\"/foo\",\"purged\":true"))
+
+	_, err = e.CreateStream(&types.CreateStreamRequest{Name: "/foo"})
+	ass.EqualString(t, err.Error(), "CreateStream: stream /foo has been deleted. it can be re-created once purged")
+
+	// like Shipper does once done
+	ass.True(t, e.database.Update(func(boltTx *bolt.Tx) error {
+		return boltTx.Bucket([]byte("_streamstopurge")).Delete([]byte("/foo"))
+	}) == nil)
+
+	// last chunk is not shipped yet
+	_, err = e.CreateStream(&types.CreateStreamRequest{Name: "/foo"})
+	ass.EqualString(t, err.Error(), "CreateStream: stream /foo has been deleted. it can be re-created once purged")
+
+	ass.True(t, e.database.Update(func(boltTx *bolt.Tx) error {
+		return boltTx.Bucket([]byte("_filestoship")).Delete([]byte("/foo:0:0"))
+	}) == nil)
+
+	_, err = e.CreateStream(&types.CreateStreamRequest{Name: "/foo"})
+	ass.True(t, err == nil)
+	ass.True(t, e.database.View(func(boltTx *bolt.Tx) error {
+		ass.False(t, isTombstoned("/foo", boltTx))
+		return nil
+	}) == nil)
+
+	// the old chunk's content is gone
+	ass.True(t, strings.HasPrefix(readLiveChunk(t, e, "/foo/_/0.log"), "/Created "))
+	ass.False(t, strings.Contains(readLiveChunk(t, e, "/foo/_/0.log"), "line"))
+
+	// and so is its last append, which was past the new stream's head
+	head, err := e.streamHead("/foo", nil)
+	ass.True(t, err == nil)
+	_, err = e.AppendToStream(&types.AppendToStreamRequest{
+		Stream:         "/foo",
+		Lines:          []string{"line"},
+		ExpectedOffset: head.Serialize(),
+	})
+	ass.True(t, err == nil)
+
+	ass.True(t, e.DeleteStream("/bar", true) == nil)
+	ass.EqualString(t, strings.Join(shipper.purged, ","), "/foo,/bar")
+	ass.EqualString(t, strings.Join(shipper.shipped, ","), "/foo/_/0.log")
+	ass.True(t, e.database.View(func(boltTx *bolt.Tx) error {
+		ass.True(t, boltTx.Bucket([]byte("_streamstopurge")).Get([]byte("/bar")) != nil)
+		return nil
+	}) == nil)
+
+	ass.True(t, e.SubscribeToStream("/foo", "/_sub/baz", nil, 0) == nil)
+
+	ass.EqualString(t, e.DeleteStream("/_sub/baz", false).Error(), "DeleteStream: /_sub/baz is still subscribed to [/foo]")
+	ass.True(t, e.streamExists("/_sub/baz", nil))
+
+	ass.True(t, e.UnsubscribeFromStream("/foo", "/_sub/baz") == nil)
+	ass.True(t, e.DeleteStream("/_sub/baz", false) == nil)
+
+	ass.EqualString(t, e.DeleteStream("/_sub", false).Error(), "DeleteStream: cannot delete a built-in stream")
+
+	// parent was deleted before the child was purged
+	for _, streamName := range []string{"/a", "/a/b"} {
+		_, err := e.CreateStream(&types.CreateStreamRequest{Name: streamName})
+		ass.True(t, err == nil)
+	}
+
+	ass.True(t, e.DeleteStream("/a/b", false) == nil)
+	ass.True(t, e.DeleteStream("/a", false) == nil)
+	ass.True(t, e.DeleteStream("/a/b", true) == nil)
+	ass.True(t, strings.Contains(readLiveChunk(t, e, "/_/0.log"), "/StreamDeleted {\"name\":\"/a/b\",\"purged\":true"))
+}
+
+func TestStreamExistsInTx(t *testing.T) {
+	e, cleanup := newTestWriter(t)
+	defer cleanup()
+
+	_, err := e.CreateStream(&types.CreateStreamRequest{Name: "/foo"})
+	ass.True(t, err == nil)
+
+	tx := transaction.NewEventstoreTransaction(e.database)
+	tx.DeletedStreams = append(tx.DeletedStreams, "/foo")
+	tx.NewChunks = append(tx.NewChunks, &types.ChunkSpec{StreamName: "/bar", ChunkPath: "/bar/_/0.log"})
+
+	ass.False(t, e.streamExists("/foo", tx))
+	ass.True(t, e.streamExists("/bar", tx))
+
+	ass.True(t, e.streamExists("/foo", nil))
+	ass.False(t, e.streamExists("/bar", nil))
+}
+
+// OS crash lost the end of a batched/relaxed stream's live chunk
+func TestLiveChunkThatLostWritesIsNotContinued(t *testing.T) {
+	dir, err := ioutil.TempDir("", "writer_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	e := openTestWriter(dir)
+
+	for _, streamName := range []string{"/", "/_sub"} {
+		_, err := e.CreateStream(&types.CreateStreamRequest{Name: streamName})
+		ass.True(t, err == nil)
+	}
+
+	_, err = e.CreateStream(&types.CreateStreamRequest{Name: "/foo"})
+	ass.True(t, err == nil)
+
+	appendLines(t, e, "/foo", "kept")
+	lostOffset := appendLines(t, e, "/foo", "lost")
+
+	e.mu.RLock()
+	filePath, length, err := e.walManager.SnapshotForReading("/foo/_/0.log")
+	e.mu.RUnlock()
+	ass.True(t, err == nil)
+
+	closeTestWriter(e)
+
+	ass.True(t, os.Truncate(filePath, length-int64(len(" lost\n"))) == nil)
+
+	// crash again before anything was appended. we must still remember
+	e = openTestWriter(dir)
+	closeTestWriter(e)
+
+	e = openTestWriter(dir)
+	defer closeTestWriter(e)
+
+	offset := appendLines(t, e, "/foo", "new")
+
+	ass.EqualInt(t, cursor.CursorFromserializedMust(offset).Chunk, 1)
+	ass.True(t, cursor.CursorFromserializedMust(offset).IsAheadComparedTo(cursor.CursorFromserializedMust(lostOffset)))
+
+	sealed, err := ioutil.ReadFile(filePath)
+	ass.True(t, err == nil)
+	ass.True(t, strings.Contains(string(sealed), " kept\n/LiveChunkLost "))
+	ass.True(t, strings.Contains(string(sealed), "}\n/Rotated {\"next\":\"/foo:1:0"))
+	ass.EqualString(t, strings.Join(e.shipper.(*testShipper).shipped, ","), "/foo/_/0.log")
+
+	ass.True(t, strings.HasSuffix(readLiveChunk(t, e, "/foo/_/1.log"), " new\n"))
+}
+
+func TestRecreatedStreamForgetsIdempotencyKeys(t *testing.T) {
+	e, cleanup := newTestWriter(t)
+	defer cleanup()
+
+	keyedAppend := func(line string) {
+		_, err := e.AppendToStream(&types.AppendToStreamRequest{
+			Stream:         "/foo",
+			Lines:          []string{line},
+			IdempotencyKey: "key1",
+		})
+		ass.True(t, err == nil)
+	}
+
+	_, err := e.CreateStream(&types.CreateStreamRequest{Name: "/foo"})
+	ass.True(t, err == nil)
+
+	keyedAppend("old")
+
+	ass.True(t, e.DeleteStream("/foo", true) == nil)
+
+	// like Shipper does once done
+	ass.True(t, e.database.Update(func(boltTx *bolt.Tx) error {
+		return boltTx.Bucket([]byte("_streamstopurge")).Delete([]byte("/foo"))
+	}) == nil)
+
+	_, err = e.CreateStream(&types.CreateStreamRequest{Name: "/foo"})
+	ass.True(t, err == nil)
+
+	// not a retry of the old stream's append
+	keyedAppend("new")
+	ass.True(t, strings.Contains(readLiveChunk(t, e, "/foo/_/0.log"), " new\n"))
+
+	// the new record's by-time entry is the only one
+	ass.True(t, e.database.View(func(boltTx *bolt.Tx) error {
+		ass.EqualInt(t, boltTx.Bucket([]byte("_idempotencykeysbytime")).Stats().KeyN, 1)
+		return nil
+	}) == nil)
+}
+
+// a re-create whose commit fails must keep the forgotten chunk that the
+// committed length still points to
+func TestForgottenFileIsRemovedOnlyAfterCommit(t *testing.T) {
+	e, cleanup := newTestWriter(t)
+	defer cleanup()
+
+	_, err := e.CreateStream(&types.CreateStreamRequest{Name: "/foo"})
+	ass.True(t, err == nil)
+
+	appendLines(t, e, "/foo", "line")
+
+	e.mu.RLock()
+	filePath, _, err := e.walManager.SnapshotForReading("/foo/_/0.log")
+	e.mu.RUnlock()
+	ass.True(t, err == nil)
+
+	// not purged, so the chunk stays until shipped
+	ass.True(t, e.DeleteStream("/foo", false) == nil)
+
+	tx := transaction.NewEventstoreTransaction(e.database)
+
+	ass.EqualString(t, e.database.Update(func(boltTx *bolt.Tx) error {
+		tx.BoltTx = boltTx
+
+		if err := e.walManager.ForgetFiles(types.ChunkPathPrefix("/foo"), tx); err != nil {
+			return err
+		}
+
+		if err := e.walManager.PrepareCommit(tx); err != nil {
+			return err
+		}
+
+		return errors.New("commit failed")
+	}).Error(), "commit failed")
+
+	_, err = os.Stat(filePath)
+	ass.True(t, err == nil)
+	ass.True(t, e.database.View(func(boltTx *bolt.Tx) error {
+		ass.True(t, boltTx.Bucket([]byte("_walfilelengths")).Get([]byte("/foo/_/0.log")) != nil)
+		return nil
+	}) == nil)
+}
@@ -0,0 +1,196 @@
+package writer
+
+import (
+	"errors"
+	"github.com/function61/eventhorizon/config"
+	rtypes "github.com/function61/eventhorizon/reader/types"
+	"github.com/function61/eventhorizon/writer/types"
+	"github.com/function61/eventhorizon/writer/writerclient"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*	Follower Writer ("horizon writer-follower <Writer>") is read-only. It keeps
+	copies of the Writer's live chunks by asking the Writer for new bytes
+	(/writer/tail) every FollowerPollInterval, and serves live reads from them,
+	so they don't take the Writer's lock. The copies lag behind a bit, so
+	readers fall back to the Writer if the follower doesn't have a chunk.
+
+	Nothing is persisted: a restarted follower fetches the live chunks again.
+*/
+
+type Follower struct {
+	writer  string // the Writer we follow
+	client  tailer
+	mu      sync.RWMutex
+	lengths map[string]int64 // chunk path => bytes we have
+	stop    chan bool
+	done    chan bool
+	confCtx *config.Context
+}
+
+// *writerclient.Client. tests tail a Writer directly
+type tailer interface {
+	Tail(server string, req *types.TailRequest) (*types.TailOutput, error)
+}
+
+func NewFollower(confCtx *config.Context, writer string) *Follower {
+	// leftovers from a previous run would not be in lengths
+	if err := os.RemoveAll(config.FollowerDataDir); err != nil {
+		log.Fatalf("Follower: %s", err.Error())
+	}
+
+	if err := os.MkdirAll(config.FollowerDataDir, 0755); err != nil {
+		log.Fatalf("Follower: %s", err.Error())
+	}
+
+	f := &Follower{
+		writer:  writer,
+		client:  writerclient.New(confCtx),
+		lengths: map[string]int64{},
+		stop:    make(chan bool),
+		done:    make(chan bool),
+		confCtx: confCtx,
+	}
+
+	go f.loopUntilStopped()
+
+	log.Printf("Follower: following Writer %s", writer)
+
+	return f
+}
+
+func (f *Follower) GetConfigurationContext() *config.Context {
+	return f.confCtx
+}
+
+// like LiveReader, but reading at our head is not an error, as the Writer may
+// well have more
+func (f *Follower) ReadIntoWriter(opts *rtypes.ReadOptions, writer io.Writer) error {
+	chunkPath := opts.Cursor.ToChunkPath()
+
+	// opened under the lock, as forget() removes the file only after taking it
+	f.mu.RLock()
+	length, has := f.lengths[chunkPath]
+	if !has || int64(opts.Cursor.Offset) > length {
+		f.mu.RUnlock()
+		return os.ErrNotExist
+	}
+	fd, err := os.Open(followerFilePath(chunkPath))
+	f.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	return readLinesIntoWriter(fd, int64(opts.Cursor.Offset), length, opts.MaxLinesToRead, writer)
+}
+
+func (f *Follower) loopUntilStopped() {
+	for {
+		gotData, err := f.poll()
+		if err != nil {
+			log.Printf("Follower: %s", err.Error())
+		}
+
+		// more may be waiting if we got some, as a response is capped
+		interval := config.FollowerPollInterval
+		if gotData {
+			interval = 0
+		}
+
+		select {
+		case <-f.stop:
+			f.done <- true
+			return
+		case <-time.After(interval):
+			break
+		}
+	}
+}
+
+func (f *Follower) poll() (bool, error) {
+	req := &types.TailRequest{
+		Have: map[string]int64{},
+	}
+
+	// only poll() changes lengths, so no need to hold the lock after this
+	f.mu.RLock()
+	for chunkPath, length := range f.lengths {
+		req.Have[chunkPath] = length
+	}
+	f.mu.RUnlock()
+
+	output, err := f.client.Tail(f.writer, req)
+	if err != nil {
+		return false, err
+	}
+
+	for _, chunkPath := range output.Gone {
+		f.forget(chunkPath)
+	}
+
+	for _, chunk := range output.Chunks {
+		if err := f.apply(chunk, req.Have[chunk.ChunkPath]); err != nil {
+			return false, err
+		}
+	}
+
+	return len(output.Chunks) > 0, nil
+}
+
+func (f *Follower) apply(chunk types.TailedChunk, have int64) error {
+	if chunk.Offset != have {
+		return errors.New("Follower: got " + chunk.ChunkPath + " at unexpected offset")
+	}
+
+	fd, err := os.OpenFile(followerFilePath(chunk.ChunkPath), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = fd.WriteAt(chunk.Data, chunk.Offset)
+	if errClose := fd.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return err
+	}
+
+	// readers only see the new bytes once they're written
+	f.mu.Lock()
+	f.lengths[chunk.ChunkPath] = chunk.Offset + int64(len(chunk.Data))
+	f.mu.Unlock()
+
+	return nil
+}
+
+// sealed (readers find it from scalablestore), or our copy is not valid anymore
+func (f *Follower) forget(chunkPath string) {
+	f.mu.Lock()
+	delete(f.lengths, chunkPath)
+	f.mu.Unlock()
+
+	if err := os.Remove(followerFilePath(chunkPath)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Follower: %s", err.Error())
+	}
+}
+
+func (f *Follower) Close() {
+	log.Printf("Follower: stopping")
+
+	f.stop <- true
+
+	<-f.done
+
+	log.Printf("Follower: stopped")
+}
+
+// "/tenants/foo/_/0.log" => "<FollowerDataDir>/_tenants_foo___0.log", like WAL's files
+func followerFilePath(chunkPath string) string {
+	return config.FollowerDataDir + "/" + strings.Replace(chunkPath, "/", "_", -1)
+}
@@ -0,0 +1,102 @@
+package writer
+
+import (
+	"bytes"
+	"github.com/function61/eventhorizon/config"
+	"github.com/function61/eventhorizon/cursor"
+	rtypes "github.com/function61/eventhorizon/reader/types"
+	"github.com/function61/eventhorizon/util/ass"
+	"github.com/function61/eventhorizon/writer/types"
+	"os"
+	"testing"
+	"time"
+)
+
+// tails the Writer directly instead of over HTTP
+type liveReaderTailer struct {
+	liveReader *LiveReader
+}
+
+func (l *liveReaderTailer) Tail(server string, req *types.TailRequest) (*types.TailOutput, error) {
+	return l.liveReader.Tail(req)
+}
+
+func TestFollower(t *testing.T) {
+	e, cleanup := newTestWriter(t)
+	defer cleanup()
+
+	ass.True(t, os.MkdirAll(config.FollowerDataDir, 0755) == nil)
+
+	f := &Follower{
+		writer:  "127.0.0.1",
+		client:  &liveReaderTailer{e.LiveReader},
+		lengths: map[string]int64{},
+	}
+
+	read := func(chunkPath string, offset int) (string, error) {
+		streamName, chunkNumber, _ := parseChunkKey(chunkPath)
+
+		lines := &bytes.Buffer{}
+		err := f.ReadIntoWriter(&rtypes.ReadOptions{
+			MaxLinesToRead: 100,
+			Cursor:         cursor.New(streamName, chunkNumber, offset, cursor.NoServer),
+		}, lines)
+
+		return lines.String(), err
+	}
+
+	_, err := e.CreateStream(&types.CreateStreamRequest{Name: "/foo"})
+	ass.True(t, err == nil)
+
+	appendLines(t, e, "/foo", "first")
+
+	_, err = read("/foo/_/0.log", 0)
+	ass.True(t, err == os.ErrNotExist)
+
+	gotData, err := f.poll()
+	ass.True(t, err == nil)
+	ass.True(t, gotData)
+
+	content, err := read("/foo/_/0.log", 0)
+	ass.True(t, err == nil)
+	ass.EqualString(t, content, readLiveChunk(t, e, "/foo/_/0.log"))
+
+	// nothing new
+	gotData, err = f.poll()
+	ass.True(t, err == nil)
+	ass.False(t, gotData)
+
+	// only the new bytes are applied
+	offsetBefore := len(content)
+	appendLines(t, e, "/foo", "second")
+
+	gotData, err = f.poll()
+	ass.True(t, err == nil)
+	ass.True(t, gotData)
+
+	content, err = read("/foo/_/0.log", offsetBefore)
+	ass.True(t, err == nil)
+	ass.EqualString(t, content, " second\n")
+
+	ass.EqualString(t, f.apply(types.TailedChunk{
+		ChunkPath: "/foo/_/0.log",
+		Offset:    3,
+		Data:      []byte("garbage\n"),
+	}, int64(offsetBefore)).Error(), "Follower: got /foo/_/0.log at unexpected offset")
+
+	// sealed chunk is forgotten, readers find it from scalablestore
+	ass.True(t, (&ChunkSealerTask{writer: e}).sealOldChunks(-1*time.Second) == nil)
+
+	_, err = f.poll()
+	ass.True(t, err == nil)
+
+	_, err = read("/foo/_/0.log", 0)
+	ass.True(t, err == os.ErrNotExist)
+
+	_, err = os.Stat(followerFilePath("/foo/_/0.log"))
+	ass.True(t, os.IsNotExist(err))
+
+	content, err = read("/foo/_/1.log", 0)
+	ass.True(t, err == nil)
+	ass.EqualString(t, content, readLiveChunk(t, e, "/foo/_/1.log"))
+}
@@ -0,0 +1,217 @@
+package writer
+
+import (
+	"errors"
+	"github.com/function61/eventhorizon/config"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"github.com/function61/eventhorizon/writer/types"
+	"log"
+	"sync"
+	"time"
+)
+
+// Every bolt transaction costs an fsync, so instead of one transaction per append
+// we gather appends that arrive close to each other and commit them in one
+// transaction and one round of side effects. Callers are completed together.
+//
+// Appends are committed in the order they arrived, so per-stream ordering is kept.
+// If an append of a batch fails (f.ex. ExpectedOffset conflict), the batch is
+// rolled back, only that append is failed and the rest are re-committed, so one
+// bad append does not fail the others.
+
+type GroupCommitter struct {
+	writer   *EventstoreWriter
+	pending  chan *pendingAppend
+	mu       sync.Mutex
+	closed   bool
+	inFlight sync.WaitGroup
+	stop     chan bool
+	done     chan bool
+}
+
+type pendingAppend struct {
+	req      *types.AppendToStreamRequest
+	rawLines string
+	output   *types.AppendToStreamOutput
+	replayed bool
+	err      error
+	done     chan bool
+}
+
+func NewGroupCommitter(writer *EventstoreWriter) *GroupCommitter {
+	g := &GroupCommitter{
+		writer:  writer,
+		pending: make(chan *pendingAppend, config.GroupCommitMaxAppends),
+		stop:    make(chan bool),
+		done:    make(chan bool),
+	}
+
+	go g.loopUntilStopped()
+
+	return g
+}
+
+// blocks until the append is committed (or failed)
+func (g *GroupCommitter) Append(req *types.AppendToStreamRequest, rawLines string) (*types.AppendToStreamOutput, error) {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return nil, errors.New("GroupCommitter: writer is closing")
+	}
+	g.inFlight.Add(1)
+	g.mu.Unlock()
+
+	defer g.inFlight.Done()
+
+	item := &pendingAppend{
+		req:      req,
+		rawLines: rawLines,
+		done:     make(chan bool, 1),
+	}
+
+	g.pending <- item
+
+	<-item.done
+
+	if item.err != nil {
+		return nil, item.err
+	}
+
+	return item.output, nil
+}
+
+func (g *GroupCommitter) loopUntilStopped() {
+	for {
+		select {
+		case <-g.stop:
+			g.done <- true
+			return
+		case first := <-g.pending:
+			g.commit(g.gatherBatch(first))
+		}
+	}
+}
+
+func (g *GroupCommitter) gatherBatch(first *pendingAppend) []*pendingAppend {
+	batch := []*pendingAppend{first}
+
+	windowEnd := time.After(config.GroupCommitWindow)
+
+	for len(batch) < config.GroupCommitMaxAppends {
+		select {
+		case item := <-g.pending:
+			batch = append(batch, item)
+		case <-windowEnd:
+			return batch
+		}
+	}
+
+	return batch
+}
+
+func (g *GroupCommitter) commit(batch []*pendingAppend) {
+	g.writer.mu.Lock()
+	defer g.writer.mu.Unlock()
+
+	remaining := batch
+
+	for len(remaining) > 0 {
+		tx, failed, err := g.appendInOneTransaction(remaining)
+		if err == nil {
+			g.applySideEffects(tx, remaining)
+			break
+		}
+
+		// not any single append's fault (f.ex. disk error)
+		if failed == nil {
+			for _, item := range remaining {
+				item.err = err
+			}
+			break
+		}
+
+		failed.err = err
+		remaining = withoutAppend(remaining, failed)
+
+		if len(remaining) > 0 {
+			log.Printf("GroupCommitter: append to %s failed, re-committing the other %d: %s", failed.req.Stream, len(remaining), err.Error())
+		}
+	}
+
+	for _, item := range batch {
+		item.done <- true
+	}
+}
+
+// nothing is committed if this returns an error, so the appends can be re-tried.
+// failed is the append that caused the error, or nil if it was none of them.
+func (g *GroupCommitter) appendInOneTransaction(batch []*pendingAppend) (*transaction.EventstoreTransaction, *pendingAppend, error) {
+	tx := transaction.NewEventstoreTransaction(g.writer.database)
+
+	var failed *pendingAppend
+
+	err := g.writer.update(tx, func() error {
+		for _, item := range batch {
+			var err error
+			item.output, item.replayed, err = g.writer.appendToStreamInTx(item.req, item.rawLines, tx)
+			if err != nil {
+				failed = item
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err == nil {
+		return tx, nil, nil
+	}
+
+	return tx, failed, err
+}
+
+func withoutAppend(batch []*pendingAppend, item *pendingAppend) []*pendingAppend {
+	without := []*pendingAppend{}
+
+	for _, other := range batch {
+		if other != item {
+			without = append(without, other)
+		}
+	}
+
+	return without
+}
+
+// transaction is committed, so appends must not be re-tried even if this fails
+func (g *GroupCommitter) applySideEffects(tx *transaction.EventstoreTransaction, batch []*pendingAppend) {
+	g.writer.metrics.GroupCommits.Inc()
+
+	err := g.writer.applySideEffects(tx)
+
+	for _, item := range batch {
+		if err != nil {
+			item.err = err
+		} else if item.replayed {
+			g.writer.metrics.AppendToStreamIdempotentReplays.Inc()
+		} else {
+			g.writer.metrics.AppendToStreamOps.Inc()
+		}
+	}
+}
+
+// appends already accepted are committed before stopping
+func (g *GroupCommitter) Close() {
+	log.Printf("GroupCommitter: stopping")
+
+	g.mu.Lock()
+	g.closed = true
+	g.mu.Unlock()
+
+	g.inFlight.Wait()
+
+	g.stop <- true
+
+	<-g.done
+
+	log.Printf("GroupCommitter: stopped")
+}
@@ -0,0 +1,149 @@
+package writer
+
+import (
+	"github.com/function61/eventhorizon/cursor"
+	"github.com/function61/eventhorizon/util/ass"
+	"github.com/function61/eventhorizon/writer/types"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// a GroupCommitter without its loop, so tests control the batches
+func newTestGroupCommitter(e *EventstoreWriter) *GroupCommitter {
+	return &GroupCommitter{
+		writer:  e,
+		pending: make(chan *pendingAppend, 10),
+	}
+}
+
+func newTestPendingAppend(t *testing.T, req *types.AppendToStreamRequest) *pendingAppend {
+	rawLines, err := encodeAppend(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &pendingAppend{
+		req:      req,
+		rawLines: rawLines,
+		done:     make(chan bool, 1),
+	}
+}
+
+func TestGroupCommitBatchesInOrder(t *testing.T) {
+	e, cleanup := newTestWriter(t)
+	defer cleanup()
+
+	_, err := e.CreateStream(&types.CreateStreamRequest{Name: "/foo"})
+	ass.True(t, err == nil)
+
+	g := newTestGroupCommitter(e)
+
+	items := []*pendingAppend{}
+	for _, line := range []string{"a", "b", "c"} {
+		items = append(items, newTestPendingAppend(t, &types.AppendToStreamRequest{
+			Stream: "/foo",
+			Lines:  []string{line},
+		}))
+	}
+
+	for _, item := range items[1:] {
+		g.pending <- item
+	}
+
+	batch := g.gatherBatch(items[0])
+	ass.EqualInt(t, len(batch), 3)
+	for i := range items {
+		ass.True(t, batch[i] == items[i])
+	}
+
+	g.commit(batch)
+
+	previous := cursor.BeginningOfStream("/foo", cursor.NoServer)
+	for _, item := range batch {
+		ass.True(t, item.err == nil)
+		ass.True(t, len(item.done) == 1)
+
+		offset := cursor.CursorFromserializedMust(item.output.Offset)
+		ass.True(t, offset.IsAheadComparedTo(previous))
+		previous = offset
+	}
+
+	ass.True(t, strings.HasSuffix(readLiveChunk(t, e, "/foo/_/0.log"), " a\n b\n c\n"))
+}
+
+func TestGroupCommitFailsOnlyTheFailingAppend(t *testing.T) {
+	e, cleanup := newTestWriter(t)
+	defer cleanup()
+
+	_, err := e.CreateStream(&types.CreateStreamRequest{Name: "/foo"})
+	ass.True(t, err == nil)
+
+	head := appendLines(t, e, "/foo", "first")
+
+	g := newTestGroupCommitter(e)
+
+	batch := []*pendingAppend{
+		newTestPendingAppend(t, &types.AppendToStreamRequest{Stream: "/foo", Lines: []string{"a"}}),
+		// conflicts, as "a" was appended after head
+		newTestPendingAppend(t, &types.AppendToStreamRequest{Stream: "/foo", Lines: []string{"b"}, ExpectedOffset: head}),
+		newTestPendingAppend(t, &types.AppendToStreamRequest{Stream: "/nonexistent", Lines: []string{"c"}}),
+		newTestPendingAppend(t, &types.AppendToStreamRequest{Stream: "/foo", Lines: []string{"d"}}),
+	}
+
+	g.commit(batch)
+
+	ass.True(t, batch[0].err == nil)
+	_, isConflict := batch[1].err.(*types.AppendConflictError)
+	ass.True(t, isConflict)
+	ass.True(t, batch[2].err != nil)
+	ass.True(t, batch[3].err == nil)
+
+	for _, item := range batch {
+		ass.True(t, len(item.done) == 1)
+	}
+
+	ass.True(t, strings.HasSuffix(readLiveChunk(t, e, "/foo/_/0.log"), " first\n a\n d\n"))
+}
+
+func TestGroupCommitConcurrentAppends(t *testing.T) {
+	e, cleanup := newTestWriter(t)
+	defer cleanup()
+
+	_, err := e.CreateStream(&types.CreateStreamRequest{Name: "/foo"})
+	ass.True(t, err == nil)
+
+	var wg sync.WaitGroup
+	offsets := make([]string, 20)
+	errs := make([]error, len(offsets))
+
+	for i := range offsets {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			output, err := e.AppendToStream(&types.AppendToStreamRequest{
+				Stream: "/foo",
+				Lines:  []string{"line"},
+			})
+			if err != nil {
+				errs[i] = err
+				return
+			}
+
+			offsets[i] = output.Offset
+		}(i)
+	}
+
+	wg.Wait()
+
+	unique := map[string]bool{}
+	for i, offset := range offsets {
+		ass.True(t, errs[i] == nil)
+		unique[offset] = true
+	}
+
+	ass.EqualInt(t, len(unique), len(offsets))
+	ass.EqualInt(t, strings.Count(readLiveChunk(t, e, "/foo/_/0.log"), " line\n"), len(offsets))
+}
@@ -0,0 +1,389 @@
+package writer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/function61/eventhorizon/cursor"
+	"github.com/function61/eventhorizon/metaevents"
+	"github.com/function61/eventhorizon/scalablestore"
+	"github.com/function61/eventhorizon/util/stringslice"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"github.com/function61/eventhorizon/writer/types"
+	"log"
+)
+
+/*	Handing a stream off to another Writer:
+
+	1) The old owner seals the live chunk N with a Rotated event pointing to
+	   chunk N+1 on the new owner, ships it and forgets the stream. Its
+	   settings, retention policy, subscriptions and stats are kept in
+	   _handoffs until the new owner has them.
+	2) The old owner records the new owner in scalablestore (placement record).
+	3) The new owner adopts the stream: it opens chunk N+1 with the same
+	   settings etc.
+	4) The old owner removes the stream from _handoffs.
+
+	Requests for the stream get 503 from the old owner between 1) and 4), and
+	421 (redirect to the new owner) after. If 2) - 4) fail, CrossShardTask retries.
+
+	_handoffs:
+		/tenants/foo => {"Writer": "10.0.0.2", "Adopt": {"Stream": "/tenants/foo", "Chunk": 4, ..}}
+
+	/_placement/tenants/foo in scalablestore:
+		{"Stream": "/tenants/foo", "Writer": "10.0.0.2"}
+*/
+
+const placementPrefix = "/_placement"
+
+var ErrHandoffInProgress = errors.New("stream is being handed off to another Writer. try again")
+
+type pendingHandoff struct {
+	Writer string
+	Adopt  types.AdoptStreamRequest
+}
+
+type placementRecord struct {
+	Stream string
+	Writer string
+}
+
+func (e *EventstoreWriter) HandoffStream(streamName string, newOwner string) error {
+	if err := e.checkOwnership(streamName); err != nil {
+		return err
+	}
+
+	if streamName == "/" || streamName == "/_sub" {
+		return errors.New("HandoffStream: cannot hand off a built-in stream")
+	}
+
+	if newOwner == e.confCtx.GetWriterIp() || stringslice.ItemIndex(newOwner, e.confCtx.WriterShards()) == -1 {
+		return errors.New(fmt.Sprintf("HandoffStream: %s is not another Writer shard", newOwner))
+	}
+
+	handoff, err := e.sealForHandoff(streamName, newOwner)
+	if err != nil {
+		return err
+	}
+
+	if err := e.crossShard.completeHandoff(streamName, handoff); err != nil {
+		return errors.New(fmt.Sprintf("HandoffStream: %s is pending and will be retried: %s", streamName, err.Error()))
+	}
+
+	return nil
+}
+
+func (e *EventstoreWriter) sealForHandoff(streamName string, newOwner string) (*pendingHandoff, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	log.Printf("EventstoreWriter: HandoffStream: %s -> %s", streamName, newOwner)
+
+	tx := transaction.NewEventstoreTransaction(e.database)
+
+	handoff := &pendingHandoff{Writer: newOwner}
+
+	err := e.update(tx, func() error {
+		chunkSpec, streamExists := e.chunkSpecInTx(streamName, tx)
+		if !streamExists {
+			return errors.New(fmt.Sprintf("HandoffStream: stream %s does not exist", streamName))
+		}
+
+		// readers continue from the new owner
+		nextChunkCursor := cursor.New(streamName, chunkSpec.ChunkNumber+1, 0, newOwner)
+
+		rotatedEvent := metaevents.NewRotated(nextChunkCursor.Serialize())
+
+		if _, err := e.walManager.AppendToFile(chunkSpec.ChunkPath, rotatedEvent.Serialize(), tx); err != nil {
+			return err
+		}
+
+		if err := updateStreamStats(streamName, "", rotatedEvent.Serialize(), 0, tx); err != nil {
+			return err
+		}
+
+		liveFilePath, err := e.walManager.CloseActiveFile(chunkSpec.ChunkPath, tx)
+		if err != nil {
+			return err
+		}
+
+		fileToShip := &types.LongTermShippableFile{
+			Block:    cursor.New(chunkSpec.StreamName, chunkSpec.ChunkNumber, 0, cursor.NoServer),
+			FilePath: liveFilePath,
+		}
+
+		if err := e.shipper.MarkFileToBeShipped(fileToShip, tx); err != nil {
+			return err
+		}
+
+		handoff.Adopt, err = adoptStreamRequest(streamName, nextChunkCursor.Chunk, tx.BoltTx)
+		if err != nil {
+			return err
+		}
+
+		handoffJson, err := json.Marshal(handoff)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Put("_handoffs", []byte(streamName), handoffJson); err != nil {
+			return err
+		}
+
+		if err := e.forgetHandedOffStream(streamName, tx); err != nil {
+			return err
+		}
+
+		tx.Placements[streamName] = newOwner
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := e.applySideEffects(tx); err != nil {
+		return nil, err
+	}
+
+	return handoff, nil
+}
+
+func adoptStreamRequest(streamName string, chunk int, tx *bolt.Tx) (types.AdoptStreamRequest, error) {
+	req := types.AdoptStreamRequest{
+		Stream:        streamName,
+		Chunk:         chunk,
+		Subscriptions: getSubscriptionsForStream(streamName, tx),
+
+		RecursiveSubscriptions: getRecursiveSubscriptionsForStream(streamName, tx),
+		SubscriptionFilters:    getSubscriptionFiltersForStream(streamName, tx),
+		ActivityIntervals:      getSubscriptionActivityIntervalsForStream(streamName, tx),
+	}
+
+	settings, err := getStreamSettings(streamName, tx)
+	if err != nil {
+		return req, err
+	}
+
+	req.Settings = *settings
+
+	req.RetentionPolicy, err = getRetentionPolicy(streamName, tx)
+	if err != nil {
+		return req, err
+	}
+
+	stats, err := getStreamStats(streamName, tx)
+	if err != nil {
+		return req, err
+	}
+
+	req.LineCount = stats.LineCount
+	req.ByteCount = stats.ByteCount
+	req.ChunkCount = stats.ChunkCount
+	req.LastAppend = stats.LastAppend
+
+	return req, nil
+}
+
+// like forgetStream(), but the name is not tombstoned as the stream lives on
+// elsewhere. the live chunk must already be closed
+func (e *EventstoreWriter) forgetHandedOffStream(streamName string, tx *transaction.EventstoreTransaction) error {
+	if err := tx.Delete("_streams", []byte(streamName)); err != nil {
+		return err
+	}
+
+	if err := saveSubscriptionsForStream(streamName, []string{}, tx); err != nil {
+		return err
+	}
+
+	if err := saveRecursiveSubscriptionsForStream(streamName, []string{}, tx); err != nil {
+		return err
+	}
+
+	if err := forgetSubscriptionFilters(streamName, tx); err != nil {
+		return err
+	}
+
+	// lag is tracked anew by the new owner, once Pushers report there
+	if err := forgetSubscriptionAcks(streamName, tx); err != nil {
+		return err
+	}
+
+	// the new owner raises SubscriptionActivity for the stream when it adopts it
+	if err := tx.Delete("_dirtystreams", []byte(streamName)); err != nil {
+		return err
+	}
+
+	if err := deleteStreamStats(streamName, tx); err != nil {
+		return err
+	}
+
+	if err := saveStreamSettings(streamName, &types.StreamSettings{}, tx); err != nil {
+		return err
+	}
+
+	if err := saveRetentionPolicy(streamName, &types.RetentionPolicy{}, tx); err != nil {
+		return err
+	}
+
+	tx.DeletedStreams = append(tx.DeletedStreams, streamName)
+
+	return nil
+}
+
+// called by the old owner. a retry after the stream is ours already is not an error
+func (e *EventstoreWriter) AdoptStream(req *types.AdoptStreamRequest) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if chunkSpec, exists := e.streamToChunkName[req.Stream]; exists {
+		if chunkSpec.ChunkNumber >= req.Chunk {
+			return nil
+		}
+
+		return errors.New(fmt.Sprintf("AdoptStream: stream %s already exists here", req.Stream))
+	}
+
+	log.Printf("EventstoreWriter: AdoptStream: %s from chunk %d", req.Stream, req.Chunk)
+
+	tx := transaction.NewEventstoreTransaction(e.database)
+
+	err := e.update(tx, func() error {
+		if err := saveStreamSettings(req.Stream, &req.Settings, tx); err != nil {
+			return err
+		}
+
+		if req.RetentionPolicy != nil {
+			if err := saveRetentionPolicy(req.Stream, req.RetentionPolicy, tx); err != nil {
+				return err
+			}
+		}
+
+		if err := saveSubscriptionsForStream(req.Stream, req.Subscriptions, tx); err != nil {
+			return err
+		}
+
+		if err := saveRecursiveSubscriptionsForStream(req.Stream, req.RecursiveSubscriptions, tx); err != nil {
+			return err
+		}
+
+		if err := saveSubscriptionFiltersForStream(req.Stream, req.SubscriptionFilters, tx); err != nil {
+			return err
+		}
+
+		if err := saveSubscriptionActivityIntervalsForStream(req.Stream, req.ActivityIntervals, tx); err != nil {
+			return err
+		}
+
+		if err := saveStreamStats(req.Stream, &streamStats{
+			LineCount:  req.LineCount,
+			ByteCount:  req.ByteCount,
+			ChunkCount: req.ChunkCount,
+			LastAppend: req.LastAppend,
+		}, tx); err != nil {
+			return err
+		}
+
+		cursorAfter, err := e.openChunkLocally(cursor.New(req.Stream, req.Chunk, 0, e.confCtx.GetWriterIp()), tx)
+		if err != nil {
+			return err
+		}
+
+		// subscribers learn the stream's new head, which now points to us. we
+		// don't know if the old owner had matching lines not yet broadcast to
+		// subscribers with a filter, so they're woken up too
+		if err := e.streamHeadMoved(cursorAfter, "", tx); err != nil {
+			return err
+		}
+
+		for subscriptionId := range req.SubscriptionFilters {
+			if err := e.subAct.MarkDirtyForSubscription(cursorAfter, subscriptionId, tx); err != nil {
+				return err
+			}
+		}
+
+		tx.Placements[req.Stream] = e.confCtx.GetWriterIp()
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return e.applySideEffects(tx)
+}
+
+func (e *EventstoreWriter) handoffPending(streamName string) bool {
+	pending := false
+
+	e.database.View(func(boltTx *bolt.Tx) error {
+		if handoffsBucket := boltTx.Bucket([]byte("_handoffs")); handoffsBucket != nil {
+			pending = handoffsBucket.Get([]byte(streamName)) != nil
+		}
+
+		return nil
+	})
+
+	return pending
+}
+
+// streams handed off before a restart are not ours even if they hash to us
+func (e *EventstoreWriter) discoverPendingHandoffs(tx *transaction.EventstoreTransaction) error {
+	handoffsBucket := tx.BoltTx.Bucket([]byte("_handoffs"))
+	if handoffsBucket == nil {
+		return nil
+	}
+
+	return handoffsBucket.ForEach(func(streamName []byte, handoffJson []byte) error {
+		handoff := pendingHandoff{}
+		if err := json.Unmarshal(handoffJson, &handoff); err != nil {
+			return err
+		}
+
+		tx.Placements[string(streamName)] = handoff.Writer
+
+		return nil
+	})
+}
+
+// completed handoffs only have their placement record
+func (e *EventstoreWriter) loadPlacements(s3Manager *scalablestore.S3Manager) error {
+	objects, err := s3Manager.List(placementPrefix + "/")
+	if err != nil {
+		return err
+	}
+
+	for _, object := range objects {
+		response, err := s3Manager.Get(object.Key)
+		if err != nil {
+			return err
+		}
+
+		record := placementRecord{}
+		err = json.NewDecoder(response.Body).Decode(&record)
+		response.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		e.confCtx.SetWriterIpForStream(record.Stream, record.Writer)
+	}
+
+	log.Printf("EventstoreWriter: loaded %d placement record(s)", len(objects))
+
+	return nil
+}
+
+func putPlacement(s3Manager *scalablestore.S3Manager, streamName string, writerIp string) error {
+	recordJson, err := json.Marshal(&placementRecord{
+		Stream: streamName,
+		Writer: writerIp,
+	})
+	if err != nil {
+		return err
+	}
+
+	return s3Manager.Put(placementPrefix+streamName, bytes.NewReader(recordJson))
+}
@@ -0,0 +1,41 @@
+package writer
+
+import (
+	"github.com/function61/eventhorizon/util/ass"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"github.com/function61/eventhorizon/writer/types"
+	"testing"
+)
+
+func TestAdoptStreamRequestAndForgetHandedOffStream(t *testing.T) {
+	e := &EventstoreWriter{}
+
+	withTestDatabase(t, func(tx *transaction.EventstoreTransaction) error {
+		ass.True(t, saveStreamSettings("/tenants/foo", &types.StreamSettings{ChunkSize: 64 * 1024}, tx) == nil)
+		ass.True(t, saveRetentionPolicy("/tenants/foo", &types.RetentionPolicy{MaxChunks: 10}, tx) == nil)
+		ass.True(t, saveSubscriptionsForStream("/tenants/foo", []string{"/_sub/a", "/_sub/b"}, tx) == nil)
+		ass.True(t, saveStreamStats("/tenants/foo", &streamStats{LineCount: 3, ByteCount: 300, ChunkCount: 2}, tx) == nil)
+
+		req, err := adoptStreamRequest("/tenants/foo", 2, tx.BoltTx)
+		ass.True(t, err == nil)
+		ass.EqualString(t, req.Stream, "/tenants/foo")
+		ass.EqualInt(t, req.Chunk, 2)
+		ass.EqualInt(t, req.Settings.ChunkSize, 64*1024)
+		ass.EqualInt(t, req.RetentionPolicy.MaxChunks, 10)
+		ass.EqualInt(t, len(req.Subscriptions), 2)
+		ass.True(t, req.LineCount == 3 && req.ByteCount == 300 && req.ChunkCount == 2)
+
+		ass.True(t, e.forgetHandedOffStream("/tenants/foo", tx) == nil)
+		ass.EqualString(t, tx.DeletedStreams[0], "/tenants/foo")
+
+		// nothing left behind
+		forgotten, err := adoptStreamRequest("/tenants/foo", 2, tx.BoltTx)
+		ass.True(t, err == nil)
+		ass.True(t, forgotten.Settings == types.StreamSettings{})
+		ass.True(t, forgotten.RetentionPolicy == nil)
+		ass.EqualInt(t, len(forgotten.Subscriptions), 0)
+		ass.True(t, forgotten.LineCount == 0 && forgotten.ChunkCount == 0)
+
+		return nil
+	})
+}
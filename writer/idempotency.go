@@ -0,0 +1,178 @@
+package writer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"github.com/function61/eventhorizon/writer/types"
+	"time"
+)
+
+/*	Retries of appends (f.ex. after a lost response) carry the same idempotency
+	key, so we remember the output of each keyed append for a while.
+
+	_idempotencykeys:
+		/tenants/foo\x00key1 => {"output": {"Offset": "/tenants/foo:0:123:127.0.0.1"}, "ts": 1490000000}
+
+	_idempotencykeysbytime (so expiring keys does not require a full scan):
+		<8 byte unix nanos>/tenants/foo\x00key1 => (empty)
+*/
+
+type idempotencyRecord struct {
+	Output    *types.AppendToStreamOutput `json:"output"`
+	Timestamp int64                       `json:"ts"` // unix nanos
+}
+
+func idempotencyRecordKey(streamName string, idempotencyKey string) []byte {
+	return []byte(streamName + "\x00" + idempotencyKey)
+}
+
+// returns nil if key was not seen within the window
+func lookupIdempotencyKey(streamName string, idempotencyKey string, window time.Duration, tx *bolt.Tx) (*types.AppendToStreamOutput, error) {
+	keysBucket, err := tx.CreateBucketIfNotExists([]byte("_idempotencykeys"))
+	if err != nil {
+		return nil, err
+	}
+
+	recordJson := keysBucket.Get(idempotencyRecordKey(streamName, idempotencyKey))
+	if recordJson == nil {
+		return nil, nil
+	}
+
+	record := idempotencyRecord{}
+	if err := json.Unmarshal(recordJson, &record); err != nil {
+		return nil, err
+	}
+
+	// expired but not yet purged
+	if time.Since(time.Unix(0, record.Timestamp)) > window {
+		return nil, nil
+	}
+
+	return record.Output, nil
+}
+
+func saveIdempotencyKey(streamName string, idempotencyKey string, output *types.AppendToStreamOutput, window time.Duration, tx *transaction.EventstoreTransaction) error {
+	now := time.Now()
+
+	if err := purgeExpiredIdempotencyKeys(now.Add(-window), tx); err != nil {
+		return err
+	}
+
+	recordJson, err := json.Marshal(&idempotencyRecord{
+		Output:    output,
+		Timestamp: now.UnixNano(),
+	})
+	if err != nil {
+		return err
+	}
+
+	recordKey := idempotencyRecordKey(streamName, idempotencyKey)
+
+	// an expired record that was not purged yet. don't leave its by-time entry
+	// behind, because it would later purge the new record
+	if previousJson := getIdempotencyRecordJson(recordKey, tx.BoltTx); previousJson != nil {
+		previous := idempotencyRecord{}
+		if err := json.Unmarshal(previousJson, &previous); err != nil {
+			return err
+		}
+
+		if err := tx.Delete("_idempotencykeysbytime", append(itobTime(time.Unix(0, previous.Timestamp)), recordKey...)); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Put("_idempotencykeys", recordKey, recordJson); err != nil {
+		return err
+	}
+
+	return tx.Put("_idempotencykeysbytime", append(itobTime(now), recordKey...), []byte{})
+}
+
+func getIdempotencyRecordJson(recordKey []byte, tx *bolt.Tx) []byte {
+	keysBucket := tx.Bucket([]byte("_idempotencykeys"))
+	if keysBucket == nil {
+		return nil
+	}
+
+	return keysBucket.Get(recordKey)
+}
+
+// keys in by-time bucket are ordered from oldest to newest, so we can stop at
+// the first non-expired key
+func purgeExpiredIdempotencyKeys(olderThan time.Time, tx *transaction.EventstoreTransaction) error {
+	byTimeBucket := tx.BoltTx.Bucket([]byte("_idempotencykeysbytime"))
+	if byTimeBucket == nil {
+		return nil
+	}
+
+	olderThanKey := itobTime(olderThan)
+
+	// deleting while iterating with a cursor is not safe, so collect first
+	expiredKeys := [][]byte{}
+
+	byTime := byTimeBucket.Cursor()
+	for key, _ := byTime.First(); key != nil && string(key[:8]) < string(olderThanKey); key, _ = byTime.Next() {
+		expiredKeys = append(expiredKeys, key)
+	}
+
+	for _, expiredKey := range expiredKeys {
+		if err := tx.Delete("_idempotencykeys", expiredKey[8:]); err != nil {
+			return err
+		}
+
+		if err := tx.Delete("_idempotencykeysbytime", expiredKey); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// for a deleted stream, so that a re-created stream with the same name does not
+// replay the old stream's outputs
+func forgetIdempotencyKeys(streamName string, tx *transaction.EventstoreTransaction) error {
+	keysBucket := tx.BoltTx.Bucket([]byte("_idempotencykeys"))
+	if keysBucket == nil {
+		return nil
+	}
+
+	prefix := idempotencyRecordKey(streamName, "")
+
+	// not deleting while iterating
+	recordKeys := [][]byte{}
+	byTimeKeys := [][]byte{}
+
+	c := keysBucket.Cursor()
+	for key, recordJson := c.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, recordJson = c.Next() {
+		record := idempotencyRecord{}
+		if err := json.Unmarshal(recordJson, &record); err != nil {
+			return err
+		}
+
+		recordKey := append([]byte{}, key...)
+
+		recordKeys = append(recordKeys, recordKey)
+		byTimeKeys = append(byTimeKeys, append(itobTime(time.Unix(0, record.Timestamp)), recordKey...))
+	}
+
+	for idx, recordKey := range recordKeys {
+		if err := tx.Delete("_idempotencykeys", recordKey); err != nil {
+			return err
+		}
+
+		if err := tx.Delete("_idempotencykeysbytime", byTimeKeys[idx]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func itobTime(ts time.Time) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(ts.UnixNano()))
+	return b
+}
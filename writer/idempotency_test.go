@@ -0,0 +1,44 @@
+package writer
+
+import (
+	"github.com/function61/eventhorizon/util/ass"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"github.com/function61/eventhorizon/writer/types"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKeys(t *testing.T) {
+	withTestDatabase(t, func(tx *transaction.EventstoreTransaction) error {
+		output, err := lookupIdempotencyKey("/foo", "key1", time.Hour, tx.BoltTx)
+		ass.True(t, err == nil && output == nil)
+
+		if err := saveIdempotencyKey("/foo", "key1", &types.AppendToStreamOutput{Offset: "/foo:0:10"}, time.Hour, tx); err != nil {
+			return err
+		}
+
+		output, err = lookupIdempotencyKey("/foo", "key1", time.Hour, tx.BoltTx)
+		ass.True(t, err == nil)
+		ass.EqualString(t, output.Offset, "/foo:0:10")
+
+		// keys are per stream
+		output, _ = lookupIdempotencyKey("/bar", "key1", time.Hour, tx.BoltTx)
+		ass.True(t, output == nil)
+
+		// zero window => everything is expired, and saving purges the old keys
+		if err := saveIdempotencyKey("/foo", "key2", &types.AppendToStreamOutput{Offset: "/foo:0:20"}, 0, tx); err != nil {
+			return err
+		}
+
+		ass.True(t, tx.BoltTx.Bucket([]byte("_idempotencykeys")).Get(idempotencyRecordKey("/foo", "key1")) == nil)
+
+		byTimeKeys := 0
+		tx.BoltTx.Bucket([]byte("_idempotencykeysbytime")).ForEach(func(key, value []byte) error {
+			byTimeKeys++
+			return nil
+		})
+		ass.EqualInt(t, byTimeKeys, 1)
+
+		return nil
+	})
+}
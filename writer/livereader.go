@@ -2,8 +2,11 @@ package writer
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
+	"github.com/function61/eventhorizon/config"
 	rtypes "github.com/function61/eventhorizon/reader/types"
+	"github.com/function61/eventhorizon/writer/types"
 	"io"
 	"os"
 )
@@ -28,36 +31,148 @@ func NewLiveReader(writer *EventstoreWriter) *LiveReader {
 // it would be stupid to implement parsing both at Writer and Reader - those are
 // usually separate nodes so code and data structures would have to be 100 % in sync.
 func (l *LiveReader) ReadIntoWriter(opts *rtypes.ReadOptions, writer io.Writer) error {
-	l.writer.mu.Lock()
-	defer l.writer.mu.Unlock()
-
 	l.writer.metrics.LiveReaderReadOps.Inc()
 
-	// borrowing must be done completely within the above mutex
-	fd, err := l.writer.walManager.BorrowFileForReading(opts.Cursor.ToChunkPath())
+	// only the snapshot is taken under the lock, so a slow consumer cannot block
+	// the Writer. lines appended after the snapshot are left for the next read.
+	// the file is opened under the lock as well, because shipping removes it -
+	// our descriptor stays readable after that
+	l.writer.mu.RLock()
+	fd, length, err := l.openSnapshot(opts.Cursor.ToChunkPath())
+	l.writer.mu.RUnlock()
 	if err != nil {
-		return os.ErrNotExist
+		return err
+	}
+	defer fd.Close()
+
+	if int64(opts.Cursor.Offset) > length {
+		return errors.New("Attempt to seek past EOF")
 	}
 
-	// We are intentionally not closing the fd, as it is under writing
+	return readLinesIntoWriter(fd, int64(opts.Cursor.Offset), length, opts.MaxLinesToRead, writer)
+}
+
+// must be called with at least the read lock held
+func (l *LiveReader) openSnapshot(chunkPath string) (*os.File, int64, error) {
+	filePath, length, err := l.writer.walManager.SnapshotForReading(chunkPath)
+	if err != nil {
+		return nil, 0, os.ErrNotExist
+	}
 
-	fileInfo, errStat := fd.Stat()
-	if errStat != nil {
-		return errStat
+	// own descriptor, because the Writer's descriptor is seeked by writes
+	fd, err := os.Open(filePath)
+	if err != nil {
+		return nil, 0, err
 	}
 
-	if int64(opts.Cursor.Offset) > fileInfo.Size() {
-		return errors.New("Attempt to seek past EOF")
+	return fd, length, nil
+}
+
+// for live chunks that are on the Writer's disk but not yet in scalablestore
+func (l *LiveReader) Tail(req *types.TailRequest) (*types.TailOutput, error) {
+	return l.tail(req, config.FollowerTailMaxBytes)
+}
+
+// chunks that don't fit in maxBytes are cut at the last whole line that fits.
+// lines are much shorter than maxBytes (live reads scan lines of at most 64 KB)
+func (l *LiveReader) tail(req *types.TailRequest, maxBytes int) (*types.TailOutput, error) {
+	output := &types.TailOutput{
+		Chunks: []types.TailedChunk{},
+		Gone:   []string{},
+	}
+
+	type liveChunk struct {
+		chunkPath string
+		fd        *os.File
+		offset    int64
+		size      int64
+		cut       bool // by budget, so probably in the middle of a line
+	}
+
+	toRead := []liveChunk{}
+	defer func() {
+		for _, chunk := range toRead {
+			chunk.fd.Close()
+		}
+	}()
+
+	isLive := map[string]bool{}
+	budget := int64(maxBytes)
+
+	// like ReadIntoWriter, files are opened under the lock but read without it
+	l.writer.mu.RLock()
+	for _, chunkSpec := range l.writer.streamToChunkName {
+		_, length, err := l.writer.walManager.SnapshotForReading(chunkSpec.ChunkPath)
+		if err != nil {
+			continue
+		}
+
+		isLive[chunkSpec.ChunkPath] = true
+
+		offset := req.Have[chunkSpec.ChunkPath]
+		if offset > length { // follower has garbage. it starts over
+			output.Gone = append(output.Gone, chunkSpec.ChunkPath)
+			continue
+		}
+
+		size := length - offset
+		cut := false
+		if size > budget {
+			size = budget
+			cut = true
+		}
+
+		if size == 0 {
+			continue
+		}
+
+		fd, _, err := l.openSnapshot(chunkSpec.ChunkPath)
+		if err != nil {
+			l.writer.mu.RUnlock()
+			return nil, err
+		}
+
+		toRead = append(toRead, liveChunk{chunkSpec.ChunkPath, fd, offset, size, cut})
+
+		budget -= size
+	}
+	l.writer.mu.RUnlock()
+
+	for _, chunk := range toRead {
+		data, err := readRange(chunk.fd, chunk.offset, chunk.size)
+		if err != nil {
+			return nil, err
+		}
+
+		// follower would serve the partial line as a whole one
+		if chunk.cut {
+			data = data[:bytes.LastIndexByte(data, '\n')+1]
+
+			if len(data) == 0 {
+				continue
+			}
+		}
+
+		output.Chunks = append(output.Chunks, types.TailedChunk{
+			ChunkPath: chunk.chunkPath,
+			Offset:    chunk.offset,
+			Data:      data,
+		})
 	}
 
-	_, errSeek := fd.Seek(int64(opts.Cursor.Offset), io.SeekStart)
-	if errSeek != nil {
-		panic(errSeek)
+	for chunkPath := range req.Have {
+		if !isLive[chunkPath] {
+			output.Gone = append(output.Gone, chunkPath)
+		}
 	}
 
-	scanner := bufio.NewScanner(fd)
+	return output, nil
+}
+
+func readLinesIntoWriter(fd io.ReaderAt, offset int64, length int64, maxLines int, writer io.Writer) error {
+	scanner := bufio.NewScanner(io.NewSectionReader(fd, offset, length-offset))
 
-	for linesRead := 0; linesRead < opts.MaxLinesToRead && scanner.Scan(); linesRead++ {
+	for linesRead := 0; linesRead < maxLines && scanner.Scan(); linesRead++ {
 		rawLine := scanner.Text() + "\n" // trailing \n was trimmed
 
 		// just dump lines to writer
@@ -65,9 +180,15 @@ func (l *LiveReader) ReadIntoWriter(opts *rtypes.ReadOptions, writer io.Writer)
 			return err
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		return err
+
+	return scanner.Err()
+}
+
+func readRange(fd io.ReaderAt, offset int64, size int64) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := fd.ReadAt(data, offset); err != nil {
+		return nil, err
 	}
 
-	return nil
+	return data, nil
 }
@@ -0,0 +1,178 @@
+package writer
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/function61/eventhorizon/cursor"
+	rtypes "github.com/function61/eventhorizon/reader/types"
+	"github.com/function61/eventhorizon/util/ass"
+	"github.com/function61/eventhorizon/writer/types"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadLinesIntoWriterAndReadRange(t *testing.T) {
+	chunkFile, err := ioutil.TempFile("", "livereader_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(chunkFile.Name())
+	defer chunkFile.Close()
+
+	chunkFile.WriteString("foo\nbar\nbaz\npartial")
+
+	// bytes after the snapshot length are not read
+	lines := &bytes.Buffer{}
+	ass.True(t, readLinesIntoWriter(chunkFile, 4, 12, 10, lines) == nil)
+	ass.EqualString(t, lines.String(), "bar\nbaz\n")
+
+	lines.Reset()
+	ass.True(t, readLinesIntoWriter(chunkFile, 0, 12, 1, lines) == nil)
+	ass.EqualString(t, lines.String(), "foo\n")
+
+	data, err := readRange(chunkFile, 8, 4)
+	ass.True(t, err == nil)
+	ass.EqualString(t, string(data), "baz\n")
+}
+
+// reads race with appends, sealing (which closes the live file) and deleting
+// with purge (which removes it). a read must either succeed with whole lines or
+// find that the chunk is not live anymore
+func TestLiveReadsDuringSealAndDelete(t *testing.T) {
+	e, cleanup := newTestWriter(t)
+	defer cleanup()
+
+	_, err := e.CreateStream(&types.CreateStreamRequest{Name: "/foo"})
+	ass.True(t, err == nil)
+
+	stop := make(chan bool)
+	readErrors := make(chan error, 100)
+
+	checkLines := func(data string) error {
+		if data != "" && !strings.HasSuffix(data, "\n") {
+			return fmt.Errorf("partial line: %q", data)
+		}
+
+		return nil
+	}
+
+	var readers sync.WaitGroup
+
+	reader := func() {
+		defer readers.Done()
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			for chunkNumber := 0; chunkNumber < 5; chunkNumber++ {
+				lines := &bytes.Buffer{}
+				err := e.LiveReader.ReadIntoWriter(&rtypes.ReadOptions{
+					MaxLinesToRead: 1000,
+					Cursor:         cursor.New("/foo", chunkNumber, 0, cursor.NoServer),
+				}, lines)
+				if err == nil {
+					err = checkLines(lines.String())
+				}
+				if err != nil && err != os.ErrNotExist {
+					readErrors <- err
+					return
+				}
+			}
+
+			tail, err := e.LiveReader.Tail(&types.TailRequest{Have: map[string]int64{}})
+			if err != nil {
+				readErrors <- err
+				return
+			}
+
+			for _, chunk := range tail.Chunks {
+				if err := checkLines(string(chunk.Data)); err != nil {
+					readErrors <- err
+					return
+				}
+			}
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go reader()
+	}
+
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 20; j++ {
+			appendLines(t, e, "/foo", "line")
+		}
+
+		ass.True(t, (&ChunkSealerTask{writer: e}).sealOldChunks(-1*time.Second) == nil)
+	}
+
+	ass.True(t, e.DeleteStream("/foo", true) == nil)
+
+	time.Sleep(10 * time.Millisecond)
+
+	close(stop)
+	readers.Wait()
+	close(readErrors)
+
+	for err := range readErrors {
+		t.Error(err)
+	}
+}
+
+func TestTail(t *testing.T) {
+	e, cleanup := newTestWriter(t)
+	defer cleanup()
+
+	_, err := e.CreateStream(&types.CreateStreamRequest{Name: "/foo"})
+	ass.True(t, err == nil)
+
+	appendLines(t, e, "/foo", "first", "second")
+
+	// followers already have the built-in streams
+	have := map[string]int64{"/gone/_/0.log": 10}
+	for _, chunkPath := range []string{"/_/0.log", "/_sub/_/0.log"} {
+		have[chunkPath] = int64(len(readLiveChunk(t, e, chunkPath)))
+	}
+
+	foo := readLiveChunk(t, e, "/foo/_/0.log")
+
+	// cut in the middle of " second\n"
+	output, err := e.LiveReader.tail(&types.TailRequest{Have: have}, len(foo)-3)
+	ass.True(t, err == nil)
+	ass.EqualInt(t, len(output.Chunks), 1)
+	ass.EqualString(t, output.Chunks[0].ChunkPath, "/foo/_/0.log")
+	ass.EqualInt(t, int(output.Chunks[0].Offset), 0)
+	ass.EqualString(t, string(output.Chunks[0].Data), strings.TrimSuffix(foo, " second\n"))
+	ass.EqualString(t, strings.Join(output.Gone, ","), "/gone/_/0.log")
+
+	have["/foo/_/0.log"] = int64(len(output.Chunks[0].Data))
+	delete(have, "/gone/_/0.log")
+
+	output, err = e.LiveReader.tail(&types.TailRequest{Have: have}, 1024)
+	ass.True(t, err == nil)
+	ass.EqualInt(t, len(output.Chunks), 1)
+	ass.EqualInt(t, int(output.Chunks[0].Offset), len(foo)-len(" second\n"))
+	ass.EqualString(t, string(output.Chunks[0].Data), " second\n")
+
+	// not even one line fits
+	have["/foo/_/0.log"] = int64(len(foo)) - int64(len(" second\n"))
+	output, err = e.LiveReader.tail(&types.TailRequest{Have: have}, 3)
+	ass.True(t, err == nil)
+	ass.EqualInt(t, len(output.Chunks), 0)
+
+	// follower has more than we do
+	have["/foo/_/0.log"] = int64(len(foo)) + 1
+	output, err = e.LiveReader.tail(&types.TailRequest{Have: have}, 1024)
+	ass.True(t, err == nil)
+	ass.EqualInt(t, len(output.Chunks), 0)
+	ass.EqualString(t, strings.Join(output.Gone, ","), "/foo/_/0.log")
+}
@@ -34,6 +34,9 @@ import (
 	Reliability: on Writer startup it calls RecoverUnfinishedShipments(), after which
 	the side effects processor calls Ship() if any files-to-recover were detected.
 
+	Purging a deleted stream's chunks from scalablestore follows the same flow with
+	MarkStreamToBePurged() and Purge().
+
 */
 
 type Shipper struct {
@@ -51,13 +54,10 @@ func New(confCtx *config.Context) *Shipper {
 }
 
 func (s *Shipper) MarkFileToBeShipped(fileToShip *wtypes.LongTermShippableFile, tx *transaction.EventstoreTransaction) error {
-	filesToShipBucket, createBucketErr := tx.BoltTx.CreateBucketIfNotExists([]byte("_filestoship"))
-	if createBucketErr != nil {
-		return createBucketErr
+	if err := tx.Put("_filestoship", []byte(fileToShip.Block.Serialize()), []byte(fileToShip.FilePath)); err != nil {
+		return err
 	}
 
-	filesToShipBucket.Put([]byte(fileToShip.Block.Serialize()), []byte(fileToShip.FilePath))
-
 	tx.ShipFiles = append(tx.ShipFiles, fileToShip)
 
 	return nil
@@ -115,6 +115,64 @@ func (s *Shipper) shipOne(ltsf *wtypes.LongTermShippableFile) error {
 	return nil
 }
 
+func (s *Shipper) MarkStreamToBePurged(streamName string, tx *transaction.EventstoreTransaction) error {
+	if err := tx.Put("_streamstopurge", []byte(streamName), []byte{}); err != nil {
+		return err
+	}
+
+	tx.PurgeStreams = append(tx.PurgeStreams, streamName)
+
+	return nil
+}
+
+// removes all chunks of a stream from scalablestore. need DB reference so we
+// can start transaction once the process finishes
+func (s *Shipper) Purge(streamName string, database *bolt.DB) {
+	// don't return from Close() until all purges finish
+	s.shipmentOperationsDone.Add(1)
+
+	go func() {
+		defer s.shipmentOperationsDone.Done()
+
+		if err := s.purgeOne(streamName); err != nil {
+			log.Printf("Shipper: purge error %s", err.Error())
+			return
+		}
+
+		if err := database.Update(func(boltTx *bolt.Tx) error {
+			streamsToPurgeBucket := boltTx.Bucket([]byte("_streamstopurge"))
+			if streamsToPurgeBucket == nil {
+				return errors.New("Unable to get _streamstopurge bucket")
+			}
+
+			return streamsToPurgeBucket.Delete([]byte(streamName))
+		}); err != nil {
+			panic(err)
+		}
+	}()
+}
+
+// NOTE: if the stream's previous chunk is still being shipped, it might land in
+// scalablestore after the purge. the purge is not re-tried for that.
+func (s *Shipper) purgeOne(streamName string) error {
+	started := time.Now()
+
+	chunks, err := s.s3Manager.List(wtypes.ChunkPathPrefix(streamName))
+	if err != nil {
+		return err
+	}
+
+	for _, chunk := range chunks {
+		if err := s.s3Manager.Delete(chunk.Key); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Shipper: purged %d chunk(s) of %s in %s", len(chunks), streamName, time.Since(started))
+
+	return nil
+}
+
 func (s *Shipper) RecoverUnfinishedShipments(tx *transaction.EventstoreTransaction) error {
 	filesToShipBucket, createBucketErr := tx.BoltTx.CreateBucketIfNotExists([]byte("_filestoship"))
 	if createBucketErr != nil {
@@ -139,7 +197,18 @@ func (s *Shipper) RecoverUnfinishedShipments(tx *transaction.EventstoreTransacti
 		panic(err)
 	}
 
-	return nil
+	streamsToPurgeBucket, createBucketErr := tx.BoltTx.CreateBucketIfNotExists([]byte("_streamstopurge"))
+	if createBucketErr != nil {
+		return createBucketErr
+	}
+
+	return streamsToPurgeBucket.ForEach(func(key, value []byte) error {
+		log.Printf("Shipper: recovering unfinished purge of %s", key)
+
+		tx.PurgeStreams = append(tx.PurgeStreams, string(key))
+
+		return nil
+	})
 }
 
 func (s *Shipper) Close() {
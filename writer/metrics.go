@@ -6,13 +6,27 @@ import (
 
 type Metrics struct {
 	CreateStreamOps                  prometheus.Counter
+	DeleteStreamOps                  prometheus.Counter
 	SubscribeToStreamOps             prometheus.Counter
 	UnsubscribeFromStreamOps         prometheus.Counter
 	AppendToStreamOps                prometheus.Counter
+	AppendMultiOps                   prometheus.Counter
+	GroupCommits                     prometheus.Counter
+	AppendToStreamIdempotentReplays  prometheus.Counter
 	AppendedLinesExclMeta            prometheus.Counter
 	ChunkShippedToLongTermStorage    prometheus.Counter
+	ChunksExpiredByRetention         prometheus.Counter
+	ChunksSealedByAge                prometheus.Counter
 	LiveReaderReadOps                prometheus.Counter
+	WalFsyncs                        prometheus.Counter
+	UnsyncedCommits                  prometheus.Counter
+	WalBytesLostOnRecovery           prometheus.Counter
 	SubscriptionActivityEventsRaised prometheus.Counter
+	CrossShardMetaEventsDelivered    prometheus.Counter
+	OrphanedSubscriptionsRemoved     prometheus.Counter
+	SubscriptionLagBytes             *prometheus.GaugeVec
+	SubscriptionLagLines             *prometheus.GaugeVec
+	SubscriptionLagSeconds           *prometheus.GaugeVec
 
 	// so we can unregister all on close without
 	// explicitly mentioning each counter
@@ -28,6 +42,12 @@ func NewMetrics() *Metrics {
 	})
 	m.register(m.CreateStreamOps)
 
+	m.DeleteStreamOps = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "delete_stream_ops",
+		Help: "Number of DeleteStream() operations",
+	})
+	m.register(m.DeleteStreamOps)
+
 	m.SubscribeToStreamOps = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "subscribe_to_stream_ops",
 		Help: "Number of SubscribeToStream() operations",
@@ -46,6 +66,24 @@ func NewMetrics() *Metrics {
 	})
 	m.register(m.AppendToStreamOps)
 
+	m.AppendToStreamIdempotentReplays = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "append_to_stream_idempotent_replays",
+		Help: "Number of AppendToStream() retries answered from idempotency key without appending",
+	})
+	m.register(m.AppendToStreamIdempotentReplays)
+
+	m.AppendMultiOps = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "append_multi_ops",
+		Help: "Number of AppendMulti() operations",
+	})
+	m.register(m.AppendMultiOps)
+
+	m.GroupCommits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "group_commits",
+		Help: "Number of transactions used for appends (appends / group commits = average batch size)",
+	})
+	m.register(m.GroupCommits)
+
 	m.AppendedLinesExclMeta = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "appended_lines_count_excl_meta",
 		Help: "Number of appended lines across all streams (excludes meta lines)",
@@ -58,18 +96,78 @@ func NewMetrics() *Metrics {
 	})
 	m.register(m.ChunkShippedToLongTermStorage)
 
+	m.ChunksExpiredByRetention = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chunks_expired_by_retention",
+		Help: "Number of sealed chunks deleted from long term storage by retention policies",
+	})
+	m.register(m.ChunksExpiredByRetention)
+
+	m.ChunksSealedByAge = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chunks_sealed_by_age",
+		Help: "Number of live chunks sealed below rotate threshold because of max chunk age",
+	})
+	m.register(m.ChunksSealedByAge)
+
 	m.LiveReaderReadOps = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "live_reader_read_ops",
 		Help: "Number of Read() operations for live reader",
 	})
 	m.register(m.LiveReaderReadOps)
 
+	m.WalFsyncs = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "wal_fsyncs",
+		Help: "Number of WAL fsyncs done for commits (strict) or by WAL sync task (batched)",
+	})
+	m.register(m.WalFsyncs)
+
+	m.UnsyncedCommits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "unsynced_commits",
+		Help: "Number of commits acknowledged before their WAL records were fsync'd (batched & relaxed durability)",
+	})
+	m.register(m.UnsyncedCommits)
+
+	m.WalBytesLostOnRecovery = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "wal_bytes_lost_on_recovery",
+		Help: "Number of committed bytes found missing on startup, because they were not fsync'd before an OS crash",
+	})
+	m.register(m.WalBytesLostOnRecovery)
+
 	m.SubscriptionActivityEventsRaised = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "subscription_activity_events_raised",
 		Help: "Number of events raised by activity on streams that have been subscribed to",
 	})
 	m.register(m.SubscriptionActivityEventsRaised)
 
+	m.CrossShardMetaEventsDelivered = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cross_shard_meta_events_delivered",
+		Help: "Number of meta events delivered to streams on other Writer shards",
+	})
+	m.register(m.CrossShardMetaEventsDelivered)
+
+	m.OrphanedSubscriptionsRemoved = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "orphaned_subscriptions_removed",
+		Help: "Number of subscriptions unsubscribed automatically because their subscription stream no longer exists",
+	})
+	m.register(m.OrphanedSubscriptionsRemoved)
+
+	m.SubscriptionLagBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "subscription_lag_bytes",
+		Help: "Bytes written after the cursors a subscription has acked, summed over its streams on this Writer",
+	}, []string{"subscription"})
+	m.register(m.SubscriptionLagBytes)
+
+	m.SubscriptionLagLines = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "subscription_lag_lines",
+		Help: "Lines (at most) written after the cursors a subscription has acked, summed over its streams on this Writer",
+	}, []string{"subscription"})
+	m.register(m.SubscriptionLagLines)
+
+	m.SubscriptionLagSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "subscription_lag_seconds",
+		Help: "Age of the oldest line a subscription has not acked, over its streams on this Writer",
+	}, []string{"subscription"})
+	m.register(m.SubscriptionLagSeconds)
+
 	return m
 }
 
@@ -0,0 +1,101 @@
+package writer
+
+import (
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/function61/eventhorizon/metaevents"
+	"github.com/function61/eventhorizon/util/stringslice"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"github.com/function61/eventhorizon/writer/types"
+	"log"
+	"time"
+)
+
+/*	DeleteStream refuses to delete a subscription stream that is still subscribed
+	to, but only sees the subscriptions on its own shard. If a subscription stream
+	disappears anyway, SubscriptionActivity (or CrossShardTask, for the other
+	shards) notices and we unsubscribe it from all our streams, with an
+	Unsubscribed event like a client's unsubscribe would produce.
+
+	_orphanedsubscriptions (for "horizon writer-orphanedsubs"):
+		/_sub/foo => {"SubscriptionId": "/_sub/foo", "Streams": ["/tenants"], "RemovedAt": "..."}
+*/
+
+func (e *EventstoreWriter) removeOrphanedSubscription(subscriptionId string, tx *transaction.EventstoreTransaction) error {
+	streams := getStreamsSubscribedTo(subscriptionId, tx.BoltTx)
+
+	// already removed, f.ex. CrossShardTask got many undeliverables for it
+	if len(streams) == 0 {
+		return nil
+	}
+
+	log.Printf("EventstoreWriter: subscription stream %s does not exist, unsubscribing from %v", subscriptionId, streams)
+
+	for _, streamName := range streams {
+		unsubscribedEvent := metaevents.NewUnsubscribed(subscriptionId)
+		unsubscribedEvent.Recursive = stringslice.ItemIndex(
+			subscriptionId,
+			getRecursiveSubscriptionsForStream(streamName, tx.BoltTx)) != -1
+
+		if err := e.unsubscribeInTx(streamName, unsubscribedEvent, tx); err != nil {
+			return err
+		}
+	}
+
+	orphanedJson, err := json.Marshal(&types.OrphanedSubscription{
+		SubscriptionId: subscriptionId,
+		Streams:        streams,
+		RemovedAt:      time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Put("_orphanedsubscriptions", []byte(subscriptionId), orphanedJson); err != nil {
+		return err
+	}
+
+	tx.OrphanedSubsRemoved++
+
+	return nil
+}
+
+func (e *EventstoreWriter) OrphanedSubscriptions() (*types.OrphanedSubscriptionsOutput, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	output := &types.OrphanedSubscriptionsOutput{
+		Subscriptions: []types.OrphanedSubscription{},
+	}
+
+	err := e.database.View(func(boltTx *bolt.Tx) error {
+		var err error
+		output.Subscriptions, err = getOrphanedSubscriptions(boltTx)
+		return err
+	})
+
+	return output, err
+}
+
+// ordered by subscription, as Bolt keeps keys sorted
+func getOrphanedSubscriptions(tx *bolt.Tx) ([]types.OrphanedSubscription, error) {
+	orphaned := []types.OrphanedSubscription{}
+
+	orphanedBucket := tx.Bucket([]byte("_orphanedsubscriptions"))
+	if orphanedBucket == nil {
+		return orphaned, nil
+	}
+
+	err := orphanedBucket.ForEach(func(subscriptionId []byte, orphanedJson []byte) error {
+		item := types.OrphanedSubscription{}
+		if err := json.Unmarshal(orphanedJson, &item); err != nil {
+			return err
+		}
+
+		orphaned = append(orphaned, item)
+
+		return nil
+	})
+
+	return orphaned, err
+}
@@ -0,0 +1,85 @@
+package writer
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/boltdb/bolt"
+	"github.com/function61/eventhorizon/util/ass"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"github.com/function61/eventhorizon/writer/types"
+	"testing"
+)
+
+func TestOrphanedSubscriptions(t *testing.T) {
+	withTestDatabase(t, func(tx *transaction.EventstoreTransaction) error {
+		e := &EventstoreWriter{}
+
+		// not subscribed to anything here => nothing to record
+		ass.True(t, e.removeOrphanedSubscription("/_sub/gone", tx) == nil)
+
+		orphaned, err := getOrphanedSubscriptions(tx.BoltTx)
+		ass.True(t, err == nil)
+		ass.EqualInt(t, len(orphaned), 0)
+
+		for _, subscriptionId := range []string{"/_sub/b", "/_sub/a"} {
+			orphanedJson, _ := json.Marshal(&types.OrphanedSubscription{
+				SubscriptionId: subscriptionId,
+				Streams:        []string{"/tenants"},
+			})
+
+			ass.True(t, tx.Put("_orphanedsubscriptions", []byte(subscriptionId), orphanedJson) == nil)
+		}
+
+		orphaned, err = getOrphanedSubscriptions(tx.BoltTx)
+		ass.True(t, err == nil)
+		ass.EqualInt(t, len(orphaned), 2)
+		ass.EqualString(t, orphaned[0].SubscriptionId, "/_sub/a")
+		ass.EqualString(t, orphaned[1].Streams[0], "/tenants")
+
+		return nil
+	})
+}
+
+func TestOrphanedSubscriptionCountedOnlyOnCommit(t *testing.T) {
+	e, cleanup := newTestWriter(t)
+	defer cleanup()
+
+	_, err := e.CreateStream(&types.CreateStreamRequest{Name: "/foo"})
+	ass.True(t, err == nil)
+	_, err = e.CreateStream(&types.CreateStreamRequest{Name: "/_sub/bar"})
+	ass.True(t, err == nil)
+	ass.True(t, e.SubscribeToStream("/foo", "/_sub/bar", nil, 0) == nil)
+
+	subscribedTo := func() []string {
+		streams := []string{}
+		ass.True(t, e.database.View(func(boltTx *bolt.Tx) error {
+			streams = getStreamsSubscribedTo("/_sub/bar", boltTx)
+			return nil
+		}) == nil)
+		return streams
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	rolledBack := transaction.NewEventstoreTransaction(e.database)
+	ass.True(t, e.update(rolledBack, func() error {
+		if err := e.removeOrphanedSubscription("/_sub/bar", rolledBack); err != nil {
+			return err
+		}
+
+		return errors.New("something after it failed")
+	}) != nil)
+
+	ass.EqualInt(t, len(subscribedTo()), 1)
+
+	tx := transaction.NewEventstoreTransaction(e.database)
+	ass.True(t, e.update(tx, func() error {
+		return e.removeOrphanedSubscription("/_sub/bar", tx)
+	}) == nil)
+	ass.True(t, e.applySideEffects(tx) == nil)
+
+	// the metric is incremented from this in applySideEffects()
+	ass.EqualInt(t, tx.OrphanedSubsRemoved, 1)
+	ass.EqualInt(t, len(subscribedTo()), 0)
+}
@@ -0,0 +1,497 @@
+package writer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/function61/eventhorizon/config"
+	"github.com/function61/eventhorizon/cursor"
+	"github.com/function61/eventhorizon/metaevents"
+	"github.com/function61/eventhorizon/reader/store"
+	"github.com/function61/eventhorizon/scalablestore"
+	"github.com/function61/eventhorizon/util/stringslice"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"github.com/function61/eventhorizon/writer/types"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*	Rebuilds Writer's state after its local disk (BoltDB + live chunks) was lost,
+	from the sealed chunks in scalablestore:
+
+	1) List scalablestore to find each stream's last sealed chunk.
+	2) Read every sealed chunk, in order, to find:
+	   - streams that never got a chunk sealed (ChildStreamCreated in parent)
+	   - deleted streams (StreamDeleted in parent) => tombstoned
+	   - subscriptions (Created lists the subscriptions active when the chunk
+	     was opened, followed by Subscribed/Unsubscribed)
+	3) For each stream, the lost live chunk was the one after the last sealed
+	   chunk (the last Rotated points to it). It's re-created with only a
+	   LiveChunkLost event and sealed right away, so the chain of chunks stays
+	   unbroken, and writing continues in the chunk after it.
+
+	Lost for good: live chunks' content, streams created after their parent's
+	last sealed chunk, stream settings, retention policies and idempotency keys.
+	Stream stats are counted again from the sealed chunks, so the lost live
+	chunks' lines are missing from them. The last append is taken to be at the
+	recovered head, so an ExpectedOffset from before the loss conflicts.
+
+	If SnapshotTask has snapshotted Writer's state (see snapshot.go), it is restored
+	first, and only the streams that the snapshot is outdated for take step 3.
+	Others continue in their restored live chunk, after a LiveChunkLost that says
+	that writes after the snapshot were lost.
+*/
+
+type recoveredStream struct {
+	Name          string
+	NextChunk     int // lost live chunk. 0 if stream never got a chunk sealed
+	Subscriptions []string
+	Recursive     []string // of Subscriptions, the recursive ones
+	Filters       map[string]*metaevents.SubscriptionFilter
+	Intervals     map[string]int64
+	Deleted       string // serialized StreamDeleted if the stream was deleted
+	sealedChunks  []int
+	lineCount     int64 // non-meta lines of the sealed chunks
+	byteCount     int64
+	scanned       bool
+}
+
+type recoveryPlan struct {
+	streams map[string]*recoveredStream
+}
+
+func newRecoveryPlan() *recoveryPlan {
+	p := &recoveryPlan{
+		streams: map[string]*recoveredStream{},
+	}
+
+	// built-in streams exist even if we don't find any trace of them
+	p.stream("/")
+	p.stream("/_sub")
+
+	return p
+}
+
+func (p *recoveryPlan) stream(streamName string) *recoveredStream {
+	stream, exists := p.streams[streamName]
+	if !exists {
+		stream = &recoveredStream{
+			Name:          streamName,
+			Subscriptions: []string{},
+			Recursive:     []string{},
+			Filters:       map[string]*metaevents.SubscriptionFilter{},
+			Intervals:     map[string]int64{},
+			sealedChunks:  []int{},
+		}
+
+		p.streams[streamName] = stream
+	}
+
+	return stream
+}
+
+// ignores objects that are not chunks
+func (p *recoveryPlan) addObject(key string) {
+	streamName, chunk, isChunk := parseChunkKey(key)
+	if !isChunk {
+		return
+	}
+
+	stream := p.stream(streamName)
+	stream.sealedChunks = append(stream.sealedChunks, chunk)
+
+	if chunk+1 > stream.NextChunk {
+		stream.NextChunk = chunk + 1
+	}
+}
+
+// lines of a stream must be given in order
+func (p *recoveryPlan) scanLine(streamName string, line string) {
+	metaType, _, event := metaevents.Parse(line)
+
+	stream := p.stream(streamName)
+
+	stream.byteCount += int64(len(line) + 1)
+	if metaType == "" {
+		stream.lineCount++
+	}
+
+	switch metaType {
+	case metaevents.CreatedId:
+		// authoritative list as of opening the chunk
+		created := event.(metaevents.Created)
+
+		stream.Subscriptions = []string{}
+		for _, subscriptionId := range created.SubscriptionIds {
+			stream.Subscriptions = append(stream.Subscriptions, subscriptionId)
+			p.stream(subscriptionId)
+		}
+
+		stream.Recursive = append([]string{}, created.RecursiveSubscriptionIds...)
+
+		stream.Filters = map[string]*metaevents.SubscriptionFilter{}
+		for subscriptionId, filter := range created.SubscriptionFilters {
+			stream.Filters[subscriptionId] = filter
+		}
+
+		stream.Intervals = map[string]int64{}
+		for subscriptionId, intervalMs := range created.SubscriptionActivityIntervals {
+			stream.Intervals[subscriptionId] = intervalMs
+		}
+	case metaevents.SubscribedId:
+		subscribed := event.(metaevents.Subscribed)
+
+		if stringslice.ItemIndex(subscribed.SubscriptionId, stream.Subscriptions) == -1 {
+			stream.Subscriptions = append(stream.Subscriptions, subscribed.SubscriptionId)
+		}
+
+		if subscribed.Recursive && stringslice.ItemIndex(subscribed.SubscriptionId, stream.Recursive) == -1 {
+			stream.Recursive = append(stream.Recursive, subscribed.SubscriptionId)
+		}
+
+		// subscribing again replaces the filter and the interval
+		delete(stream.Filters, subscribed.SubscriptionId)
+		if subscribed.Filter != nil {
+			stream.Filters[subscribed.SubscriptionId] = subscribed.Filter
+		}
+
+		delete(stream.Intervals, subscribed.SubscriptionId)
+		if subscribed.ActivityIntervalMs != 0 {
+			stream.Intervals[subscribed.SubscriptionId] = subscribed.ActivityIntervalMs
+		}
+
+		p.stream(subscribed.SubscriptionId)
+	case metaevents.UnsubscribedId:
+		subscriptionId := event.(metaevents.Unsubscribed).SubscriptionId
+
+		if idx := stringslice.ItemIndex(subscriptionId, stream.Subscriptions); idx != -1 {
+			stream.Subscriptions = append(stream.Subscriptions[:idx], stream.Subscriptions[idx+1:]...)
+		}
+
+		if idx := stringslice.ItemIndex(subscriptionId, stream.Recursive); idx != -1 {
+			stream.Recursive = append(stream.Recursive[:idx], stream.Recursive[idx+1:]...)
+		}
+
+		delete(stream.Filters, subscriptionId)
+		delete(stream.Intervals, subscriptionId)
+	case metaevents.ChildStreamCreatedId:
+		// re-created after it was deleted (and purged)
+		p.stream(event.(metaevents.ChildStreamCreated).Name).Deleted = ""
+	case metaevents.StreamDeletedId:
+		streamDeleted := event.(metaevents.StreamDeleted)
+
+		p.stream(streamDeleted.Name).Deleted = streamDeleted.Serialize()
+	}
+}
+
+// next stream whose chunks have not been scanned yet, nil if none
+func (p *recoveryPlan) nextUnscanned() *recoveredStream {
+	for _, streamName := range p.streamNames() {
+		if !p.streams[streamName].scanned {
+			return p.streams[streamName]
+		}
+	}
+
+	return nil
+}
+
+// sorted, so parents come before their children
+func (p *recoveryPlan) streamNames() []string {
+	names := []string{}
+	for streamName := range p.streams {
+		names = append(names, streamName)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// "/tenants/foo/_/3.log" => "/tenants/foo", 3
+func parseChunkKey(key string) (string, int, bool) {
+	separatorIdx := strings.LastIndex(key, "/_/")
+	if separatorIdx == -1 || !strings.HasSuffix(key, ".log") {
+		return "", 0, false
+	}
+
+	chunk, err := strconv.Atoi(strings.TrimSuffix(key[separatorIdx+len("/_/"):], ".log"))
+	if err != nil || chunk < 0 {
+		return "", 0, false
+	}
+
+	streamName := key[:separatorIdx]
+	if streamName == "" {
+		streamName = "/"
+	}
+
+	return streamName, chunk, true
+}
+
+// Writer must not be running, and its local BoltDB must not exist
+func RecoverFromScalableStore(confCtx *config.Context) error {
+	// a member that lost its disk catches up from the others when started empty.
+	// recovering all of them would need seeding the others from this one
+	if len(confCtx.WriterPeers()) > 0 {
+		return errors.New("Recovery: not supported for a replicated Writer group")
+	}
+
+	if _, err := os.Stat(dbLocation); err == nil {
+		return errors.New(fmt.Sprintf("Recovery: %s exists. refusing to overwrite Writer's state", dbLocation))
+	}
+
+	s3Manager := scalablestore.NewS3Manager(confCtx)
+	compressedEncryptedStore := store.NewCompressedEncryptedStore(confCtx)
+
+	plan, err := planRecovery(s3Manager, compressedEncryptedStore)
+	if err != nil {
+		return err
+	}
+
+	// Writer's state as of the snapshot. reconciled with the plan below
+	snapshot := loadSnapshotManifest(snapshotPrefixFor(confCtx), s3Manager)
+	if snapshot != nil {
+		if err := restoreSnapshot(snapshot, s3Manager, compressedEncryptedStore); err != nil {
+			return err
+		}
+	}
+
+	e := New(confCtx)
+	defer e.Close()
+
+	return e.recoverStreams(plan, snapshot)
+}
+
+func planRecovery(s3Manager *scalablestore.S3Manager, compressedEncryptedStore *store.CompressedEncryptedStore) (*recoveryPlan, error) {
+	seekableStore := store.NewSeekableStore()
+
+	plan, err := listSealedChunks(s3Manager)
+	if err != nil {
+		return nil, err
+	}
+
+	for stream := plan.nextUnscanned(); stream != nil; stream = plan.nextUnscanned() {
+		stream.scanned = true
+
+		sort.Ints(stream.sealedChunks)
+
+		log.Printf("Recovery: scanning %d chunk(s) of %s", len(stream.sealedChunks), stream.Name)
+
+		for _, chunk := range stream.sealedChunks {
+			chunkCursor := cursor.New(stream.Name, chunk, 0, cursor.NoServer)
+
+			if !compressedEncryptedStore.Has(chunkCursor) && !compressedEncryptedStore.DownloadFromS3(chunkCursor, s3Manager) {
+				return nil, errors.New(fmt.Sprintf("Recovery: failed to download %s", chunkCursor.ToChunkPath()))
+			}
+
+			if !seekableStore.Has(chunkCursor) {
+				compressedEncryptedStore.ExtractToSeekableStore(chunkCursor, seekableStore)
+			}
+
+			if err := scanChunk(chunkCursor, seekableStore, plan); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return plan, nil
+}
+
+// plan with the streams' sealed chunks, which are not scanned yet
+func listSealedChunks(s3Manager scalableStore) (*recoveryPlan, error) {
+	log.Printf("Recovery: listing scalablestore")
+
+	objects, err := s3Manager.List("/")
+	if err != nil {
+		return nil, err
+	}
+
+	plan := newRecoveryPlan()
+
+	for _, object := range objects {
+		plan.addObject(object.Key)
+	}
+
+	return plan, nil
+}
+
+func scanChunk(chunkCursor *cursor.Cursor, seekableStore *store.SeekableStore, plan *recoveryPlan) error {
+	fd, err := seekableStore.Open(chunkCursor)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	scanner.Buffer(make([]byte, 64*1024), types.MaxChunkSize)
+
+	for scanner.Scan() {
+		plan.scanLine(chunkCursor.Stream, scanner.Text())
+	}
+
+	return scanner.Err()
+}
+
+// all in one transaction, so SubscriptionActivity is not raised for
+// subscription streams that are not re-created yet. snapshot is nil if Writer's
+// state was not restored from a snapshot
+func (e *EventstoreWriter) recoverStreams(plan *recoveryPlan, snapshot *snapshotManifest) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	snapshotTaken := ""
+	if snapshot != nil {
+		snapshotTaken = snapshot.Taken.Format("2006-01-02T15:04:05.999Z")
+	}
+
+	// streams created after their parent's last sealed chunk
+	for streamName := range e.streamToChunkName {
+		plan.stream(streamName)
+	}
+
+	tx := transaction.NewEventstoreTransaction(e.database)
+
+	recovered := 0
+
+	if err := e.update(tx, func() error {
+		for _, streamName := range plan.streamNames() {
+			// other shards recover theirs
+			if !e.ownsStream(streamName) {
+				continue
+			}
+
+			stream := plan.streams[streamName]
+
+			liveChunk, restored := e.streamToChunkName[streamName]
+
+			switch {
+			case stream.Deleted != "" && restored:
+				log.Printf("Recovery: %s was deleted after the snapshot", streamName)
+
+				// its last chunk was shipped (or purged) when it was deleted
+				if _, err := e.walManager.CloseActiveFile(liveChunk.ChunkPath, tx); err != nil {
+					return err
+				}
+
+				if err := e.forgetStream(streamName, stream.Deleted, tx); err != nil {
+					return err
+				}
+			case stream.Deleted != "":
+				log.Printf("Recovery: %s was deleted", streamName)
+
+				if err := saveTombstone(streamName, stream.Deleted, tx); err != nil {
+					return err
+				}
+			case restored && liveChunk.ChunkNumber >= stream.NextChunk:
+				log.Printf("Recovery: %s restored from snapshot", streamName)
+
+				// only what was written after the snapshot was lost
+				if err := e.appendToStreamInternal(streamName, "", metaevents.NewLiveChunkLost(snapshotTaken).Serialize(), tx); err != nil {
+					return err
+				}
+
+				// the snapshot's last append is before the lost ones
+				if err := e.saveLastAppendAtHead(streamName, tx); err != nil {
+					return err
+				}
+
+				recovered++
+			default:
+				if restored {
+					log.Printf("Recovery: %s had chunks sealed after the snapshot", streamName)
+
+					// restored live chunk is an outdated copy of a chunk in scalablestore
+					if _, err := e.walManager.CloseActiveFile(liveChunk.ChunkPath, tx); err != nil {
+						return err
+					}
+				}
+
+				log.Printf(
+					"Recovery: %s continues from chunk %d with %d subscription(s)",
+					streamName,
+					stream.NextChunk+1,
+					len(stream.Subscriptions))
+
+				if err := e.recreateLostChunk(stream, tx); err != nil {
+					return err
+				}
+
+				recovered++
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := e.applySideEffects(tx); err != nil {
+		return err
+	}
+
+	log.Printf("Recovery: recovered %d stream(s)", recovered)
+
+	return nil
+}
+
+// re-creates the lost live chunk with only LiveChunkLost in it, and seals it
+func (e *EventstoreWriter) recreateLostChunk(stream *recoveredStream, tx *transaction.EventstoreTransaction) error {
+	// before opening the chunk, so its Created lists them
+	if err := saveSubscriptionsForStream(stream.Name, stream.Subscriptions, tx); err != nil {
+		return err
+	}
+
+	if err := saveRecursiveSubscriptionsForStream(stream.Name, stream.Recursive, tx); err != nil {
+		return err
+	}
+
+	if err := saveSubscriptionFiltersForStream(stream.Name, stream.Filters, tx); err != nil {
+		return err
+	}
+
+	if err := saveSubscriptionActivityIntervalsForStream(stream.Name, stream.Intervals, tx); err != nil {
+		return err
+	}
+
+	lostChunkCursor := cursor.New(stream.Name, stream.NextChunk, 0, e.confCtx.GetWriterIp())
+
+	if _, err := e.openChunkLocally(lostChunkCursor, tx); err != nil {
+		return err
+	}
+
+	if err := e.appendToStreamInternal(stream.Name, "", metaevents.NewLiveChunkLost("").Serialize(), tx); err != nil {
+		return err
+	}
+
+	if err := e.sealLiveChunk(stream.Name, tx); err != nil {
+		return err
+	}
+
+	// so far only the re-created chunk and the one after it are counted
+	stats, err := getStreamStats(stream.Name, tx.BoltTx)
+	if err != nil {
+		return err
+	}
+
+	stats.LineCount += stream.lineCount
+	stats.ByteCount += stream.byteCount
+	stats.ChunkCount += stream.NextChunk
+
+	if err := saveStreamStats(stream.Name, stats, tx); err != nil {
+		return err
+	}
+
+	return e.saveLastAppendAtHead(stream.Name, tx)
+}
+
+// we don't know where the lost appends ended, so ExpectedOffset must be the head
+func (e *EventstoreWriter) saveLastAppendAtHead(streamName string, tx *transaction.EventstoreTransaction) error {
+	head, err := e.streamHead(streamName, tx)
+	if err != nil {
+		return err
+	}
+
+	return saveLastAppend(head, tx)
+}
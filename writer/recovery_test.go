@@ -0,0 +1,220 @@
+package writer
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/function61/eventhorizon/cursor"
+	"github.com/function61/eventhorizon/metaevents"
+	"github.com/function61/eventhorizon/util/ass"
+	"github.com/function61/eventhorizon/writer/types"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseChunkKey(t *testing.T) {
+	streamName, chunk, isChunk := parseChunkKey("/tenants/foo/_/3.log")
+	ass.True(t, isChunk)
+	ass.EqualString(t, streamName, "/tenants/foo")
+	ass.EqualInt(t, chunk, 3)
+
+	streamName, chunk, isChunk = parseChunkKey("/_/0.log")
+	ass.True(t, isChunk)
+	ass.EqualString(t, streamName, "/")
+	ass.EqualInt(t, chunk, 0)
+
+	_, _, isChunk = parseChunkKey("/tenants/foo/_/truncated.json")
+	ass.False(t, isChunk)
+
+	_, _, isChunk = parseChunkKey("/_discovery.json")
+	ass.False(t, isChunk)
+}
+
+func TestRecoveryPlan(t *testing.T) {
+	plan := newRecoveryPlan()
+
+	plan.addObject("/_/0.log")
+	plan.addObject("/_/1.log")
+	plan.addObject("/tenants/_/0.log")
+	plan.addObject("/_discovery.json")
+
+	scanLines := func(streamName string, lines ...string) {
+		for _, line := range lines {
+			plan.scanLine(streamName, strings.TrimRight(line, "\n"))
+		}
+	}
+
+	scanLines("/",
+		metaevents.NewCreated([]string{}).Serialize(),
+		metaevents.NewChildStreamCreated("/tenants", "/tenants:0:0").Serialize(),
+		metaevents.NewChildStreamCreated("/_sub", "/_sub:0:0").Serialize())
+
+	scanLines("/tenants",
+		metaevents.NewCreated([]string{"/_sub/a"}).Serialize(),
+		" regular line",
+		metaevents.NewSubscribed("/_sub/b").Serialize(),
+		metaevents.NewUnsubscribed("/_sub/a").Serialize(),
+		// never got a chunk sealed
+		metaevents.NewChildStreamCreated("/tenants/foo", "/tenants/foo:0:0").Serialize(),
+		metaevents.NewChildStreamCreated("/tenants/bar", "/tenants/bar:0:0").Serialize(),
+		metaevents.NewStreamDeleted("/tenants/bar", false).Serialize(),
+		// purged and re-created
+		metaevents.NewChildStreamCreated("/tenants/baz", "/tenants/baz:0:0").Serialize(),
+		metaevents.NewStreamDeleted("/tenants/baz", true).Serialize(),
+		metaevents.NewChildStreamCreated("/tenants/baz", "/tenants/baz:0:0").Serialize())
+
+	ass.EqualString(t, strings.Join(plan.streamNames(), ","), "/,/_sub,/_sub/a,/_sub/b,/tenants,/tenants/bar,/tenants/baz,/tenants/foo")
+
+	ass.EqualInt(t, plan.streams["/"].NextChunk, 2)
+	ass.EqualInt(t, plan.streams["/tenants"].NextChunk, 1)
+	ass.EqualInt(t, plan.streams["/tenants/foo"].NextChunk, 0)
+
+	ass.EqualString(t, strings.Join(plan.streams["/tenants"].Subscriptions, ","), "/_sub/b")
+
+	ass.True(t, plan.streams["/tenants/bar"].Deleted != "")
+	ass.True(t, plan.streams["/tenants/foo"].Deleted == "")
+	ass.True(t, plan.streams["/tenants/baz"].Deleted == "")
+}
+
+func TestRecoveryPlanRecursiveSubscriptions(t *testing.T) {
+	plan := newRecoveryPlan()
+
+	created := metaevents.NewCreated([]string{"/_sub/a", "/_sub/b"})
+	created.RecursiveSubscriptionIds = []string{"/_sub/a"}
+
+	subscribed := metaevents.NewSubscribed("/_sub/c")
+	subscribed.Recursive = true
+
+	for _, line := range []string{
+		created.Serialize(),
+		subscribed.Serialize(),
+		metaevents.NewUnsubscribed("/_sub/a").Serialize(),
+	} {
+		plan.scanLine("/tenants", strings.TrimRight(line, "\n"))
+	}
+
+	ass.EqualString(t, strings.Join(plan.streams["/tenants"].Subscriptions, ","), "/_sub/b,/_sub/c")
+	ass.EqualString(t, strings.Join(plan.streams["/tenants"].Recursive, ","), "/_sub/c")
+}
+
+func TestRecoverStreams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "writer_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// lost its disk
+	e := openTestWriter(dir)
+	defer closeTestWriter(e)
+
+	store := newTestScalableStore()
+	for _, key := range []string{"/_/0.log", "/_/1.log", "/tenants/_/0.log", "/tenants/_/1.log", "/_sub/_/0.log"} {
+		store.objects[key] = []byte("data")
+	}
+
+	plan, err := listSealedChunks(store)
+	ass.True(t, err == nil)
+
+	// what planRecovery() would have found from the chunks' content
+	scanLines := func(streamName string, lines ...string) {
+		for _, line := range lines {
+			plan.scanLine(streamName, strings.TrimRight(line, "\n"))
+		}
+	}
+
+	created := metaevents.NewCreated([]string{"/_sub/a", "/_sub/b"})
+	created.RecursiveSubscriptionIds = []string{"/_sub/a"}
+	created.SubscriptionActivityIntervals = map[string]int64{"/_sub/a": 60000}
+
+	subscribed := metaevents.NewSubscribed("/_sub/c")
+	subscribed.Filter = &metaevents.SubscriptionFilter{EventTypes: []string{"OrderPlaced"}}
+	subscribed.ActivityIntervalMs = 1000
+
+	scanLines("/",
+		metaevents.NewCreated([]string{}).Serialize(),
+		metaevents.NewChildStreamCreated("/_sub", "/_sub:0:0").Serialize(),
+		metaevents.NewChildStreamCreated("/tenants", "/tenants:0:0").Serialize())
+
+	scanLines("/tenants",
+		created.Serialize(),
+		" order 1",
+		subscribed.Serialize(),
+		metaevents.NewUnsubscribed("/_sub/b").Serialize(),
+		metaevents.NewChildStreamCreated("/tenants/foo", "/tenants/foo:0:0").Serialize())
+
+	ass.True(t, e.recoverStreams(plan, nil) == nil)
+
+	shipper := e.shipper.(*testShipper)
+
+	for streamName, lostChunk := range map[string]int{"/": 2, "/tenants": 2, "/_sub": 1, "/tenants/foo": 0, "/_sub/a": 0} {
+		info, err := e.StreamInfo(streamName)
+		ass.True(t, err == nil)
+		ass.EqualInt(t, cursor.CursorFromserializedMust(info.Head).Chunk, lostChunk+1)
+
+		lostChunkPath := cursor.New(streamName, lostChunk, 0, cursor.NoServer).ToChunkPath()
+
+		filePath, shipped := shipper.shippedFiles[lostChunkPath]
+		ass.True(t, shipped)
+
+		content, err := ioutil.ReadFile(filePath)
+		ass.True(t, err == nil)
+		ass.True(t, strings.HasPrefix(string(content), "/Created "))
+		ass.True(t, strings.Contains(string(content), "\n/LiveChunkLost "))
+		ass.True(t, strings.Contains(string(content), "\n/Rotated "))
+	}
+
+	ass.True(t, e.database.View(func(boltTx *bolt.Tx) error {
+		ass.EqualString(t, strings.Join(getSubscriptionsForStream("/tenants", boltTx), ","), "/_sub/a,/_sub/c")
+		ass.EqualString(t, strings.Join(getRecursiveSubscriptionsForStream("/tenants", boltTx), ","), "/_sub/a")
+
+		filters := getSubscriptionFiltersForStream("/tenants", boltTx)
+		ass.EqualInt(t, len(filters), 1)
+		ass.EqualString(t, strings.Join(filters["/_sub/c"].EventTypes, ","), "OrderPlaced")
+
+		intervals := getSubscriptionActivityIntervalsForStream("/tenants", boltTx)
+		ass.EqualInt(t, len(intervals), 2)
+		ass.EqualInt(t, int(intervals["/_sub/a"]), 60000)
+		ass.EqualInt(t, int(intervals["/_sub/c"]), 1000)
+
+		ass.EqualInt(t, len(getSubscriptionsForStream("/tenants/foo", boltTx)), 0)
+
+		return nil
+	}) == nil)
+
+	// the live chunk carries them on as well
+	firstLine := strings.SplitN(readLiveChunk(t, e, "/tenants/_/3.log"), "\n", 2)[0]
+	metaType, _, event := metaevents.Parse(firstLine)
+	ass.EqualString(t, metaType, metaevents.CreatedId)
+
+	liveCreated := event.(metaevents.Created)
+	ass.EqualString(t, strings.Join(liveCreated.SubscriptionIds, ","), "/_sub/a,/_sub/c")
+	ass.EqualString(t, strings.Join(liveCreated.RecursiveSubscriptionIds, ","), "/_sub/a")
+	ass.EqualString(t, strings.Join(liveCreated.SubscriptionFilters["/_sub/c"].EventTypes, ","), "OrderPlaced")
+	ass.EqualInt(t, int(liveCreated.SubscriptionActivityIntervals["/_sub/a"]), 60000)
+
+	ass.True(t, e.database.View(func(boltTx *bolt.Tx) error {
+		stats, err := getStreamStats("/tenants", boltTx)
+		ass.True(t, err == nil)
+		ass.EqualInt(t, int(stats.LineCount), 1)
+		ass.EqualInt(t, stats.ChunkCount, 4)
+		return nil
+	}) == nil)
+
+	appendExpecting := func(expectedOffset string) error {
+		_, err := e.AppendToStream(&types.AppendToStreamRequest{
+			Stream:         "/tenants",
+			Lines:          []string{"order 2"},
+			ExpectedOffset: expectedOffset,
+		})
+		return err
+	}
+
+	// might have been before a lost append
+	_, isConflict := appendExpecting(cursor.New("/tenants", 3, 0, "127.0.0.1").Serialize()).(*types.AppendConflictError)
+	ass.True(t, isConflict)
+
+	info, err := e.StreamInfo("/tenants")
+	ass.True(t, err == nil)
+	ass.True(t, appendExpecting(info.Head) == nil)
+}
@@ -0,0 +1,337 @@
+package writer
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/function61/eventhorizon/config"
+	"github.com/function61/eventhorizon/writer/replication"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"github.com/function61/eventhorizon/writer/types"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*	Replicated Writer group (writer_peers, or writer_shard_peers for other shards,
+	in discovery file):
+
+	The leader replicates each transaction (EventstoreTransaction serialized as
+	JSON: its bolt writes + file writes + side effects) through Raft just before
+	committing it. Followers apply the transaction as is: bolt writes, WAL and the
+	side effects, so each Writer has the same BoltDB & chunks. Every Writer ships
+	sealed chunks itself, which is idempotent.
+
+	The index of the latest applied Raft log entry is stored in the same bolt
+	transaction, so entries that Raft gives again after a restart are skipped.
+
+	A follower too far behind gets a snapshot: a tar of BoltDB ("db") and the files
+	whose content is only on Writer's disk (like SnapshotTask, see snapshot.go).
+*/
+
+var appliedIndexKey = []byte("appliedindex")
+
+func (e *EventstoreWriter) startReplication() {
+	nodeIp := e.confCtx.GetWriterNodeIp()
+
+	node, err := replication.New(replication.Config{
+		NodeIp: nodeIp,
+		Peers:  e.confCtx.WriterPeers(),
+		Port:   config.WriterRaftPort,
+		Dir:    config.WriterRaftDir,
+		Tls: &replication.TlsConfig{
+			Certificate:    e.confCtx.GetSignedCertificateFor(nodeIp),
+			CaCertificates: e.confCtx.GetCaCertificates(),
+		},
+	}, &replicatedStateMachine{e})
+	if err != nil {
+		log.Fatalf("EventstoreWriter: replication: %s", err.Error())
+	}
+
+	e.replication = node
+}
+
+// true if this Writer accepts writes. always true if not replicated
+func (e *EventstoreWriter) IsLeader() bool {
+	return e.replication == nil || e.replication.IsLeader()
+}
+
+// IP of the Writer that accepts writes. empty if there is no leader currently
+func (e *EventstoreWriter) LeaderIp() string {
+	if e.replication == nil {
+		return e.confCtx.GetWriterNodeIp()
+	}
+
+	return e.replication.LeaderIp()
+}
+
+// call from within update(), after the transaction is otherwise ready
+func (e *EventstoreWriter) replicate(tx *transaction.EventstoreTransaction) error {
+	if e.replication == nil {
+		return nil
+	}
+
+	entry, err := json.Marshal(tx)
+	if err != nil {
+		return err
+	}
+
+	index, err := e.replication.Propose(entry)
+	if err != nil {
+		return err
+	}
+
+	return saveAppliedIndex(index, tx.BoltTx)
+}
+
+func getAppliedIndex(boltTx *bolt.Tx) uint64 {
+	replicationBucket := boltTx.Bucket([]byte("_replication"))
+	if replicationBucket == nil {
+		return 0
+	}
+
+	appliedIndex := replicationBucket.Get(appliedIndexKey)
+	if appliedIndex == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(appliedIndex)
+}
+
+// not via tx.Put(), as this is not part of the replicated transaction
+func saveAppliedIndex(index uint64, boltTx *bolt.Tx) error {
+	replicationBucket, err := boltTx.CreateBucketIfNotExists([]byte("_replication"))
+	if err != nil {
+		return err
+	}
+
+	appliedIndex := make([]byte, 8)
+	binary.BigEndian.PutUint64(appliedIndex, index)
+
+	return replicationBucket.Put(appliedIndexKey, appliedIndex)
+}
+
+type replicatedStateMachine struct {
+	writer *EventstoreWriter
+}
+
+// applies a transaction replicated by the leader
+func (r *replicatedStateMachine) Apply(index uint64, entry []byte) error {
+	e := r.writer
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	alreadyApplied := false
+	if err := e.database.View(func(boltTx *bolt.Tx) error {
+		alreadyApplied = index <= getAppliedIndex(boltTx)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if alreadyApplied {
+		return nil
+	}
+
+	tx := transaction.NewEventstoreTransaction(e.database)
+	if err := json.Unmarshal(entry, tx); err != nil {
+		return err
+	}
+
+	if err := e.updateLocal(tx, func() error {
+		if err := tx.ApplyBoltWrites(); err != nil {
+			return err
+		}
+
+		return saveAppliedIndex(index, tx.BoltTx)
+	}); err != nil {
+		return err
+	}
+
+	return e.applySideEffects(tx)
+}
+
+func (r *replicatedStateMachine) Snapshot() (replication.Snapshot, error) {
+	return &replicationSnapshot{r.writer}, nil
+}
+
+// replaces BoltDB and the live files with the leader's
+func (r *replicatedStateMachine) Restore(snapshot io.Reader) error {
+	e := r.writer
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// shipments update the database we're about to close
+	e.shipper.Close()
+
+	tx := transaction.NewEventstoreTransaction(e.database)
+
+	e.walManager.Close(tx)
+
+	if err := e.applySideEffects(tx); err != nil {
+		return err
+	}
+
+	if err := e.database.Close(); err != nil {
+		return err
+	}
+
+	for _, path := range []string{dbLocation, config.WalManagerDataDir, config.WalSegmentsDir} {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+
+	restoredFiles, err := extractReplicationSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("EventstoreWriter: restored BoltDB and %d file(s) from the leader's snapshot", restoredFiles)
+
+	e.streamToChunkName = map[string]*types.ChunkSpec{}
+
+	e.openDatabase()
+
+	return nil
+}
+
+// creates the built-in streams if this is a new group
+func (r *replicatedStateMachine) BecameLeader() {
+	e := r.writer
+
+	// they live on writer_ip's shard
+	if !e.ownsStream("/") {
+		return
+	}
+
+	for _, streamName := range []string{"/", "/_sub"} {
+		e.mu.RLock()
+		exists := e.streamExists(streamName, nil)
+		e.mu.RUnlock()
+
+		if exists {
+			continue
+		}
+
+		if _, err := e.CreateStream(&types.CreateStreamRequest{Name: streamName}); err != nil {
+			log.Printf("EventstoreWriter: failed to create built-in stream %s: %s", streamName, err.Error())
+			return
+		}
+	}
+}
+
+type replicationSnapshot struct {
+	writer *EventstoreWriter
+}
+
+// taken when persisting, which is fine as the state being newer than Raft
+// thinks only makes us skip entries we already have
+func (s *replicationSnapshot) Persist(sink io.Writer) error {
+	e := s.writer
+
+	// same consistency dance as in SnapshotTask
+	e.mu.RLock()
+
+	boltTx, err := e.database.Begin(false)
+	if err != nil {
+		e.mu.RUnlock()
+		return err
+	}
+
+	files, err := e.snapshotFiles(boltTx)
+
+	e.mu.RUnlock()
+
+	defer func() {
+		for _, file := range files {
+			file.fd.Close()
+		}
+	}()
+
+	dbContent := &bytes.Buffer{}
+	if err == nil {
+		_, err = boltTx.WriteTo(dbContent)
+	}
+
+	boltTx.Rollback()
+
+	if err != nil {
+		return err
+	}
+
+	archive := tar.NewWriter(sink)
+
+	if err := archive.WriteHeader(&tar.Header{Name: "db", Mode: 0600, Size: int64(dbContent.Len())}); err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(archive, dbContent); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err := archive.WriteHeader(&tar.Header{Name: file.Path, Mode: 0644, Size: file.Length}); err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(archive, io.NewSectionReader(file.fd, 0, file.Length)); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+func (s *replicationSnapshot) Release() {}
+
+func extractReplicationSnapshot(snapshot io.Reader) (int, error) {
+	archive := tar.NewReader(snapshot)
+
+	restoredFiles := 0
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return restoredFiles, nil
+		}
+		if err != nil {
+			return restoredFiles, err
+		}
+
+		path := header.Name
+		if path == "db" {
+			path = dbLocation
+		} else if !strings.HasPrefix(filepath.Clean(path), config.WalManagerDataDir+"/") {
+			return restoredFiles, errors.New(fmt.Sprintf("EventstoreWriter: unexpected file in snapshot: %s", path))
+		} else {
+			restoredFiles++
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return restoredFiles, err
+		}
+
+		fd, err := os.Create(path)
+		if err != nil {
+			return restoredFiles, err
+		}
+
+		if _, err := io.Copy(fd, archive); err != nil {
+			fd.Close()
+			return restoredFiles, err
+		}
+
+		if err := fd.Close(); err != nil {
+			return restoredFiles, err
+		}
+	}
+}
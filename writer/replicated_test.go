@@ -0,0 +1,44 @@
+package writer
+
+import (
+	"encoding/json"
+	"github.com/function61/eventhorizon/util/ass"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"github.com/function61/eventhorizon/writer/types"
+	"testing"
+)
+
+func TestReplicatedTransactionAppliesBoltWrites(t *testing.T) {
+	var entry []byte
+
+	// leader
+	withTestDatabase(t, func(tx *transaction.EventstoreTransaction) error {
+		ass.True(t, saveStreamSettings("/foo", &types.StreamSettings{ChunkSize: 1024 * 1024}, tx) == nil)
+		ass.True(t, saveTombstone("/bar", "deleted", tx) == nil)
+		ass.True(t, tx.Put("_streams", []byte("/baz"), []byte("{}")) == nil)
+		ass.True(t, tx.Delete("_streams", []byte("/baz")) == nil)
+
+		var err error
+		entry, err = json.Marshal(tx)
+		return err
+	})
+
+	// follower
+	withTestDatabase(t, func(tx *transaction.EventstoreTransaction) error {
+		ass.True(t, getAppliedIndex(tx.BoltTx) == 0)
+
+		ass.True(t, json.Unmarshal(entry, tx) == nil)
+		ass.True(t, tx.ApplyBoltWrites() == nil)
+		ass.True(t, saveAppliedIndex(42, tx.BoltTx) == nil)
+
+		settings, err := getStreamSettings("/foo", tx.BoltTx)
+		ass.True(t, err == nil)
+		ass.EqualInt(t, settings.ChunkSize, 1024*1024)
+
+		ass.True(t, isTombstoned("/bar", tx.BoltTx))
+		ass.True(t, tx.BoltTx.Bucket([]byte("_streams")).Get([]byte("/baz")) == nil)
+		ass.True(t, getAppliedIndex(tx.BoltTx) == 42)
+
+		return nil
+	})
+}
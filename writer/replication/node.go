@@ -0,0 +1,344 @@
+package replication
+
+import (
+	"errors"
+	"fmt"
+	"github.com/function61/eventhorizon/util/cryptorandombytes"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Replicates entries (Writer's transactions) to a group of Writers with Raft.
+// The leader proposes an entry, which returns once a majority of the group has
+// it, and applies the entry itself. Other nodes get the entry given to their
+// StateMachine, in log order.
+//
+// Entries proposed by this process are not given to the StateMachine, as the
+// proposer applies them itself. Entries look like:
+//
+//	proposer id length (1 B) | proposer id | entry
+//
+// After a leader change, the new leader only accepts proposals after it has
+// applied all entries of the previous terms (see IsLeader()).
+
+var ErrNotLeader = errors.New("replication: not the leader")
+
+const (
+	logCacheSize      = 512
+	retainSnapshots   = 2
+	maxPool           = 3
+	transportTimeout  = 10 * time.Second
+	enqueueTimeout    = 10 * time.Second
+	snapshotThreshold = 16384
+)
+
+type StateMachine interface {
+	// entries are given again after a restart, from the latest snapshot on, so
+	// the StateMachine must skip the ones it has already applied. an error is fatal
+	Apply(index uint64, entry []byte) error
+	// called when the log is compacted. the state may already be newer than
+	// the latest applied entry
+	Snapshot() (Snapshot, error)
+	// replaces the state with one given by another node's snapshot
+	Restore(snapshot io.Reader) error
+	// we're the leader and have applied all entries of the previous terms
+	BecameLeader()
+}
+
+type Snapshot interface {
+	Persist(sink io.Writer) error
+	Release()
+}
+
+type Config struct {
+	NodeIp string
+	Peers  []string // IPs of all nodes in the group, including this one
+	Port   int
+	Dir    string
+	Tls    *TlsConfig
+}
+
+type proposal struct {
+	index uint64 // set when the entry was committed
+}
+
+type Node struct {
+	raft       *raft.Raft
+	sm         StateMachine
+	proposerId string
+	mu         sync.Mutex
+	seq        uint64
+	proposals  map[string]*proposal
+	readyTerm  uint64 // atomic. term in which we became leader & applied previous terms' entries
+	stop       chan bool
+	done       chan bool
+}
+
+func New(conf Config, sm StateMachine) (*Node, error) {
+	if err := os.MkdirAll(conf.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	store, err := raftboltdb.NewBoltStore(filepath.Join(conf.Dir, "raft.boltdb"))
+	if err != nil {
+		return nil, err
+	}
+
+	logs, err := raft.NewLogCache(logCacheSize, store)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := raft.NewFileSnapshotStore(conf.Dir, retainSnapshots, log.Writer())
+	if err != nil {
+		return nil, err
+	}
+
+	streamLayer, err := newTlsStreamLayer(conf.NodeIp, conf.Port, conf.Tls)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := raft.NewNetworkTransport(streamLayer, maxPool, transportTimeout, log.Writer())
+
+	raftConf := raft.DefaultConfig()
+	raftConf.LocalID = raft.ServerID(conf.NodeIp)
+	raftConf.LogOutput = log.Writer()
+	raftConf.LogLevel = "INFO"
+	raftConf.SnapshotThreshold = snapshotThreshold
+	// our state is persistent (BoltDB + chunks), so it's not rebuilt from a snapshot
+	raftConf.NoSnapshotRestoreOnStart = true
+
+	servers := []raft.Server{}
+	for _, peer := range conf.Peers {
+		servers = append(servers, raft.Server{
+			ID:      raft.ServerID(peer),
+			Address: raft.ServerAddress(fmt.Sprintf("%s:%d", peer, conf.Port)),
+		})
+	}
+
+	return newNode(raftConf, sm, logs, store, snapshots, transport, servers)
+}
+
+func newNode(
+	raftConf *raft.Config,
+	sm StateMachine,
+	logs raft.LogStore,
+	stable raft.StableStore,
+	snapshots raft.SnapshotStore,
+	transport raft.Transport,
+	servers []raft.Server,
+) (*Node, error) {
+	hasState, err := raft.HasExistingState(logs, stable, snapshots)
+	if err != nil {
+		return nil, err
+	}
+
+	// every node is given the same configuration, so it does not matter who starts first
+	if !hasState {
+		log.Printf("Replication: bootstrapping group of %d node(s)", len(servers))
+
+		if err := raft.BootstrapCluster(raftConf, logs, stable, snapshots, transport, raft.Configuration{
+			Servers: servers,
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	n := &Node{
+		sm:         sm,
+		proposerId: cryptorandombytes.Hex(8),
+		proposals:  map[string]*proposal{},
+		stop:       make(chan bool),
+		done:       make(chan bool),
+	}
+
+	n.raft, err = raft.NewRaft(raftConf, (*fsm)(n), logs, stable, snapshots, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// entries are applied as soon as the node is created, but we only start
+// leading (accepting proposals) after this
+func (n *Node) Start() {
+	go n.watchLeadership()
+}
+
+// replicates the entry to a majority of the group. returns the entry's index
+// in the log. on error, the entry may or may not get applied by the group later
+func (n *Node) Propose(entry []byte) (uint64, error) {
+	if !n.IsLeader() {
+		return 0, ErrNotLeader
+	}
+
+	n.mu.Lock()
+	n.seq++
+	id := fmt.Sprintf("%s.%d", n.proposerId, n.seq)
+	p := &proposal{}
+	n.proposals[id] = p
+	n.mu.Unlock()
+
+	err := n.raft.Apply(encodeEntry(id, entry), enqueueTimeout).Error()
+
+	n.mu.Lock()
+	delete(n.proposals, id)
+	index := p.index
+	n.mu.Unlock()
+
+	// the entry can be committed even though we were told otherwise (e.g. we
+	// lost leadership just after). we must then apply it, as our state machine
+	// was told to skip it
+	if index != 0 {
+		return index, nil
+	}
+
+	if err == nil {
+		err = errors.New("replication: entry was not committed")
+	}
+
+	return 0, err
+}
+
+// true if we're the leader and have applied all entries of the previous terms
+func (n *Node) IsLeader() bool {
+	return n.raft.State() == raft.Leader && atomic.LoadUint64(&n.readyTerm) == n.raft.CurrentTerm()
+}
+
+// empty if there is no leader currently
+func (n *Node) LeaderIp() string {
+	_, id := n.raft.LeaderWithID()
+	return string(id)
+}
+
+// must be started
+func (n *Node) Close() error {
+	log.Printf("Replication: stopping")
+
+	// first, so an ongoing barrier returns
+	err := n.raft.Shutdown().Error()
+
+	n.stop <- true
+
+	<-n.done
+
+	log.Printf("Replication: stopped")
+
+	return err
+}
+
+func (n *Node) watchLeadership() {
+	for {
+		select {
+		case <-n.stop:
+			n.done <- true
+			return
+		case isLeader := <-n.raft.LeaderCh():
+			if !isLeader {
+				log.Printf("Replication: lost leadership")
+				continue
+			}
+
+			term := n.raft.CurrentTerm()
+
+			log.Printf("Replication: became leader for term %d. applying previous terms' entries", term)
+
+			// an entry committed in our term is preceded by all previous terms' entries
+			if err := n.raft.Barrier(0).Error(); err != nil {
+				log.Printf("Replication: barrier failed: %s", err.Error())
+				continue
+			}
+
+			atomic.StoreUint64(&n.readyTerm, term)
+
+			log.Printf("Replication: ready to lead term %d", term)
+
+			n.sm.BecameLeader()
+		}
+	}
+}
+
+func encodeEntry(proposalId string, entry []byte) []byte {
+	return append(append([]byte{byte(len(proposalId))}, proposalId...), entry...)
+}
+
+func decodeEntry(data []byte) (string, []byte, error) {
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return "", nil, fmt.Errorf("replication: entry too short (%d bytes)", len(data))
+	}
+
+	idLen := int(data[0])
+
+	return string(data[1 : 1+idLen]), data[1+idLen:], nil
+}
+
+// adapts Node to raft.FSM. raft calls these from one goroutine
+type fsm Node
+
+func (f *fsm) Apply(entry *raft.Log) interface{} {
+	proposalId, data, err := decodeEntry(entry.Data)
+	if err != nil {
+		panic(err)
+	}
+
+	f.mu.Lock()
+	p, proposedByUs := f.proposals[proposalId]
+	if proposedByUs {
+		p.index = entry.Index
+	}
+	f.mu.Unlock()
+
+	if proposedByUs {
+		return nil
+	}
+
+	// followers cannot continue with state that differs from the leader's
+	if err := f.sm.Apply(entry.Index, data); err != nil {
+		panic(fmt.Errorf("replication: failed to apply entry %d: %s", entry.Index, err.Error()))
+	}
+
+	return nil
+}
+
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	snapshot, err := f.sm.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	return &fsmSnapshot{snapshot}, nil
+}
+
+func (f *fsm) Restore(snapshot io.ReadCloser) error {
+	defer snapshot.Close()
+
+	log.Printf("Replication: restoring snapshot from the leader")
+
+	return f.sm.Restore(snapshot)
+}
+
+type fsmSnapshot struct {
+	snapshot Snapshot
+}
+
+func (f *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := f.snapshot.Persist(sink); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	return sink.Close()
+}
+
+func (f *fsmSnapshot) Release() {
+	f.snapshot.Release()
+}
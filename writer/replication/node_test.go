@@ -0,0 +1,306 @@
+package replication
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/function61/eventhorizon/util/ass"
+	"github.com/hashicorp/raft"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// in-process group of nodes over raft's in-memory transport. a node's stores and
+// state machine survive kill() & start(), like they would on disk
+
+type testStateMachine struct {
+	mu        sync.Mutex
+	LastIndex uint64
+	Entries   []string
+}
+
+func (s *testStateMachine) Apply(index uint64, entry []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if index <= s.LastIndex {
+		return nil
+	}
+
+	s.LastIndex = index
+	s.Entries = append(s.Entries, string(entry))
+
+	return nil
+}
+
+func (s *testStateMachine) Snapshot() (Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	content, err := json.Marshal(s)
+	return testSnapshot(content), err
+}
+
+func (s *testStateMachine) Restore(snapshot io.Reader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return json.NewDecoder(snapshot).Decode(s)
+}
+
+func (s *testStateMachine) BecameLeader() {}
+
+func (s *testStateMachine) content() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return strings.Join(s.Entries, ",")
+}
+
+type testSnapshot []byte
+
+func (t testSnapshot) Persist(sink io.Writer) error {
+	_, err := sink.Write(t)
+	return err
+}
+
+func (t testSnapshot) Release() {}
+
+type testNode struct {
+	addr      raft.ServerAddress
+	sm        *testStateMachine
+	store     *raft.InmemStore
+	snapshots *raft.InmemSnapshotStore
+	transport *raft.InmemTransport
+	node      *Node // nil when killed
+}
+
+type testCluster struct {
+	t            *testing.T
+	nodes        []*testNode
+	trailingLogs uint64
+}
+
+func newTestCluster(t *testing.T, size int, trailingLogs uint64) *testCluster {
+	c := &testCluster{t: t, trailingLogs: trailingLogs}
+
+	for i := 0; i < size; i++ {
+		c.nodes = append(c.nodes, &testNode{
+			addr:      raft.ServerAddress(fmt.Sprintf("10.0.0.%d", i+1)),
+			sm:        &testStateMachine{Entries: []string{}},
+			store:     raft.NewInmemStore(),
+			snapshots: raft.NewInmemSnapshotStore(),
+		})
+	}
+
+	for _, n := range c.nodes {
+		c.start(n)
+	}
+
+	return c
+}
+
+func (c *testCluster) start(n *testNode) {
+	_, n.transport = raft.NewInmemTransport(n.addr)
+
+	servers := []raft.Server{}
+
+	for _, other := range c.nodes {
+		servers = append(servers, raft.Server{ID: raft.ServerID(other.addr), Address: other.addr})
+
+		if other == n || other.node == nil {
+			continue
+		}
+
+		n.transport.Connect(other.addr, other.transport)
+		other.transport.Connect(n.addr, n.transport)
+	}
+
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(n.addr)
+	conf.HeartbeatTimeout = 50 * time.Millisecond
+	conf.ElectionTimeout = 50 * time.Millisecond
+	conf.LeaderLeaseTimeout = 50 * time.Millisecond
+	conf.CommitTimeout = 5 * time.Millisecond
+	conf.TrailingLogs = c.trailingLogs
+	conf.SnapshotInterval = time.Hour // only when asked
+	conf.NoSnapshotRestoreOnStart = true
+	conf.LogOutput = ioutil.Discard
+
+	node, err := newNode(conf, n.sm, n.store, n.store, n.snapshots, n.transport, servers)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	node.Start()
+
+	n.node = node
+}
+
+func (c *testCluster) kill(n *testNode) {
+	for _, other := range c.nodes {
+		if other != n && other.node != nil {
+			other.transport.Disconnect(n.addr)
+		}
+	}
+
+	if err := n.node.Close(); err != nil {
+		c.t.Fatal(err)
+	}
+
+	n.transport.Close()
+	n.node = nil
+}
+
+func (c *testCluster) close() {
+	for _, n := range c.nodes {
+		if n.node != nil {
+			c.kill(n)
+		}
+	}
+}
+
+func (c *testCluster) waitForLeader() *testNode {
+	var leader *testNode
+
+	c.waitFor("leader", func() bool {
+		for _, n := range c.nodes {
+			if n.node != nil && n.node.IsLeader() {
+				leader = n
+				return true
+			}
+		}
+
+		return false
+	})
+
+	return leader
+}
+
+func (c *testCluster) waitFor(what string, condition func() bool) {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		if condition() {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c.t.Fatalf("timed out waiting for %s", what)
+}
+
+// every node, including killed ones, has the content
+func (c *testCluster) waitForContent(content string) {
+	c.waitFor("content "+content, func() bool {
+		for _, n := range c.nodes {
+			if n.sm.content() != content {
+				return false
+			}
+		}
+
+		return true
+	})
+}
+
+// like Writer does: proposer applies the entry itself
+func propose(t *testing.T, n *testNode, entry string) {
+	index, err := n.node.Propose([]byte(entry))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := n.sm.Apply(index, []byte(entry)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLeaderKills(t *testing.T) {
+	c := newTestCluster(t, 3, 10240)
+	defer c.close()
+
+	first := c.waitForLeader()
+
+	propose(t, first, "a")
+	propose(t, first, "b")
+
+	c.waitForContent("a,b")
+
+	c.kill(first)
+
+	second := c.waitForLeader()
+	ass.True(t, second != first)
+
+	propose(t, second, "c")
+
+	c.kill(second)
+
+	// 1 of 3 cannot make progress
+	time.Sleep(300 * time.Millisecond)
+	for _, n := range c.nodes {
+		if n.node != nil {
+			ass.False(t, n.node.IsLeader())
+		}
+	}
+
+	c.start(first)
+
+	third := c.waitForLeader()
+
+	propose(t, third, "d")
+
+	c.start(second)
+
+	c.waitForContent("a,b,c,d")
+}
+
+func TestProposeOnFollower(t *testing.T) {
+	c := newTestCluster(t, 3, 10240)
+	defer c.close()
+
+	leader := c.waitForLeader()
+
+	for _, n := range c.nodes {
+		if n == leader {
+			continue
+		}
+
+		_, err := n.node.Propose([]byte("x"))
+		ass.True(t, err == ErrNotLeader)
+		ass.EqualString(t, n.node.LeaderIp(), string(leader.addr))
+	}
+}
+
+func TestLaggingNodeGetsSnapshot(t *testing.T) {
+	c := newTestCluster(t, 3, 1)
+	defer c.close()
+
+	leader := c.waitForLeader()
+
+	var lagging *testNode
+	for _, n := range c.nodes {
+		if n != leader {
+			lagging = n
+		}
+	}
+
+	c.kill(lagging)
+
+	expected := []string{}
+	for i := 0; i < 20; i++ {
+		entry := fmt.Sprintf("%d", i)
+		propose(t, leader, entry)
+		expected = append(expected, entry)
+	}
+
+	// compacts the log, so the lagging node cannot catch up from it
+	if err := leader.node.raft.Snapshot().Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.start(lagging)
+
+	c.waitForContent(strings.Join(expected, ","))
+}
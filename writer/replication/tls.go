@@ -0,0 +1,81 @@
+package replication
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/raft"
+	"net"
+	"time"
+)
+
+// nodes talk to each other over mutual TLS, with certificates signed by the
+// cluster's CA (the one in the discovery file)
+type TlsConfig struct {
+	Certificate    tls.Certificate // for this node's IP
+	CaCertificates *x509.CertPool
+}
+
+func (t *TlsConfig) tlsConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{t.Certificate},
+		RootCAs:      t.CaCertificates,
+		// verified below, because the CA restricts its certificates to server auth
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: t.verifyPeerCertificate,
+	}
+}
+
+func (t *TlsConfig) verifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("replication: peer did not present a certificate")
+	}
+
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:     t.CaCertificates,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	return err
+}
+
+// raft.StreamLayer over TLS
+type tlsStreamLayer struct {
+	net.Listener
+	advertise net.Addr
+	config    *tls.Config
+}
+
+func newTlsStreamLayer(nodeIp string, port int, conf *TlsConfig) (*tlsStreamLayer, error) {
+	advertise, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", nodeIp, port))
+	if err != nil {
+		return nil, err
+	}
+
+	config := conf.tlsConfig()
+
+	listener, err := tls.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", port), config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tlsStreamLayer{
+		Listener:  listener,
+		advertise: advertise,
+		config:    config,
+	}, nil
+}
+
+// other nodes dial this, not the address we listen on
+func (t *tlsStreamLayer) Addr() net.Addr {
+	return t.advertise
+}
+
+func (t *tlsStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", string(address), t.config)
+}
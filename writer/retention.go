@@ -0,0 +1,117 @@
+package writer
+
+import (
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"github.com/function61/eventhorizon/writer/types"
+	"time"
+)
+
+/*	_retentionpolicies:
+		/telemetry => {"MaxAgeSeconds": 604800, "Recursive": true, ..}
+		/telemetry/noisy => {"MaxChunks": 10, ..}
+*/
+
+func saveRetentionPolicy(streamName string, policy *types.RetentionPolicy, tx *transaction.EventstoreTransaction) error {
+	if policy.IsUnlimited() {
+		return tx.Delete("_retentionpolicies", []byte(streamName))
+	}
+
+	policyJson, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+
+	return tx.Put("_retentionpolicies", []byte(streamName), policyJson)
+}
+
+// stream's own policy, nil if none
+func getRetentionPolicy(streamName string, tx *bolt.Tx) (*types.RetentionPolicy, error) {
+	policiesBucket := tx.Bucket([]byte("_retentionpolicies"))
+	if policiesBucket == nil {
+		return nil, nil
+	}
+
+	policyJson := policiesBucket.Get([]byte(streamName))
+	if policyJson == nil {
+		return nil, nil
+	}
+
+	policy := &types.RetentionPolicy{}
+	if err := json.Unmarshal(policyJson, policy); err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+// stream's own policy wins. otherwise the closest ancestor's recursive policy
+// applies. returns nil if none
+func getEffectiveRetentionPolicy(streamName string, tx *bolt.Tx) (*types.RetentionPolicy, error) {
+	policiesBucket := tx.Bucket([]byte("_retentionpolicies"))
+	if policiesBucket == nil {
+		return nil, nil
+	}
+
+	for current := streamName; ; current = parentStreamName(current) {
+		if policyJson := policiesBucket.Get([]byte(current)); policyJson != nil {
+			policy := &types.RetentionPolicy{}
+			if err := json.Unmarshal(policyJson, policy); err != nil {
+				return nil, err
+			}
+
+			if current == streamName || policy.Recursive {
+				return policy, nil
+			}
+		}
+
+		if current == parentStreamName(current) { // reached root
+			return nil, nil
+		}
+	}
+}
+
+type sealedChunk struct {
+	Number   int
+	Size     int64
+	SealedAt time.Time
+}
+
+// chunks must be sorted from oldest to newest. returns how many of the oldest
+// chunks have expired. always a prefix, so the stream's earliest valid position
+// is the beginning of the first non-expired chunk
+func countExpiredChunks(chunks []sealedChunk, policy *types.RetentionPolicy, now time.Time) int {
+	expired := 0
+
+	if policy.MaxChunks > 0 && len(chunks) > policy.MaxChunks {
+		expired = len(chunks) - policy.MaxChunks
+	}
+
+	if policy.MaxTotalBytes > 0 {
+		totalBytes := int64(0)
+		for _, chunk := range chunks {
+			totalBytes += chunk.Size
+		}
+
+		for idx := 0; idx < len(chunks) && totalBytes > policy.MaxTotalBytes; idx++ {
+			totalBytes -= chunks[idx].Size
+
+			if idx+1 > expired {
+				expired = idx + 1
+			}
+		}
+	}
+
+	if policy.MaxAgeSeconds > 0 {
+		maxAge := time.Duration(policy.MaxAgeSeconds) * time.Second
+
+		for idx := 0; idx < len(chunks) && now.Sub(chunks[idx].SealedAt) > maxAge; idx++ {
+			if idx+1 > expired {
+				expired = idx + 1
+			}
+		}
+	}
+
+	return expired
+}
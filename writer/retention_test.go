@@ -0,0 +1,89 @@
+package writer
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/function61/eventhorizon/util/ass"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"github.com/function61/eventhorizon/writer/types"
+	"testing"
+	"time"
+)
+
+func TestCountExpiredChunks(t *testing.T) {
+	now := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	chunks := []sealedChunk{
+		{Number: 0, Size: 100, SealedAt: now.Add(-72 * time.Hour)},
+		{Number: 1, Size: 100, SealedAt: now.Add(-48 * time.Hour)},
+		{Number: 2, Size: 100, SealedAt: now.Add(-24 * time.Hour)},
+		{Number: 3, Size: 100, SealedAt: now.Add(-1 * time.Hour)},
+	}
+
+	count := func(policy types.RetentionPolicy) int {
+		return countExpiredChunks(chunks, &policy, now)
+	}
+
+	ass.EqualInt(t, count(types.RetentionPolicy{}), 0)
+	ass.EqualInt(t, count(types.RetentionPolicy{MaxChunks: 4}), 0)
+	ass.EqualInt(t, count(types.RetentionPolicy{MaxChunks: 1}), 3)
+	ass.EqualInt(t, count(types.RetentionPolicy{MaxTotalBytes: 250}), 2)
+	ass.EqualInt(t, count(types.RetentionPolicy{MaxAgeSeconds: 36 * 3600}), 2)
+
+	// the strictest limit wins
+	ass.EqualInt(t, count(types.RetentionPolicy{MaxChunks: 3, MaxAgeSeconds: 36 * 3600}), 2)
+	ass.EqualInt(t, count(types.RetentionPolicy{MaxChunks: 1, MaxAgeSeconds: 36 * 3600}), 3)
+}
+
+func TestGetEffectiveRetentionPolicy(t *testing.T) {
+	withTestDatabase(t, func(tx *transaction.EventstoreTransaction) error {
+		policy, _ := getEffectiveRetentionPolicy("/telemetry/foo", tx.BoltTx)
+		ass.True(t, policy == nil)
+
+		if err := saveRetentionPolicy("/telemetry", &types.RetentionPolicy{MaxChunks: 10, Recursive: true}, tx); err != nil {
+			return err
+		}
+		if err := saveRetentionPolicy("/telemetry/noisy", &types.RetentionPolicy{MaxChunks: 2}, tx); err != nil {
+			return err
+		}
+		if err := saveRetentionPolicy("/audit", &types.RetentionPolicy{MaxChunks: 5}, tx); err != nil {
+			return err
+		}
+
+		policy, _ = getEffectiveRetentionPolicy("/telemetry/foo/bar", tx.BoltTx)
+		ass.EqualInt(t, policy.MaxChunks, 10)
+
+		policy, _ = getEffectiveRetentionPolicy("/telemetry/noisy", tx.BoltTx)
+		ass.EqualInt(t, policy.MaxChunks, 2)
+
+		// not recursive
+		policy, _ = getEffectiveRetentionPolicy("/audit/foo", tx.BoltTx)
+		ass.True(t, policy == nil)
+
+		// unlimited policy removes
+		if err := saveRetentionPolicy("/telemetry", &types.RetentionPolicy{}, tx); err != nil {
+			return err
+		}
+
+		policy, _ = getEffectiveRetentionPolicy("/telemetry/foo", tx.BoltTx)
+		ass.True(t, policy == nil)
+
+		return nil
+	})
+}
+
+func TestDeletedStreamForgetsRetentionPolicy(t *testing.T) {
+	e, cleanup := newTestWriter(t)
+	defer cleanup()
+
+	_, err := e.CreateStream(&types.CreateStreamRequest{Name: "/foo"})
+	ass.True(t, err == nil)
+	ass.True(t, e.SetRetentionPolicy("/foo", &types.RetentionPolicy{MaxChunks: 1}) == nil)
+
+	ass.True(t, e.DeleteStream("/foo", true) == nil)
+
+	ass.True(t, e.database.View(func(boltTx *bolt.Tx) error {
+		policy, err := getRetentionPolicy("/foo", boltTx)
+		ass.True(t, err == nil && policy == nil)
+		return nil
+	}) == nil)
+}
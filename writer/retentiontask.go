@@ -0,0 +1,221 @@
+package writer
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/function61/eventhorizon/config"
+	"github.com/function61/eventhorizon/cursor"
+	"github.com/function61/eventhorizon/metaevents"
+	"github.com/function61/eventhorizon/scalablestore"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"github.com/function61/eventhorizon/writer/types"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Periodically enforces retention policies:
+//
+// - For each stream that has an effective retention policy
+// - List its sealed chunks from scalablestore
+// - Write a truncation marker (the new earliest valid cursor) to scalablestore,
+//   so readers can respond with a TruncatedError instead of "not found"
+// - Delete the expired chunks
+// - Append a Truncated meta event to the stream
+//
+// The live chunk is never expired. The writer lock is only held for finding the
+// streams and for appending the Truncated event, not while talking to scalablestore.
+
+type RetentionTask struct {
+	writer    *EventstoreWriter
+	s3Manager scalableStore
+	stop      chan bool
+	done      chan bool
+}
+
+// the subset of *scalablestore.S3Manager that we need. tests use an in-memory one
+type scalableStore interface {
+	List(prefix string) ([]scalablestore.ScalableStoreObject, error)
+	Put(key string, body io.ReadSeeker) error
+	Delete(key string) error
+}
+
+type retentionCandidate struct {
+	streamName      string
+	liveChunkNumber int
+	policy          *types.RetentionPolicy
+}
+
+func NewRetentionTask(writer *EventstoreWriter) *RetentionTask {
+	t := &RetentionTask{
+		writer:    writer,
+		s3Manager: scalablestore.NewS3Manager(writer.confCtx),
+		stop:      make(chan bool),
+		done:      make(chan bool),
+	}
+
+	go t.loopUntilStopped()
+
+	return t
+}
+
+func (t *RetentionTask) loopUntilStopped() {
+	for {
+		select {
+		case <-t.stop:
+			t.done <- true
+			return
+		case <-time.After(config.RetentionTaskInterval):
+			break
+		}
+
+		// leader enforces retention for the whole replicated group
+		if !t.writer.IsLeader() {
+			continue
+		}
+
+		candidates, err := t.findCandidates()
+		if err != nil {
+			log.Printf("RetentionTask: %s", err.Error())
+			continue
+		}
+
+		for _, candidate := range candidates {
+			if err := t.enforce(candidate); err != nil {
+				log.Printf("RetentionTask: %s: %s", candidate.streamName, err.Error())
+			}
+		}
+	}
+}
+
+func (t *RetentionTask) findCandidates() ([]*retentionCandidate, error) {
+	t.writer.mu.RLock()
+	defer t.writer.mu.RUnlock()
+
+	candidates := []*retentionCandidate{}
+
+	err := t.writer.database.View(func(boltTx *bolt.Tx) error {
+		for streamName, chunkSpec := range t.writer.streamToChunkName {
+			policy, err := getEffectiveRetentionPolicy(streamName, boltTx)
+			if err != nil {
+				return err
+			}
+
+			if policy == nil {
+				continue
+			}
+
+			candidates = append(candidates, &retentionCandidate{
+				streamName:      streamName,
+				liveChunkNumber: chunkSpec.ChunkNumber,
+				policy:          policy,
+			})
+		}
+
+		return nil
+	})
+
+	return candidates, err
+}
+
+func (t *RetentionTask) enforce(candidate *retentionCandidate) error {
+	chunkPathPrefix := types.ChunkPathPrefix(candidate.streamName)
+
+	objects, err := t.s3Manager.List(chunkPathPrefix)
+	if err != nil {
+		return err
+	}
+
+	chunks := []sealedChunk{}
+
+	for _, object := range objects {
+		// "/tenants/foo/_/12.log" => 12. skips the truncation marker
+		if !strings.HasSuffix(object.Key, ".log") {
+			continue
+		}
+
+		chunkNumber, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(object.Key, chunkPathPrefix), ".log"))
+		if err != nil || chunkNumber >= candidate.liveChunkNumber {
+			continue
+		}
+
+		chunks = append(chunks, sealedChunk{
+			Number:   chunkNumber,
+			Size:     object.Size,
+			SealedAt: object.LastModified,
+		})
+	}
+
+	// listing is in lexicographic order ("10.log" < "2.log")
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Number < chunks[j].Number })
+
+	expiredCount := countExpiredChunks(chunks, candidate.policy, time.Now())
+	if expiredCount == 0 {
+		return nil
+	}
+
+	earliestValid := cursor.New(candidate.streamName, chunks[expiredCount-1].Number+1, 0, cursor.NoServer)
+
+	log.Printf("RetentionTask: expiring %d chunk(s), earliest valid is now %s", expiredCount, earliestValid.Serialize())
+
+	// marker first, so readers never see a missing chunk without knowing why
+	markerJson, err := json.Marshal(&types.TruncationMarker{
+		EarliestValidCursor: earliestValid.Serialize(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := t.s3Manager.Put(types.TruncationMarkerPath(candidate.streamName), bytes.NewReader(markerJson)); err != nil {
+		return err
+	}
+
+	for _, chunk := range chunks[:expiredCount] {
+		chunkCursor := cursor.New(candidate.streamName, chunk.Number, 0, cursor.NoServer)
+
+		if err := t.s3Manager.Delete(chunkCursor.ToChunkPath()); err != nil {
+			return err
+		}
+
+		t.writer.metrics.ChunksExpiredByRetention.Inc()
+	}
+
+	return t.appendTruncated(earliestValid)
+}
+
+func (t *RetentionTask) appendTruncated(earliestValid *cursor.Cursor) error {
+	t.writer.mu.Lock()
+	defer t.writer.mu.Unlock()
+
+	// might have been deleted while we were talking to scalablestore
+	if _, exists := t.writer.streamToChunkName[earliestValid.Stream]; !exists {
+		return nil
+	}
+
+	truncated := metaevents.NewTruncated(earliestValid.Serialize())
+
+	tx := transaction.NewEventstoreTransaction(t.writer.database)
+
+	err := t.writer.update(tx, func() error {
+		return t.writer.appendToStreamInternal(earliestValid.Stream, "", truncated.Serialize(), tx)
+	})
+	if err != nil {
+		return err
+	}
+
+	return t.writer.applySideEffects(tx)
+}
+
+func (t *RetentionTask) Close() {
+	log.Printf("RetentionTask: stopping")
+
+	t.stop <- true
+
+	<-t.done
+
+	log.Printf("RetentionTask: stopped")
+}
@@ -0,0 +1,187 @@
+package writer
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"github.com/function61/eventhorizon/writer/types"
+	"log"
+	"strings"
+)
+
+/*	Streams are spread over Writer shards (see config/sharding.go). Meta events
+	for a stream on another shard (ChildStreamCreated & StreamDeleted for the
+	parent, SubscriptionActivity for the subscription stream) are queued in the
+	same transaction that produced them, and CrossShardTask delivers them to
+	the owning shard afterwards. That way we never call another shard while
+	holding our lock, and a delivery survives a crash.
+
+	_crossshardoutbox:
+		<8 byte seq> => {"Stream": "/tenants", "MetaEvent": "/ChildStreamCreated {...}\n"}
+
+	_crossshardseq:
+		next => <8 byte seq> (so a seq is never reused, even after the outbox drains)
+*/
+
+var ErrStreamNotFound = errors.New("stream does not exist")
+
+// only meta events that a Writer produces for another stream are accepted from other shards
+var crossShardMetaTypes = []string{"/ChildStreamCreated ", "/StreamDeleted ", "/SubscriptionActivity "}
+
+type crossShardMetaEvent struct {
+	Stream    string
+	MetaEvent string
+}
+
+func (e *EventstoreWriter) ownsStream(streamName string) bool {
+	return e.confCtx.GetWriterIpForStream(streamName) == e.confCtx.GetWriterIp()
+}
+
+// clients route by stream, so this only fails if they disagree with us about
+// the shards, or don't know yet that the stream was handed off
+func (e *EventstoreWriter) checkOwnership(streamName string) error {
+	if e.ownsStream(streamName) {
+		return nil
+	}
+
+	// the new owner may not have it yet
+	if e.handoffPending(streamName) {
+		return ErrHandoffInProgress
+	}
+
+	return &types.WrongWriterError{
+		Stream: streamName,
+		Writer: e.confCtx.GetWriterIpForStream(streamName),
+	}
+}
+
+// our children are in _streams, but other shards must be asked
+func (e *EventstoreWriter) checkNoChildStreamsOnOtherShards(streamName string) error {
+	for _, shard := range e.confCtx.WriterShards() {
+		if shard == e.confCtx.GetWriterIp() {
+			continue
+		}
+
+		children, err := e.shardClient.ListStreamsOnShard(shard, &types.ListStreamsRequest{Stream: streamName})
+		if err != nil {
+			return errors.New(fmt.Sprintf("failed to list child streams on Writer %s: %s", shard, err.Error()))
+		}
+
+		if len(children.Streams) > 0 {
+			return errors.New(fmt.Sprintf("stream %s has child streams on Writer %s", streamName, shard))
+		}
+	}
+
+	return nil
+}
+
+// appends the meta event now if the stream is ours, otherwise queues it for the owner
+func (e *EventstoreWriter) appendMetaToStream(streamName string, metaEventSerialized string, tx *transaction.EventstoreTransaction) error {
+	if e.ownsStream(streamName) {
+		return e.appendToStreamInternal(streamName, "", metaEventSerialized, tx)
+	}
+
+	seq := uint64(1)
+	if seqBucket := tx.BoltTx.Bucket([]byte("_crossshardseq")); seqBucket != nil {
+		if next := seqBucket.Get([]byte("next")); next != nil {
+			seq = binary.BigEndian.Uint64(next)
+		}
+	}
+
+	seqKey := make([]byte, 8)
+	binary.BigEndian.PutUint64(seqKey, seq)
+
+	nextKey := make([]byte, 8)
+	binary.BigEndian.PutUint64(nextKey, seq+1)
+
+	if err := tx.Put("_crossshardseq", []byte("next"), nextKey); err != nil {
+		return err
+	}
+
+	entryJson, err := json.Marshal(&crossShardMetaEvent{
+		Stream:    streamName,
+		MetaEvent: metaEventSerialized,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Put("_crossshardoutbox", seqKey, entryJson); err != nil {
+		return err
+	}
+
+	e.crossShard.Wake()
+
+	return nil
+}
+
+// receiving end of CrossShardTask. returns ErrStreamNotFound if the stream
+// does not exist (anymore), in which case the sender gives up
+func (e *EventstoreWriter) AppendMeta(req *types.AppendMetaRequest) error {
+	if err := e.checkOwnership(req.Stream); err != nil {
+		return err
+	}
+
+	if !isCrossShardMetaEvent(req.MetaEvent) {
+		return errors.New("AppendMeta: not a cross-shard meta event")
+	}
+
+	if req.IdempotencyKey == "" {
+		return errors.New("AppendMeta: IdempotencyKey is required")
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.streamExists(req.Stream, nil) {
+		return ErrStreamNotFound
+	}
+
+	tx := transaction.NewEventstoreTransaction(e.database)
+
+	if err := e.update(tx, func() error {
+		idempotencyKeyWindow := e.confCtx.IdempotencyKeyWindow()
+
+		replayedOutput, err := lookupIdempotencyKey(req.Stream, req.IdempotencyKey, idempotencyKeyWindow, tx.BoltTx)
+		if err != nil {
+			return err
+		}
+
+		if replayedOutput != nil {
+			return nil
+		}
+
+		if err := e.appendToStreamInternal(req.Stream, "", req.MetaEvent, tx); err != nil {
+			return err
+		}
+
+		output := &types.AppendToStreamOutput{
+			Offset: tx.AffectedStreams[req.Stream],
+		}
+
+		return saveIdempotencyKey(req.Stream, req.IdempotencyKey, output, idempotencyKeyWindow, tx)
+	}); err != nil {
+		return err
+	}
+
+	return e.applySideEffects(tx)
+}
+
+// exactly one line of a whitelisted type
+func isCrossShardMetaEvent(metaEventSerialized string) bool {
+	if strings.Count(metaEventSerialized, "\n") != 1 || !strings.HasSuffix(metaEventSerialized, "\n") {
+		return false
+	}
+
+	for _, prefix := range crossShardMetaTypes {
+		if strings.HasPrefix(metaEventSerialized, prefix) {
+			return true
+		}
+	}
+
+	log.Printf("EventstoreWriter: rejected cross-shard meta event %s", strings.TrimSpace(metaEventSerialized))
+
+	return false
+}
@@ -0,0 +1,72 @@
+package writer
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/function61/eventhorizon/config"
+	ctypes "github.com/function61/eventhorizon/config/types"
+	"github.com/function61/eventhorizon/metaevents"
+	"github.com/function61/eventhorizon/util/ass"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"testing"
+)
+
+func TestAppendMetaToStreamOnAnotherShardIsQueued(t *testing.T) {
+	e := &EventstoreWriter{
+		confCtx: config.NewContext(&ctypes.DiscoveryFile{
+			WriterIp:     "10.0.0.1",
+			WriterShards: []string{"10.0.0.1", "10.0.0.2"},
+		}, nil),
+		crossShard: &CrossShardTask{wake: make(chan bool, 1)},
+	}
+
+	remoteStream := ""
+	for i := 0; remoteStream == ""; i++ {
+		if candidate := fmt.Sprintf("/tenants/%d", i); !e.ownsStream(candidate) {
+			remoteStream = candidate
+		}
+	}
+
+	ass.True(t, e.ownsStream("/"))
+
+	withTestDatabase(t, func(tx *transaction.EventstoreTransaction) error {
+		first := metaevents.NewChildStreamCreated(remoteStream+"/a", "dummy").Serialize()
+		second := metaevents.NewStreamDeleted(remoteStream+"/a", false).Serialize()
+
+		ass.True(t, e.appendMetaToStream(remoteStream, first, tx) == nil)
+		ass.True(t, e.appendMetaToStream(remoteStream, second, tx) == nil)
+
+		outbox := tx.BoltTx.Bucket([]byte("_crossshardoutbox"))
+
+		seqKey := make([]byte, 8)
+		for seq, expected := range []string{first, second} {
+			binary.BigEndian.PutUint64(seqKey, uint64(seq+1))
+
+			queued := crossShardMetaEvent{}
+			ass.True(t, json.Unmarshal(outbox.Get(seqKey), &queued) == nil)
+			ass.EqualString(t, queued.Stream, remoteStream)
+			ass.EqualString(t, queued.MetaEvent, expected)
+		}
+
+		next := tx.BoltTx.Bucket([]byte("_crossshardseq")).Get([]byte("next"))
+		ass.True(t, binary.BigEndian.Uint64(next) == 3)
+
+		// delivered ones are removed, but seqs are not reused
+		ass.True(t, tx.Delete("_crossshardoutbox", seqKey) == nil)
+		ass.True(t, e.appendMetaToStream(remoteStream, first, tx) == nil)
+		binary.BigEndian.PutUint64(seqKey, 3)
+		ass.True(t, outbox.Get(seqKey) != nil)
+
+		return nil
+	})
+
+	ass.EqualInt(t, len(e.crossShard.wake), 1)
+}
+
+func TestIsCrossShardMetaEvent(t *testing.T) {
+	ass.True(t, isCrossShardMetaEvent(metaevents.NewSubscriptionActivity().Serialize()))
+	ass.False(t, isCrossShardMetaEvent(metaevents.NewSubscribed("/_sub/foo").Serialize()))
+	ass.False(t, isCrossShardMetaEvent(" regular line\n"))
+	ass.False(t, isCrossShardMetaEvent(metaevents.NewSubscriptionActivity().Serialize()+" smuggled\n"))
+}
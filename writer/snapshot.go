@@ -0,0 +1,297 @@
+package writer
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/function61/eventhorizon/config"
+	"github.com/function61/eventhorizon/cursor"
+	"github.com/function61/eventhorizon/reader/store"
+	"github.com/function61/eventhorizon/scalablestore"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*	Writer's snapshot in scalablestore, written by SnapshotTask and restored by
+	writer-recover:
+
+	With many shards, each has its own /_writer-snapshot/<shard>/ instead.
+
+	/_writer-snapshot/manifest.json
+		the latest complete snapshot (plaintext JSON)
+	/_writer-snapshot/db/<taken>
+		BoltDB
+	/_writer-snapshot/tails/<file>/<from>-<taken>
+		bytes [from, to) of a live chunk (or a sealed chunk not yet shipped)
+
+	Live chunks are uploaded incrementally: each snapshot only uploads what was
+	appended after the previous one, and lists all of the chunk's tails. Everything
+	except the manifest is compressed & encrypted like chunks. Objects not referenced
+	by the latest manifest are deleted after it is uploaded.
+*/
+
+const snapshotPrefix = "/_writer-snapshot/"
+
+// shards must not overwrite (or delete as unreferenced) each other's snapshots
+func snapshotPrefixFor(confCtx *config.Context) string {
+	if len(confCtx.WriterShards()) == 1 {
+		return snapshotPrefix
+	}
+
+	return snapshotPrefix + confCtx.GetWriterIp() + "/"
+}
+
+func snapshotManifestPath(prefix string) string {
+	return prefix + "manifest.json"
+}
+
+type snapshotManifest struct {
+	Taken time.Time
+	Db    string // key in scalablestore
+	Files []*snapshotFile
+}
+
+type snapshotFile struct {
+	FileName   string // "/tenants/foo/_/3.log"
+	Path       string // local path
+	Length     int64
+	Generation string // hash of the first line (Created event), see fileGeneration()
+	Tails      []snapshotTail
+
+	fd *os.File // opened when the snapshot is taken, so later removal does not matter
+}
+
+type snapshotTail struct {
+	Key  string
+	From int64
+	To   int64
+}
+
+func (s *snapshotManifest) file(fileName string) *snapshotFile {
+	if s == nil {
+		return nil
+	}
+
+	for _, file := range s.Files {
+		if file.FileName == fileName {
+			return file
+		}
+	}
+
+	return nil
+}
+
+func (s *snapshotManifest) referencedKeys(prefix string) map[string]bool {
+	keys := map[string]bool{
+		snapshotManifestPath(prefix): true,
+		s.Db:                         true,
+	}
+
+	for _, file := range s.Files {
+		for _, tail := range file.Tails {
+			keys[tail.Key] = true
+		}
+	}
+
+	return keys
+}
+
+// tails already uploaded by the previous snapshot are reused. returns the first
+// offset that needs uploading
+func (s *snapshotFile) reuseTailsFrom(previous *snapshotFile) int64 {
+	s.Tails = []snapshotTail{}
+
+	// a file with the same name can be re-created (deleted & purged stream)
+	if previous == nil || previous.Length > s.Length || previous.Generation != s.Generation {
+		return 0
+	}
+
+	s.Tails = append(s.Tails, previous.Tails...)
+
+	return previous.Length
+}
+
+func snapshotTailKey(prefix string, fileName string, from int64, taken time.Time) string {
+	return fmt.Sprintf(
+		"%stails/%s/%d-%d",
+		prefix,
+		strings.Replace(fileName, "/", "_", -1),
+		from,
+		taken.UnixNano())
+}
+
+// files whose content is only on Writer's disk. call with Writer's lock held and
+// the same bolt transaction the snapshot is taken from, so they are consistent
+func (e *EventstoreWriter) snapshotFiles(boltTx *bolt.Tx) ([]*snapshotFile, error) {
+	files := []*snapshotFile{}
+
+	openAndAdd := func(fileName string, path string, length int64) error {
+		fd, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		generation, err := fileGeneration(fd, length)
+		if err != nil {
+			fd.Close()
+			return err
+		}
+
+		files = append(files, &snapshotFile{
+			FileName:   fileName,
+			Path:       path,
+			Length:     length,
+			Generation: generation,
+			fd:         fd,
+		})
+
+		return nil
+	}
+
+	for _, chunkSpec := range e.streamToChunkName {
+		path, length, err := e.walManager.SnapshotForReading(chunkSpec.ChunkPath)
+		if err != nil {
+			return files, err
+		}
+
+		if err := openAndAdd(chunkSpec.ChunkPath, path, length); err != nil {
+			return files, err
+		}
+	}
+
+	// sealed chunks are immutable, so file size is the length
+	if filesToShipBucket := boltTx.Bucket([]byte("_filestoship")); filesToShipBucket != nil {
+		if err := filesToShipBucket.ForEach(func(key, value []byte) error {
+			info, err := os.Stat(string(value))
+			if err != nil {
+				return err
+			}
+
+			return openAndAdd(cursor.CursorFromserializedMust(string(key)).ToChunkPath(), string(value), info.Size())
+		}); err != nil {
+			return files, err
+		}
+	}
+
+	return files, nil
+}
+
+// chunk's first line is its Created event, which has the time the chunk was
+// opened. it's written in the same transaction that opens the file, and never
+// changes, so it tells apart files that had the same name
+func fileGeneration(fd io.ReaderAt, length int64) (string, error) {
+	firstLine, err := bufio.NewReader(io.NewSectionReader(fd, 0, length)).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	hash := sha256.Sum256([]byte(firstLine))
+
+	return hex.EncodeToString(hash[:8]), nil
+}
+
+// nil if there is no snapshot
+func loadSnapshotManifest(prefix string, s3Manager *scalablestore.S3Manager) *snapshotManifest {
+	response, err := s3Manager.Get(snapshotManifestPath(prefix))
+	if err != nil { // FIXME: assuming 404
+		return nil
+	}
+	defer response.Body.Close()
+
+	manifest := &snapshotManifest{}
+	if err := json.NewDecoder(response.Body).Decode(manifest); err != nil {
+		log.Printf("Recovery: invalid snapshot manifest: %s", err.Error())
+		return nil
+	}
+
+	return manifest
+}
+
+// restores BoltDB and the files from the snapshot to Writer's local disk
+func restoreSnapshot(
+	manifest *snapshotManifest,
+	s3Manager *scalablestore.S3Manager,
+	compressedEncryptedStore *store.CompressedEncryptedStore,
+) error {
+	log.Printf("Recovery: restoring snapshot taken at %s", manifest.Taken.Format(time.RFC3339))
+
+	if err := downloadDecrypted(manifest.Db, dbLocation, s3Manager, compressedEncryptedStore); err != nil {
+		return err
+	}
+
+	for _, file := range manifest.Files {
+		if err := os.MkdirAll(filepath.Dir(file.Path), 0755); err != nil {
+			return err
+		}
+
+		fd, err := os.Create(file.Path)
+		if err != nil {
+			return err
+		}
+
+		for _, tail := range file.Tails {
+			response, err := s3Manager.Get(tail.Key)
+			if err != nil {
+				fd.Close()
+				return err
+			}
+
+			err = compressedEncryptedStore.Decrypt(response.Body, fd)
+			response.Body.Close()
+			if err != nil {
+				fd.Close()
+				return err
+			}
+		}
+
+		info, err := fd.Stat()
+		if err != nil {
+			fd.Close()
+			return err
+		}
+
+		if err := fd.Close(); err != nil {
+			return err
+		}
+
+		if info.Size() != file.Length {
+			return errors.New(fmt.Sprintf("Recovery: restored %s is %d bytes, expected %d", file.FileName, info.Size(), file.Length))
+		}
+	}
+
+	log.Printf("Recovery: restored BoltDB and %d file(s) from snapshot", len(manifest.Files))
+
+	return nil
+}
+
+func downloadDecrypted(key string, path string, s3Manager *scalablestore.S3Manager, compressedEncryptedStore *store.CompressedEncryptedStore) error {
+	response, err := s3Manager.Get(key)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	fd, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := compressedEncryptedStore.Decrypt(response.Body, fd); err != nil {
+		fd.Close()
+		return err
+	}
+
+	return fd.Close()
+}
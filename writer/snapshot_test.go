@@ -0,0 +1,95 @@
+package writer
+
+import (
+	"github.com/function61/eventhorizon/util/ass"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotTailKey(t *testing.T) {
+	taken := time.Unix(1488215400, 0)
+
+	ass.EqualString(
+		t,
+		snapshotTailKey(snapshotPrefix, "/tenants/foo/_/3.log", 4096, taken),
+		"/_writer-snapshot/tails/_tenants_foo___3.log/4096-1488215400000000000")
+}
+
+func TestReuseTailsFrom(t *testing.T) {
+	previous := &snapshotManifest{
+		Db: "/_writer-snapshot/db/1",
+		Files: []*snapshotFile{
+			{
+				FileName:   "/_/0.log",
+				Length:     100,
+				Generation: "gen1",
+				Tails:      []snapshotTail{{Key: "tail-a", From: 0, To: 100}},
+			},
+		},
+	}
+
+	grown := &snapshotFile{FileName: "/_/0.log", Length: 150, Generation: "gen1"}
+	ass.True(t, grown.reuseTailsFrom(previous.file("/_/0.log")) == 100)
+	ass.EqualInt(t, len(grown.Tails), 1)
+	ass.EqualString(t, grown.Tails[0].Key, "tail-a")
+
+	unchanged := &snapshotFile{FileName: "/_/0.log", Length: 100, Generation: "gen1"}
+	ass.True(t, unchanged.reuseTailsFrom(previous.file("/_/0.log")) == 100)
+
+	// not the same file anymore
+	recreated := &snapshotFile{FileName: "/_/0.log", Length: 150, Generation: "gen2"}
+	ass.True(t, recreated.reuseTailsFrom(previous.file("/_/0.log")) == 0)
+	ass.EqualInt(t, len(recreated.Tails), 0)
+
+	shrunk := &snapshotFile{FileName: "/_/0.log", Length: 50, Generation: "gen1"}
+	ass.True(t, shrunk.reuseTailsFrom(previous.file("/_/0.log")) == 0)
+	ass.EqualInt(t, len(shrunk.Tails), 0)
+
+	unknown := &snapshotFile{FileName: "/_/1.log", Length: 10}
+	ass.True(t, unknown.reuseTailsFrom(previous.file("/_/1.log")) == 0)
+
+	// first snapshot
+	var noPrevious *snapshotManifest
+	first := &snapshotFile{FileName: "/_/0.log", Length: 10}
+	ass.True(t, first.reuseTailsFrom(noPrevious.file("/_/0.log")) == 0)
+}
+
+func TestFileGeneration(t *testing.T) {
+	generation := func(content string, length int64) string {
+		gen, err := fileGeneration(strings.NewReader(content), length)
+		ass.True(t, err == nil)
+		return gen
+	}
+
+	created := "/Created {\"ts\":\"2017-02-27T17:10:00.000Z\"}\n"
+
+	// appends don't change it
+	ass.EqualString(t, generation(created, int64(len(created))), generation(created+" line\n", int64(len(created))+6))
+
+	recreated := "/Created {\"ts\":\"2017-02-27T17:12:31.446Z\"}\n"
+	ass.True(t, generation(created, int64(len(created))) != generation(recreated, int64(len(recreated))))
+}
+
+func TestReferencedKeys(t *testing.T) {
+	manifest := &snapshotManifest{
+		Db: "/_writer-snapshot/db/2",
+		Files: []*snapshotFile{
+			{
+				FileName: "/_/0.log",
+				Tails: []snapshotTail{
+					{Key: "tail-a", From: 0, To: 100},
+					{Key: "tail-b", From: 100, To: 150},
+				},
+			},
+		},
+	}
+
+	referenced := manifest.referencedKeys(snapshotPrefix)
+
+	ass.EqualInt(t, len(referenced), 4)
+	ass.True(t, referenced["/_writer-snapshot/manifest.json"])
+	ass.True(t, referenced["/_writer-snapshot/db/2"])
+	ass.True(t, referenced["tail-b"])
+	ass.True(t, !referenced["/_writer-snapshot/db/1"])
+}
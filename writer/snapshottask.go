@@ -0,0 +1,263 @@
+package writer
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/function61/eventhorizon/reader/store"
+	"github.com/function61/eventhorizon/scalablestore"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Snapshots Writer's BoltDB and live chunks to scalablestore, so losing Writer's
+// disk loses at most the snapshot interval's worth of data (see snapshot.go).
+
+type SnapshotTask struct {
+	writer                   *EventstoreWriter
+	s3Manager                *scalablestore.S3Manager
+	compressedEncryptedStore *store.CompressedEncryptedStore
+	previous                 *snapshotManifest // nil until first snapshot, so it's always full
+	stop                     chan bool
+	done                     chan bool
+}
+
+func NewSnapshotTask(writer *EventstoreWriter) *SnapshotTask {
+	t := &SnapshotTask{
+		writer:                   writer,
+		s3Manager:                scalablestore.NewS3Manager(writer.confCtx),
+		compressedEncryptedStore: store.NewCompressedEncryptedStore(writer.confCtx),
+		stop:                     make(chan bool),
+		done:                     make(chan bool),
+	}
+
+	go t.loopUntilStopped()
+
+	return t
+}
+
+func (t *SnapshotTask) loopUntilStopped() {
+	interval := t.writer.confCtx.SnapshotInterval()
+	if interval == 0 { // disabled
+		<-t.stop
+		t.done <- true
+		return
+	}
+
+	for {
+		select {
+		case <-t.stop:
+			t.done <- true
+			return
+		case <-time.After(interval):
+			break
+		}
+
+		// one snapshot per replicated group, taken by the leader
+		if !t.writer.IsLeader() {
+			continue
+		}
+
+		if err := t.snapshot(); err != nil {
+			log.Printf("SnapshotTask: %s", err.Error())
+		}
+	}
+}
+
+func (t *SnapshotTask) snapshot() error {
+	started := time.Now()
+
+	// bolt read transaction & the files' lengths are consistent because nothing
+	// is written while we hold the lock. after releasing it, the read transaction
+	// keeps seeing the same state, and the files are append-only
+	t.writer.mu.RLock()
+
+	boltTx, err := t.writer.database.Begin(false)
+	if err != nil {
+		t.writer.mu.RUnlock()
+		return err
+	}
+
+	files, err := t.writer.snapshotFiles(boltTx)
+
+	t.writer.mu.RUnlock()
+
+	defer func() {
+		for _, file := range files {
+			file.fd.Close()
+		}
+	}()
+
+	manifest := &snapshotManifest{
+		Taken: started.UTC(),
+		Db:    snapshotPrefixFor(t.writer.confCtx) + "db/" + strconv.FormatInt(started.UnixNano(), 10),
+		Files: files,
+	}
+
+	var encryptedDb *os.File
+	if err == nil {
+		encryptedDb, err = t.encryptDb(boltTx)
+	}
+
+	// not keeping the read transaction open during uploads, as it could block
+	// BoltDB from growing its mmap
+	boltTx.Rollback()
+
+	if err != nil {
+		return err
+	}
+
+	err = t.s3Manager.Put(manifest.Db, encryptedDb)
+	removeTempFile(encryptedDb)
+	if err != nil {
+		return err
+	}
+
+	uploadedBytes := int64(0)
+
+	for _, file := range files {
+		from := file.reuseTailsFrom(t.previous.file(file.FileName))
+
+		if from == file.Length {
+			continue
+		}
+
+		tail := snapshotTail{
+			Key:  snapshotTailKey(snapshotPrefixFor(t.writer.confCtx), file.FileName, from, started),
+			From: from,
+			To:   file.Length,
+		}
+
+		if err := t.uploadEncrypted(tail.Key, io.NewSectionReader(file.fd, from, file.Length-from)); err != nil {
+			return err
+		}
+
+		file.Tails = append(file.Tails, tail)
+
+		uploadedBytes += tail.To - tail.From
+	}
+
+	manifestJson, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	// this makes the snapshot visible
+	if err := t.s3Manager.Put(snapshotManifestPath(snapshotPrefixFor(t.writer.confCtx)), bytes.NewReader(manifestJson)); err != nil {
+		return err
+	}
+
+	t.previous = manifest
+
+	if err := t.deleteUnreferenced(manifest); err != nil {
+		return err
+	}
+
+	log.Printf(
+		"SnapshotTask: snapshot of %d file(s) (%d new bytes) took %s",
+		len(files),
+		uploadedBytes,
+		time.Since(started))
+
+	return nil
+}
+
+func (t *SnapshotTask) uploadEncrypted(key string, plaintext io.Reader) error {
+	encrypted, err := t.encryptToTempFile(plaintext)
+	if err != nil {
+		return err
+	}
+	defer removeTempFile(encrypted)
+
+	return t.s3Manager.Put(key, encrypted)
+}
+
+// BoltDB is piped straight into encryption, so it's never in memory as a whole
+func (t *SnapshotTask) encryptDb(boltTx *bolt.Tx) (*os.File, error) {
+	dbReader, dbWriter := io.Pipe()
+
+	writeDone := make(chan bool)
+
+	go func() {
+		_, err := boltTx.WriteTo(dbWriter)
+		dbWriter.CloseWithError(err)
+
+		writeDone <- true
+	}()
+
+	encrypted, err := t.encryptToTempFile(dbReader)
+
+	// if encryption failed, unblocks WriteTo(), which must finish before the
+	// transaction is rolled back
+	dbReader.Close()
+	<-writeDone
+
+	return encrypted, err
+}
+
+// encrypted content is spooled to disk instead of memory, because uploading
+// needs a seekable body. caller removes the file with removeTempFile()
+func (t *SnapshotTask) encryptToTempFile(plaintext io.Reader) (*os.File, error) {
+	encrypted, err := ioutil.TempFile("", "writer-snapshot")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.compressedEncryptedStore.Encrypt(plaintext, encrypted); err != nil {
+		removeTempFile(encrypted)
+		return nil, err
+	}
+
+	if _, err := encrypted.Seek(0, io.SeekStart); err != nil {
+		removeTempFile(encrypted)
+		return nil, err
+	}
+
+	return encrypted, nil
+}
+
+func removeTempFile(fd *os.File) {
+	fd.Close()
+
+	if err := os.Remove(fd.Name()); err != nil {
+		log.Printf("SnapshotTask: %s", err.Error())
+	}
+}
+
+// previous snapshots' DBs, tails of chunks that were shipped since etc.
+func (t *SnapshotTask) deleteUnreferenced(manifest *snapshotManifest) error {
+	prefix := snapshotPrefixFor(t.writer.confCtx)
+
+	objects, err := t.s3Manager.List(prefix)
+	if err != nil {
+		return err
+	}
+
+	referenced := manifest.referencedKeys(prefix)
+
+	for _, object := range objects {
+		if referenced[object.Key] {
+			continue
+		}
+
+		if err := t.s3Manager.Delete(object.Key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *SnapshotTask) Close() {
+	log.Printf("SnapshotTask: stopping")
+
+	t.stop <- true
+
+	<-t.done
+
+	log.Printf("SnapshotTask: stopped")
+}
@@ -0,0 +1,119 @@
+package writer
+
+import (
+	"bytes"
+	"github.com/boltdb/bolt"
+	"github.com/function61/eventhorizon/metaevents"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"strings"
+)
+
+/*	_streams bucket is keyed by stream name, so a stream's descendants are
+	found by a prefix scan.
+
+	A deleted stream's name is tombstoned, because its chunks are still in
+	scalablestore and a re-created stream would overwrite them. Once the chunks
+	are purged the name can be re-created, which removes the tombstone.
+
+	_tombstones:
+		/tenants/foo => /StreamDeleted {...}
+*/
+
+func hasChildStreams(streamName string, tx *bolt.Tx) bool {
+	streamsBucket := tx.Bucket([]byte("_streams"))
+	if streamsBucket == nil {
+		return false
+	}
+
+	// root stream's children are "/foo", others' are "/tenants/foo/bar"
+	childPrefix := strings.TrimRight(streamName, "/") + "/"
+
+	key, _ := streamsBucket.Cursor().Seek([]byte(childPrefix))
+
+	return key != nil && strings.HasPrefix(string(key), childPrefix)
+}
+
+// recursive lists all descendants, otherwise only direct children. sorted by name
+func listChildStreams(streamName string, recursive bool, tx *bolt.Tx) []string {
+	children := []string{}
+
+	streamsBucket := tx.Bucket([]byte("_streams"))
+	if streamsBucket == nil {
+		return children
+	}
+
+	childPrefix := strings.TrimRight(streamName, "/") + "/"
+
+	streams := streamsBucket.Cursor()
+	for key, _ := streams.Seek([]byte(childPrefix)); key != nil && strings.HasPrefix(string(key), childPrefix); key, _ = streams.Next() {
+		// root stream's own key matches the prefix
+		if string(key) == streamName {
+			continue
+		}
+
+		// "/tenants/foo/bar" is not a direct child of "/tenants"
+		if !recursive && strings.Contains(string(key[len(childPrefix):]), "/") {
+			continue
+		}
+
+		children = append(children, string(key))
+	}
+
+	return children
+}
+
+func saveTombstone(streamName string, streamDeletedSerialized string, tx *transaction.EventstoreTransaction) error {
+	return tx.Put("_tombstones", []byte(streamName), []byte(streamDeletedSerialized))
+}
+
+func isTombstoned(streamName string, tx *bolt.Tx) bool {
+	tombstonesBucket := tx.Bucket([]byte("_tombstones"))
+	if tombstonesBucket == nil {
+		return false
+	}
+
+	return tombstonesBucket.Get([]byte(streamName)) != nil
+}
+
+// nil if the stream is not tombstoned
+func getTombstone(streamName string, tx *bolt.Tx) *metaevents.StreamDeleted {
+	tombstonesBucket := tx.Bucket([]byte("_tombstones"))
+	if tombstonesBucket == nil {
+		return nil
+	}
+
+	streamDeletedSerialized := tombstonesBucket.Get([]byte(streamName))
+	if streamDeletedSerialized == nil {
+		return nil
+	}
+
+	_, _, streamDeleted := metaevents.Parse(strings.TrimRight(string(streamDeletedSerialized), "\n"))
+
+	tombstone := streamDeleted.(metaevents.StreamDeleted)
+
+	return &tombstone
+}
+
+// name can be re-created once the deleted stream's chunks are purged. a chunk
+// still waiting to be shipped would land in scalablestore after the purge
+func canRecreate(tombstone *metaevents.StreamDeleted, tx *bolt.Tx) bool {
+	if !tombstone.Purged {
+		return false
+	}
+
+	if streamsToPurgeBucket := tx.Bucket([]byte("_streamstopurge")); streamsToPurgeBucket != nil && streamsToPurgeBucket.Get([]byte(tombstone.Name)) != nil {
+		return false
+	}
+
+	filesToShipBucket := tx.Bucket([]byte("_filestoship"))
+	if filesToShipBucket == nil {
+		return true
+	}
+
+	// keyed by cursor, "/tenants/foo:0:0:"
+	chunkPrefix := []byte(tombstone.Name + ":")
+
+	key, _ := filesToShipBucket.Cursor().Seek(chunkPrefix)
+
+	return key == nil || !bytes.HasPrefix(key, chunkPrefix)
+}
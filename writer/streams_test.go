@@ -0,0 +1,33 @@
+package writer
+
+import (
+	"github.com/function61/eventhorizon/util/ass"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"strings"
+	"testing"
+)
+
+func TestListChildStreams(t *testing.T) {
+	withTestDatabase(t, func(tx *transaction.EventstoreTransaction) error {
+		for _, stream := range []string{"/", "/_sub", "/tenants", "/tenants/foo", "/tenants/foo/bar", "/tenants/foo-x"} {
+			if err := tx.Put("_streams", []byte(stream), []byte("{}")); err != nil {
+				return err
+			}
+		}
+
+		list := func(streamName string, recursive bool) string {
+			return strings.Join(listChildStreams(streamName, recursive, tx.BoltTx), ",")
+		}
+
+		ass.EqualString(t, list("/", false), "/_sub,/tenants")
+		ass.EqualString(t, list("/tenants", false), "/tenants/foo,/tenants/foo-x")
+		ass.EqualString(t, list("/tenants", true), "/tenants/foo,/tenants/foo-x,/tenants/foo/bar")
+		ass.EqualString(t, list("/tenants/foo", true), "/tenants/foo/bar")
+		ass.EqualString(t, list("/tenants/foo/bar", true), "")
+
+		ass.True(t, hasChildStreams("/tenants/foo", tx.BoltTx))
+		ass.True(t, !hasChildStreams("/tenants/foo-x", tx.BoltTx))
+
+		return nil
+	})
+}
@@ -0,0 +1,49 @@
+package writer
+
+import (
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"github.com/function61/eventhorizon/writer/types"
+)
+
+/*	Settings are resolved (inherited from parent) when the stream is created, so
+	changing parent's settings later does not affect existing children.
+
+	_streamsettings:
+		/telemetry => {"ChunkSize": 67108864}
+*/
+
+// returns zero settings (= defaults) for streams without settings
+func getStreamSettings(streamName string, tx *bolt.Tx) (*types.StreamSettings, error) {
+	settings := &types.StreamSettings{}
+
+	settingsBucket := tx.Bucket([]byte("_streamsettings"))
+	if settingsBucket == nil {
+		return settings, nil
+	}
+
+	settingsJson := settingsBucket.Get([]byte(streamName))
+	if settingsJson == nil {
+		return settings, nil
+	}
+
+	if err := json.Unmarshal(settingsJson, settings); err != nil {
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+func saveStreamSettings(streamName string, settings *types.StreamSettings, tx *transaction.EventstoreTransaction) error {
+	if *settings == (types.StreamSettings{}) {
+		return tx.Delete("_streamsettings", []byte(streamName))
+	}
+
+	settingsJson, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+
+	return tx.Put("_streamsettings", []byte(streamName), settingsJson)
+}
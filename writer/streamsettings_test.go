@@ -0,0 +1,56 @@
+package writer
+
+import (
+	"github.com/function61/eventhorizon/config"
+	"github.com/function61/eventhorizon/util/ass"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"github.com/function61/eventhorizon/writer/types"
+	"testing"
+)
+
+func TestStreamSettings(t *testing.T) {
+	withTestDatabase(t, func(tx *transaction.EventstoreTransaction) error {
+		settings, err := getStreamSettings("/telemetry", tx.BoltTx)
+		ass.True(t, err == nil)
+		ass.EqualInt(t, settings.EffectiveChunkSize(), config.ChunkRotateThreshold)
+
+		if err := saveStreamSettings("/telemetry", &types.StreamSettings{ChunkSize: 64 * 1024}, tx); err != nil {
+			return err
+		}
+
+		parent, _ := getStreamSettings("/telemetry", tx.BoltTx)
+
+		// child without own settings inherits
+		child := (&types.StreamSettings{}).InheritFrom(parent)
+		ass.EqualInt(t, child.EffectiveChunkSize(), 64*1024)
+
+		// child's own setting wins
+		child = (&types.StreamSettings{ChunkSize: 8 * 1024}).InheritFrom(parent)
+		ass.EqualInt(t, child.EffectiveChunkSize(), 8*1024)
+
+		return nil
+	})
+}
+
+func TestStreamSettingsValidate(t *testing.T) {
+	ass.True(t, (&types.StreamSettings{}).Validate() == nil)
+	ass.True(t, (&types.StreamSettings{ChunkSize: 1024 * 1024}).Validate() == nil)
+	ass.EqualString(t, (&types.StreamSettings{ChunkSize: 1}).Validate().Error(), "ChunkSize must be between 4096 and 1073741824")
+}
+
+func TestStreamSettingsDurability(t *testing.T) {
+	parent := &types.StreamSettings{Durability: types.DurabilityRelaxed}
+
+	ass.EqualString(t, string((&types.StreamSettings{}).EffectiveDurability(types.DurabilityStrict)), "strict")
+	ass.EqualString(t, string((&types.StreamSettings{}).InheritFrom(parent).EffectiveDurability(types.DurabilityStrict)), "relaxed")
+
+	ass.EqualString(t, (&types.StreamSettings{Durability: "yolo"}).Validate().Error(), "unknown durability: yolo")
+
+	// transaction touching many streams gets the strictest durability
+	tx := transaction.NewEventstoreTransaction(nil)
+	tx.RequireDurability(types.DurabilityRelaxed)
+	ass.EqualString(t, string(tx.Durability), "relaxed")
+	tx.RequireDurability(types.DurabilityStrict)
+	tx.RequireDurability(types.DurabilityBatched)
+	ass.EqualString(t, string(tx.Durability), "strict")
+}
@@ -0,0 +1,86 @@
+package writer
+
+import (
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/function61/eventhorizon/cursor"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"strings"
+	"time"
+)
+
+/*	_streamstats:
+		/tenants/foo => {"lines": 1234, "bytes": 56789, "chunks": 2, "last_write": 1490000000000000000, "last_append": "/tenants/foo:1:678:127.0.0.1"}
+
+	Counters start from zero for streams created before stats were introduced.
+*/
+
+type streamStats struct {
+	LineCount  int64 `json:"lines"` // excluding meta events
+	ByteCount  int64 `json:"bytes"` // including meta events, i.e. sum of chunk sizes
+	ChunkCount int   `json:"chunks"`
+	LastWrite  int64 `json:"last_write"` // unix nanos
+
+	// cursor after the latest non-meta append. empty if there's none, or it was
+	// made by an older version
+	LastAppend string `json:"last_append,omitempty"`
+}
+
+func getStreamStats(streamName string, tx *bolt.Tx) (*streamStats, error) {
+	stats := &streamStats{}
+
+	statsBucket := tx.Bucket([]byte("_streamstats"))
+	if statsBucket == nil {
+		return stats, nil
+	}
+
+	statsJson := statsBucket.Get([]byte(streamName))
+	if statsJson == nil {
+		return stats, nil
+	}
+
+	if err := json.Unmarshal(statsJson, stats); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// rawLines are the non-meta lines, metaEventsRaw are only counted into bytes
+func updateStreamStats(streamName string, rawLines string, metaEventsRaw string, chunksAdded int, tx *transaction.EventstoreTransaction) error {
+	stats, err := getStreamStats(streamName, tx.BoltTx)
+	if err != nil {
+		return err
+	}
+
+	stats.LineCount += int64(strings.Count(rawLines, "\n"))
+	stats.ByteCount += int64(len(rawLines) + len(metaEventsRaw))
+	stats.ChunkCount += chunksAdded
+	stats.LastWrite = time.Now().UnixNano()
+
+	return saveStreamStats(streamName, stats, tx)
+}
+
+func saveLastAppend(cursorAfter *cursor.Cursor, tx *transaction.EventstoreTransaction) error {
+	stats, err := getStreamStats(cursorAfter.Stream, tx.BoltTx)
+	if err != nil {
+		return err
+	}
+
+	stats.LastAppend = cursorAfter.Serialize()
+
+	return saveStreamStats(cursorAfter.Stream, stats, tx)
+}
+
+func saveStreamStats(streamName string, stats *streamStats, tx *transaction.EventstoreTransaction) error {
+	statsJson, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+
+	return tx.Put("_streamstats", []byte(streamName), statsJson)
+}
+
+func deleteStreamStats(streamName string, tx *transaction.EventstoreTransaction) error {
+	return tx.Delete("_streamstats", []byte(streamName))
+}
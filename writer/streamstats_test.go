@@ -0,0 +1,37 @@
+package writer
+
+import (
+	"github.com/function61/eventhorizon/util/ass"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"testing"
+)
+
+func TestStreamStats(t *testing.T) {
+	withTestDatabase(t, func(tx *transaction.EventstoreTransaction) error {
+		stats, err := getStreamStats("/foo", tx.BoltTx)
+		ass.True(t, err == nil)
+		ass.True(t, stats.LineCount == 0 && stats.LastWrite == 0)
+
+		if err := updateStreamStats("/foo", "", "/Created {}\n", 1, tx); err != nil {
+			return err
+		}
+		if err := updateStreamStats("/foo", "line 1\nline 2\n", "", 0, tx); err != nil {
+			return err
+		}
+
+		stats, _ = getStreamStats("/foo", tx.BoltTx)
+		ass.True(t, stats.LineCount == 2)
+		ass.True(t, stats.ByteCount == 26)
+		ass.EqualInt(t, stats.ChunkCount, 1)
+		ass.True(t, stats.LastWrite != 0)
+
+		if err := deleteStreamStats("/foo", tx); err != nil {
+			return err
+		}
+
+		stats, _ = getStreamStats("/foo", tx.BoltTx)
+		ass.True(t, stats.ByteCount == 0)
+
+		return nil
+	})
+}
@@ -1,35 +1,52 @@
 package writer
 
 import (
-	"github.com/boltdb/bolt"
+	"github.com/function61/eventhorizon/config"
 	"github.com/function61/eventhorizon/cursor"
 	"github.com/function61/eventhorizon/metaevents"
+	"github.com/function61/eventhorizon/util/stringslice"
 	"github.com/function61/eventhorizon/writer/transaction"
 	"log"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
-// - Every 5 seconds
+// - Every 5 seconds (subscription_activity_interval_ms in discovery file)
 // - For each stream that have new events
 // - See which subscribers have subscribed to changes for those streams
 // - Deliver notification as a SubscriptionActivity meta event to the respective
 //   subscribers streams (implemented as regular streams).
-// - All activity for the tracked streams are aggregated in 5 second intervals and all it does
+// - All activity for the tracked streams are aggregated over the interval and all it does
 //   is contain the latest offset, so no perf difference in 1 or millions of events/sec.
 //
 // Therefore, a subscriber can just listen to its own stream to get aggregate
 // notifications for all the streams it its following, whether it's 1 or millions of streams.
 //
-// This design does not impose 5 second delay on events because the pub/sub subsystem delivers
+// This design does not impose the interval's delay on events because the pub/sub subsystem delivers
 // the change notifications in realtime, so in practice all subscribed events are delivered instantly.
 //
 // But the pub/sub system does not guarantee delivery (connection problem or at-times-offline subscribers),
 // so we need this mechanism to guarantee that all events will be delivered when subscriber comes back online.
+//
+// A subscription whose subscription stream no longer exists is unsubscribed (see orphanedsubscriptions.go).
+//
+// A subscription with a filter is only notified when lines that match it are appended. Those are tracked
+// per subscription in _dirtyfiltered, and the notification carries the cursor after the last matching append.
+// A subscription with an activity interval has its activity moved there as well (when raising it, not
+// on every append), and its entries are kept there until the subscriber is due again.
+//
+// In adaptive mode we check every SubscriptionActivityAdaptiveTick, but only take the lock and raise
+// activity if something was marked dirty, and either the interval has passed or there was a burst of
+// marks. That way a short interval doesn't cost idle rounds, and subscribers hear of bursts sooner.
 
 type SubscriptionActivityTask struct {
+	marks                    int64 // since the last round. only a hint, as the marking transaction may roll back. first for 64-bit alignment
 	writer                   *EventstoreWriter
 	subscriptionActivityStop chan bool
 	subscriptionActivityDone chan bool
+	deferred                 int // _dirtyfiltered entries left for subscribers that are not due yet
+	lastActivity             map[string]time.Time
 }
 
 func NewSubscriptionActivityTask(writer *EventstoreWriter) *SubscriptionActivityTask {
@@ -37,6 +54,7 @@ func NewSubscriptionActivityTask(writer *EventstoreWriter) *SubscriptionActivity
 		writer:                   writer,
 		subscriptionActivityStop: make(chan bool),
 		subscriptionActivityDone: make(chan bool),
+		lastActivity:             map[string]time.Time{},
 	}
 
 	go t.loopUntilStopped()
@@ -45,94 +63,256 @@ func NewSubscriptionActivityTask(writer *EventstoreWriter) *SubscriptionActivity
 }
 
 func (t *SubscriptionActivityTask) MarkOneDirty(cursorAfter *cursor.Cursor, tx *transaction.EventstoreTransaction) error {
-	dirtyStreamsBucket, err := tx.BoltTx.CreateBucketIfNotExists([]byte("_dirtystreams"))
-	if err != nil {
-		return err
-	}
+	atomic.AddInt64(&t.marks, 1)
 
-	if err := dirtyStreamsBucket.Put([]byte(cursorAfter.Stream), []byte(cursorAfter.Serialize())); err != nil {
-		return err
-	}
+	return tx.Put("_dirtystreams", []byte(cursorAfter.Stream), []byte(cursorAfter.Serialize()))
+}
+
+func (t *SubscriptionActivityTask) MarkDirtyForSubscription(cursorAfter *cursor.Cursor, subscriptionId string, tx *transaction.EventstoreTransaction) error {
+	atomic.AddInt64(&t.marks, 1)
 
-	return nil
+	return tx.Put("_dirtyfiltered", streamSubscriptionKey(cursorAfter.Stream, subscriptionId), []byte(cursorAfter.Serialize()))
 }
 
 func (t *SubscriptionActivityTask) loopUntilStopped() {
+	interval := t.writer.confCtx.SubscriptionActivityInterval()
+	adaptive := t.writer.confCtx.SubscriptionActivityAdaptive()
+
+	tick := interval
+	if adaptive && config.SubscriptionActivityAdaptiveTick < interval {
+		tick = config.SubscriptionActivityAdaptiveTick
+	}
+
+	var lastRound time.Time
+	var lastAcksPersisted time.Time
+	wasLeader := false
+
 	for {
 		select {
 		case <-t.subscriptionActivityStop:
 			t.subscriptionActivityDone <- true
 			return
-		case <-time.After(5 * time.Second):
+		case <-time.After(tick):
 			break
 		}
 
-		t.writer.mu.Lock()
+		// followers get the leader's SubscriptionActivity events
+		if !t.writer.IsLeader() {
+			wasLeader = false
+			continue
+		}
 
-		tx := transaction.NewEventstoreTransaction(t.writer.database)
+		// marks from before we started or became the leader are only in _dirtystreams
+		if !wasLeader {
+			wasLeader = true
+			atomic.AddInt64(&t.marks, 1)
+		}
 
-		err := t.writer.database.Update(func(boltTx *bolt.Tx) error {
-			tx.BoltTx = boltTx
+		// not only in due rounds, as acks can move without new activity
+		if time.Since(lastAcksPersisted) >= interval {
+			lastAcksPersisted = time.Now()
 
-			return t.broadcastSubscriptionActivities(tx)
-		})
-		if err != nil {
-			panic(err)
+			if err := t.writer.persistSubscriptionAcks(); err != nil {
+				log.Printf("SubscriptionActivityTask: persistSubscriptionAcks: %s", err.Error())
+			}
 		}
 
-		if err := t.writer.applySideEffects(tx); err != nil {
-			panic(err)
+		if adaptive && !t.due(time.Since(lastRound) >= interval) {
+			continue
 		}
 
-		t.writer.mu.Unlock()
+		lastRound = time.Now()
+
+		t.raiseActivity(lastRound)
+
+		t.writer.updateSubscriptionLagMetrics()
 	}
 }
 
-func (t *SubscriptionActivityTask) broadcastSubscriptionActivities(tx *transaction.EventstoreTransaction) error {
+func (t *SubscriptionActivityTask) due(intervalPassed bool) bool {
+	marks := atomic.LoadInt64(&t.marks)
+
+	if marks == 0 && t.deferred == 0 {
+		return false // nothing's dirty, no need for a transaction
+	}
+
+	return intervalPassed || marks >= config.SubscriptionActivityBurstMarks
+}
+
+func (t *SubscriptionActivityTask) raiseActivity(now time.Time) {
+	t.writer.mu.Lock()
+	defer t.writer.mu.Unlock()
+
+	// marking happens under the lock, so this round handles all the marks so far
+	marks := atomic.SwapInt64(&t.marks, 0)
+
+	tx := transaction.NewEventstoreTransaction(t.writer.database)
+
+	var delivered []string
+	var deferred int
+
+	err := t.writer.update(tx, func() error {
+		var err error
+		delivered, deferred, err = t.broadcastSubscriptionActivities(now, tx)
+		return err
+	})
+	if err != nil {
+		// f.ex. we lost leadership while replicating. the transaction was rolled
+		// back, so the dirty marks are still there for the next round
+		log.Printf("SubscriptionActivityTask: %s", err.Error())
+
+		atomic.AddInt64(&t.marks, marks)
+		return
+	}
+
+	if err := t.writer.applySideEffects(tx); err != nil {
+		panic(err)
+	}
+
+	t.deferred = deferred
+
+	for _, subscription := range delivered {
+		t.lastActivity[subscription] = now
+	}
+}
+
+// returns the subscriptions that got activity, and how many _dirtyfiltered entries were left for later
+func (t *SubscriptionActivityTask) broadcastSubscriptionActivities(now time.Time, tx *transaction.EventstoreTransaction) ([]string, int, error) {
 	dirtyStreamsBucket, err := tx.BoltTx.CreateBucketIfNotExists([]byte("_dirtystreams"))
 	if err != nil {
-		return err
+		return nil, 0, err
+	}
+
+	dirtyFilteredBucket, err := tx.BoltTx.CreateBucketIfNotExists([]byte("_dirtyfiltered"))
+	if err != nil {
+		return nil, 0, err
 	}
 
 	activityBySubscription := make(map[string]*metaevents.SubscriptionActivity)
 
-	dirtyStreamsBucket.ForEach(func(dirtyStream []byte, latestCursorSerialized []byte) error {
+	addActivity := func(subscription string, latestCursorSerialized string) {
+		if _, exists := activityBySubscription[subscription]; !exists {
+			activityBySubscription[subscription] = metaevents.NewSubscriptionActivity()
+		}
+
+		activityBySubscription[subscription].Activity = append(
+			activityBySubscription[subscription].Activity,
+			latestCursorSerialized)
+	}
+
+	// append() by itself does not guarantee that each stream is mentioned
+	// only once (a must for SubscriptionActivity event), but the ForEach()es
+	// iterate over unique streams (per subscription), and a subscription of a
+	// stream is either handled here or via _dirtyfiltered, so we're good
+
+	err = dirtyStreamsBucket.ForEach(func(dirtyStream []byte, latestCursorSerialized []byte) error {
+		if hasSubscriptionAcks(string(dirtyStream), tx.BoltTx) {
+			if err := addLagCheckpoint(cursor.CursorFromserializedMust(string(latestCursorSerialized)), now, tx); err != nil {
+				return err
+			}
+		}
+
 		subscriptions := getSubscriptionsForStream(string(dirtyStream), tx.BoltTx)
+		filters := getSubscriptionFiltersForStream(string(dirtyStream), tx.BoltTx)
+		intervals := getSubscriptionActivityIntervalsForStream(string(dirtyStream), tx.BoltTx)
 
 		for _, subscription := range subscriptions {
-			if _, exists := activityBySubscription[subscription]; !exists {
-				activityBySubscription[subscription] = metaevents.NewSubscriptionActivity()
+			if _, hasFilter := filters[subscription]; hasFilter {
+				continue // marked for it by streamHeadMoved() if it had matching lines
+			}
+
+			// checked for being due below
+			if _, hasInterval := intervals[subscription]; hasInterval {
+				if err := tx.Put("_dirtyfiltered", streamSubscriptionKey(string(dirtyStream), subscription), []byte(string(latestCursorSerialized))); err != nil {
+					return err
+				}
+
+				continue
 			}
 
-			// append() by itself does not guarantee that each stream is mentioned
-			// only once (a must for SubscriptionActivity event), but the above
-			// ForEach() iterates over unique streams, so we're good
-			activityBySubscription[subscription].Activity = append(
-				activityBySubscription[subscription].Activity,
-				string(latestCursorSerialized))
+			addActivity(subscription, string(latestCursorSerialized))
 		}
 
-		if err := dirtyStreamsBucket.Delete(dirtyStream); err != nil {
+		if err := tx.Delete("_dirtystreams", dirtyStream); err != nil {
 			panic(err) // cannot delete a key we just found?
 		}
 
 		return nil
 	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	deferred := 0
+
+	// not deleting while iterating
+	handledKeys := [][]byte{}
+
+	err = dirtyFilteredBucket.ForEach(func(key []byte, latestCursorSerialized []byte) error {
+		streamAndSubscription := strings.SplitN(string(key), "\x00", 2)
+
+		// might have unsubscribed since
+		if stringslice.ItemIndex(streamAndSubscription[1], getSubscriptionsForStream(streamAndSubscription[0], tx.BoltTx)) != -1 {
+			if !t.subscriptionDue(streamAndSubscription[0], streamAndSubscription[1], now, tx) {
+				deferred++
+				return nil
+			}
+
+			addActivity(streamAndSubscription[1], string(latestCursorSerialized))
+		}
+
+		handledKeys = append(handledKeys, append([]byte{}, key...))
+
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for _, key := range handledKeys {
+		if err := tx.Delete("_dirtyfiltered", key); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	delivered := []string{}
 
 	for subscription, subscriptionActivityEvent := range activityBySubscription {
 		log.Printf("SubscriptionActivityTask: %s: %v", subscription, subscriptionActivityEvent.Activity)
 
-		t.writer.metrics.SubscriptionActivityEventsRaised.Inc()
+		// appending would fail the whole transaction, and with it everybody's activity.
+		// subscription streams on other shards are checked by CrossShardTask
+		if t.writer.ownsStream(subscription) && !t.writer.streamExists(subscription, tx) {
+			if err := t.writer.removeOrphanedSubscription(subscription, tx); err != nil {
+				return nil, 0, err
+			}
 
-		// FIXME: this will fail all subscriptions if even one subscription stream is deleted later.
-		//        automatically unsubscribe if subscription stream does not exist?
+			continue
+		}
 
-		if err := t.writer.appendToStreamInternal(subscription, nil, subscriptionActivityEvent.Serialize(), tx); err != nil {
-			return err
+		t.writer.metrics.SubscriptionActivityEventsRaised.Inc()
+
+		if err := t.writer.appendMetaToStream(subscription, subscriptionActivityEvent.Serialize(), tx); err != nil {
+			return nil, 0, err
 		}
+
+		delivered = append(delivered, subscription)
 	}
 
-	return nil
+	return delivered, deferred, nil
+}
+
+// subscriptions with an activity interval are due once it has passed since their
+// previous activity (from any of their streams)
+func (t *SubscriptionActivityTask) subscriptionDue(streamName string, subscriptionId string, now time.Time, tx *transaction.EventstoreTransaction) bool {
+	intervalMs, hasInterval := getSubscriptionActivityIntervalsForStream(streamName, tx.BoltTx)[subscriptionId]
+	if !hasInterval {
+		return true
+	}
+
+	lastActivity, has := t.lastActivity[subscriptionId]
+
+	return !has || now.Sub(lastActivity) >= time.Duration(intervalMs)*time.Millisecond
 }
 
 func (t *SubscriptionActivityTask) Close() {
@@ -0,0 +1,110 @@
+package writer
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/function61/eventhorizon/config"
+	"github.com/function61/eventhorizon/metaevents"
+	"github.com/function61/eventhorizon/util/ass"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"github.com/function61/eventhorizon/writer/types"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionActivityDue(t *testing.T) {
+	task := &SubscriptionActivityTask{}
+
+	// nothing dirty => no transaction, even if the interval has passed
+	ass.False(t, task.due(true))
+
+	task.marks = 1
+	ass.False(t, task.due(false))
+	ass.True(t, task.due(true))
+
+	task.marks = config.SubscriptionActivityBurstMarks
+	ass.True(t, task.due(false))
+
+	task.marks = 0
+	task.deferred = 1
+	ass.False(t, task.due(false))
+	ass.True(t, task.due(true))
+}
+
+func TestSubscriptionDue(t *testing.T) {
+	withTestDatabase(t, func(tx *transaction.EventstoreTransaction) error {
+		task := &SubscriptionActivityTask{
+			lastActivity: map[string]time.Time{},
+		}
+
+		now := time.Now()
+
+		ass.True(t, saveSubscriptionActivityInterval("/logs", "/_sub/slow", 60000, tx) == nil)
+
+		ass.True(t, task.subscriptionDue("/logs", "/_sub/slow", now, tx))
+
+		task.lastActivity["/_sub/slow"] = now.Add(-10 * time.Second)
+		ass.False(t, task.subscriptionDue("/logs", "/_sub/slow", now, tx))
+
+		task.lastActivity["/_sub/slow"] = now.Add(-61 * time.Second)
+		ass.True(t, task.subscriptionDue("/logs", "/_sub/slow", now, tx))
+
+		// no interval
+		task.lastActivity["/_sub/fast"] = now
+		ass.True(t, task.subscriptionDue("/logs", "/_sub/fast", now, tx))
+
+		return nil
+	})
+}
+
+func TestActivityIntervalWithoutFilter(t *testing.T) {
+	e, cleanup := newTestWriter(t)
+	defer cleanup()
+
+	for _, streamName := range []string{"/logs", "/_sub/slow", "/_sub/fast"} {
+		_, err := e.CreateStream(&types.CreateStreamRequest{Name: streamName})
+		ass.True(t, err == nil)
+	}
+
+	ass.True(t, e.SubscribeToStream("/logs", "/_sub/slow", nil, 60000) == nil)
+	ass.True(t, e.SubscribeToStream("/logs", "/_sub/fast", nil, 0) == nil)
+
+	activities := func(subscriptionId string) int {
+		return strings.Count(readLiveChunk(t, e, subscriptionId+"/_/0.log"), "/"+metaevents.SubscriptionActivityId+" ")
+	}
+
+	deferredFor := func(subscriptionId string) bool {
+		deferred := false
+		ass.True(t, e.database.View(func(boltTx *bolt.Tx) error {
+			if dirtyFiltered := boltTx.Bucket([]byte("_dirtyfiltered")); dirtyFiltered != nil {
+				deferred = dirtyFiltered.Get(streamSubscriptionKey("/logs", subscriptionId)) != nil
+			}
+			return nil
+		}) == nil)
+		return deferred
+	}
+
+	now := time.Now()
+
+	// not notified before, so both are due
+	e.subAct.raiseActivity(now)
+	ass.EqualInt(t, activities("/_sub/slow"), 1)
+	ass.EqualInt(t, activities("/_sub/fast"), 1)
+
+	appendLines(t, e, "/logs", "first")
+
+	// appends only mark the stream dirty, as for subscriptions without an interval
+	ass.False(t, deferredFor("/_sub/slow"))
+
+	e.subAct.raiseActivity(now.Add(10 * time.Second))
+	ass.EqualInt(t, activities("/_sub/slow"), 1)
+	ass.EqualInt(t, activities("/_sub/fast"), 2)
+	ass.True(t, deferredFor("/_sub/slow"))
+	ass.EqualInt(t, e.subAct.deferred, 1)
+
+	e.subAct.raiseActivity(now.Add(61 * time.Second))
+	ass.EqualInt(t, activities("/_sub/slow"), 2)
+	ass.EqualInt(t, activities("/_sub/fast"), 2)
+	ass.False(t, deferredFor("/_sub/slow"))
+	ass.EqualInt(t, e.subAct.deferred, 0)
+}
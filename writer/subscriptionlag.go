@@ -0,0 +1,560 @@
+package writer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/boltdb/bolt"
+	"github.com/function61/eventhorizon/config"
+	"github.com/function61/eventhorizon/cursor"
+	"github.com/function61/eventhorizon/writer/replication"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"github.com/function61/eventhorizon/writer/types"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*	Pushers report the cursors their target has acked (see pusher/ackreporter.go),
+	and lag is the distance from those to the stream's head. Reports only update
+	the newest ack per stream and subscription in memory, and SubscriptionActivityTask
+	persists the ones that moved forward once per its interval, so many pushers
+	reporting don't each cost a write transaction. Acks not persisted yet are lost
+	on restart, as pushers only report an ack once. Lag then stays at the
+	persisted ack until the subscriber acks again.
+
+	_subscriptionacks:
+		/tenants\x00/_sub/foo => {"cursor": "/tenants:0:123:127.0.0.1", "acked_at": 1490000000000000000}
+
+	Bytes are exact if the acked cursor is in the live chunk, but lines and time
+	are not known for an arbitrary cursor. So for the streams that have acks, we
+	take checkpoints of the head along with _streamstats' counters, when
+	SubscriptionActivityTask sees that the stream moved and when a subscriber
+	acks the head:
+
+	_lagcheckpoints:
+		/tenants => [{"cursor": "/tenants:0:123:127.0.0.1", "lines": 12, "bytes": 345, "ts": 1490000000000000000}, ...]
+
+	Lag in lines counts from the last checkpoint at or before the acked cursor, so
+	it's an upper bound. Lag in seconds is the age of the first checkpoint after
+	it, i.e. when we first saw the stream move past it. Thinning keeps the recent
+	checkpoints dense and the old ones sparse.
+*/
+
+type subscriptionAck struct {
+	Cursor  string `json:"cursor"`
+	AckedAt int64  `json:"acked_at"` // unix nanos
+}
+
+type lagCheckpoint struct {
+	Cursor    string `json:"cursor"`
+	LineCount int64  `json:"lines"`
+	ByteCount int64  `json:"bytes"`
+	Timestamp int64  `json:"ts"` // unix nanos
+}
+
+// acks are only kept in memory here, without taking the lock. they're persisted in
+// batches by persistSubscriptionAcks()
+func (e *EventstoreWriter) ReportAckedCursors(req *types.ReportAckedCursorsRequest) error {
+	if req.SubscriptionId == "" {
+		return errors.New("ReportAckedCursors: SubscriptionId is required")
+	}
+
+	// only the leader persists them
+	if !e.IsLeader() {
+		return replication.ErrNotLeader
+	}
+
+	acked := []*cursor.Cursor{}
+
+	for _, cursorSerialized := range req.Cursors {
+		ackedCursor, err := cursor.CursorFromserialized(cursorSerialized)
+		if err != nil {
+			return err
+		}
+
+		// the client may not know yet that the stream was handed off. its next
+		// report will reach the new owner
+		if !e.ownsStream(ackedCursor.Stream) {
+			continue
+		}
+
+		acked = append(acked, ackedCursor)
+	}
+
+	e.pendingAcks.add(req.SubscriptionId, acked, time.Now())
+
+	return nil
+}
+
+// writes the acks reported since the last call in one transaction, skipping the
+// ones that are not ahead of what we already have. if that fails, the acks are
+// put back to be tried again, as pushers don't report them again
+func (e *EventstoreWriter) persistSubscriptionAcks() error {
+	acks := e.pendingAcks.take()
+	if len(acks) == 0 {
+		return nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	newer := []*pendingAck{}
+
+	if err := e.database.View(func(boltTx *bolt.Tx) error {
+		for _, ack := range acks {
+			// f.ex. deleted or handed off since
+			if !e.streamExists(ack.cursor.Stream, nil) {
+				continue
+			}
+
+			previous, err := getSubscriptionAck(ack.cursor.Stream, ack.subscriptionId, boltTx)
+			if err != nil {
+				return err
+			}
+
+			if previous == nil || ack.cursor.IsAheadComparedTo(cursor.CursorFromserializedMust(previous.Cursor)) {
+				newer = append(newer, ack)
+			}
+		}
+
+		return nil
+	}); err != nil {
+		e.pendingAcks.putBack(acks)
+
+		return err
+	}
+
+	// reports can arrive out of order, so they may be behind what we already have
+	if len(newer) == 0 {
+		return nil
+	}
+
+	tx := transaction.NewEventstoreTransaction(e.database)
+
+	if err := e.update(tx, func() error {
+		for _, ack := range newer {
+			ackJson, err := json.Marshal(&subscriptionAck{
+				Cursor:  ack.cursor.Serialize(),
+				AckedAt: ack.ackedAt.UnixNano(),
+			})
+			if err != nil {
+				return err
+			}
+
+			if err := tx.Put("_subscriptionacks", streamSubscriptionKey(ack.cursor.Stream, ack.subscriptionId), ackJson); err != nil {
+				return err
+			}
+
+			head, err := e.streamHead(ack.cursor.Stream, tx)
+			if err != nil {
+				return err
+			}
+
+			if ack.cursor.PositionEquals(head) {
+				if err := addLagCheckpoint(head, ack.ackedAt, tx); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}); err != nil {
+		e.pendingAcks.putBack(newer)
+
+		return err
+	}
+
+	return e.applySideEffects(tx)
+}
+
+type pendingAck struct {
+	subscriptionId string
+	cursor         *cursor.Cursor
+	ackedAt        time.Time
+}
+
+// acks reported since the last persistSubscriptionAcks(), the newest one per
+// stream and subscription. zero value is ready to use
+type pendingAcks struct {
+	mu   sync.Mutex
+	acks map[string]*pendingAck // streamSubscriptionKey => ack
+}
+
+func (p *pendingAcks) add(subscriptionId string, acked []*cursor.Cursor, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.acks == nil {
+		p.acks = map[string]*pendingAck{}
+	}
+
+	for _, ackedCursor := range acked {
+		key := string(streamSubscriptionKey(ackedCursor.Stream, subscriptionId))
+
+		// reports can arrive out of order
+		if previous, has := p.acks[key]; has && !ackedCursor.IsAheadComparedTo(previous.cursor) {
+			continue
+		}
+
+		p.acks[key] = &pendingAck{
+			subscriptionId: subscriptionId,
+			cursor:         ackedCursor,
+			ackedAt:        now,
+		}
+	}
+}
+
+func (p *pendingAcks) list() []*pendingAck {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	acks := []*pendingAck{}
+	for _, ack := range p.acks {
+		acks = append(acks, ack)
+	}
+
+	return acks
+}
+
+func (p *pendingAcks) take() []*pendingAck {
+	acks := p.list()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, ack := range acks {
+		key := string(streamSubscriptionKey(ack.cursor.Stream, ack.subscriptionId))
+
+		// a newer one may have been reported in between
+		if p.acks[key] == ack {
+			delete(p.acks, key)
+		}
+	}
+
+	return acks
+}
+
+// undoes take() for acks that could not be persisted, unless newer ones were
+// reported in between
+func (p *pendingAcks) putBack(acks []*pendingAck) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.acks == nil {
+		p.acks = map[string]*pendingAck{}
+	}
+
+	for _, ack := range acks {
+		key := string(streamSubscriptionKey(ack.cursor.Stream, ack.subscriptionId))
+
+		if previous, has := p.acks[key]; has && !ack.cursor.IsAheadComparedTo(previous.cursor) {
+			continue
+		}
+
+		p.acks[key] = ack
+	}
+}
+
+func (e *EventstoreWriter) SubscriptionStatus(subscriptionId string) (*types.SubscriptionStatusOutput, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	bySubscription := map[string]*types.SubscriptionStatus{}
+
+	err := e.database.View(func(boltTx *bolt.Tx) error {
+		acks := map[string]*subscriptionAck{}
+
+		if acksBucket := boltTx.Bucket([]byte("_subscriptionacks")); acksBucket != nil {
+			if err := acksBucket.ForEach(func(key []byte, ackJson []byte) error {
+				ack := &subscriptionAck{}
+				if err := json.Unmarshal(ackJson, ack); err != nil {
+					return err
+				}
+
+				acks[string(key)] = ack
+
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+
+		// not persisted yet
+		for _, pending := range e.pendingAcks.list() {
+			key := string(streamSubscriptionKey(pending.cursor.Stream, pending.subscriptionId))
+
+			if previous, has := acks[key]; has && !pending.cursor.IsAheadComparedTo(cursor.CursorFromserializedMust(previous.Cursor)) {
+				continue
+			}
+
+			acks[key] = &subscriptionAck{
+				Cursor:  pending.cursor.Serialize(),
+				AckedAt: pending.ackedAt.UnixNano(),
+			}
+		}
+
+		// in Bolt's order, i.e. by stream
+		keys := []string{}
+		for key := range acks {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		now := time.Now()
+
+		for _, key := range keys {
+			ack := acks[key]
+			streamAndSubscription := strings.SplitN(key, "\x00", 2)
+			streamName := streamAndSubscription[0]
+
+			if subscriptionId != "" && streamAndSubscription[1] != subscriptionId {
+				continue
+			}
+
+			// handed off, but not forgotten yet
+			if !e.streamExists(streamName, nil) {
+				continue
+			}
+
+			head, err := e.streamHead(streamName, nil)
+			if err != nil {
+				return err
+			}
+
+			stats, err := getStreamStats(streamName, boltTx)
+			if err != nil {
+				return err
+			}
+
+			streamStatus := streamLag(
+				cursor.CursorFromserializedMust(ack.Cursor),
+				head,
+				stats,
+				getLagCheckpoints(streamName, boltTx),
+				now)
+			streamStatus.AckedAt = time.Unix(0, ack.AckedAt).UTC()
+
+			if _, exists := bySubscription[streamAndSubscription[1]]; !exists {
+				bySubscription[streamAndSubscription[1]] = &types.SubscriptionStatus{
+					SubscriptionId: streamAndSubscription[1],
+					Streams:        []types.SubscriptionStreamStatus{},
+				}
+			}
+
+			bySubscription[streamAndSubscription[1]].AddStream(streamStatus)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	output := &types.SubscriptionStatusOutput{
+		Subscriptions: []types.SubscriptionStatus{},
+	}
+
+	for _, subscriptionStatus := range bySubscription {
+		output.Subscriptions = append(output.Subscriptions, *subscriptionStatus)
+	}
+
+	sort.Slice(output.Subscriptions, func(i, j int) bool {
+		return output.Subscriptions[i].SubscriptionId < output.Subscriptions[j].SubscriptionId
+	})
+
+	return output, nil
+}
+
+// lag doesn't need a report to grow, so this is refreshed periodically
+func (e *EventstoreWriter) updateSubscriptionLagMetrics() {
+	output, err := e.SubscriptionStatus("")
+	if err != nil {
+		log.Printf("EventstoreWriter: updateSubscriptionLagMetrics: %s", err.Error())
+		return
+	}
+
+	// forget unsubscribed ones
+	e.metrics.SubscriptionLagBytes.Reset()
+	e.metrics.SubscriptionLagLines.Reset()
+	e.metrics.SubscriptionLagSeconds.Reset()
+
+	for _, subscriptionStatus := range output.Subscriptions {
+		e.metrics.SubscriptionLagBytes.WithLabelValues(subscriptionStatus.SubscriptionId).Set(float64(subscriptionStatus.LagBytes))
+		e.metrics.SubscriptionLagLines.WithLabelValues(subscriptionStatus.SubscriptionId).Set(float64(subscriptionStatus.LagLines))
+		e.metrics.SubscriptionLagSeconds.WithLabelValues(subscriptionStatus.SubscriptionId).Set(float64(subscriptionStatus.LagSeconds))
+	}
+}
+
+func streamLag(acked *cursor.Cursor, head *cursor.Cursor, stats *streamStats, checkpoints []lagCheckpoint, now time.Time) types.SubscriptionStreamStatus {
+	status := types.SubscriptionStreamStatus{
+		Stream: head.Stream,
+		Acked:  acked.Serialize(),
+		Head:   head.Serialize(),
+	}
+
+	if !head.IsAheadComparedTo(acked) {
+		return status
+	}
+
+	var before *lagCheckpoint
+	var after *lagCheckpoint
+
+	for i := range checkpoints {
+		checkpointCursor := cursor.CursorFromserializedMust(checkpoints[i].Cursor)
+
+		if checkpointCursor.IsAheadComparedTo(acked) {
+			after = &checkpoints[i]
+			break
+		}
+
+		before = &checkpoints[i]
+	}
+
+	// without a checkpoint before it, the subscriber may be anywhere since the beginning
+	status.LagLines = stats.LineCount
+	status.LagBytes = stats.ByteCount
+
+	if before != nil {
+		status.LagLines = stats.LineCount - before.LineCount
+		status.LagBytes = stats.ByteCount - before.ByteCount
+
+		if beforeCursor := cursor.CursorFromserializedMust(before.Cursor); beforeCursor.Chunk == acked.Chunk {
+			status.LagBytes -= int64(acked.Offset - beforeCursor.Offset)
+		}
+	}
+
+	if acked.Chunk == head.Chunk {
+		status.LagBytes = int64(head.Offset - acked.Offset)
+	}
+
+	// no checkpoint after it => the stream moved past it after the latest one
+	if after != nil {
+		status.LagSeconds = int64(now.Sub(time.Unix(0, after.Timestamp)) / time.Second)
+	}
+
+	return status
+}
+
+func getLagCheckpoints(streamName string, tx *bolt.Tx) []lagCheckpoint {
+	checkpoints := []lagCheckpoint{}
+
+	checkpointsBucket := tx.Bucket([]byte("_lagcheckpoints"))
+	if checkpointsBucket == nil {
+		return checkpoints
+	}
+
+	checkpointsJson := checkpointsBucket.Get([]byte(streamName))
+	if checkpointsJson == nil {
+		return checkpoints
+	}
+
+	if err := json.Unmarshal(checkpointsJson, &checkpoints); err != nil {
+		panic(err) // we wrote it
+	}
+
+	return checkpoints
+}
+
+// head must be the stream's head, as _streamstats' counters are
+func addLagCheckpoint(head *cursor.Cursor, now time.Time, tx *transaction.EventstoreTransaction) error {
+	checkpoints := getLagCheckpoints(head.Stream, tx.BoltTx)
+
+	if len(checkpoints) > 0 && cursor.CursorFromserializedMust(checkpoints[len(checkpoints)-1].Cursor).PositionEquals(head) {
+		return nil // the earlier time is the one that matters
+	}
+
+	stats, err := getStreamStats(head.Stream, tx.BoltTx)
+	if err != nil {
+		return err
+	}
+
+	checkpoints = thinLagCheckpoints(append(checkpoints, lagCheckpoint{
+		Cursor:    head.Serialize(),
+		LineCount: stats.LineCount,
+		ByteCount: stats.ByteCount,
+		Timestamp: now.UnixNano(),
+	}), config.LagCheckpointsMax)
+
+	checkpointsJson, err := json.Marshal(checkpoints)
+	if err != nil {
+		return err
+	}
+
+	return tx.Put("_lagcheckpoints", []byte(head.Stream), checkpointsJson)
+}
+
+// drops every other checkpoint of the older half if there are more than max
+func thinLagCheckpoints(checkpoints []lagCheckpoint, max int) []lagCheckpoint {
+	if len(checkpoints) <= max {
+		return checkpoints
+	}
+
+	olderHalf := len(checkpoints) - max/2
+
+	thinned := []lagCheckpoint{}
+
+	for i := 0; i < olderHalf; i += 2 {
+		thinned = append(thinned, checkpoints[i])
+	}
+
+	return append(thinned, checkpoints[olderHalf:]...)
+}
+
+// nil if not acked
+func getSubscriptionAck(streamName string, subscriptionId string, tx *bolt.Tx) (*subscriptionAck, error) {
+	acksBucket := tx.Bucket([]byte("_subscriptionacks"))
+	if acksBucket == nil {
+		return nil, nil
+	}
+
+	ackJson := acksBucket.Get(streamSubscriptionKey(streamName, subscriptionId))
+	if ackJson == nil {
+		return nil, nil
+	}
+
+	ack := &subscriptionAck{}
+	if err := json.Unmarshal(ackJson, ack); err != nil {
+		return nil, err
+	}
+
+	return ack, nil
+}
+
+// no need for checkpoints if nobody has reported acks
+func hasSubscriptionAcks(streamName string, tx *bolt.Tx) bool {
+	acksBucket := tx.Bucket([]byte("_subscriptionacks"))
+	if acksBucket == nil {
+		return false
+	}
+
+	prefix := streamSubscriptionKey(streamName, "")
+
+	key, _ := acksBucket.Cursor().Seek(prefix)
+
+	return key != nil && bytes.HasPrefix(key, prefix)
+}
+
+func forgetSubscriptionAcks(streamName string, tx *transaction.EventstoreTransaction) error {
+	if acksBucket := tx.BoltTx.Bucket([]byte("_subscriptionacks")); acksBucket != nil {
+		prefix := streamSubscriptionKey(streamName, "")
+
+		// not deleting while iterating
+		keys := [][]byte{}
+
+		c := acksBucket.Cursor()
+		for key, _ := c.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = c.Next() {
+			keys = append(keys, append([]byte{}, key...))
+		}
+
+		for _, key := range keys {
+			if err := tx.Delete("_subscriptionacks", key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Delete("_lagcheckpoints", []byte(streamName))
+}
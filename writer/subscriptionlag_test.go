@@ -0,0 +1,195 @@
+package writer
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/function61/eventhorizon/cursor"
+	"github.com/function61/eventhorizon/util/ass"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"github.com/function61/eventhorizon/writer/types"
+	"testing"
+	"time"
+)
+
+func TestStreamLag(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+
+	head := cursor.New("/t", 1, 500, "127.0.0.1")
+	stats := &streamStats{LineCount: 100, ByteCount: 5000}
+	checkpoints := []lagCheckpoint{
+		{Cursor: "/t:0:100:127.0.0.1", LineCount: 10, ByteCount: 100, Timestamp: now.Add(-60 * time.Second).UnixNano()},
+		{Cursor: "/t:1:200:127.0.0.1", LineCount: 60, ByteCount: 4500, Timestamp: now.Add(-30 * time.Second).UnixNano()},
+		{Cursor: "/t:1:400:127.0.0.1", LineCount: 90, ByteCount: 4900, Timestamp: now.Add(-10 * time.Second).UnixNano()},
+	}
+
+	lag := func(acked string) (int64, int64, int64) {
+		status := streamLag(cursor.CursorFromserializedMust(acked), head, stats, checkpoints, now)
+		return status.LagBytes, status.LagLines, status.LagSeconds
+	}
+
+	// in the live chunk => bytes exact
+	bytes, lines, seconds := lag("/t:1:250:127.0.0.1")
+	ass.EqualInt(t, int(bytes), 250)
+	ass.EqualInt(t, int(lines), 40)
+	ass.EqualInt(t, int(seconds), 10)
+
+	bytes, lines, seconds = lag("/t:0:150:127.0.0.1")
+	ass.EqualInt(t, int(bytes), 4850)
+	ass.EqualInt(t, int(lines), 90)
+	ass.EqualInt(t, int(seconds), 30)
+
+	// moved past the latest checkpoint only just now
+	bytes, lines, seconds = lag("/t:1:450:127.0.0.1")
+	ass.EqualInt(t, int(bytes), 50)
+	ass.EqualInt(t, int(lines), 10)
+	ass.EqualInt(t, int(seconds), 0)
+
+	bytes, lines, seconds = lag("/t:1:500:127.0.0.1")
+	ass.EqualInt(t, int(bytes), 0)
+	ass.EqualInt(t, int(lines), 0)
+	ass.EqualInt(t, int(seconds), 0)
+}
+
+func TestThinLagCheckpoints(t *testing.T) {
+	checkpoints := []lagCheckpoint{}
+	for i := 0; i < 9; i++ {
+		checkpoints = append(checkpoints, lagCheckpoint{LineCount: int64(i)})
+	}
+
+	ass.EqualInt(t, len(thinLagCheckpoints(checkpoints[0:8], 8)), 8)
+
+	thinned := thinLagCheckpoints(checkpoints, 8)
+	ass.EqualInt(t, len(thinned), 7)
+	ass.EqualInt(t, int(thinned[1].LineCount), 2)
+	ass.EqualInt(t, int(thinned[2].LineCount), 4)
+	ass.EqualInt(t, int(thinned[3].LineCount), 5)
+	ass.EqualInt(t, int(thinned[6].LineCount), 8)
+}
+
+func TestAddLagCheckpoint(t *testing.T) {
+	withTestDatabase(t, func(tx *transaction.EventstoreTransaction) error {
+		now := time.Now()
+
+		ass.True(t, saveStreamStats("/t", &streamStats{LineCount: 3, ByteCount: 30}, tx) == nil)
+
+		ass.True(t, addLagCheckpoint(cursor.New("/t", 0, 30, "127.0.0.1"), now, tx) == nil)
+		// same position again keeps the earlier time
+		ass.True(t, addLagCheckpoint(cursor.New("/t", 0, 30, "127.0.0.1"), now.Add(time.Second), tx) == nil)
+
+		checkpoints := getLagCheckpoints("/t", tx.BoltTx)
+		ass.EqualInt(t, len(checkpoints), 1)
+		ass.EqualInt(t, int(checkpoints[0].LineCount), 3)
+		ass.True(t, checkpoints[0].Timestamp == now.UnixNano())
+
+		ass.False(t, hasSubscriptionAcks("/t", tx.BoltTx))
+		ass.True(t, tx.Put("_subscriptionacks", streamSubscriptionKey("/t", "/_sub/foo"), []byte("{}")) == nil)
+		ass.True(t, hasSubscriptionAcks("/t", tx.BoltTx))
+		ass.False(t, hasSubscriptionAcks("/", tx.BoltTx))
+
+		ass.True(t, forgetSubscriptionAcks("/t", tx) == nil)
+		ass.False(t, hasSubscriptionAcks("/t", tx.BoltTx))
+		ass.EqualInt(t, len(getLagCheckpoints("/t", tx.BoltTx)), 0)
+
+		return nil
+	})
+}
+
+func TestReportAckedCursors(t *testing.T) {
+	e, cleanup := newTestWriter(t)
+	defer cleanup()
+
+	_, err := e.CreateStream(&types.CreateStreamRequest{Name: "/foo"})
+	ass.True(t, err == nil)
+
+	appendLines(t, e, "/foo", "first")
+
+	middle, err := e.streamHead("/foo", nil)
+	ass.True(t, err == nil)
+
+	appendLines(t, e, "/foo", "second")
+
+	head, err := e.streamHead("/foo", nil)
+	ass.True(t, err == nil)
+
+	report := func(acked *cursor.Cursor) {
+		ass.True(t, e.ReportAckedCursors(&types.ReportAckedCursorsRequest{
+			SubscriptionId: "/_sub/bar",
+			Cursors:        []string{acked.Serialize()},
+		}) == nil)
+	}
+
+	ackedInStatus := func() string {
+		output, err := e.SubscriptionStatus("/_sub/bar")
+		ass.True(t, err == nil)
+		ass.EqualInt(t, len(output.Subscriptions), 1)
+		return output.Subscriptions[0].Streams[0].Acked
+	}
+
+	persisted := func() (ack string, checkpoints int) {
+		ass.True(t, e.database.View(func(boltTx *bolt.Tx) error {
+			stored, err := getSubscriptionAck("/foo", "/_sub/bar", boltTx)
+			ass.True(t, err == nil)
+			if stored != nil {
+				ack = stored.Cursor
+			}
+
+			checkpoints = len(getLagCheckpoints("/foo", boltTx))
+
+			return nil
+		}) == nil)
+		return
+	}
+
+	report(head)
+	report(middle) // moves backwards => ignored
+
+	// visible before persisting
+	ass.EqualString(t, ackedInStatus(), head.Serialize())
+
+	ack, checkpoints := persisted()
+	ass.EqualString(t, ack, "")
+
+	ass.True(t, e.persistSubscriptionAcks() == nil)
+	ass.EqualInt(t, len(e.pendingAcks.list()), 0)
+
+	// acked the head => checkpoint
+	ack, checkpoints = persisted()
+	ass.EqualString(t, ack, head.Serialize())
+	ass.EqualInt(t, checkpoints, 1)
+
+	// persisted ack is not overwritten by an older one
+	report(middle)
+	ass.EqualString(t, ackedInStatus(), head.Serialize())
+	ass.True(t, e.persistSubscriptionAcks() == nil)
+
+	ack, _ = persisted()
+	ass.EqualString(t, ack, head.Serialize())
+}
+
+// acks that failed to persist are tried again, unless newer ones were reported
+func TestPendingAcksPutBack(t *testing.T) {
+	acks := pendingAcks{}
+
+	now := time.Now()
+
+	acks.add("/_sub/bar", []*cursor.Cursor{
+		cursor.New("/foo", 0, 10, "127.0.0.1"),
+		cursor.New("/baz", 0, 10, "127.0.0.1"),
+	}, now)
+
+	taken := acks.take()
+	ass.EqualInt(t, len(taken), 2)
+	ass.EqualInt(t, len(acks.list()), 0)
+
+	acks.add("/_sub/bar", []*cursor.Cursor{cursor.New("/foo", 0, 20, "127.0.0.1")}, now)
+
+	acks.putBack(taken)
+
+	offsets := map[string]int{}
+	for _, ack := range acks.list() {
+		offsets[ack.cursor.Stream] = ack.cursor.Offset
+	}
+
+	ass.EqualInt(t, len(offsets), 2)
+	ass.EqualInt(t, offsets["/foo"], 20)
+	ass.EqualInt(t, offsets["/baz"], 10)
+}
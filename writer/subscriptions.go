@@ -1,7 +1,13 @@
 package writer
 
 import (
+	"bytes"
+	"encoding/json"
 	"github.com/boltdb/bolt"
+	"github.com/function61/eventhorizon/metaevents"
+	"github.com/function61/eventhorizon/util/stringslice"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"strconv"
 	"strings"
 )
 
@@ -10,33 +16,234 @@ func subscriptionStreamPath(subscriptionId string) string {
 }
 
 func getSubscriptionsForStream(streamName string, tx *bolt.Tx) []string {
-	streamSubscriptionsBucket, err := tx.CreateBucketIfNotExists([]byte("_streamsubscriptions"))
-	if err != nil {
-		panic(err)
+	return getSubscriptionList("_streamsubscriptions", streamName, tx)
+}
+
+func saveSubscriptionsForStream(streamName string, subscriptions []string, tx *transaction.EventstoreTransaction) error {
+	return saveSubscriptionList("_streamsubscriptions", streamName, subscriptions, tx)
+}
+
+// subscriptions (made with "/tenants/**") that child streams created afterwards
+// inherit. these are in getSubscriptionsForStream() as well, and child streams
+// inherit them as recursive too, so the subscription covers all descendants
+func getRecursiveSubscriptionsForStream(streamName string, tx *bolt.Tx) []string {
+	return getSubscriptionList("_recursivesubscriptions", streamName, tx)
+}
+
+func saveRecursiveSubscriptionsForStream(streamName string, subscriptions []string, tx *transaction.EventstoreTransaction) error {
+	return saveSubscriptionList("_recursivesubscriptions", streamName, subscriptions, tx)
+}
+
+// subscription streams never inherit subscriptions, because that would cause an
+// endless SubscriptionActivity notification loop
+func inheritsSubscriptions(streamName string) bool {
+	return streamName != "/_sub" && !strings.HasPrefix(streamName, subscriptionStreamPath(""))
+}
+
+// nil if the subscription has no filter, i.e. it's notified about every line
+func getSubscriptionFilter(streamName string, subscriptionId string, tx *bolt.Tx) *metaevents.SubscriptionFilter {
+	return getSubscriptionFiltersForStream(streamName, tx)[subscriptionId]
+}
+
+// only the subscriptions that have a filter
+func getSubscriptionFiltersForStream(streamName string, tx *bolt.Tx) map[string]*metaevents.SubscriptionFilter {
+	filters := map[string]*metaevents.SubscriptionFilter{}
+
+	filtersBucket := tx.Bucket([]byte("_subscriptionfilters"))
+	if filtersBucket == nil {
+		return filters
 	}
 
-	subscriptionsSerialized := streamSubscriptionsBucket.Get([]byte(streamName))
+	prefix := streamSubscriptionKey(streamName, "")
 
-	if subscriptionsSerialized == nil {
-		return []string{}
+	c := filtersBucket.Cursor()
+	for key, filterJson := c.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, filterJson = c.Next() {
+		filter := &metaevents.SubscriptionFilter{}
+		if err := json.Unmarshal(filterJson, filter); err != nil {
+			panic(err) // we wrote it
+		}
+
+		filters[string(key[len(prefix):])] = filter
 	}
 
-	return strings.Split(string(subscriptionsSerialized), ",")
+	return filters
 }
 
-func saveSubscriptionsForStream(streamName string, subscriptions []string, tx *bolt.Tx) error {
-	streamSubscriptionsBucket, err := tx.CreateBucketIfNotExists([]byte("_streamsubscriptions"))
+// nil or empty filter removes it
+func saveSubscriptionFilter(streamName string, subscriptionId string, filter *metaevents.SubscriptionFilter, tx *transaction.EventstoreTransaction) error {
+	if filter == nil || filter.IsEmpty() {
+		return tx.Delete("_subscriptionfilters", streamSubscriptionKey(streamName, subscriptionId))
+	}
+
+	filterJson, err := json.Marshal(filter)
 	if err != nil {
 		return err
 	}
 
+	return tx.Put("_subscriptionfilters", streamSubscriptionKey(streamName, subscriptionId), filterJson)
+}
+
+func saveSubscriptionFiltersForStream(streamName string, filters map[string]*metaevents.SubscriptionFilter, tx *transaction.EventstoreTransaction) error {
+	for subscriptionId := range getSubscriptionFiltersForStream(streamName, tx.BoltTx) {
+		if err := saveSubscriptionFilter(streamName, subscriptionId, nil, tx); err != nil {
+			return err
+		}
+	}
+
+	for subscriptionId, filter := range filters {
+		if err := saveSubscriptionFilter(streamName, subscriptionId, filter, tx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// only the subscriptions that have an activity interval (milliseconds). they're
+// notified at most this often, see SubscriptionActivityTask
+func getSubscriptionActivityIntervalsForStream(streamName string, tx *bolt.Tx) map[string]int64 {
+	intervals := map[string]int64{}
+
+	intervalsBucket := tx.Bucket([]byte("_subscriptionintervals"))
+	if intervalsBucket == nil {
+		return intervals
+	}
+
+	prefix := streamSubscriptionKey(streamName, "")
+
+	c := intervalsBucket.Cursor()
+	for key, intervalMs := c.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, intervalMs = c.Next() {
+		parsed, err := strconv.ParseInt(string(intervalMs), 10, 64)
+		if err != nil {
+			panic(err) // we wrote it
+		}
+
+		intervals[string(key[len(prefix):])] = parsed
+	}
+
+	return intervals
+}
+
+// zero removes it
+func saveSubscriptionActivityInterval(streamName string, subscriptionId string, intervalMs int64, tx *transaction.EventstoreTransaction) error {
+	if intervalMs == 0 {
+		return tx.Delete("_subscriptionintervals", streamSubscriptionKey(streamName, subscriptionId))
+	}
+
+	return tx.Put("_subscriptionintervals", streamSubscriptionKey(streamName, subscriptionId), []byte(strconv.FormatInt(intervalMs, 10)))
+}
+
+func saveSubscriptionActivityIntervalsForStream(streamName string, intervals map[string]int64, tx *transaction.EventstoreTransaction) error {
+	for subscriptionId := range getSubscriptionActivityIntervalsForStream(streamName, tx.BoltTx) {
+		if err := saveSubscriptionActivityInterval(streamName, subscriptionId, 0, tx); err != nil {
+			return err
+		}
+	}
+
+	for subscriptionId, intervalMs := range intervals {
+		if err := saveSubscriptionActivityInterval(streamName, subscriptionId, intervalMs, tx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// the Subscribed event wakes up the subscriber even if it has a filter, so it
+// notices the subscription
+func subscribedIn(subscriptionId string, rawLines string) bool {
+	if !strings.Contains(rawLines, "/"+metaevents.SubscribedId+" ") {
+		return false
+	}
+
+	for _, line := range strings.Split(rawLines, "\n") {
+		if !strings.HasPrefix(line, "/"+metaevents.SubscribedId+" ") {
+			continue
+		}
+
+		if _, _, event := metaevents.Parse(line); event.(metaevents.Subscribed).SubscriptionId == subscriptionId {
+			return true
+		}
+	}
+
+	return false
+}
+
+// and activity intervals. also their subscriptions' pending notifications
+func forgetSubscriptionFilters(streamName string, tx *transaction.EventstoreTransaction) error {
+	for subscriptionId := range getSubscriptionActivityIntervalsForStream(streamName, tx.BoltTx) {
+		if err := saveSubscriptionActivityInterval(streamName, subscriptionId, 0, tx); err != nil {
+			return err
+		}
+
+		if err := tx.Delete("_dirtyfiltered", streamSubscriptionKey(streamName, subscriptionId)); err != nil {
+			return err
+		}
+	}
+
+	for subscriptionId := range getSubscriptionFiltersForStream(streamName, tx.BoltTx) {
+		if err := saveSubscriptionFilter(streamName, subscriptionId, nil, tx); err != nil {
+			return err
+		}
+
+		if err := tx.Delete("_dirtyfiltered", streamSubscriptionKey(streamName, subscriptionId)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// "/tenants\x00/_sub/foo"
+func streamSubscriptionKey(streamName string, subscriptionId string) []byte {
+	return []byte(streamName + "\x00" + subscriptionId)
+}
+
+func getSubscriptionList(bucketName string, streamName string, tx *bolt.Tx) []string {
+	// not creating the bucket, because read-only transactions cannot
+	subscriptionsBucket := tx.Bucket([]byte(bucketName))
+	if subscriptionsBucket == nil {
+		return []string{}
+	}
+
+	subscriptionsSerialized := subscriptionsBucket.Get([]byte(streamName))
+
+	if subscriptionsSerialized == nil {
+		return []string{}
+	}
+
+	return strings.Split(string(subscriptionsSerialized), ",")
+}
+
+func saveSubscriptionList(bucketName string, streamName string, subscriptions []string, tx *transaction.EventstoreTransaction) error {
 	// when empty, don't store empty string because that would:
 	// 1) consume unnecessary space 2) yield [""] (len=1) when deserializing
 	if len(subscriptions) == 0 {
-		return streamSubscriptionsBucket.Delete([]byte(streamName))
+		return tx.Delete(bucketName, []byte(streamName))
 	}
 
 	subscriptionsSerialized := strings.Join(subscriptions, ",")
 
-	return streamSubscriptionsBucket.Put([]byte(streamName), []byte(subscriptionsSerialized))
+	return tx.Put(bucketName, []byte(streamName), []byte(subscriptionsSerialized))
+}
+
+// reverse lookup of getSubscriptionsForStream(). this is a full scan, so don't
+// use it in hot paths
+func getStreamsSubscribedTo(subscriptionId string, tx *bolt.Tx) []string {
+	streams := []string{}
+
+	streamSubscriptionsBucket := tx.Bucket([]byte("_streamsubscriptions"))
+	if streamSubscriptionsBucket == nil {
+		return streams
+	}
+
+	streamSubscriptionsBucket.ForEach(func(streamName []byte, subscriptionsSerialized []byte) error {
+		if stringslice.ItemIndex(subscriptionId, strings.Split(string(subscriptionsSerialized), ",")) != -1 {
+			streams = append(streams, string(streamName))
+		}
+
+		return nil
+	})
+
+	return streams
 }
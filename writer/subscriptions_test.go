@@ -0,0 +1,171 @@
+package writer
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/function61/eventhorizon/metaevents"
+	"github.com/function61/eventhorizon/util/ass"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"github.com/function61/eventhorizon/writer/types"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecursiveSubscriptionStream(t *testing.T) {
+	streamName, recursive := types.RecursiveSubscriptionStream("/tenants/**")
+	ass.EqualString(t, streamName, "/tenants")
+	ass.True(t, recursive)
+
+	streamName, recursive = types.RecursiveSubscriptionStream("/**")
+	ass.EqualString(t, streamName, "/")
+	ass.True(t, recursive)
+
+	streamName, recursive = types.RecursiveSubscriptionStream("/tenants")
+	ass.EqualString(t, streamName, "/tenants")
+	ass.False(t, recursive)
+}
+
+func TestRecursiveSubscriptions(t *testing.T) {
+	withTestDatabase(t, func(tx *transaction.EventstoreTransaction) error {
+		ass.True(t, saveSubscriptionsForStream("/tenants", []string{"/_sub/a", "/_sub/b"}, tx) == nil)
+		ass.True(t, saveRecursiveSubscriptionsForStream("/tenants", []string{"/_sub/b"}, tx) == nil)
+
+		ass.EqualString(t, strings.Join(getSubscriptionsForStream("/tenants", tx.BoltTx), ","), "/_sub/a,/_sub/b")
+		ass.EqualString(t, strings.Join(getRecursiveSubscriptionsForStream("/tenants", tx.BoltTx), ","), "/_sub/b")
+		ass.EqualInt(t, len(getRecursiveSubscriptionsForStream("/tenants/foo", tx.BoltTx)), 0)
+
+		ass.True(t, saveRecursiveSubscriptionsForStream("/tenants", []string{}, tx) == nil)
+		ass.EqualInt(t, len(getRecursiveSubscriptionsForStream("/tenants", tx.BoltTx)), 0)
+
+		return nil
+	})
+
+	ass.True(t, inheritsSubscriptions("/tenants/foo"))
+	ass.False(t, inheritsSubscriptions("/_sub"))
+	ass.False(t, inheritsSubscriptions("/_sub/foo"))
+}
+
+func TestRecursiveUnsubscribe(t *testing.T) {
+	e, cleanup := newTestWriter(t)
+	defer cleanup()
+
+	for _, streamName := range []string{"/tenants", "/_sub/a", "/_sub/b"} {
+		_, err := e.CreateStream(&types.CreateStreamRequest{Name: streamName})
+		ass.True(t, err == nil)
+	}
+
+	ass.True(t, e.SubscribeToStream("/tenants/**", "/_sub/a", nil, 0) == nil)
+
+	for _, streamName := range []string{"/tenants/foo", "/tenants/foo/bar", "/tenants/baz"} {
+		_, err := e.CreateStream(&types.CreateStreamRequest{Name: streamName})
+		ass.True(t, err == nil)
+	}
+
+	// of its own, so it stays
+	ass.True(t, e.SubscribeToStream("/tenants/baz", "/_sub/b", nil, 0) == nil)
+	ass.True(t, e.UnsubscribeFromStream("/tenants/baz", "/_sub/a") == nil)
+	ass.True(t, e.SubscribeToStream("/tenants/baz", "/_sub/a", nil, 0) == nil)
+
+	ass.True(t, e.UnsubscribeFromStream("/tenants/**", "/_sub/a") == nil)
+
+	ass.True(t, e.database.View(func(boltTx *bolt.Tx) error {
+		for _, streamName := range []string{"/tenants", "/tenants/foo", "/tenants/foo/bar"} {
+			ass.EqualInt(t, len(getSubscriptionsForStream(streamName, boltTx)), 0)
+			ass.EqualInt(t, len(getRecursiveSubscriptionsForStream(streamName, boltTx)), 0)
+		}
+
+		ass.EqualString(t, strings.Join(getSubscriptionsForStream("/tenants/baz", boltTx), ","), "/_sub/b,/_sub/a")
+
+		return nil
+	}) == nil)
+
+	ass.True(t, strings.Contains(readLiveChunk(t, e, "/tenants/foo/bar/_/0.log"), "/Unsubscribed {\"subscription_id\":\"/_sub/a\""))
+}
+
+func TestSubscriptionFilters(t *testing.T) {
+	withTestDatabase(t, func(tx *transaction.EventstoreTransaction) error {
+		onlyErrors := &metaevents.SubscriptionFilter{LinePrefix: "ERROR"}
+
+		ass.True(t, saveSubscriptionFilter("/logs", "/_sub/alerts", onlyErrors, tx) == nil)
+		ass.True(t, saveSubscriptionFilter("/logs", "/_sub/all", &metaevents.SubscriptionFilter{}, tx) == nil)
+		ass.True(t, saveSubscriptionFilter("/logs/foo", "/_sub/other", onlyErrors, tx) == nil)
+
+		// empty filter is not stored, and /logs/foo is not /logs
+		filters := getSubscriptionFiltersForStream("/logs", tx.BoltTx)
+		ass.EqualInt(t, len(filters), 1)
+		ass.EqualString(t, filters["/_sub/alerts"].LinePrefix, "ERROR")
+		ass.True(t, getSubscriptionFilter("/logs", "/_sub/all", tx.BoltTx) == nil)
+
+		ass.True(t, forgetSubscriptionFilters("/logs", tx) == nil)
+		ass.EqualInt(t, len(getSubscriptionFiltersForStream("/logs", tx.BoltTx)), 0)
+		ass.EqualInt(t, len(getSubscriptionFiltersForStream("/logs/foo", tx.BoltTx)), 1)
+
+		return nil
+	})
+}
+
+func TestSubscriptionActivityIntervals(t *testing.T) {
+	withTestDatabase(t, func(tx *transaction.EventstoreTransaction) error {
+		ass.True(t, saveSubscriptionActivityInterval("/logs", "/_sub/slow", 60000, tx) == nil)
+		ass.True(t, saveSubscriptionActivityInterval("/logs", "/_sub/fast", 0, tx) == nil)
+		ass.True(t, saveSubscriptionActivityInterval("/logs/foo", "/_sub/slow", 1000, tx) == nil)
+		ass.True(t, tx.Put("_dirtyfiltered", streamSubscriptionKey("/logs", "/_sub/slow"), []byte("/logs:0:10")) == nil)
+
+		// zero is not stored, and /logs/foo is not /logs
+		intervals := getSubscriptionActivityIntervalsForStream("/logs", tx.BoltTx)
+		ass.EqualInt(t, len(intervals), 1)
+		ass.EqualInt(t, int(intervals["/_sub/slow"]), 60000)
+
+		ass.True(t, saveSubscriptionActivityIntervalsForStream("/logs", map[string]int64{"/_sub/fast": 10}, tx) == nil)
+		intervals = getSubscriptionActivityIntervalsForStream("/logs", tx.BoltTx)
+		ass.EqualInt(t, len(intervals), 1)
+		ass.EqualInt(t, int(intervals["/_sub/fast"]), 10)
+
+		ass.True(t, saveSubscriptionActivityIntervalsForStream("/logs", map[string]int64{"/_sub/slow": 60000}, tx) == nil)
+
+		// also the deferred activity
+		ass.True(t, forgetSubscriptionFilters("/logs", tx) == nil)
+		ass.EqualInt(t, len(getSubscriptionActivityIntervalsForStream("/logs", tx.BoltTx)), 0)
+		ass.EqualInt(t, len(getSubscriptionActivityIntervalsForStream("/logs/foo", tx.BoltTx)), 1)
+		ass.True(t, tx.BoltTx.Bucket([]byte("_dirtyfiltered")).Get(streamSubscriptionKey("/logs", "/_sub/slow")) == nil)
+
+		return nil
+	})
+}
+
+func TestSubscribedIn(t *testing.T) {
+	lines := " foo\n" + metaevents.NewSubscribed("/_sub/a").Serialize()
+
+	ass.True(t, subscribedIn("/_sub/a", lines))
+	ass.False(t, subscribedIn("/_sub/b", lines))
+	ass.False(t, subscribedIn("/_sub/a", " /Subscribed\n"))
+}
+
+func TestFilteredActivityForManySubscriptions(t *testing.T) {
+	e, cleanup := newTestWriter(t)
+	defer cleanup()
+
+	subscriptions := []string{"/_sub/a", "/_sub/b", "/_sub/c"}
+
+	for _, streamName := range append([]string{"/logs"}, subscriptions...) {
+		_, err := e.CreateStream(&types.CreateStreamRequest{Name: streamName})
+		ass.True(t, err == nil)
+	}
+
+	for _, subscriptionId := range subscriptions {
+		ass.True(t, e.SubscribeToStream("/logs", subscriptionId, &metaevents.SubscriptionFilter{LinePrefix: "ERROR"}, 0) == nil)
+	}
+
+	appendLines(t, e, "/logs", "ERROR disk full")
+
+	e.subAct.raiseActivity(time.Now())
+
+	for _, subscriptionId := range subscriptions {
+		ass.True(t, strings.Contains(readLiveChunk(t, e, subscriptionId+"/_/0.log"), "/"+metaevents.SubscriptionActivityId+" "))
+	}
+
+	ass.True(t, e.database.View(func(boltTx *bolt.Tx) error {
+		ass.EqualInt(t, boltTx.Bucket([]byte("_dirtyfiltered")).Stats().KeyN, 0)
+		return nil
+	}) == nil)
+}
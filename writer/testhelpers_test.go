@@ -0,0 +1,242 @@
+package writer
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/function61/eventhorizon/config"
+	ctypes "github.com/function61/eventhorizon/config/types"
+	"github.com/function61/eventhorizon/scalablestore"
+	"github.com/function61/eventhorizon/writer/longtermshipper"
+	"github.com/function61/eventhorizon/writer/transaction"
+	"github.com/function61/eventhorizon/writer/types"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// runs fn inside a read-write transaction of a throwaway database
+func withTestDatabase(t *testing.T, fn func(tx *transaction.EventstoreTransaction) error) {
+	dbFile, err := ioutil.TempFile("", "writer_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dbFile.Name())
+	dbFile.Close()
+
+	db, err := bolt.Open(dbFile.Name(), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Update(func(boltTx *bolt.Tx) error {
+		tx := transaction.NewEventstoreTransaction(db)
+		tx.BoltTx = boltTx
+
+		return fn(tx)
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// records what would have been shipped to scalablestore
+type testShipper struct {
+	*longtermshipper.Shipper // only for marking in the transaction
+	mu                       sync.Mutex
+	shipped                  []string
+	shippedFiles             map[string]string // chunk path => file path
+	purged                   []string
+}
+
+func (s *testShipper) Ship(ltsf *types.LongTermShippableFile, database *bolt.DB) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.shipped = append(s.shipped, ltsf.Block.ToChunkPath())
+
+	if s.shippedFiles == nil {
+		s.shippedFiles = map[string]string{}
+	}
+	s.shippedFiles[ltsf.Block.ToChunkPath()] = ltsf.FilePath
+}
+
+func (s *testShipper) Purge(streamName string, database *bolt.DB) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.purged = append(s.purged, streamName)
+}
+
+func (s *testShipper) Close() {}
+
+// in-memory scalablestore
+type testScalableStore struct {
+	objects map[string][]byte
+}
+
+func newTestScalableStore() *testScalableStore {
+	return &testScalableStore{objects: map[string][]byte{}}
+}
+
+func (s *testScalableStore) List(prefix string) ([]scalablestore.ScalableStoreObject, error) {
+	objects := []scalablestore.ScalableStoreObject{}
+
+	for _, key := range s.keys(prefix) {
+		objects = append(objects, scalablestore.ScalableStoreObject{
+			Key:          key,
+			Size:         int64(len(s.objects[key])),
+			LastModified: time.Now(),
+		})
+	}
+
+	return objects, nil
+}
+
+func (s *testScalableStore) Put(key string, body io.ReadSeeker) error {
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	s.objects[key] = content
+
+	return nil
+}
+
+func (s *testScalableStore) Delete(key string) error {
+	delete(s.objects, key)
+
+	return nil
+}
+
+// sorted like S3 lists them
+func (s *testScalableStore) keys(prefix string) []string {
+	keys := []string{}
+
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+type testPublisher struct {
+	mu        sync.Mutex
+	published []string // "topic message"
+}
+
+func (p *testPublisher) Publish(topic string, message string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.published = append(p.published, topic+" "+message)
+}
+
+func (p *testPublisher) Close() {}
+
+// a Writer with the built-in streams, in a temp dir. see openTestWriter()
+func newTestWriter(t *testing.T) (*EventstoreWriter, func()) {
+	dir, err := ioutil.TempDir("", "writer_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := openTestWriter(dir)
+
+	for _, streamName := range []string{"/", "/_sub"} {
+		if _, err := e.CreateStream(&types.CreateStreamRequest{Name: streamName}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return e, func() {
+		closeTestWriter(e)
+		os.RemoveAll(dir)
+	}
+}
+
+// opens (or re-opens) a Writer whose data is in dir. only group commit of the
+// background tasks runs, chunks are not shipped and nothing is published
+func openTestWriter(dir string) *EventstoreWriter {
+	config.WalManagerDataDir = dir + "/store-live"
+	config.WalSegmentsDir = dir + "/wal-segments"
+	config.FollowerDataDir = dir + "/store-follower"
+	dbLocation = dir + "/eventstore.boltdb"
+
+	e := &EventstoreWriter{
+		streamToChunkName: map[string]*types.ChunkSpec{},
+		shipper:           &testShipper{Shipper: &longtermshipper.Shipper{}},
+		pubSubClient:      &testPublisher{},
+		metrics:           NewMetrics(),
+		confCtx:           config.NewContext(&ctypes.DiscoveryFile{WriterIp: "127.0.0.1"}, nil),
+	}
+
+	e.subAct = &SubscriptionActivityTask{
+		writer:       e,
+		lastActivity: map[string]time.Time{},
+	}
+
+	e.openDatabase()
+
+	e.groupCommitter = NewGroupCommitter(e)
+
+	e.LiveReader = NewLiveReader(e)
+
+	return e
+}
+
+func closeTestWriter(e *EventstoreWriter) {
+	e.groupCommitter.Close()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	tx := transaction.NewEventstoreTransaction(e.database)
+
+	e.walManager.Close(tx)
+
+	if err := e.walManager.ApplySideEffects(tx); err != nil {
+		panic(err)
+	}
+
+	e.database.Close()
+
+	e.metrics.Close()
+}
+
+func appendLines(t *testing.T, e *EventstoreWriter, streamName string, lines ...string) string {
+	output, err := e.AppendToStream(&types.AppendToStreamRequest{
+		Stream: streamName,
+		Lines:  lines,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return output.Offset
+}
+
+// committed content of a live chunk
+func readLiveChunk(t *testing.T, e *EventstoreWriter, chunkPath string) string {
+	e.mu.RLock()
+	filePath, length, err := e.walManager.SnapshotForReading(chunkPath)
+	e.mu.RUnlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(content[:length])
+}
@@ -11,34 +11,60 @@ type Write struct {
 	Position int64
 }
 
+// recorded by Put() and Delete(), so the transaction can be replicated
+type BoltWrite struct {
+	Bucket string
+	Key    []byte
+	Value  []byte
+	Delete bool
+}
+
+// everything except the bolt handles (and WalSynced) is serializable, so a
+// transaction can be replicated to other Writers and applied there as is
 type EventstoreTransaction struct {
-	BoltTx                  *bolt.Tx
-	Bolt                    *bolt.DB
+	BoltTx                  *bolt.Tx `json:"-"`
+	Bolt                    *bolt.DB `json:"-"`
+	BoltWrites              []*BoltWrite
 	NewChunks               []*wtypes.ChunkSpec
 	ShipFiles               []*wtypes.LongTermShippableFile
+	PurgeStreams            []string
+	DeletedStreams          []string
 	FilesToDisengageWalFor  []string
-	NeedsWALCompaction      []string
+	FilesToSync             []string
 	FilesToOpen             []string
 	FilesToClose            []string
+	FilesToForget           []string // closed files whose names are re-used
 	WriteOps                []*Write
+	FileLengths             map[string]uint64 // lengths of files appended to in this transaction
+	Durability              wtypes.Durability // strictest required by the streams written to. empty = strict
+	WalSynced               bool              `json:"-"` // WAL was fsync'd before commit (only for metrics)
 	AffectedStreams         map[string]string // streamName => cursorSerialized
 	SubscriberNotifications []*wtypes.SubscriberNotification
-	NonMetaLinesAdded       int // only for metrics
+	Placements              map[string]string // streamName => Writer, for handed off streams
+	NonMetaLinesAdded       int               // only for metrics
+	OrphanedSubsRemoved     int               // only for metrics
 }
 
 func NewEventstoreTransaction(bolt *bolt.DB) *EventstoreTransaction {
 	return &EventstoreTransaction{
 		Bolt:                    bolt,
+		BoltWrites:              []*BoltWrite{},
 		NewChunks:               []*wtypes.ChunkSpec{},
 		ShipFiles:               []*wtypes.LongTermShippableFile{},
+		PurgeStreams:            []string{},
+		DeletedStreams:          []string{},
 		FilesToDisengageWalFor:  []string{},
-		NeedsWALCompaction:      []string{},
+		FilesToSync:             []string{},
 		FilesToOpen:             []string{},
 		FilesToClose:            []string{},
+		FilesToForget:           []string{},
 		WriteOps:                []*Write{},
+		FileLengths:             make(map[string]uint64),
 		AffectedStreams:         make(map[string]string),
 		SubscriberNotifications: []*wtypes.SubscriberNotification{},
+		Placements:              make(map[string]string),
 		NonMetaLinesAdded:       0,
+		OrphanedSubsRemoved:     0,
 	}
 }
 
@@ -51,3 +77,77 @@ func (e *EventstoreTransaction) QueueWrite(filename string, buffer []byte, posit
 
 	e.WriteOps = append(e.WriteOps, write)
 }
+
+// transaction's durability is the strictest of the streams it writes to
+func (e *EventstoreTransaction) RequireDurability(durability wtypes.Durability) {
+	if e.Durability == "" || durability.StricterThan(e.Durability) {
+		e.Durability = durability
+	}
+}
+
+// like bucket.Put(), but creates the bucket if needed and records the write
+func (e *EventstoreTransaction) Put(bucketName string, key []byte, value []byte) error {
+	bucket, err := e.BoltTx.CreateBucketIfNotExists([]byte(bucketName))
+	if err != nil {
+		return err
+	}
+
+	if err := bucket.Put(key, value); err != nil {
+		return err
+	}
+
+	e.BoltWrites = append(e.BoltWrites, &BoltWrite{
+		Bucket: bucketName,
+		Key:    key,
+		Value:  value,
+	})
+
+	return nil
+}
+
+// like bucket.Delete(), but records the write. not an error if the bucket does
+// not exist
+func (e *EventstoreTransaction) Delete(bucketName string, key []byte) error {
+	bucket := e.BoltTx.Bucket([]byte(bucketName))
+	if bucket == nil {
+		return nil
+	}
+
+	if err := bucket.Delete(key); err != nil {
+		return err
+	}
+
+	e.BoltWrites = append(e.BoltWrites, &BoltWrite{
+		Bucket: bucketName,
+		Key:    key,
+		Delete: true,
+	})
+
+	return nil
+}
+
+// applies BoltWrites (recorded by the same transaction on another Writer) to BoltTx
+func (e *EventstoreTransaction) ApplyBoltWrites() error {
+	for _, write := range e.BoltWrites {
+		if write.Delete {
+			if bucket := e.BoltTx.Bucket([]byte(write.Bucket)); bucket != nil {
+				if err := bucket.Delete(write.Key); err != nil {
+					return err
+				}
+			}
+
+			continue
+		}
+
+		bucket, err := e.BoltTx.CreateBucketIfNotExists([]byte(write.Bucket))
+		if err != nil {
+			return err
+		}
+
+		if err := bucket.Put(write.Key, write.Value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
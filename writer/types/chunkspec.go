@@ -1,9 +1,25 @@
 package types
 
+import (
+	"strings"
+)
+
 type ChunkSpec struct {
 	// TODO: calculate this
 	ChunkPath string `json:"chunk_path"`
 
 	StreamName  string `json:"stream_name"`
 	ChunkNumber int    `json:"chunk_number"`
+
+	// for sealing chunks by age. zero for chunks opened by older versions
+	OpenedAt int64 `json:"opened_at,omitempty"` // unix seconds
+
+	// length after the Created meta event, i.e. longer chunk has something in it
+	HeadAfterOpen int `json:"head_after_open,omitempty"`
+}
+
+// "/tenants/foo" => "/tenants/foo/_/". contains only chunks of this stream, as
+// child streams' chunks are in "/tenants/foo/child/_/"
+func ChunkPathPrefix(streamName string) string {
+	return strings.TrimRight(streamName, "/") + "/_/"
 }
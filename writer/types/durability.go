@@ -0,0 +1,41 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+)
+
+// when an append is acknowledged relative to its WAL record being fsync'd
+type Durability string
+
+const (
+	DurabilityStrict  Durability = "strict"  // fsync'd before acknowledging
+	DurabilityBatched Durability = "batched" // fsync'd within the batch interval
+	DurabilityRelaxed Durability = "relaxed" // fsync'd at WAL checkpoint (or by a stricter commit)
+)
+
+func (d Durability) Validate() error {
+	switch d {
+	case DurabilityStrict, DurabilityBatched, DurabilityRelaxed:
+		return nil
+	default:
+		return errors.New(fmt.Sprintf("unknown durability: %s", d))
+	}
+}
+
+func (d Durability) StricterThan(other Durability) bool {
+	return durabilityRank(d) > durabilityRank(other)
+}
+
+func durabilityRank(d Durability) int {
+	switch d {
+	case DurabilityStrict:
+		return 3
+	case DurabilityBatched:
+		return 2
+	case DurabilityRelaxed:
+		return 1
+	default:
+		return 0
+	}
+}
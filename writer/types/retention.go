@@ -0,0 +1,29 @@
+package types
+
+// zero values mean unlimited
+type RetentionPolicy struct {
+	MaxAgeSeconds int   // measured from the time the chunk was sealed
+	MaxTotalBytes int64 // sealed chunks' size in scalablestore (compressed)
+	MaxChunks     int   // sealed chunks kept in scalablestore
+	Recursive     bool  // applies also to descendant streams that don't have their own policy
+}
+
+func (r *RetentionPolicy) IsUnlimited() bool {
+	return r.MaxAgeSeconds == 0 && r.MaxTotalBytes == 0 && r.MaxChunks == 0
+}
+
+type SetRetentionPolicyRequest struct {
+	Stream string
+	Policy RetentionPolicy
+}
+
+// written to scalablestore by Writer's retention task, so readers can tell
+// expired chunks apart from missing ones
+type TruncationMarker struct {
+	EarliestValidCursor string `json:"earliest_valid_cursor"`
+}
+
+// "/tenants/foo" => "/tenants/foo/_/truncated.json"
+func TruncationMarkerPath(streamName string) string {
+	return ChunkPathPrefix(streamName) + "truncated.json"
+}
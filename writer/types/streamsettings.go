@@ -0,0 +1,64 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"github.com/function61/eventhorizon/config"
+)
+
+const (
+	MinChunkSize = 4 * 1024
+	MaxChunkSize = 1024 * 1024 * 1024
+)
+
+// zero values mean "inherit from parent stream", and if no ancestor has the
+// setting, the Writer's default
+type StreamSettings struct {
+	ChunkSize  int        `json:",omitempty"` // rotate threshold in bytes
+	Durability Durability `json:",omitempty"`
+}
+
+func (s *StreamSettings) Validate() error {
+	if s.ChunkSize != 0 && (s.ChunkSize < MinChunkSize || s.ChunkSize > MaxChunkSize) {
+		return errors.New(fmt.Sprintf("ChunkSize must be between %d and %d", MinChunkSize, MaxChunkSize))
+	}
+
+	if s.Durability != "" {
+		if err := s.Durability.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fills settings not set in s from parent's settings
+func (s *StreamSettings) InheritFrom(parent *StreamSettings) *StreamSettings {
+	inherited := *s
+
+	if inherited.ChunkSize == 0 {
+		inherited.ChunkSize = parent.ChunkSize
+	}
+
+	if inherited.Durability == "" {
+		inherited.Durability = parent.Durability
+	}
+
+	return &inherited
+}
+
+func (s *StreamSettings) EffectiveChunkSize() int {
+	if s.ChunkSize == 0 {
+		return config.ChunkRotateThreshold
+	}
+
+	return s.ChunkSize
+}
+
+func (s *StreamSettings) EffectiveDurability(clusterDefault Durability) Durability {
+	if s.Durability == "" {
+		return clusterDefault
+	}
+
+	return s.Durability
+}
@@ -0,0 +1,77 @@
+package types
+
+import (
+	"strings"
+	"time"
+)
+
+const recursiveSuffix = "/**"
+
+// "/tenants/**" => "/tenants", true. "/**" => "/", true. "/tenants" => "/tenants", false
+func RecursiveSubscriptionStream(stream string) (string, bool) {
+	if !strings.HasSuffix(stream, recursiveSuffix) {
+		return stream, false
+	}
+
+	streamName := strings.TrimSuffix(stream, recursiveSuffix)
+	if streamName == "" {
+		streamName = "/"
+	}
+
+	return streamName, true
+}
+
+// subscription that was unsubscribed automatically, because its subscription
+// stream no longer exists
+type OrphanedSubscription struct {
+	SubscriptionId string
+	Streams        []string // the streams it was unsubscribed from
+	RemovedAt      time.Time
+}
+
+type OrphanedSubscriptionsOutput struct {
+	Subscriptions []OrphanedSubscription
+}
+
+type ReportAckedCursorsRequest struct {
+	SubscriptionId string
+	Cursors        []string // the latest the subscriber has processed, one per stream
+}
+
+type SubscriptionStatusRequest struct {
+	SubscriptionId string // empty for all subscriptions
+}
+
+type SubscriptionStatusOutput struct {
+	Subscriptions []SubscriptionStatus
+}
+
+// lag is summed over the streams, except LagSeconds which is the largest
+type SubscriptionStatus struct {
+	SubscriptionId string
+	LagBytes       int64
+	LagLines       int64
+	LagSeconds     int64
+	Streams        []SubscriptionStreamStatus
+}
+
+type SubscriptionStreamStatus struct {
+	Stream     string
+	Acked      string // cursor
+	AckedAt    time.Time
+	Head       string // cursor
+	LagBytes   int64
+	LagLines   int64 // an upper bound, see writer/subscriptionlag.go
+	LagSeconds int64 // age of the oldest line not acked
+}
+
+func (s *SubscriptionStatus) AddStream(stream SubscriptionStreamStatus) {
+	s.Streams = append(s.Streams, stream)
+
+	s.LagBytes += stream.LagBytes
+	s.LagLines += stream.LagLines
+
+	if stream.LagSeconds > s.LagSeconds {
+		s.LagSeconds = stream.LagSeconds
+	}
+}
@@ -1,38 +1,183 @@
 package types
 
+import (
+	"fmt"
+	"github.com/function61/eventhorizon/metaevents"
+	"time"
+)
+
 type CreateStreamRequest struct {
-	Name string
+	Name     string
+	Settings StreamSettings // unset settings are inherited from parent stream
 }
 
 type CreateStreamOutput struct {
 	Name string
 }
 
+type DeleteStreamRequest struct {
+	Name  string
+	Purge bool // also remove the stream's chunks from scalablestore
+}
+
 type AppendToStreamRequest struct {
 	Stream string
 	Lines  []string
+	Events []EventToAppend // alternative to Lines, cannot use both in the same request
+
+	// optimistic concurrency: if set, append only if nobody appended to the stream
+	// after this cursor (the offset of the previous append, or the head as seen
+	// by a reader). otherwise fails with AppendConflictError. meta events that
+	// Writer appends by itself (Subscribed, Rotated etc.) don't count as appends
+	ExpectedOffset string
+
+	// if set, a retry with the same key (within the idempotency window) does not
+	// append again, but returns the original AppendToStreamOutput
+	IdempotencyKey string
+}
+
+// stored as an envelope line, so readers get the metadata as structured fields
+type EventToAppend struct {
+	Id      string // Writer generates one if empty
+	Type    string
+	Headers map[string]string
+	Content string
 }
 
 type AppendToStreamOutput struct {
 	Offset string
 }
 
+// appends to many streams in one transaction. IdempotencyKey is not supported
+type AppendMultiRequest struct {
+	Appends []AppendToStreamRequest
+}
+
+type AppendMultiOutput struct {
+	Outputs []AppendToStreamOutput // in the same order as the appends
+}
+
+// returned when somebody else appended to the stream after
+// AppendToStreamRequest.ExpectedOffset (or it is past the stream's head)
+type AppendConflictError struct {
+	ExpectedOffset string
+	CurrentOffset  string
+}
+
+func (a *AppendConflictError) Error() string {
+	return fmt.Sprintf("append conflict: expected offset %s but stream is at %s", a.ExpectedOffset, a.CurrentOffset)
+}
+
+// internal: a meta event (ChildStreamCreated, StreamDeleted or SubscriptionActivity)
+// that a Writer delivers to a stream on another shard
+type AppendMetaRequest struct {
+	Stream         string
+	MetaEvent      string // serialized meta line
+	IdempotencyKey string // retried deliveries don't append again
+}
+
+// moves the stream to another Writer (see docs/operating.md)
+type HandoffStreamRequest struct {
+	Stream string
+	Writer string // new owner
+}
+
+// internal: what the new owner of a handed off stream needs to continue it
+type AdoptStreamRequest struct {
+	Stream                 string
+	Chunk                  int // the old owner sealed the chunk before this
+	Settings               StreamSettings
+	RetentionPolicy        *RetentionPolicy // nil if the stream has none of its own
+	Subscriptions          []string
+	RecursiveSubscriptions []string
+	SubscriptionFilters    map[string]*metaevents.SubscriptionFilter
+	ActivityIntervals      map[string]int64
+	LineCount              int64
+	ByteCount              int64
+	ChunkCount             int
+	LastAppend             string // for ExpectedOffset
+}
+
+// returned (421 Misdirected Request) by a Writer that does not own the stream
+type WrongWriterError struct {
+	Stream string
+	Writer string // owner
+}
+
+func (w *WrongWriterError) Error() string {
+	return fmt.Sprintf("stream %s belongs to Writer %s", w.Stream, w.Writer)
+}
+
 type LiveReadInput struct {
 	Cursor         string
 	MaxLinesToRead int
 }
 
+// a follower Writer asks the primary for what it doesn't have yet. keyed by
+// chunk path, value is the length the follower has
+type TailRequest struct {
+	Have map[string]int64
+}
+
+type TailOutput struct {
+	Chunks []TailedChunk
+	Gone   []string // chunks in Have that are not live anymore
+}
+
+// Data is appended at Offset
+type TailedChunk struct {
+	ChunkPath string
+	Offset    int64
+	Data      []byte
+}
+
 type SubscriberNotification struct {
 	SubscriptionId         string
 	LatestCursorSerialized string
 }
 
+// Stream "/tenants/**" subscribes to /tenants and all of its child streams
+// created afterwards (see RecursiveSubscriptionStream())
 type SubscribeToStreamRequest struct {
 	Stream         string
 	SubscriptionId string
+	Filter         *metaevents.SubscriptionFilter // nil = notified about every line
+
+	// notified at most this often, but not more often than the cluster's
+	// subscription_activity_interval_ms. 0 = the cluster's interval
+	ActivityIntervalMs int64
 }
 
 type UnsubscribeFromStreamRequest struct {
 	Stream         string
 	SubscriptionId string
 }
+
+type ListStreamsRequest struct {
+	Stream    string // parent stream, "/" lists from the root
+	Recursive bool   // all descendants instead of only direct children
+}
+
+type ListStreamsOutput struct {
+	Streams []string
+}
+
+type StreamInfoRequest struct {
+	Stream string
+}
+
+type StreamInfoOutput struct {
+	Name          string
+	Head          string // cursor after the last line
+	LineCount     int64  // excluding meta events
+	ByteCount     int64  // including meta events
+	ChunkCount    int    // including the live chunk and chunks expired by retention
+	LastWriteTime time.Time
+	Settings      StreamSettings
+
+	// subscriptions that new child streams inherit
+	RecursiveSubscriptions []string
+
+	SubscriptionFilters map[string]*metaevents.SubscriptionFilter // only the subscriptions that have one
+	ActivityIntervals   map[string]int64                          // only the subscriptions that have one
+}
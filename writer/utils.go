@@ -3,6 +3,8 @@ package writer
 import (
 	"errors"
 	"github.com/function61/eventhorizon/metaevents"
+	"github.com/function61/eventhorizon/util/cryptorandombytes"
+	"github.com/function61/eventhorizon/writer/types"
 	"path"
 	"strings"
 )
@@ -24,3 +26,47 @@ func stringArrayToRawLines(contentArr []string) (string, error) {
 
 	return buf, nil
 }
+
+// validates & encodes request's lines or events into raw lines
+func encodeAppend(req *types.AppendToStreamRequest) (string, error) {
+	if len(req.Lines) > 0 && len(req.Events) > 0 {
+		return "", errors.New("EventstoreWriter.AppendToStream: cannot append both Lines and Events")
+	}
+
+	rawLines, err := stringArrayToRawLines(req.Lines)
+	if err != nil {
+		return "", err
+	}
+
+	rawEventLines, err := eventsToRawLines(req.Events)
+	if err != nil {
+		return "", err
+	}
+
+	return rawLines + rawEventLines, nil
+}
+
+func eventsToRawLines(events []types.EventToAppend) (string, error) {
+	buf := ""
+
+	for _, event := range events {
+		if strings.Contains(event.Content, "\n") {
+			return "", errors.New("content cannot contain \\n")
+		}
+
+		if event.Type == "" {
+			return "", errors.New("event type cannot be empty")
+		}
+
+		eventId := event.Id
+		if eventId == "" {
+			eventId = cryptorandombytes.Hex(8)
+		}
+
+		envelope := metaevents.NewEnvelope(eventId, event.Type, event.Headers)
+
+		buf += envelope.Encode(event.Content) + "\n"
+	}
+
+	return buf, nil
+}
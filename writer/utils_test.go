@@ -1,7 +1,10 @@
 package writer
 
 import (
+	"github.com/function61/eventhorizon/metaevents"
 	"github.com/function61/eventhorizon/util/ass"
+	"github.com/function61/eventhorizon/writer/types"
+	"strings"
 	"testing"
 )
 
@@ -30,3 +33,51 @@ func TestStringArrayToRawLinesFails(t *testing.T) {
 
 	ass.EqualString(t, err.Error(), "content cannot contain \\n")
 }
+
+func TestEventsToRawLines(t *testing.T) {
+	rawLines, err := eventsToRawLines([]types.EventToAppend{
+		{Id: "5f0c6d1e", Type: "OrderPlaced", Content: "{\"order_id\": 42}"},
+		{Type: "OrderShipped", Headers: map[string]string{"causation_id": "5f0c6d1e"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimRight(rawLines, "\n"), "\n")
+
+	ass.EqualInt(t, len(lines), 2)
+
+	_, content, first := metaevents.Parse(lines[0])
+
+	ass.EqualString(t, content, "{\"order_id\": 42}")
+	ass.EqualString(t, first.(metaevents.Envelope).Id, "5f0c6d1e")
+	ass.EqualString(t, first.(metaevents.Envelope).Type, "OrderPlaced")
+
+	_, _, second := metaevents.Parse(lines[1])
+
+	ass.EqualInt(t, len(second.(metaevents.Envelope).Id), 16) // generated
+	ass.EqualString(t, second.(metaevents.Envelope).Headers["causation_id"], "5f0c6d1e")
+}
+
+func TestEventsToRawLinesFails(t *testing.T) {
+	_, err := eventsToRawLines([]types.EventToAppend{{Type: "Foo", Content: "foo\nbar"}})
+
+	ass.EqualString(t, err.Error(), "content cannot contain \\n")
+
+	_, err = eventsToRawLines([]types.EventToAppend{{Content: "foo"}})
+
+	ass.EqualString(t, err.Error(), "event type cannot be empty")
+}
+
+func TestEncodeAppend(t *testing.T) {
+	rawLines, err := encodeAppend(&types.AppendToStreamRequest{Lines: []string{"foo", "bar"}})
+	ass.True(t, err == nil)
+	ass.EqualString(t, rawLines, " foo\n bar\n")
+
+	_, err = encodeAppend(&types.AppendToStreamRequest{
+		Lines:  []string{"foo"},
+		Events: []types.EventToAppend{{Type: "Foo"}},
+	})
+
+	ass.EqualString(t, err.Error(), "EventstoreWriter.AppendToStream: cannot append both Lines and Events")
+}
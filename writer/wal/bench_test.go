@@ -0,0 +1,90 @@
+package wal
+
+import (
+	"encoding/binary"
+	"github.com/boltdb/bolt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// compares the segment log against the WAL of older versions, which stored
+// each write in a bolt bucket as part of the writer's transaction.
+//
+//	$ go test -bench . ./writer/wal/
+
+var benchmarkLine = []byte(" {\"foo\": \"some reasonably sized line of event data\"}\n")
+
+func BenchmarkSegmentLogAppend(b *testing.B) {
+	dir, err := ioutil.TempDir("", "segmentlog_bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, _, err := openSegmentLog(dir, 1024*1024)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.close()
+
+	position := uint64(0)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := s.append([]walRecord{{FileName: "/foo/_/0.log", Position: position, Content: benchmarkLine}}); err != nil {
+			b.Fatal(err)
+		}
+
+		if err := s.sync(); err != nil {
+			b.Fatal(err)
+		}
+
+		position += uint64(len(benchmarkLine))
+
+		// keep the log bounded like WalManager does
+		if s.size() > 4*1024*1024 {
+			if err := s.checkpoint(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkBoltBucketAppend(b *testing.B) {
+	dbFile, err := ioutil.TempFile("", "boltwal_bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(dbFile.Name())
+	dbFile.Close()
+
+	db, err := bolt.Open(dbFile.Name(), 0600, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	position := uint64(0)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			bucket, err := tx.CreateBucketIfNotExists([]byte("/foo/_/0.log"))
+			if err != nil {
+				return err
+			}
+
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, position)
+
+			return bucket.Put(key, benchmarkLine)
+		}); err != nil {
+			b.Fatal(err)
+		}
+
+		position += uint64(len(benchmarkLine))
+	}
+}
@@ -0,0 +1,72 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Redo recovery: writes every logged record into its file, in log order, and
+// then truncates each file to its committed length. A file can be shorter than
+// that if records were lost before their fsync (non-strict durability), which is
+// handled when the file is recovered.
+//
+// Writes of a transaction whose bolt commit failed (after its records were
+// logged) are either beyond the committed length, or were overwritten by a
+// later committed write, because the failed transaction did not advance the
+// write position. Files that no longer exist locally (f.ex. purged) are skipped.
+func replayRecords(
+	records []walRecord,
+	committedLength func(fileName string) (uint64, bool),
+	internalPath func(fileName string) string,
+) error {
+	recordsByFile := map[string][]walRecord{}
+	for _, record := range records {
+		recordsByFile[record.FileName] = append(recordsByFile[record.FileName], record)
+	}
+
+	for fileName, fileRecords := range recordsByFile {
+		length, committed := committedLength(fileName)
+		if !committed {
+			// file was opened by a transaction that did not commit
+			continue
+		}
+
+		if err := replayFile(internalPath(fileName), fileRecords, int64(length)); err != nil {
+			return errors.New(fmt.Sprintf("replay %s: %s", fileName, err.Error()))
+		}
+	}
+
+	return nil
+}
+
+func replayFile(path string, records []walRecord, committedLength int64) error {
+	fd, err := os.OpenFile(path, os.O_RDWR, 0755)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+	defer fd.Close()
+
+	for _, record := range records {
+		if _, err := fd.WriteAt(record.Content, int64(record.Position)); err != nil {
+			return err
+		}
+	}
+
+	stats, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+
+	if stats.Size() > committedLength {
+		if err := fd.Truncate(committedLength); err != nil {
+			return err
+		}
+	}
+
+	return fd.Sync()
+}
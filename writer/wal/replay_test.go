@@ -0,0 +1,74 @@
+package wal
+
+import (
+	"github.com/function61/eventhorizon/util/ass"
+	"io/ioutil"
+	"testing"
+)
+
+func TestReplayRecords(t *testing.T) {
+	withTempDir(t, func(dir string) {
+		internalPath := func(fileName string) string {
+			return dir + "/" + fileName
+		}
+
+		// fsync'd only partly before crash
+		ass.True(t, ioutil.WriteFile(internalPath("a.log"), []byte("line 1\n"), 0644) == nil)
+		// purged after its records were logged
+		purgedMissing := "b.log"
+
+		records := []walRecord{
+			{FileName: "a.log", Position: 0, Content: []byte("line 1\n")},
+			// this transaction's bolt commit failed..
+			{FileName: "a.log", Position: 7, Content: []byte("failed commit\n")},
+			// ..so the next one was written to the same position
+			{FileName: "a.log", Position: 7, Content: []byte("line 2\n")},
+			{FileName: purgedMissing, Position: 0, Content: []byte("foo\n")},
+			// OpenNewFile() in a transaction that did not commit
+			{FileName: "c.log", Position: 0, Content: []byte("bar\n")},
+		}
+
+		committedLength := func(fileName string) (uint64, bool) {
+			switch fileName {
+			case "a.log":
+				return 14, true
+			case purgedMissing:
+				return 4, true
+			default:
+				return 0, false
+			}
+		}
+
+		ass.True(t, replayRecords(records, committedLength, internalPath) == nil)
+
+		content, err := ioutil.ReadFile(internalPath("a.log"))
+		ass.True(t, err == nil)
+		ass.EqualString(t, string(content), "line 1\nline 2\n")
+
+		_, err = ioutil.ReadFile(internalPath("c.log"))
+		ass.True(t, err != nil)
+	})
+}
+
+// non-strict durability: the last records were lost before fsync
+func TestReplayRecordsLeavesLostTail(t *testing.T) {
+	withTempDir(t, func(dir string) {
+		internalPath := func(fileName string) string {
+			return dir + "/" + fileName
+		}
+
+		ass.True(t, ioutil.WriteFile(internalPath("a.log"), []byte{}, 0644) == nil)
+
+		committedLength := func(fileName string) (uint64, bool) {
+			return 14, true
+		}
+
+		ass.True(t, replayRecords([]walRecord{
+			{FileName: "a.log", Position: 0, Content: []byte("line 1\n")},
+		}, committedLength, internalPath) == nil)
+
+		content, err := ioutil.ReadFile(internalPath("a.log"))
+		ass.True(t, err == nil)
+		ass.EqualString(t, string(content), "line 1\n")
+	})
+}
@@ -0,0 +1,336 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Append-only log of file writes, split into segments so that the log can be
+// cleaned by deleting whole segments. Records look like:
+//
+//	+---------------+---------------+------------------------------+
+//	| length (4 B)  | CRC-32C (4 B) | payload (length bytes)       |
+//	+---------------+---------------+------------------------------+
+//
+//	payload = file name length (2 B) | file name | position (8 B) | content
+//
+// All integers are big endian. Records are fsync'd before the bolt transaction
+// referring to them commits, so a record that is cut short or fails its
+// checksum can only be a torn write at the end of the last segment. Reading
+// stops there and the tail is truncated.
+
+const (
+	recordHeaderLen = 8
+	segmentSuffix   = ".wal"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type walRecord struct {
+	FileName string
+	Position uint64
+	Content  []byte
+}
+
+type segmentLog struct {
+	dir            string
+	maxSegmentSize int64
+	segments       []uint64 // ascending, last one is active
+	active         *os.File
+	activeSize     int64
+	totalSize      int64
+}
+
+// returns the records of all segments for recovery
+func openSegmentLog(dir string, maxSegmentSize int64) (*segmentLog, []walRecord, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+
+	s := &segmentLog{
+		dir:            dir,
+		maxSegmentSize: maxSegmentSize,
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	records := []walRecord{}
+
+	for idx, segment := range segments {
+		isLast := idx == len(segments)-1
+
+		segmentRecords, validLength, err := readSegment(s.segmentPath(segment))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		fileInfo, err := os.Stat(s.segmentPath(segment))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if validLength != fileInfo.Size() {
+			if !isLast {
+				return nil, nil, errors.New(fmt.Sprintf("segmentLog: corrupted record in the middle of the log, in segment %d", segment))
+			}
+
+			log.Printf("segmentLog: truncating torn write at %d in segment %d", validLength, segment)
+
+			if err := os.Truncate(s.segmentPath(segment), validLength); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		records = append(records, segmentRecords...)
+
+		s.totalSize += validLength
+	}
+
+	s.segments = segments
+
+	if len(s.segments) == 0 {
+		if err := s.startSegment(1); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		last := s.segments[len(s.segments)-1]
+
+		active, err := os.OpenFile(s.segmentPath(last), os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		stats, err := active.Stat()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		s.active = active
+		s.activeSize = stats.Size()
+	}
+
+	return s, records, nil
+}
+
+// not durable until sync()
+func (s *segmentLog) append(records []walRecord) error {
+	// rotating only before writing, so that the previous segment was already
+	// synced by the previous commit
+	if s.activeSize >= s.maxSegmentSize {
+		if err := s.startSegment(s.segments[len(s.segments)-1] + 1); err != nil {
+			return err
+		}
+	}
+
+	buf := []byte{}
+	for _, record := range records {
+		buf = append(buf, encodeRecord(record)...)
+	}
+
+	if _, err := s.active.Write(buf); err != nil {
+		return err
+	}
+
+	s.activeSize += int64(len(buf))
+	s.totalSize += int64(len(buf))
+
+	return nil
+}
+
+func (s *segmentLog) sync() error {
+	return s.active.Sync()
+}
+
+// total size of all segments
+func (s *segmentLog) size() int64 {
+	return s.totalSize
+}
+
+// call only after all the records' writes are durable in the actual files.
+// starts a new segment and deletes the old ones
+func (s *segmentLog) checkpoint() error {
+	oldSegments := s.segments
+
+	if err := s.startSegment(oldSegments[len(oldSegments)-1] + 1); err != nil {
+		return err
+	}
+
+	for _, segment := range oldSegments {
+		if err := os.Remove(s.segmentPath(segment)); err != nil {
+			return err
+		}
+	}
+
+	s.segments = s.segments[len(oldSegments):]
+	s.totalSize = 0
+
+	return nil
+}
+
+func (s *segmentLog) close() error {
+	return s.active.Close()
+}
+
+func (s *segmentLog) startSegment(number uint64) error {
+	active, err := os.OpenFile(s.segmentPath(number), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	// so the new segment's directory entry survives a crash
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+
+	if s.active != nil {
+		if err := s.active.Close(); err != nil {
+			return err
+		}
+	}
+
+	s.active = active
+	s.activeSize = 0
+	s.segments = append(s.segments, number)
+
+	return nil
+}
+
+func (s *segmentLog) segmentPath(number uint64) string {
+	return fmt.Sprintf("%s/%020d%s", s.dir, number, segmentSuffix)
+}
+
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []uint64{}
+
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), segmentSuffix) {
+			continue
+		}
+
+		number, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), segmentSuffix), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		segments = append(segments, number)
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+
+	return segments, nil
+}
+
+// returns the valid records and the length they span. reading stops at the
+// first short or corrupted record
+func readSegment(path string) ([]walRecord, int64, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	records := []walRecord{}
+	offset := 0
+
+	for {
+		record, recordLen, err := decodeRecord(content[offset:])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("segmentLog: %s at %d: %s", filepath.Base(path), offset, err.Error())
+			break
+		}
+
+		records = append(records, *record)
+		offset += recordLen
+	}
+
+	return records, int64(offset), nil
+}
+
+func encodeRecord(record walRecord) []byte {
+	payloadLen := 2 + len(record.FileName) + 8 + len(record.Content)
+
+	buf := make([]byte, recordHeaderLen+payloadLen)
+	payload := buf[recordHeaderLen:]
+
+	binary.BigEndian.PutUint16(payload[0:2], uint16(len(record.FileName)))
+	copy(payload[2:], record.FileName)
+	binary.BigEndian.PutUint64(payload[2+len(record.FileName):], record.Position)
+	copy(payload[2+len(record.FileName)+8:], record.Content)
+
+	binary.BigEndian.PutUint32(buf[0:4], uint32(payloadLen))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(payload, crcTable))
+
+	return buf
+}
+
+// io.EOF if buf is empty, i.e. end of segment
+func decodeRecord(buf []byte) (*walRecord, int, error) {
+	if len(buf) == 0 {
+		return nil, 0, io.EOF
+	}
+
+	if len(buf) < recordHeaderLen {
+		return nil, 0, errors.New("short record header")
+	}
+
+	payloadLen := int(binary.BigEndian.Uint32(buf[0:4]))
+	checksum := binary.BigEndian.Uint32(buf[4:8])
+
+	if len(buf) < recordHeaderLen+payloadLen {
+		return nil, 0, errors.New("short record")
+	}
+
+	payload := buf[recordHeaderLen : recordHeaderLen+payloadLen]
+
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return nil, 0, errors.New("checksum mismatch")
+	}
+
+	if len(payload) < 2 {
+		return nil, 0, errors.New("payload too short")
+	}
+
+	fileNameLen := int(binary.BigEndian.Uint16(payload[0:2]))
+
+	if len(payload) < 2+fileNameLen+8 {
+		return nil, 0, errors.New("payload too short")
+	}
+
+	record := &walRecord{
+		FileName: string(payload[2 : 2+fileNameLen]),
+		Position: binary.BigEndian.Uint64(payload[2+fileNameLen:]),
+		Content:  payload[2+fileNameLen+8:],
+	}
+
+	return record, recordHeaderLen + payloadLen, nil
+}
+
+func syncDir(dir string) error {
+	dirFd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dirFd.Close()
+
+	return dirFd.Sync()
+}
@@ -0,0 +1,158 @@
+package wal
+
+import (
+	"github.com/function61/eventhorizon/util/ass"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func withTempDir(t *testing.T, fn func(dir string)) {
+	dir, err := ioutil.TempDir("", "segmentlog_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn(dir)
+}
+
+func mustOpen(t *testing.T, dir string, maxSegmentSize int64) (*segmentLog, []walRecord) {
+	s, records, err := openSegmentLog(dir, maxSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, records
+}
+
+func mustAppend(t *testing.T, s *segmentLog, records ...walRecord) {
+	if err := s.append(records); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.sync(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSegmentLogRoundTrip(t *testing.T) {
+	withTempDir(t, func(dir string) {
+		s, records := mustOpen(t, dir, 1024*1024)
+		ass.EqualInt(t, len(records), 0)
+
+		mustAppend(t, s,
+			walRecord{FileName: "/foo/_/0.log", Position: 0, Content: []byte("hello\n")},
+			walRecord{FileName: "/bar/_/0.log", Position: 10, Content: []byte("world\n")})
+		s.close()
+
+		_, records = mustOpen(t, dir, 1024*1024)
+		ass.EqualInt(t, len(records), 2)
+		ass.EqualString(t, records[0].FileName, "/foo/_/0.log")
+		ass.EqualInt(t, int(records[0].Position), 0)
+		ass.EqualString(t, string(records[0].Content), "hello\n")
+		ass.EqualString(t, records[1].FileName, "/bar/_/0.log")
+		ass.EqualInt(t, int(records[1].Position), 10)
+		ass.EqualString(t, string(records[1].Content), "world\n")
+	})
+}
+
+func TestSegmentLogTruncatesTornWrite(t *testing.T) {
+	withTempDir(t, func(dir string) {
+		s, _ := mustOpen(t, dir, 1024*1024)
+		mustAppend(t, s, walRecord{FileName: "/foo/_/0.log", Position: 0, Content: []byte("first\n")})
+		mustAppend(t, s, walRecord{FileName: "/foo/_/0.log", Position: 6, Content: []byte("second\n")})
+		s.close()
+
+		// crash in the middle of writing the second record
+		path := s.segmentPath(1)
+		stats, _ := os.Stat(path)
+		ass.True(t, os.Truncate(path, stats.Size()-3) == nil)
+
+		s, records := mustOpen(t, dir, 1024*1024)
+		ass.EqualInt(t, len(records), 1)
+		ass.EqualString(t, string(records[0].Content), "first\n")
+
+		// torn tail was removed, so new records are readable after the valid ones
+		mustAppend(t, s, walRecord{FileName: "/foo/_/0.log", Position: 6, Content: []byte("third\n")})
+		s.close()
+
+		_, records = mustOpen(t, dir, 1024*1024)
+		ass.EqualInt(t, len(records), 2)
+		ass.EqualString(t, string(records[1].Content), "third\n")
+	})
+}
+
+func TestSegmentLogStopsAtChecksumMismatch(t *testing.T) {
+	withTempDir(t, func(dir string) {
+		s, _ := mustOpen(t, dir, 1024*1024)
+		mustAppend(t, s, walRecord{FileName: "/foo/_/0.log", Position: 0, Content: []byte("first\n")})
+		mustAppend(t, s, walRecord{FileName: "/foo/_/0.log", Position: 6, Content: []byte("second\n")})
+		s.close()
+
+		flipLastByte(t, s.segmentPath(1))
+
+		_, records := mustOpen(t, dir, 1024*1024)
+		ass.EqualInt(t, len(records), 1)
+		ass.EqualString(t, string(records[0].Content), "first\n")
+	})
+}
+
+func TestSegmentLogCorruptionInMiddleSegmentFails(t *testing.T) {
+	withTempDir(t, func(dir string) {
+		// tiny segments so that each append starts a new segment
+		s, _ := mustOpen(t, dir, 1)
+		mustAppend(t, s, walRecord{FileName: "/foo/_/0.log", Position: 0, Content: []byte("first\n")})
+		mustAppend(t, s, walRecord{FileName: "/foo/_/0.log", Position: 6, Content: []byte("second\n")})
+		s.close()
+
+		ass.EqualInt(t, len(s.segments), 2)
+
+		flipLastByte(t, s.segmentPath(1))
+
+		_, _, err := openSegmentLog(dir, 1)
+		ass.EqualString(t, err.Error(), "segmentLog: corrupted record in the middle of the log, in segment 1")
+	})
+}
+
+func TestSegmentLogRotationAndCheckpoint(t *testing.T) {
+	withTempDir(t, func(dir string) {
+		s, _ := mustOpen(t, dir, 1)
+		mustAppend(t, s, walRecord{FileName: "/foo/_/0.log", Position: 0, Content: []byte("first\n")})
+		mustAppend(t, s, walRecord{FileName: "/foo/_/0.log", Position: 6, Content: []byte("second\n")})
+		mustAppend(t, s, walRecord{FileName: "/foo/_/0.log", Position: 13, Content: []byte("third\n")})
+
+		ass.EqualInt(t, len(s.segments), 3)
+		ass.True(t, s.size() > 0)
+
+		// rotation keeps all records
+		s.close()
+		s, records := mustOpen(t, dir, 1)
+		ass.EqualInt(t, len(records), 3)
+		ass.EqualString(t, string(records[2].Content), "third\n")
+
+		ass.True(t, s.checkpoint() == nil)
+		ass.EqualInt(t, int(s.size()), 0)
+
+		segments, _ := listSegments(dir)
+		ass.EqualInt(t, len(segments), 1)
+		ass.EqualInt(t, int(segments[0]), 4)
+
+		s.close()
+		_, records = mustOpen(t, dir, 1)
+		ass.EqualInt(t, len(records), 0)
+	})
+}
+
+func flipLastByte(t *testing.T, path string) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content[len(content)-1] ^= 0xff
+
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -4,231 +4,483 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"github.com/boltdb/bolt"
 	"github.com/function61/eventhorizon/config"
+	"github.com/function61/eventhorizon/util/stringslice"
 	"github.com/function61/eventhorizon/writer/transaction"
+	wtypes "github.com/function61/eventhorizon/writer/types"
 	"io"
 	"log"
 	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
-// Uses BoltDB as a backing store for the write-ahead-log.
-// Only supports WAL for append-only files.
+// Write-ahead-log for append-only files. Writes are logged to a segmented,
+// checksummed log (see segmentLog) that is fsync'd just before the bolt
+// transaction commits (PrepareCommit), and written to the actual files after the
+// commit. Bolt holds the committed length of each file, which is the source of
+// truth for the write position.
+//
+// When the log grows over WalSizeThreshold, the files written to are fsync'd and
+// the log's segments are deleted (checkpoint).
+//
+//	_walfilelengths:
+//		/tenants/foo/_/0.log => <8 byte committed length>
+//
+//	_walfileslost:
+//		/tenants/foo/_/1.log => (empty)
+//
+// How soon the log is fsync'd depends on the transaction's durability:
+//
+//	strict:  before the commit
+//	batched: within syncInterval (WalSyncTask in Writer calls SyncIfDue())
+//	relaxed: at checkpoint, or when a stricter transaction fsyncs the log
+//
+// With the latter two, an OS crash can lose committed writes. Recovery then
+// opens the file at the length it actually has, and remembers (_walfileslost)
+// that the file must not be continued: Writer seals it before appending, so the
+// lost writes' offsets are not given to new lines.
+//
+// Older versions used a bolt bucket per file for WAL entries. Those are
+// replayed and removed on recovery.
 
 // TODO: since there is not much state, merge WALGuardedFile and WalManager
 
 type WalManager struct {
-	openFiles map[string]*WalGuardedFile
+	openFiles            map[string]*WalGuardedFile
+	log                  *segmentLog
+	dirtyFiles           map[string]bool // written to since the last checkpoint
+	closing              bool
+	syncInterval         time.Duration
+	batchedUnsyncedSince time.Time // zero if no batched transactions await fsync
+	bytesLostOnRecovery  uint64
 }
 
-func NewWalManager(tx *transaction.EventstoreTransaction) *WalManager {
+func NewWalManager(syncInterval time.Duration, tx *transaction.EventstoreTransaction) *WalManager {
 	w := &WalManager{
-		openFiles: make(map[string]*WalGuardedFile),
+		openFiles:    make(map[string]*WalGuardedFile),
+		dirtyFiles:   make(map[string]bool),
+		syncInterval: syncInterval,
 	}
 
 	w.ensureDataDirectoryExists()
 
+	lengthsBucket, err := tx.BoltTx.CreateBucketIfNotExists([]byte("_walfilelengths"))
+	if err != nil {
+		panic(err)
+	}
+
+	segmentLog, records, err := openSegmentLog(config.WalSegmentsDir, config.WalSegmentSize)
+	if err != nil {
+		panic(err)
+	}
+
+	w.log = segmentLog
+
+	if len(records) > 0 {
+		log.Printf("WalManager: replaying %d record(s)", len(records))
+
+		committedLength := func(fileName string) (uint64, bool) {
+			length := lengthsBucket.Get([]byte(fileName))
+			if length == nil {
+				return 0, false
+			}
+
+			return btoi(length), true
+		}
+
+		if err := replayRecords(records, committedLength, computeInternalPath); err != nil {
+			panic(err)
+		}
+
+		// replay fsync'd the files
+		if err := w.log.checkpoint(); err != nil {
+			panic(err)
+		}
+	}
+
 	return w
 }
 
-// WARNING: do only call once per file per transaction
+// can be called many times per file per transaction (group commit does that)
 func (w *WalManager) AppendToFile(fileName string, content string, tx *transaction.EventstoreTransaction) (int, error) {
-	contentLen := uint64(len(content)) // is safe because length is in bytes, not runes
+	_, isOpen := w.openFiles[fileName]
 
-	// Append write to WAL before writing to actual file
-	chunkWalBucket := tx.BoltTx.Bucket([]byte(fileName))
-
-	if chunkWalBucket == nil {
+	// might not be open yet if called within transaction: OpenNewFile() + AppendToFile()
+	if !isOpen && stringslice.ItemIndex(fileName, tx.FilesToOpen) == -1 {
 		return 0, errors.New(fmt.Sprintf("WalManager: AppendToFile: chunk %s does not exist", fileName))
 	}
 
-	fileEntry, exists := w.openFiles[fileName]
+	writePosition := w.pendingLength(fileName, tx)
 
-	// FIXME: does not support 2x AppendToFile() after OpenNewFile()
-	//        (currently not ever done so not a problem)
-	writePosition := uint64(0)
+	positionAfterWrite := writePosition + uint64(len(content)) // is safe because length is in bytes, not runes
 
-	if exists { // might not exist if called within transaction: OpenNewFile() + AppendToFile()
-		writePosition = fileEntry.nextFreePosition
-	}
+	// logged in PrepareCommit(). nextFreePosition is updated in side effects,
+	// because this whole transaction must be cancellable
+	tx.QueueWrite(fileName, []byte(content), int64(writePosition))
+
+	tx.FileLengths[fileName] = positionAfterWrite
+
+	return int(positionAfterWrite), nil
+}
 
-	positionAfterWrite := writePosition + contentLen
+// must be called as the last thing before the bolt transaction commits. makes the
+// transaction's writes durable in the log and records the files' committed lengths.
+// if the commit still fails, recovery truncates those writes away.
+func (w *WalManager) PrepareCommit(tx *transaction.EventstoreTransaction) error {
+	// before the lengths below, as a forgotten file can be opened again
+	if err := w.forgetFiles(tx); err != nil {
+		return err
+	}
 
-	// WAL entries look like this:
-	// bucket="/foostream/_/0.log" key=123 value="line\n"
-	if err := chunkWalBucket.Put(itob(writePosition), []byte(content)); err != nil {
-		return 0, err
+	if len(tx.FileLengths) == 0 {
+		return nil
 	}
 
-	tx.QueueWrite(fileName, []byte(content), int64(writePosition))
+	if len(tx.WriteOps) > 0 {
+		records := []walRecord{}
+		for _, write := range tx.WriteOps {
+			records = append(records, walRecord{
+				FileName: write.Filename,
+				Position: uint64(write.Position),
+				Content:  write.Buffer,
+			})
+		}
+
+		if err := w.log.append(records); err != nil {
+			return err
+		}
+
+		switch tx.Durability {
+		case wtypes.DurabilityRelaxed:
+			break
+		case wtypes.DurabilityBatched:
+			if w.batchedUnsyncedSince.IsZero() {
+				w.batchedUnsyncedSince = time.Now()
+				break
+			}
+
+			// busy Writer does not have to wait for WalSyncTask
+			if time.Since(w.batchedUnsyncedSince) >= w.syncInterval {
+				if err := w.syncLog(); err != nil {
+					return err
+				}
 
-	// NOTE: walSize + nextFreePosition updated in side effects,
-	//       because this whole transaction must be cancellable
+				tx.WalSynced = true
+			}
+		default: // strict
+			if err := w.syncLog(); err != nil {
+				return err
+			}
 
-	if exists {
-		if (fileEntry.walSize + contentLen) > config.WalSizeThreshold {
-			log.Printf("WalManager: AppendToFile: WAL size %d exceeded for chunk %s", config.WalSizeThreshold, fileName)
+			tx.WalSynced = true
+		}
+	}
+
+	lengthsBucket := tx.BoltTx.Bucket([]byte("_walfilelengths"))
 
-			tx.NeedsWALCompaction = append(tx.NeedsWALCompaction, fileName)
+	for fileName, length := range tx.FileLengths {
+		if err := lengthsBucket.Put([]byte(fileName), itob(length)); err != nil {
+			return err
 		}
 	}
 
-	return int(positionAfterWrite), nil
+	return nil
+}
+
+// fsyncs the log if batched transactions await fsync. returns true if it did
+func (w *WalManager) SyncIfDue() (bool, error) {
+	if w.batchedUnsyncedSince.IsZero() {
+		return false, nil
+	}
+
+	return true, w.syncLog()
 }
 
-// - the file is actually open in write mode. you are responsible for not writing to it.
-// - and you are responsible for abandoning the use of the descriptor once you release the Writer's guarding mutex.
-// - seeks are OK as we'll seek at the correct position on every write.
-func (w *WalManager) BorrowFileForReading(fileName string) (*os.File, error) {
+// also makes earlier relaxed transactions durable
+func (w *WalManager) syncLog() error {
+	if err := w.log.sync(); err != nil {
+		return err
+	}
+
+	w.batchedUnsyncedSince = time.Time{}
+
+	return nil
+}
+
+// committed bytes that an OS crash lost before they were fsync'd (non-strict durability)
+func (w *WalManager) BytesLostOnRecovery() uint64 {
+	return w.bytesLostOnRecovery
+}
+
+// returns the internal path & the length of applied writes, so the caller can
+// read the file with its own descriptor without holding the Writer's lock.
+// content before the length never changes as the file is append-only, and the
+// file stays readable via an already opened descriptor even if it's removed.
+func (w *WalManager) SnapshotForReading(fileName string) (string, int64, error) {
 	walFile, has := w.openFiles[fileName]
 	if !has {
-		return nil, errors.New("No file: " + fileName)
+		return "", 0, errors.New("No file: " + fileName)
 	}
 
-	return walFile.fd, nil
+	return walFile.GetInternalRealPath(), int64(walFile.nextFreePosition), nil
 }
 
 func (w *WalManager) OpenNewFile(fileName string, tx *transaction.EventstoreTransaction) error {
-	existsCheck := tx.BoltTx.Bucket([]byte(fileName))
-	if existsCheck != nil {
+	// WAL bucket is from older versions
+	existsCheck := tx.BoltTx.Bucket([]byte("_walfilelengths")).Get([]byte(fileName)) != nil || tx.BoltTx.Bucket([]byte(fileName)) != nil
+	if existsCheck && stringslice.ItemIndex(fileName, tx.FilesToForget) == -1 {
 		return errors.New(fmt.Sprintf("WalManager: OpenNewFile: chunk %s already exists", fileName))
 	}
 
-	// create WAL bucket for file
-	_, err := tx.BoltTx.CreateBucket([]byte(fileName))
-	if err != nil {
-		return err
-	}
-
 	log.Printf("WalManager: OpenNewFile: added %s", fileName)
 
 	tx.FilesToOpen = append(tx.FilesToOpen, fileName)
 
+	// losing a chunk's Created event would break the chain of chunks
+	tx.RequireDurability(wtypes.DurabilityStrict)
+
+	// committed as zero-length in PrepareCommit(), which also marks it as existing
+	tx.FileLengths[fileName] = 0
+
+	return nil
+}
+
+// so that the names of closed files that start with prefix (a deleted stream's
+// chunks) can be opened again in this transaction
+func (w *WalManager) ForgetFiles(prefix string, tx *transaction.EventstoreTransaction) error {
+	lengths := tx.BoltTx.Bucket([]byte("_walfilelengths")).Cursor()
+
+	for key, _ := lengths.Seek([]byte(prefix)); key != nil && strings.HasPrefix(string(key), prefix); key, _ = lengths.Next() {
+		if _, isOpen := w.openFiles[string(key)]; isOpen {
+			return errors.New(fmt.Sprintf("WalManager: ForgetFiles: %s is open", key))
+		}
+
+		tx.FilesToForget = append(tx.FilesToForget, string(key))
+	}
+
+	return nil
+}
+
+// only the committed lengths. the files are removed in side effects, as the
+// commit can still fail and leave the lengths pointing to them
+func (w *WalManager) forgetFiles(tx *transaction.EventstoreTransaction) error {
+	lengthsBucket := tx.BoltTx.Bucket([]byte("_walfilelengths"))
+
+	for _, fileName := range tx.FilesToForget {
+		log.Printf("WalManager: forgetting %s", fileName)
+
+		if err := lengthsBucket.Delete([]byte(fileName)); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 func (w *WalManager) ApplySideEffects(tx *transaction.EventstoreTransaction) error {
-	// queued file opens
+	// before the opens below, as a forgotten file's name can be opened again
+	for _, fileName := range tx.FilesToForget {
+		if err := os.Remove(computeInternalPath(fileName)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// queued file opens. a new file was committed as zero-length, so anything at
+	// its path is a forgotten file that a crash kept us from removing above
 	for _, fileName := range tx.FilesToOpen {
+		if err := os.Truncate(computeInternalPath(fileName), 0); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
 		w.openFiles[fileName] = WalGuardedFileOpen(fileName)
 	}
 
-	// Write all committed WAL entries to the actual files
+	// Write all committed writes to the actual files
+	if err := w.applyWrites(tx.WriteOps); err != nil {
+		return err
+	}
+
 	for _, write := range tx.WriteOps {
-		walFile := w.openFiles[write.Filename]
+		w.dirtyFiles[write.Filename] = true
+	}
 
-		if _, err := walFile.fd.Seek(write.Position, io.SeekStart); err != nil {
+	// sealed files etc.
+	for _, fileName := range tx.FilesToSync {
+		if err := w.syncFile(fileName); err != nil {
 			return err
 		}
-		if _, err := walFile.fd.Write(write.Buffer); err != nil {
+	}
+
+	if uint64(w.log.size()) > config.WalSizeThreshold || w.closing {
+		if err := w.checkpoint(); err != nil {
 			return err
 		}
+	}
 
-		// we cannot just increase the nextFreePosition because at Writer start
-		// this is initialized from file size and the file size can be more than
-		// it should be if previous fwrite failed, so WAL entries are the ultimate
-		// source of truth for the write position.
-		// obviously this implementation relies on low -> high order of WriteOps.
-		walFile.nextFreePosition = uint64(write.Position + int64(len(write.Buffer)))
-		walFile.walSize += uint64(len(write.Buffer))
+	for _, fileName := range tx.FilesToClose {
+		// close logs itself
+		if err := w.openFiles[fileName].Close(); err != nil {
+			panic(err)
+		}
 	}
 
-	// Queued WAL compactions:
-	// - Must ensure fsync() for the above queued writes because after we have purged
-	//   WAL, failed writes cannot be reconstructed.
-	// - These happen in a new transaction (ok since Writer's applySideEffects()
-	//   is outside of a tx. It is not the end of the world if this fails, that
-	//   just means that the WAL compaction will be triggered again on next Append.
-	//
-	for _, fileName := range tx.NeedsWALCompaction {
-		walFile := w.openFiles[fileName]
+	for _, fileName := range tx.FilesToDisengageWalFor {
+		// this is a promise not to write into the file ever again
+		delete(w.openFiles, fileName)
+	}
+
+	if w.closing {
+		return w.log.close()
+	}
+
+	return nil
+}
 
-		log.Printf("WalManager: fsync() %s", walFile.fileNameFictional)
+// makes all logged writes durable in the actual files, after which the log's
+// segments are not needed anymore
+func (w *WalManager) checkpoint() error {
+	checkpointStarted := time.Now()
 
-		syncStarted := time.Now()
+	dirtyCount := len(w.dirtyFiles)
 
-		if err := w.openFiles[fileName].fd.Sync(); err != nil {
+	for fileName := range w.dirtyFiles {
+		if err := w.syncFile(fileName); err != nil {
 			return err
 		}
+	}
 
-		err := tx.Bolt.Update(func(tx *bolt.Tx) error {
-			// after sync is done, it's ok to clear WAL records
+	if err := w.log.checkpoint(); err != nil {
+		return err
+	}
 
-			if err := tx.DeleteBucket([]byte(walFile.fileNameFictional)); err != nil {
-				log.Printf("WalManager: no bucket found for %s", walFile.fileNameFictional)
-				return err
-			}
+	w.batchedUnsyncedSince = time.Time{}
 
-			if _, err := tx.CreateBucket([]byte(walFile.fileNameFictional)); err != nil {
-				return err
-			}
+	log.Printf("WalManager: checkpoint (%d file(s) fsync'd) took %s", dirtyCount, time.Since(checkpointStarted))
 
-			log.Printf("WalManager: WAL entries purged in %s for %s", time.Since(syncStarted), walFile.fileNameFictional)
+	return nil
+}
 
-			return nil
-		})
-		if err != nil {
-			panic(err)
-		}
+func (w *WalManager) syncFile(fileName string) error {
+	if err := w.openFiles[fileName].fd.Sync(); err != nil {
+		return err
+	}
+
+	delete(w.dirtyFiles, fileName)
 
-		log.Printf("WalManager: ApplySideEffects: WAL purged in %s", time.Since(syncStarted))
+	return nil
+}
 
-		walFile.walSize = 0
+// files are independent of each other, so each file's writes are done concurrently
+// (a group commit can touch many streams). within a file the order is kept.
+func (w *WalManager) applyWrites(writeOps []*transaction.Write) error {
+	writesByFile := map[string][]*transaction.Write{}
+	for _, write := range writeOps {
+		writesByFile[write.Filename] = append(writesByFile[write.Filename], write)
 	}
 
-	for _, fileName := range tx.FilesToClose {
-		// close logs itself
-		if err := w.openFiles[fileName].Close(); err != nil {
-			panic(err)
+	errs := make(chan error, len(writesByFile))
+
+	wg := sync.WaitGroup{}
+
+	for fileName, writes := range writesByFile {
+		wg.Add(1)
+
+		go func(walFile *WalGuardedFile, writes []*transaction.Write) {
+			defer wg.Done()
+
+			errs <- writeToFile(walFile, writes)
+		}(w.openFiles[fileName], writes)
+	}
+
+	wg.Wait()
+
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
 		}
 	}
 
-	// FIXME: chunk WAL bucket is left behind, and this bug is actually the only
-	//        thing preventing Writer from re-opening a stream where blockIdx > 0
-	for _, fileName := range tx.FilesToDisengageWalFor {
-		// this is a promise not to write into the file ever again
-		delete(w.openFiles, fileName)
+	return nil
+}
+
+func writeToFile(walFile *WalGuardedFile, writes []*transaction.Write) error {
+	for _, write := range writes {
+		if _, err := walFile.fd.Seek(write.Position, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := walFile.fd.Write(write.Buffer); err != nil {
+			return err
+		}
+
+		// committed length (in bolt) is the ultimate source of truth for the
+		// write position, as the file can be longer if a previous write failed.
+		// obviously this implementation relies on low -> high order of WriteOps.
+		walFile.nextFreePosition = uint64(write.Position + int64(len(write.Buffer)))
 	}
 
 	return nil
 }
 
+// true if recovery found that the file lost committed writes. only meta events
+// that close the file should be appended to it
+func (w *WalManager) LostWritesOnRecovery(fileName string, tx *transaction.EventstoreTransaction) bool {
+	lostBucket := tx.BoltTx.Bucket([]byte("_walfileslost"))
+
+	return lostBucket != nil && lostBucket.Get([]byte(fileName)) != nil
+}
+
 // this file will never be written into again.
 // returns the internal file path to the finished file, but it is only usable
 // after WAL's ApplySideEffects() closes the file handle.
 func (w *WalManager) CloseActiveFile(fileName string, tx *transaction.EventstoreTransaction) (string, error) {
-	guardedFile, exists := w.openFiles[fileName]
-	if !exists {
+	// can be opened in the same transaction (f.ex. recovery re-creates a lost
+	// chunk only to seal it). side effects open before closing
+	_, exists := w.openFiles[fileName]
+	if !exists && stringslice.ItemIndex(fileName, tx.FilesToOpen) == -1 {
 		return "", errors.New(fmt.Sprintf("WalManager: CloseActiveFile: %s not open", fileName))
 	}
 
 	log.Printf("WalManager: sealing %s", fileName)
 
+	// sealed file gets shipped, so it must not lose its Rotated event
+	tx.RequireDurability(wtypes.DurabilityStrict)
+
+	if err := tx.Delete("_walfileslost", []byte(fileName)); err != nil {
+		return "", err
+	}
+
 	// these will be done in side effects if the whole transaction succeeds
-	tx.NeedsWALCompaction = append(tx.NeedsWALCompaction, fileName)
+	tx.FilesToSync = append(tx.FilesToSync, fileName)
 	tx.FilesToDisengageWalFor = append(tx.FilesToDisengageWalFor, fileName)
 	tx.FilesToClose = append(tx.FilesToClose, fileName)
 
-	return guardedFile.GetInternalRealPath(), nil
+	return computeInternalPath(fileName), nil
 }
 
 func (w *WalManager) Close(tx *transaction.EventstoreTransaction) {
 	log.Printf("WalManager: Close: closing all open WAL guarded files")
 
-	for _, openFile := range w.openFiles {
-		// compact WAL for each file that have WAL entries,
-		// so we don't have to re-write them when we start again
-		if openFile.walSize > 0 {
-			tx.NeedsWALCompaction = append(tx.NeedsWALCompaction, openFile.fileNameFictional)
-		}
+	// checkpoint in side effects, so we don't have to replay anything when we start again
+	w.closing = true
 
-		// cannot close yet, because WAL compaction is done as a side effect and needs the open file
+	for _, openFile := range w.openFiles {
+		// cannot close yet, because checkpoint is done as a side effect and needs the open file
 		tx.FilesToClose = append(tx.FilesToClose, openFile.fileNameFictional)
 	}
 }
 
-func (w *WalManager) GetCurrentFileLength(fileName string) (int, error) {
+// with tx, includes that transaction's appends. without, only the applied ones
+func (w *WalManager) GetCurrentFileLength(fileName string, tx *transaction.EventstoreTransaction) (int, error) {
+	if tx != nil {
+		if length, appendedInTx := tx.FileLengths[fileName]; appendedInTx {
+			return int(length), nil
+		}
+	}
+
 	wgf, exists := w.openFiles[fileName]
 	if !exists {
 		return 0, errors.New(fmt.Sprintf("WalManager: file %s does not exist", fileName))
@@ -237,7 +489,21 @@ func (w *WalManager) GetCurrentFileLength(fileName string) (int, error) {
 	return int(wgf.nextFreePosition), nil
 }
 
-// use this after restart to recover and re-open a file that was previously open.
+// length including appends of this transaction that are not yet applied
+func (w *WalManager) pendingLength(fileName string, tx *transaction.EventstoreTransaction) uint64 {
+	if length, appendedInTx := tx.FileLengths[fileName]; appendedInTx {
+		return length
+	}
+
+	if fileEntry, exists := w.openFiles[fileName]; exists {
+		return fileEntry.nextFreePosition
+	}
+
+	return 0 // opened in this transaction
+}
+
+// use this after restart to re-open a file that was previously open. the log
+// was already replayed when WalManager started.
 // you cannot re-open file that was CloseActiveFile()'d, because that's final
 func (w *WalManager) RecoverAndOpenFile(fileName string, tx *transaction.EventstoreTransaction) error {
 	log.Printf("WalManager: recovering %s", fileName)
@@ -245,35 +511,68 @@ func (w *WalManager) RecoverAndOpenFile(fileName string, tx *transaction.Eventst
 	// panics if open fails
 	walFile := WalGuardedFileOpen(fileName)
 
+	if length := tx.BoltTx.Bucket([]byte("_walfilelengths")).Get([]byte(fileName)); length != nil {
+		committedLength := btoi(length)
+
+		if committedLength > walFile.nextFreePosition {
+			lost := committedLength - walFile.nextFreePosition
+
+			log.Printf("WalManager: %s lost %d committed byte(s) that were not fsync'd", fileName, lost)
+
+			w.bytesLostOnRecovery += lost
+
+			// the committed length is forgotten below, so this must be as well
+			// in case we crash again before the file gets closed
+			if err := tx.Put("_walfileslost", []byte(fileName), []byte{}); err != nil {
+				return err
+			}
+
+			// sealing it continues from what we have
+			tx.FileLengths[fileName] = walFile.nextFreePosition
+		} else {
+			walFile.nextFreePosition = committedLength
+		}
+	}
+
+	// FIXME: this should be a side effect
+	w.openFiles[fileName] = walFile
+
+	return w.recoverLegacyWalBucket(walFile, tx)
+}
+
+// WAL entries of older versions: bucket="/foostream/_/0.log" key=123 value="line\n"
+func (w *WalManager) recoverLegacyWalBucket(walFile *WalGuardedFile, tx *transaction.EventstoreTransaction) error {
+	fileName := walFile.fileNameFictional
+
 	chunkWalBucket := tx.BoltTx.Bucket([]byte(fileName))
 	if chunkWalBucket == nil {
-		return errors.New("No WAL bucket: " + fileName)
+		return nil
 	}
 
 	walRecordsQueued := 0
 
 	// these are in order from low to high, since the EventStore is append-only
-	chunkWalBucket.ForEach(func(key, value []byte) error {
+	if err := chunkWalBucket.ForEach(func(key, value []byte) error {
 		filePosition := btoi(key) // this is the absolute truth and cannot be questioned
 
-		tx.QueueWrite(walFile.fileNameFictional, value, int64(filePosition))
+		tx.QueueWrite(fileName, value, int64(filePosition))
+
+		tx.FileLengths[fileName] = filePosition + uint64(len(value))
 
 		walRecordsQueued++
 
 		return nil
-	})
-
-	// compact the WAL entries
-	if walRecordsQueued > 0 {
-		log.Printf("WalManager: recovering %d record(s) for %s", walRecordsQueued, fileName)
+	}); err != nil {
+		return err
+	}
 
-		tx.NeedsWALCompaction = append(tx.NeedsWALCompaction, walFile.fileNameFictional)
+	if _, hasLength := tx.FileLengths[fileName]; !hasLength {
+		tx.FileLengths[fileName] = walFile.nextFreePosition
 	}
 
-	// FIXME: this should be a side effect
-	w.openFiles[fileName] = walFile
+	log.Printf("WalManager: migrating %d record(s) from old WAL for %s", walRecordsQueued, fileName)
 
-	return nil
+	return tx.BoltTx.DeleteBucket([]byte(fileName))
 }
 
 func (w *WalManager) ensureDataDirectoryExists() {
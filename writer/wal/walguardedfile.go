@@ -9,7 +9,6 @@ import (
 
 type WalGuardedFile struct {
 	nextFreePosition uint64
-	walSize          uint64
 	fd               *os.File
 
 	// This is original filename (not real filename)
@@ -30,7 +29,6 @@ func WalGuardedFileOpen(fileName string) *WalGuardedFile {
 	return &WalGuardedFile{
 		nextFreePosition:  uint64(stats.Size()),
 		fd:                fd,
-		walSize:           0, // filled on WAL scanning
 		fileNameFictional: fileName,
 	}
 }
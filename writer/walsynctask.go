@@ -0,0 +1,72 @@
+package writer
+
+import (
+	"log"
+	"time"
+)
+
+// Commits of streams with "batched" durability are acknowledged before their WAL
+// records are fsync'd. This task fsyncs the WAL every batch interval, so an idle
+// Writer does not leave them unsynced. A busy Writer fsyncs in PrepareCommit().
+
+type WalSyncTask struct {
+	writer *EventstoreWriter
+	stop   chan bool
+	done   chan bool
+}
+
+func NewWalSyncTask(writer *EventstoreWriter) *WalSyncTask {
+	t := &WalSyncTask{
+		writer: writer,
+		stop:   make(chan bool),
+		done:   make(chan bool),
+	}
+
+	go t.loopUntilStopped()
+
+	return t
+}
+
+func (t *WalSyncTask) loopUntilStopped() {
+	interval := t.writer.confCtx.DurabilityBatchInterval()
+
+	for {
+		select {
+		case <-t.stop:
+			t.done <- true
+			return
+		case <-time.After(interval):
+			break
+		}
+
+		if err := t.syncIfDue(); err != nil {
+			log.Printf("WalSyncTask: %s", err.Error())
+		}
+	}
+}
+
+func (t *WalSyncTask) syncIfDue() error {
+	t.writer.mu.Lock()
+	defer t.writer.mu.Unlock()
+
+	synced, err := t.writer.walManager.SyncIfDue()
+	if err != nil {
+		return err
+	}
+
+	if synced {
+		t.writer.metrics.WalFsyncs.Inc()
+	}
+
+	return nil
+}
+
+func (t *WalSyncTask) Close() {
+	log.Printf("WalSyncTask: stopping")
+
+	t.stop <- true
+
+	<-t.done
+
+	log.Printf("WalSyncTask: stopped")
+}
@@ -11,7 +11,18 @@ import (
 	wtypes "github.com/function61/eventhorizon/writer/types"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"sort"
+	"time"
+)
+
+var ErrStreamNotFound = errors.New("writerclient: stream not found")
+
+const (
+	maxRedirects  = 3
+	maxRetries    = 50
+	retryInterval = 100 * time.Millisecond
 )
 
 type Client struct {
@@ -32,10 +43,22 @@ func New(confCtx *config.Context) *Client {
 	}
 }
 
+// served by one of the Writer's followers, if it has any. the follower may lag
+// behind, and it answers 404 if it doesn't have the chunk (yet). in that case,
+// or if the follower is down, we ask the Writer
 func (c *Client) LiveRead(input *wtypes.LiveReadInput) (reader io.Reader, wasFileNotExist bool, err error) {
 	cur := cursor.CursorFromserializedMust(input.Cursor)
 	reqJson, _ := json.Marshal(input)
 
+	if followers := c.confCtx.WriterFollowers(cur.Server); len(followers) > 0 {
+		follower := followers[rand.Intn(len(followers))]
+
+		body, _, err := c.handleAndReturnBodyAndStatusCode(c.url(follower, "/writer/liveread"), reqJson, http.StatusOK)
+		if err == nil {
+			return bytes.NewReader(body), false, nil
+		}
+	}
+
 	body, statusCode, err := c.handleAndReturnBodyAndStatusCode(c.url(cur.Server, "/writer/liveread"), reqJson, http.StatusOK)
 
 	if err != nil {
@@ -49,7 +72,7 @@ func (c *Client) LiveRead(input *wtypes.LiveReadInput) (reader io.Reader, wasFil
 func (c *Client) CreateStream(req *wtypes.CreateStreamRequest) (*wtypes.CreateStreamOutput, error) {
 	reqJson, _ := json.Marshal(req)
 
-	resJson, _, err := c.handleAndReturnBodyAndStatusCode(c.url("", "/writer/create_stream"), reqJson, http.StatusCreated)
+	resJson, _, err := c.handleForStream(req.Name, "/writer/create_stream", reqJson, http.StatusCreated)
 	if err != nil {
 		return nil, err
 	}
@@ -62,12 +85,24 @@ func (c *Client) CreateStream(req *wtypes.CreateStreamRequest) (*wtypes.CreateSt
 	return &output, nil
 }
 
+func (c *Client) DeleteStream(req *wtypes.DeleteStreamRequest) error {
+	reqJson, _ := json.Marshal(req)
+
+	return c.handleSuccessOnlyForStream(req.Name, "/writer/delete_stream", reqJson, http.StatusOK)
+}
+
+func (c *Client) SetRetentionPolicy(req *wtypes.SetRetentionPolicyRequest) error {
+	reqJson, _ := json.Marshal(req)
+
+	return c.handleSuccessOnlyForStream(req.Stream, "/writer/set_retention_policy", reqJson, http.StatusOK)
+}
+
 func (c *Client) Append(req *wtypes.AppendToStreamRequest) (*wtypes.AppendToStreamOutput, error) {
 	reqJson, _ := json.Marshal(req)
 
-	resJson, _, err := c.handleAndReturnBodyAndStatusCode(c.url("", "/writer/append"), reqJson, http.StatusCreated)
+	resJson, statusCode, err := c.handleForStream(req.Stream, "/writer/append", reqJson, http.StatusCreated)
 	if err != nil {
-		return nil, err
+		return nil, AppendError(resJson, statusCode, err)
 	}
 
 	var output wtypes.AppendToStreamOutput
@@ -78,16 +113,274 @@ func (c *Client) Append(req *wtypes.AppendToStreamRequest) (*wtypes.AppendToStre
 	return &output, nil
 }
 
+// children can be on any shard, so every shard is asked
+func (c *Client) ListStreams(req *wtypes.ListStreamsRequest) (*wtypes.ListStreamsOutput, error) {
+	output := &wtypes.ListStreamsOutput{
+		Streams: []string{},
+	}
+
+	for _, shard := range c.confCtx.WriterShards() {
+		shardOutput, err := c.ListStreamsOnShard(shard, req)
+		if err != nil {
+			return nil, err
+		}
+
+		output.Streams = append(output.Streams, shardOutput.Streams...)
+	}
+
+	sort.Strings(output.Streams)
+
+	return output, nil
+}
+
+// only the children that are on the given shard
+func (c *Client) ListStreamsOnShard(shard string, req *wtypes.ListStreamsRequest) (*wtypes.ListStreamsOutput, error) {
+	reqJson, _ := json.Marshal(req)
+
+	resJson, _, err := c.handleAndReturnBodyAndStatusCode(c.url(shard, "/writer/list_streams"), reqJson, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+
+	var output wtypes.ListStreamsOutput
+	if err := json.Unmarshal(resJson, &output); err != nil {
+		return nil, err
+	}
+
+	return &output, nil
+}
+
+// from all the shards, as each only knows about the subscriptions it removed
+func (c *Client) OrphanedSubscriptions() (*wtypes.OrphanedSubscriptionsOutput, error) {
+	output := &wtypes.OrphanedSubscriptionsOutput{
+		Subscriptions: []wtypes.OrphanedSubscription{},
+	}
+
+	for _, shard := range c.confCtx.WriterShards() {
+		resJson, _, err := c.handleAndReturnBodyAndStatusCode(c.url(shard, "/writer/orphaned_subscriptions"), nil, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+
+		var shardOutput wtypes.OrphanedSubscriptionsOutput
+		if err := json.Unmarshal(resJson, &shardOutput); err != nil {
+			return nil, err
+		}
+
+		output.Subscriptions = append(output.Subscriptions, shardOutput.Subscriptions...)
+	}
+
+	return output, nil
+}
+
+// cursors are grouped by the shard that owns their stream
+func (c *Client) ReportAckedCursors(req *wtypes.ReportAckedCursorsRequest) error {
+	cursorsByShard := map[string][]string{}
+
+	for _, cursorSerialized := range req.Cursors {
+		cur, err := cursor.CursorFromserialized(cursorSerialized)
+		if err != nil {
+			return err
+		}
+
+		shard := c.confCtx.GetWriterIpForStream(cur.Stream)
+
+		cursorsByShard[shard] = append(cursorsByShard[shard], cursorSerialized)
+	}
+
+	for shard, cursors := range cursorsByShard {
+		reqJson, _ := json.Marshal(&wtypes.ReportAckedCursorsRequest{
+			SubscriptionId: req.SubscriptionId,
+			Cursors:        cursors,
+		})
+
+		if _, _, err := c.handleAndReturnBodyAndStatusCode(c.url(shard, "/writer/report_acked"), reqJson, http.StatusOK); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// from all the shards, merging each subscription's streams
+func (c *Client) SubscriptionStatus(req *wtypes.SubscriptionStatusRequest) (*wtypes.SubscriptionStatusOutput, error) {
+	reqJson, _ := json.Marshal(req)
+
+	bySubscription := map[string]*wtypes.SubscriptionStatus{}
+	subscriptionIds := []string{}
+
+	for _, shard := range c.confCtx.WriterShards() {
+		resJson, _, err := c.handleAndReturnBodyAndStatusCode(c.url(shard, "/writer/subscription_status"), reqJson, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+
+		var shardOutput wtypes.SubscriptionStatusOutput
+		if err := json.Unmarshal(resJson, &shardOutput); err != nil {
+			return nil, err
+		}
+
+		for _, shardStatus := range shardOutput.Subscriptions {
+			merged, exists := bySubscription[shardStatus.SubscriptionId]
+			if !exists {
+				merged = &wtypes.SubscriptionStatus{
+					SubscriptionId: shardStatus.SubscriptionId,
+					Streams:        []wtypes.SubscriptionStreamStatus{},
+				}
+
+				bySubscription[shardStatus.SubscriptionId] = merged
+				subscriptionIds = append(subscriptionIds, shardStatus.SubscriptionId)
+			}
+
+			for _, streamStatus := range shardStatus.Streams {
+				merged.AddStream(streamStatus)
+			}
+		}
+	}
+
+	sort.Strings(subscriptionIds)
+
+	output := &wtypes.SubscriptionStatusOutput{
+		Subscriptions: []wtypes.SubscriptionStatus{},
+	}
+
+	for _, subscriptionId := range subscriptionIds {
+		output.Subscriptions = append(output.Subscriptions, *bySubscription[subscriptionId])
+	}
+
+	return output, nil
+}
+
+func (c *Client) StreamInfo(req *wtypes.StreamInfoRequest) (*wtypes.StreamInfoOutput, error) {
+	reqJson, _ := json.Marshal(req)
+
+	resJson, _, err := c.handleForStream(req.Stream, "/writer/stream_info", reqJson, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+
+	var output wtypes.StreamInfoOutput
+	if err := json.Unmarshal(resJson, &output); err != nil {
+		return nil, err
+	}
+
+	return &output, nil
+}
+
+// all the streams must be on the same shard
+func (c *Client) AppendMulti(req *wtypes.AppendMultiRequest) (*wtypes.AppendMultiOutput, error) {
+	if len(req.Appends) == 0 {
+		return nil, errors.New("AppendMulti: no appends")
+	}
+
+	reqJson, _ := json.Marshal(req)
+
+	resJson, statusCode, err := c.handleForStream(req.Appends[0].Stream, "/writer/append_multi", reqJson, http.StatusCreated)
+	if err != nil {
+		return nil, AppendError(resJson, statusCode, err)
+	}
+
+	var output wtypes.AppendMultiOutput
+	if err := json.Unmarshal(resJson, &output); err != nil {
+		return nil, err
+	}
+
+	return &output, nil
+}
+
 func (c *Client) SubscribeToStream(req *wtypes.SubscribeToStreamRequest) error {
 	reqJson, _ := json.Marshal(req)
 
-	return c.handleSuccessOnly(c.url("", "/writer/subscribe"), reqJson, http.StatusOK)
+	// "/tenants/**" is handled by the Writer of /tenants
+	streamName, _ := wtypes.RecursiveSubscriptionStream(req.Stream)
+
+	return c.handleSuccessOnlyForStream(streamName, "/writer/subscribe", reqJson, http.StatusOK)
 }
 
 func (c *Client) UnsubscribeFromStream(req *wtypes.UnsubscribeFromStreamRequest) error {
 	reqJson, _ := json.Marshal(req)
 
-	return c.handleSuccessOnly(c.url("", "/writer/unsubscribe"), reqJson, http.StatusOK)
+	streamName, _ := wtypes.RecursiveSubscriptionStream(req.Stream)
+
+	return c.handleSuccessOnlyForStream(streamName, "/writer/unsubscribe", reqJson, http.StatusOK)
+}
+
+// returns ErrStreamNotFound if the stream does not exist (anymore)
+func (c *Client) AppendMeta(req *wtypes.AppendMetaRequest) error {
+	reqJson, _ := json.Marshal(req)
+
+	_, statusCode, err := c.handleForStream(req.Stream, "/writer/append_meta", reqJson, http.StatusCreated)
+	if statusCode == http.StatusNotFound {
+		return ErrStreamNotFound
+	}
+
+	return err
+}
+
+// moves the stream's live chunk to another Writer
+func (c *Client) HandoffStream(req *wtypes.HandoffStreamRequest) error {
+	reqJson, _ := json.Marshal(req)
+
+	return c.handleSuccessOnlyForStream(req.Stream, "/writer/handoff_stream", reqJson, http.StatusOK)
+}
+
+// internal: used by a follower Writer to replicate live chunks
+func (c *Client) Tail(server string, req *wtypes.TailRequest) (*wtypes.TailOutput, error) {
+	reqJson, _ := json.Marshal(req)
+
+	resJson, _, err := c.handleAndReturnBodyAndStatusCode(c.url(server, "/writer/tail"), reqJson, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+
+	var output wtypes.TailOutput
+	if err := json.Unmarshal(resJson, &output); err != nil {
+		return nil, err
+	}
+
+	return &output, nil
+}
+
+// internal: sent to the new owner, which does not own the stream yet
+func (c *Client) AdoptStream(writerIp string, req *wtypes.AdoptStreamRequest) error {
+	reqJson, _ := json.Marshal(req)
+
+	return c.handleSuccessOnly(c.url(writerIp, "/writer/adopt_stream"), reqJson, http.StatusOK)
+}
+
+// routed to the stream's Writer. a Writer that does not own the stream (because
+// it was handed off) tells us the owner, and one that is in the middle of
+// handing it off tells us to retry. so do Writers without a leader (replicated)
+func (c *Client) handleForStream(stream string, path string, requestBody []byte, expectedCode int) (body []byte, statusCode int, err error) {
+	redirects := 0
+	retries := 0
+
+	for {
+		body, statusCode, err = c.handleAndReturnBodyAndStatusCode(c.url(c.confCtx.GetWriterIpForStream(stream), path), requestBody, expectedCode)
+
+		switch {
+		case statusCode == http.StatusMisdirectedRequest && redirects < maxRedirects:
+			wrongWriter := &wtypes.WrongWriterError{}
+			if errJson := json.Unmarshal(body, wrongWriter); errJson != nil {
+				return body, statusCode, err
+			}
+
+			c.confCtx.SetWriterIpForStream(stream, wrongWriter.Writer)
+
+			redirects++
+		case statusCode == http.StatusServiceUnavailable && retries < maxRetries:
+			time.Sleep(retryInterval)
+
+			retries++
+		default:
+			return body, statusCode, err
+		}
+	}
+}
+
+func (c *Client) handleSuccessOnlyForStream(stream string, path string, asJson []byte, expectedCode int) error {
+	_, _, err := c.handleForStream(stream, path, asJson, expectedCode)
+	return err
 }
 
 // less specific version for callers that are only interested about success, but
@@ -127,6 +420,35 @@ func (c *Client) handleAndReturnBodyAndStatusCode(url string, requestBody []byte
 	return body, resp.StatusCode, nil
 }
 
+// *AppendConflictError for a 409, so callers can retry with the current offset.
+// also used by writerproxyclient, as Pusher's proxy passes the 409 on
+func AppendError(resJson []byte, statusCode int, err error) error {
+	if statusCode != http.StatusConflict {
+		return err
+	}
+
+	conflictErr := &wtypes.AppendConflictError{}
+	if errJson := json.Unmarshal(resJson, conflictErr); errJson != nil {
+		return err
+	}
+
+	return conflictErr
+}
+
+// the server side of AppendError(), for Writer and Pusher's proxy. false if err
+// is not a conflict, and nothing was written
+func WriteAppendConflict(w http.ResponseWriter, err error) bool {
+	conflictErr, isConflict := err.(*wtypes.AppendConflictError)
+	if !isConflict {
+		return false
+	}
+
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(conflictErr)
+
+	return true
+}
+
 func (c *Client) url(server string, path string) string {
 	if server == "" {
 		server = c.confCtx.GetWriterIp()
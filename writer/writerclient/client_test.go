@@ -0,0 +1,44 @@
+package writerclient
+
+import (
+	"errors"
+	"github.com/function61/eventhorizon/util/ass"
+	wtypes "github.com/function61/eventhorizon/writer/types"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAppendError(t *testing.T) {
+	httpErr := errors.New("HTTP 409 Conflict")
+
+	err := AppendError(
+		[]byte(`{"ExpectedOffset": "/foo:0:100:127.0.0.1", "CurrentOffset": "/foo:0:150:127.0.0.1"}`),
+		http.StatusConflict,
+		httpErr)
+
+	conflictErr, isConflict := err.(*wtypes.AppendConflictError)
+	ass.True(t, isConflict)
+	ass.EqualString(t, conflictErr.ExpectedOffset, "/foo:0:100:127.0.0.1")
+	ass.EqualString(t, conflictErr.CurrentOffset, "/foo:0:150:127.0.0.1")
+
+	// not from Writer, f.ex. a proxy in between
+	ass.True(t, AppendError([]byte("conflict"), http.StatusConflict, httpErr) == httpErr)
+
+	ass.True(t, AppendError([]byte("{}"), http.StatusInternalServerError, httpErr) == httpErr)
+}
+
+func TestWriteAppendConflict(t *testing.T) {
+	res := httptest.NewRecorder()
+
+	ass.True(t, WriteAppendConflict(res, &wtypes.AppendConflictError{
+		ExpectedOffset: "/foo:0:100:127.0.0.1",
+		CurrentOffset:  "/foo:0:150:127.0.0.1",
+	}))
+
+	conflictErr, isConflict := AppendError(res.Body.Bytes(), res.Code, errors.New("HTTP 409 Conflict")).(*wtypes.AppendConflictError)
+	ass.True(t, isConflict)
+	ass.EqualString(t, conflictErr.CurrentOffset, "/foo:0:150:127.0.0.1")
+
+	ass.False(t, WriteAppendConflict(httptest.NewRecorder(), errors.New("stream /foo does not exist")))
+}
@@ -0,0 +1,34 @@
+package writerhttp
+
+import (
+	"encoding/json"
+	"github.com/function61/eventhorizon/writer"
+	"github.com/function61/eventhorizon/writer/authmiddleware"
+	wtypes "github.com/function61/eventhorizon/writer/types"
+	"net/http"
+)
+
+// called by other Writer shards
+func AppendMetaHandlerInit(eventWriter *writer.EventstoreWriter) {
+	ctx := eventWriter.GetConfigurationContext()
+
+	http.Handle("/writer/append_meta", authmiddleware.Protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var appendMetaRequest wtypes.AppendMetaRequest
+		if err := json.NewDecoder(r.Body).Decode(&appendMetaRequest); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := eventWriter.AppendMeta(&appendMetaRequest); err != nil {
+			if err == writer.ErrStreamNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+
+			writeStreamError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+	}), ctx))
+}
@@ -0,0 +1,31 @@
+package writerhttp
+
+import (
+	"encoding/json"
+	"github.com/function61/eventhorizon/writer"
+	"github.com/function61/eventhorizon/writer/authmiddleware"
+	wtypes "github.com/function61/eventhorizon/writer/types"
+	"net/http"
+)
+
+func AppendMultiHandlerInit(eventWriter *writer.EventstoreWriter) {
+	ctx := eventWriter.GetConfigurationContext()
+
+	http.Handle("/writer/append_multi", authmiddleware.Protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var appendMultiRequest wtypes.AppendMultiRequest
+		if err := json.NewDecoder(r.Body).Decode(&appendMultiRequest); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		output, err := eventWriter.AppendMulti(&appendMultiRequest)
+
+		if err != nil {
+			writeAppendError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(output)
+	}), ctx))
+}
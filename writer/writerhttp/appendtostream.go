@@ -18,10 +18,10 @@ func AppendToStreamHandlerInit(eventWriter *writer.EventstoreWriter) {
 			return
 		}
 
-		output, err := eventWriter.AppendToStream(appendToStreamRequest.Stream, appendToStreamRequest.Lines)
+		output, err := eventWriter.AppendToStream(&appendToStreamRequest)
 
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeAppendError(w, err)
 			return
 		}
 
@@ -18,9 +18,9 @@ func CreateStreamHandlerInit(eventWriter *writer.EventstoreWriter) {
 			return
 		}
 
-		output, err := eventWriter.CreateStream(createStreamRequest.Name)
+		output, err := eventWriter.CreateStream(&createStreamRequest)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeStreamError(w, err)
 			return
 		}
 
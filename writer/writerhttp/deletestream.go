@@ -0,0 +1,29 @@
+package writerhttp
+
+import (
+	"encoding/json"
+	"github.com/function61/eventhorizon/writer"
+	"github.com/function61/eventhorizon/writer/authmiddleware"
+	wtypes "github.com/function61/eventhorizon/writer/types"
+	"io"
+	"net/http"
+)
+
+func DeleteStreamHandlerInit(eventWriter *writer.EventstoreWriter) {
+	ctx := eventWriter.GetConfigurationContext()
+
+	http.Handle("/writer/delete_stream", authmiddleware.Protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var deleteStreamRequest wtypes.DeleteStreamRequest
+		if err := json.NewDecoder(r.Body).Decode(&deleteStreamRequest); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := eventWriter.DeleteStream(deleteStreamRequest.Name, deleteStreamRequest.Purge); err != nil {
+			writeStreamError(w, err)
+			return
+		}
+
+		io.WriteString(w, "OK\n")
+	}), ctx))
+}
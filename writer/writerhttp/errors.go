@@ -0,0 +1,35 @@
+package writerhttp
+
+import (
+	"encoding/json"
+	"github.com/function61/eventhorizon/writer"
+	wtypes "github.com/function61/eventhorizon/writer/types"
+	"github.com/function61/eventhorizon/writer/writerclient"
+	"net/http"
+)
+
+// errors for stream-routed requests. writerclient follows the 421 to the
+// stream's current owner, and retries after a 503
+func writeStreamError(w http.ResponseWriter, err error) {
+	if wrongWriter, isWrongWriter := err.(*wtypes.WrongWriterError); isWrongWriter {
+		w.WriteHeader(http.StatusMisdirectedRequest)
+		json.NewEncoder(w).Encode(wrongWriter)
+		return
+	}
+
+	if err == writer.ErrHandoffInProgress {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// like writeStreamError(), but a conflict is 409 with the stream's current offset
+func writeAppendError(w http.ResponseWriter, err error) {
+	if writerclient.WriteAppendConflict(w, err) {
+		return
+	}
+
+	writeStreamError(w, err)
+}
@@ -0,0 +1,39 @@
+package writerhttp
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/function61/eventhorizon/util/ass"
+	wtypes "github.com/function61/eventhorizon/writer/types"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteAppendError(t *testing.T) {
+	res := httptest.NewRecorder()
+
+	writeAppendError(res, &wtypes.AppendConflictError{
+		ExpectedOffset: "/foo:0:100:127.0.0.1",
+		CurrentOffset:  "/foo:0:150:127.0.0.1",
+	})
+
+	ass.EqualInt(t, res.Code, http.StatusConflict)
+
+	conflictErr := &wtypes.AppendConflictError{}
+	ass.True(t, json.Unmarshal(res.Body.Bytes(), conflictErr) == nil)
+	ass.EqualString(t, conflictErr.ExpectedOffset, "/foo:0:100:127.0.0.1")
+	ass.EqualString(t, conflictErr.CurrentOffset, "/foo:0:150:127.0.0.1")
+
+	res = httptest.NewRecorder()
+
+	writeAppendError(res, &wtypes.WrongWriterError{Stream: "/foo", Writer: "10.0.0.2"})
+
+	ass.EqualInt(t, res.Code, http.StatusMisdirectedRequest)
+
+	res = httptest.NewRecorder()
+
+	writeAppendError(res, errors.New("stream /foo does not exist"))
+
+	ass.EqualInt(t, res.Code, http.StatusInternalServerError)
+}
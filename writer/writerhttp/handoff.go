@@ -0,0 +1,49 @@
+package writerhttp
+
+import (
+	"encoding/json"
+	"github.com/function61/eventhorizon/writer"
+	"github.com/function61/eventhorizon/writer/authmiddleware"
+	wtypes "github.com/function61/eventhorizon/writer/types"
+	"io"
+	"net/http"
+)
+
+func HandoffStreamHandlerInit(eventWriter *writer.EventstoreWriter) {
+	ctx := eventWriter.GetConfigurationContext()
+
+	http.Handle("/writer/handoff_stream", authmiddleware.Protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var handoffStreamRequest wtypes.HandoffStreamRequest
+		if err := json.NewDecoder(r.Body).Decode(&handoffStreamRequest); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := eventWriter.HandoffStream(handoffStreamRequest.Stream, handoffStreamRequest.Writer); err != nil {
+			writeStreamError(w, err)
+			return
+		}
+
+		io.WriteString(w, "OK\n")
+	}), ctx))
+}
+
+// called by the Writer that hands off the stream
+func AdoptStreamHandlerInit(eventWriter *writer.EventstoreWriter) {
+	ctx := eventWriter.GetConfigurationContext()
+
+	http.Handle("/writer/adopt_stream", authmiddleware.Protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var adoptStreamRequest wtypes.AdoptStreamRequest
+		if err := json.NewDecoder(r.Body).Decode(&adoptStreamRequest); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := eventWriter.AdoptStream(&adoptStreamRequest); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		io.WriteString(w, "OK\n")
+	}), ctx))
+}
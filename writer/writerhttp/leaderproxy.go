@@ -0,0 +1,67 @@
+package writerhttp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/function61/eventhorizon/config"
+	"github.com/function61/eventhorizon/writer"
+	"net/http"
+	"net/http/httputil"
+)
+
+// In a replicated Writer group, followers proxy writes to the leader. Reads are
+// served locally, and may lag a bit behind the leader.
+
+var writePaths = map[string]bool{
+	"/writer/create_stream":        true,
+	"/writer/delete_stream":        true,
+	"/writer/append":               true,
+	"/writer/append_multi":         true,
+	"/writer/append_meta":          true,
+	"/writer/subscribe":            true,
+	"/writer/unsubscribe":          true,
+	"/writer/set_retention_policy": true,
+	"/writer/handoff_stream":       true,
+	"/writer/adopt_stream":         true,
+	"/writer/report_acked":         true,
+}
+
+// set by the proxying follower, so a request is never proxied twice (leader
+// changing mid-flight could otherwise cause a loop)
+const proxiedByHeader = "X-Eventhorizon-Proxied-By"
+
+func leaderProxy(eventWriter *writer.EventstoreWriter, confCtx *config.Context, next http.Handler) http.Handler {
+	// leaders present the same certificate as us (for writer_ip)
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs:    confCtx.GetCaCertificates(),
+			ServerName: confCtx.GetWriterIp(),
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !writePaths[r.URL.Path] || eventWriter.IsLeader() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		leaderIp := eventWriter.LeaderIp()
+
+		// no leader, or we were just elected and are still catching up
+		if leaderIp == "" || leaderIp == confCtx.GetWriterNodeIp() || r.Header.Get(proxiedByHeader) != "" {
+			http.Error(w, "no Writer currently accepts writes. try again", http.StatusServiceUnavailable)
+			return
+		}
+
+		proxy := &httputil.ReverseProxy{
+			Director: func(proxied *http.Request) {
+				proxied.URL.Scheme = "https"
+				proxied.URL.Host = fmt.Sprintf("%s:%d", leaderIp, config.WriterHttpPort)
+				proxied.Header.Set(proxiedByHeader, confCtx.GetWriterNodeIp())
+			},
+			Transport: transport,
+		}
+
+		proxy.ServeHTTP(w, r)
+	})
+}
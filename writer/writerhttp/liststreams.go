@@ -0,0 +1,29 @@
+package writerhttp
+
+import (
+	"encoding/json"
+	"github.com/function61/eventhorizon/writer"
+	"github.com/function61/eventhorizon/writer/authmiddleware"
+	wtypes "github.com/function61/eventhorizon/writer/types"
+	"net/http"
+)
+
+func ListStreamsHandlerInit(eventWriter *writer.EventstoreWriter) {
+	ctx := eventWriter.GetConfigurationContext()
+
+	http.Handle("/writer/list_streams", authmiddleware.Protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var listStreamsRequest wtypes.ListStreamsRequest
+		if err := json.NewDecoder(r.Body).Decode(&listStreamsRequest); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		output, err := eventWriter.ListStreams(listStreamsRequest.Stream, listStreamsRequest.Recursive)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(output)
+	}), ctx))
+}
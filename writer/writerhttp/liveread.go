@@ -2,18 +2,31 @@ package writerhttp
 
 import (
 	"encoding/json"
+	"github.com/function61/eventhorizon/config"
 	"github.com/function61/eventhorizon/cursor"
 	rtypes "github.com/function61/eventhorizon/reader/types"
 	"github.com/function61/eventhorizon/writer"
 	"github.com/function61/eventhorizon/writer/authmiddleware"
 	wtypes "github.com/function61/eventhorizon/writer/types"
+	"io"
 	"net/http"
 	"os"
 )
 
+// Writer's LiveReader, or a follower Writer
+type liveReader interface {
+	ReadIntoWriter(opts *rtypes.ReadOptions, writer io.Writer) error
+}
+
 func ReadHandlerInit(eventWriter *writer.EventstoreWriter) {
-	ctx := eventWriter.GetConfigurationContext()
+	liveReadHandlerInit(eventWriter.LiveReader, eventWriter.GetConfigurationContext())
+}
+
+func FollowerReadHandlerInit(follower *writer.Follower) {
+	liveReadHandlerInit(follower, follower.GetConfigurationContext())
+}
 
+func liveReadHandlerInit(reader liveReader, ctx *config.Context) {
 	http.Handle("/writer/liveread", authmiddleware.Protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var req wtypes.LiveReadInput
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -31,9 +44,7 @@ func ReadHandlerInit(eventWriter *writer.EventstoreWriter) {
 		readOpts.Cursor = cur
 		readOpts.MaxLinesToRead = req.MaxLinesToRead
 
-		// FIXME: since this read operation holds a writer-wide mutex, a slow
-		//        consumer can currently cause DOS when writer blocks
-		if err := eventWriter.LiveReader.ReadIntoWriter(readOpts, w); err != nil {
+		if err := reader.ReadIntoWriter(readOpts, w); err != nil {
 			if os.IsNotExist(err) {
 				http.Error(w, err.Error(), http.StatusNotFound)
 
@@ -0,0 +1,29 @@
+package writerhttp
+
+import (
+	"encoding/json"
+	"github.com/function61/eventhorizon/writer"
+	"github.com/function61/eventhorizon/writer/authmiddleware"
+	wtypes "github.com/function61/eventhorizon/writer/types"
+	"io"
+	"net/http"
+)
+
+func SetRetentionPolicyHandlerInit(eventWriter *writer.EventstoreWriter) {
+	ctx := eventWriter.GetConfigurationContext()
+
+	http.Handle("/writer/set_retention_policy", authmiddleware.Protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var setRetentionPolicyRequest wtypes.SetRetentionPolicyRequest
+		if err := json.NewDecoder(r.Body).Decode(&setRetentionPolicyRequest); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := eventWriter.SetRetentionPolicy(setRetentionPolicyRequest.Stream, &setRetentionPolicyRequest.Policy); err != nil {
+			writeStreamError(w, err)
+			return
+		}
+
+		io.WriteString(w, "OK\n")
+	}), ctx))
+}
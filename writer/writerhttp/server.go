@@ -16,13 +16,27 @@ func HttpServe(eventWriter *writer.EventstoreWriter, shutdown chan bool, done ch
 
 	ReadHandlerInit(eventWriter)
 	CreateStreamHandlerInit(eventWriter)
+	DeleteStreamHandlerInit(eventWriter)
 	AppendToStreamHandlerInit(eventWriter)
+	AppendMultiHandlerInit(eventWriter)
+	AppendMetaHandlerInit(eventWriter)
+	HandoffStreamHandlerInit(eventWriter)
+	AdoptStreamHandlerInit(eventWriter)
 	SubscribeToStreamHandlerInit(eventWriter)
 	UnsubscribeFromStreamHandlerInit(eventWriter)
+	SetRetentionPolicyHandlerInit(eventWriter)
+	StreamInfoHandlerInit(eventWriter)
+	ListStreamsHandlerInit(eventWriter)
+	OrphanedSubscriptionsHandlerInit(eventWriter)
+	ReportAckedCursorsHandlerInit(eventWriter)
+	SubscriptionStatusHandlerInit(eventWriter)
+	TailHandlerInit(eventWriter)
 
 	go func() {
 		log.Printf("WriterHttp: binding to %s", writerSrv.Addr)
 
+		writerSrv.Handler = leaderProxy(eventWriter, confCtx, http.DefaultServeMux)
+
 		writerSrv.TLSConfig = &tls.Config{
 			Certificates: []tls.Certificate{confCtx.GetSignedServerCertificate()},
 		}
@@ -69,3 +83,37 @@ func HttpServe(eventWriter *writer.EventstoreWriter, shutdown chan bool, done ch
 		done <- true
 	}()
 }
+
+// a follower Writer only serves live reads
+func FollowerHttpServe(follower *writer.Follower, shutdown chan bool, done chan bool, confCtx *config.Context) {
+	followerSrv := &http.Server{Addr: ":" + strconv.Itoa(config.WriterHttpPort)}
+
+	FollowerReadHandlerInit(follower)
+
+	go func() {
+		log.Printf("WriterHttp: binding to %s as a follower", followerSrv.Addr)
+
+		followerSrv.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{confCtx.GetSignedCertificateFor(confCtx.GetWriterNodeIp())},
+		}
+
+		if err := followerSrv.ListenAndServeTLS("", ""); err != nil {
+			// cannot panic, because this probably is an intentional close
+			log.Printf("WriterHttp: ListenAndServe() error: %s", err)
+		}
+	}()
+
+	go func() {
+		<-shutdown
+
+		log.Printf("WriterHttp: shutting down")
+
+		if err := followerSrv.Shutdown(nil); err != nil {
+			panic(err) // failed shutting down
+		}
+
+		log.Printf("WriterHttp: shutting down done")
+
+		done <- true
+	}()
+}
@@ -0,0 +1,29 @@
+package writerhttp
+
+import (
+	"encoding/json"
+	"github.com/function61/eventhorizon/writer"
+	"github.com/function61/eventhorizon/writer/authmiddleware"
+	wtypes "github.com/function61/eventhorizon/writer/types"
+	"net/http"
+)
+
+func StreamInfoHandlerInit(eventWriter *writer.EventstoreWriter) {
+	ctx := eventWriter.GetConfigurationContext()
+
+	http.Handle("/writer/stream_info", authmiddleware.Protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var streamInfoRequest wtypes.StreamInfoRequest
+		if err := json.NewDecoder(r.Body).Decode(&streamInfoRequest); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		output, err := eventWriter.StreamInfo(streamInfoRequest.Stream)
+		if err != nil {
+			writeStreamError(w, err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(output)
+	}), ctx))
+}
@@ -19,8 +19,8 @@ func SubscribeToStreamHandlerInit(eventWriter *writer.EventstoreWriter) {
 			return
 		}
 
-		if err := eventWriter.SubscribeToStream(subscribeToStreamRequest.Stream, subscribeToStreamRequest.SubscriptionId); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err := eventWriter.SubscribeToStream(subscribeToStreamRequest.Stream, subscribeToStreamRequest.SubscriptionId, subscribeToStreamRequest.Filter, subscribeToStreamRequest.ActivityIntervalMs); err != nil {
+			writeStreamError(w, err)
 			return
 		}
 
@@ -39,7 +39,7 @@ func UnsubscribeFromStreamHandlerInit(eventWriter *writer.EventstoreWriter) {
 		}
 
 		if err := eventWriter.UnsubscribeFromStream(unsubscribeFromStreamRequest.Stream, unsubscribeFromStreamRequest.SubscriptionId); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeStreamError(w, err)
 			return
 		}
 
@@ -0,0 +1,49 @@
+package writerhttp
+
+import (
+	"encoding/json"
+	"github.com/function61/eventhorizon/writer"
+	"github.com/function61/eventhorizon/writer/authmiddleware"
+	wtypes "github.com/function61/eventhorizon/writer/types"
+	"io"
+	"net/http"
+)
+
+func ReportAckedCursorsHandlerInit(eventWriter *writer.EventstoreWriter) {
+	ctx := eventWriter.GetConfigurationContext()
+
+	http.Handle("/writer/report_acked", authmiddleware.Protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reportAckedCursorsRequest wtypes.ReportAckedCursorsRequest
+		if err := json.NewDecoder(r.Body).Decode(&reportAckedCursorsRequest); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := eventWriter.ReportAckedCursors(&reportAckedCursorsRequest); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		io.WriteString(w, "OK\n")
+	}), ctx))
+}
+
+func SubscriptionStatusHandlerInit(eventWriter *writer.EventstoreWriter) {
+	ctx := eventWriter.GetConfigurationContext()
+
+	http.Handle("/writer/subscription_status", authmiddleware.Protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var subscriptionStatusRequest wtypes.SubscriptionStatusRequest
+		if err := json.NewDecoder(r.Body).Decode(&subscriptionStatusRequest); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		output, err := eventWriter.SubscriptionStatus(subscriptionStatusRequest.SubscriptionId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(output)
+	}), ctx))
+}